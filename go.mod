@@ -7,11 +7,14 @@ require (
 	github.com/canonical/go-dqlite v1.2.0
 	github.com/go-sql-driver/mysql v1.4.1
 	github.com/lib/pq v1.1.1
-	github.com/mattn/go-sqlite3 v1.10.0
+	github.com/mattn/go-sqlite3 v1.14.10
 	github.com/pkg/errors v0.8.1
+	github.com/prometheus/client_golang v1.0.0
 	github.com/rancher/wrangler v0.4.0
 	github.com/sirupsen/logrus v1.4.2
 	github.com/urfave/cli v1.21.0
+	go.etcd.io/bbolt v1.3.5
 	go.etcd.io/etcd v0.0.0-20191023171146-3cf2f69b5738
 	google.golang.org/grpc v1.23.1
+	modernc.org/sqlite v1.14.8
 )
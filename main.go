@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"os"
+	"time"
 
 	"github.com/rancher/kine/pkg/endpoint"
 	"github.com/rancher/wrangler/pkg/signals"
@@ -25,6 +26,62 @@ func main() {
 			Value:       "tcp://0.0.0.0:2379",
 			Destination: &config.Listener,
 		},
+		cli.StringFlag{
+			Name:        "advertise-address",
+			Usage:       "Client URL the cluster service lists this instance under, e.g. https://10.0.0.1:2379 (default is derived from the listen address and host name)",
+			Destination: &config.AdvertiseAddress,
+		},
+		cli.StringFlag{
+			Name:        "server-cert-file",
+			Usage:       "Certificate the listener serves TLS with",
+			Destination: &config.ServerTLSConfig.CertFile,
+		},
+		cli.StringFlag{
+			Name:        "server-key-file",
+			Usage:       "Key file the listener serves TLS with",
+			Destination: &config.ServerTLSConfig.KeyFile,
+		},
+		cli.StringFlag{
+			Name:        "server-ca-file",
+			Usage:       "CA cert client certificates of the listener are verified with",
+			Destination: &config.ServerTLSConfig.CAFile,
+		},
+		cli.BoolFlag{
+			Name:        "client-cert-auth",
+			Usage:       "Require clients of the listener to present a certificate signed by the server CA",
+			Destination: &config.ClientCertAuth,
+		},
+		cli.StringFlag{
+			Name:        "client-cert-file",
+			Usage:       "Certificate etcd clients configured by kine present to the listener",
+			Destination: &config.ClientTLSConfig.CertFile,
+		},
+		cli.StringFlag{
+			Name:        "client-key-file",
+			Usage:       "Key file etcd clients configured by kine present to the listener",
+			Destination: &config.ClientTLSConfig.KeyFile,
+		},
+		cli.StringFlag{
+			Name:        "client-ca-file",
+			Usage:       "CA cert etcd clients configured by kine verify the listener with (default is the server CA)",
+			Destination: &config.ClientTLSConfig.CAFile,
+		},
+		cli.BoolFlag{
+			Name:        "server-cert-as-client-cert",
+			Usage:       "Have etcd clients configured by kine present the server certificate if no client certificate is set",
+			Destination: &config.ServerCertAsClientCert,
+		},
+		cli.DurationFlag{
+			Name:        "watch-progress-notify-interval",
+			Value:       10 * time.Minute,
+			Usage:       "Interval between progress notifications of watches that request them",
+			Destination: &config.NotifyInterval,
+		},
+		cli.StringFlag{
+			Name:        "metrics-listen-address",
+			Usage:       "Address to serve Prometheus metrics on, e.g. tcp://127.0.0.1:8080 (default is disabled)",
+			Destination: &config.MetricsListener,
+		},
 		cli.StringFlag{
 			Name:        "endpoint",
 			Usage:       "Storage endpoint (default is sqlite)",
@@ -45,9 +102,38 @@ func main() {
 			Usage:       "Key file for DB connection",
 			Destination: &config.KeyFile,
 		},
+		cli.DurationFlag{
+			Name:        "compaction-interval",
+			Value:       5 * time.Minute,
+			Usage:       "Interval between background compactions",
+			Destination: &config.Compact.Interval,
+		},
+		cli.Int64Flag{
+			Name:        "compaction-min-retain",
+			Value:       1000,
+			Usage:       "Number of most recent revisions kept by background compaction",
+			Destination: &config.Compact.MinRetain,
+		},
+		cli.DurationFlag{
+			Name:        "compaction-retention",
+			Usage:       "Also keep revisions written within this duration, 0 keeps revisions regardless of age. Ages are sampled in memory, so after every restart nothing is compacted until kine has run for this duration",
+			Destination: &config.Compact.Retention,
+		},
+		cli.Int64Flag{
+			Name:        "compaction-batch-size",
+			Value:       1000,
+			Usage:       "Number of revisions compacted per batch",
+			Destination: &config.Compact.BatchSize,
+		},
+		cli.BoolFlag{
+			Name:        "disable-compaction",
+			Usage:       "Disable background compaction, clients can still compact",
+			Destination: &config.Compact.Disable,
+		},
 		cli.BoolFlag{Name: "debug"},
 	}
 	app.Action = run
+	app.Commands = []cli.Command{snapshotCommand, migrateCommand}
 
 	if err := app.Run(os.Args); err != nil {
 		logrus.Fatal(err)
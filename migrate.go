@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rancher/kine/pkg/endpoint"
+	"github.com/rancher/kine/pkg/migrate"
+	"github.com/rancher/wrangler/pkg/signals"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+var migrateCommand = cli.Command{
+	Name:  "migrate",
+	Usage: "Copy the keys with their history from one storage endpoint to another, continuing a copy that was interrupted",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "from",
+			Usage: "Storage endpoint to copy from, it must not be in use",
+		},
+		cli.StringFlag{
+			Name:  "to",
+			Usage: "Storage endpoint to copy to, it must not be in use",
+		},
+		cli.BoolFlag{
+			Name:  "snapshot",
+			Usage: "Only copy the keys at the current revision, into an empty endpoint",
+		},
+	},
+	Action: migrateEndpoints,
+}
+
+func migrateEndpoints(c *cli.Context) error {
+	if c.GlobalBool("debug") {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+	if c.String("from") == "" || c.String("to") == "" {
+		return fmt.Errorf("both --from and --to are required")
+	}
+	if c.String("from") == c.String("to") {
+		return fmt.Errorf("--from and --to are the same endpoint")
+	}
+
+	ctx, cancel := context.WithCancel(signals.SetupSignalHandler(context.Background()))
+	defer cancel()
+
+	// the database options apply to both endpoints
+	fromConfig, toConfig := config, config
+	fromConfig.Endpoint = c.String("from")
+	toConfig.Endpoint = c.String("to")
+
+	from, err := endpoint.NewBackend(ctx, fromConfig)
+	if err != nil {
+		return err
+	}
+	to, err := endpoint.NewBackend(ctx, toConfig)
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("snapshot") {
+		_, err = migrate.Snapshot(ctx, from, to)
+		return err
+	}
+	return migrate.History(ctx, from, to)
+}
@@ -3,6 +3,8 @@ package broadcaster
 import (
 	"context"
 	"sync"
+
+	"github.com/rancher/kine/pkg/metrics"
 )
 
 type ConnectFunc func() (chan interface{}, error)
@@ -68,6 +70,7 @@ func (b *Broadcaster) stream(input chan interface{}) {
 			case sub <- item:
 			default:
 				// Slow consumer, drop
+				metrics.BroadcasterDrops.Inc()
 				go b.unsub(sub, true)
 			}
 		}
@@ -0,0 +1,549 @@
+// Package bolt stores the log in a bbolt database file. It is an embedded
+// backend for a single kine process that needs no SQL engine.
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/kine/pkg/logstructured"
+	"github.com/rancher/kine/pkg/metrics"
+	"github.com/rancher/kine/pkg/server"
+	"go.etcd.io/bbolt"
+)
+
+var (
+	// revisionsBucket holds every row by ID, its sequence is the current
+	// revision
+	revisionsBucket = []byte("revisions")
+	// namesBucket indexes the rows by name. Keys are the name prefix followed
+	// by the ID, the value is 1 for deletes and 0 otherwise, followed by the
+	// batch revision of rows written in a batch.
+	namesBucket = []byte("names")
+	// batchesBucket indexes the rows written in a batch by batch revision
+	// followed by ID
+	batchesBucket = []byte("batches")
+	// leasesBucket holds the TTL and expiry of every lease by ID
+	leasesBucket = []byte("leases")
+	// leaseExpiryBucket indexes the leases by expiry followed by ID
+	leaseExpiryBucket = []byte("lease_expiry")
+	// leaseKeysBucket indexes the keys attached to a lease by lease ID
+	// followed by the name
+	leaseKeysBucket = []byte("lease_keys")
+	// membersBucket holds the members registered by the processes that used
+	// the file, by ID
+	membersBucket = []byte("members")
+	// alarmsBucket holds the raised alarms, keyed by member ID followed by
+	// the alarm type
+	alarmsBucket = []byte("alarms")
+	metaBucket   = []byte("meta")
+
+	compactRevisionKey = []byte("compact_revision")
+	clusterIDKey       = []byte("cluster_id")
+
+	buckets = [][]byte{revisionsBucket, namesBucket, batchesBucket, leasesBucket, leaseExpiryBucket, leaseKeysBucket, membersBucket, alarmsBucket, metaBucket}
+)
+
+// openTimeout bounds the wait for the lock on the file, which another process
+// using it holds
+const openTimeout = 5 * time.Second
+
+// Log is the log stored in bbolt. Writes are serialized by bbolt and every
+// revision is committed in order, so watches are woken up by the writes and
+// never see gaps.
+type Log struct {
+	db        *bbolt.DB
+	poller    *logstructured.Poller
+	compactor *logstructured.Compactor
+}
+
+func New(ctx context.Context, path string, compact logstructured.CompactConfig) (server.Backend, error) {
+	if path == "" {
+		if err := os.MkdirAll("./db", 0700); err != nil {
+			return nil, err
+		}
+		path = "./db/state.bolt"
+	}
+
+	log, err := open(path, compact)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		<-ctx.Done()
+		log.db.Close()
+	}()
+
+	return logstructured.New(log), nil
+}
+
+// open opens the database file, creating the buckets it is missing
+func open(path string, compact logstructured.CompactConfig) (*Log, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: openTimeout})
+	if err != nil {
+		return nil, errors.Wrapf(err, "open %s", path)
+	}
+
+	if err := db.Update(setup); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "setup db")
+	}
+
+	log := &Log{db: db}
+	log.poller = logstructured.NewPoller(log)
+	log.compactor = logstructured.NewCompactor(compact, log, log.poller)
+	return log, nil
+}
+
+func setup(tx *bbolt.Tx) error {
+	for _, name := range buckets {
+		if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Log) Start(ctx context.Context) error {
+	rev, err := s.CurrentRevision(ctx)
+	if err != nil {
+		return err
+	}
+	metrics.CurrentRevision.Set(float64(rev))
+
+	s.poller.Start(ctx)
+	s.compactor.Start(ctx)
+	return nil
+}
+
+func (s *Log) CurrentRevision(ctx context.Context) (rev int64, err error) {
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		rev = currentRevision(tx)
+		return nil
+	})
+	return
+}
+
+func (s *Log) CompactRevision(ctx context.Context) (rev int64, err error) {
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		rev = compactRevision(tx)
+		return nil
+	})
+	return
+}
+
+func (s *Log) DbSize(ctx context.Context) (size int64, err error) {
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		size = tx.Size()
+		return nil
+	})
+	return
+}
+
+// Defragment does nothing, bbolt reuses the pages freed by compaction but
+// never shrinks its file while it is open. Migrating the log to a new file
+// reclaims the space.
+func (s *Log) Defragment(ctx context.Context) error {
+	return nil
+}
+
+// translateErr turns a write that ran out of disk space into
+// server.ErrNoSpace
+func translateErr(err error) error {
+	cause := err
+	if pathErr, ok := err.(*os.PathError); ok {
+		cause = pathErr.Err
+	}
+	if cause == syscall.ENOSPC {
+		return server.ErrNoSpace
+	}
+	return err
+}
+
+func currentRevision(tx *bbolt.Tx) int64 {
+	return int64(tx.Bucket(revisionsBucket).Sequence())
+}
+
+func compactRevision(tx *bbolt.Tx) int64 {
+	if v := tx.Bucket(metaBucket).Get(compactRevisionKey); v != nil {
+		return int64At(v)
+	}
+	return 0
+}
+
+func (s *Log) List(ctx context.Context, key, rangeEnd string, limit, revision int64, includeDeleted bool, opts server.ListOptions) (rev int64, events []*server.Event, err error) {
+	// keys come in key order, the limit only applies right away if nothing
+	// else changes the order or filters them
+	sorted := opts.SortTarget == server.SortByKey && !opts.Descending
+	filtered := opts.MinModRevision != 0 || opts.MaxModRevision != 0 ||
+		opts.MinCreateRevision != 0 || opts.MaxCreateRevision != 0
+	// values sorted by are read and left out once sorted
+	values := !opts.KeysOnly || opts.SortTarget == server.SortByValue
+
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		rev = currentRevision(tx)
+		if revision > 0 && revision < compactRevision(tx) {
+			return server.ErrCompacted
+		}
+
+		at := revision
+		if at == 0 {
+			at = rev
+		}
+
+		return eachLatest(tx, key, rangeEnd, at, func(latest int64, deleted bool) (bool, error) {
+			if deleted && !includeDeleted {
+				return true, nil
+			}
+
+			row, err := getRow(tx, latest, values)
+			if err != nil {
+				return false, err
+			}
+			event := row.Event()
+			if !opts.InRevisionBounds(event.KV) {
+				return true, nil
+			}
+
+			events = append(events, event)
+			return !sorted || filtered || limit <= 0 || int64(len(events)) < limit, nil
+		})
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if !sorted {
+		sort.Slice(events, func(i, j int) bool {
+			return opts.Less(events[i].KV, events[j].KV)
+		})
+	}
+	if limit > 0 && int64(len(events)) > limit {
+		events = events[:limit]
+	}
+	if opts.KeysOnly {
+		for _, event := range events {
+			event.KV.Value = nil
+		}
+	}
+	return rev, events, nil
+}
+
+func (s *Log) Count(ctx context.Context, key, rangeEnd string) (rev int64, count int64, err error) {
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		rev = currentRevision(tx)
+		return eachLatest(tx, key, rangeEnd, rev, func(_ int64, deleted bool) (bool, error) {
+			if !deleted {
+				count++
+			}
+			return true, nil
+		})
+	})
+	return
+}
+
+// eachLatest calls fn with the ID of the latest row at or below the revision of
+// every name in the range, in name order, and whether it is a delete. It stops
+// early if fn returns false.
+func eachLatest(tx *bbolt.Tx, key, rangeEnd string, revision int64, fn func(latest int64, deleted bool) (bool, error)) error {
+	start, end := indexRange(key, rangeEnd)
+
+	var (
+		prefix  []byte
+		latest  int64
+		deleted bool
+	)
+	c := tx.Bucket(namesBucket).Cursor()
+	for k, v := c.Seek(start); k != nil && (end == nil || bytes.Compare(k, end) < 0); k, v = c.Next() {
+		name := k[:len(k)-8]
+		if !bytes.Equal(name, prefix) {
+			if latest > 0 {
+				if more, err := fn(latest, deleted); err != nil || !more {
+					return err
+				}
+			}
+			prefix = append(prefix[:0], name...)
+			latest = 0
+		}
+
+		// the rows of a name are in the same order by ID as by revision
+		if id := int64At(k); indexRevision(id, v) <= revision {
+			latest, deleted = id, len(v) > 0 && v[0] == 1
+		}
+	}
+
+	if latest > 0 {
+		_, err := fn(latest, deleted)
+		return err
+	}
+	return nil
+}
+
+// latestRow returns the latest row of the name without its values, nil if the
+// name has no rows
+func latestRow(tx *bbolt.Tx, name string) (*logstructured.Row, error) {
+	prefix := namePrefix(name)
+	c := tx.Bucket(namesBucket).Cursor()
+
+	// the first key after the rows of the name, or the end
+	k, _ := c.Seek(append(prefix, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff))
+	if k == nil {
+		k, _ = c.Last()
+	} else {
+		k, _ = c.Prev()
+	}
+	if k == nil || !bytes.HasPrefix(k, prefix) {
+		return nil, nil
+	}
+	return getRow(tx, int64At(k), false)
+}
+
+// rowAt returns the row of the name written at the revision without its
+// values, nil if there is none
+func rowAt(tx *bbolt.Tx, name string, revision int64) (*logstructured.Row, error) {
+	prefix := namePrefix(name)
+	c := tx.Bucket(namesBucket).Cursor()
+
+	// the revision of a row is never below its ID
+	k, v := c.Seek(indexKey(name, revision+1))
+	if k == nil {
+		k, v = c.Last()
+	} else {
+		k, v = c.Prev()
+	}
+	for ; k != nil && bytes.HasPrefix(k, prefix); k, v = c.Prev() {
+		id := int64At(k)
+		if rev := indexRevision(id, v); rev == revision {
+			return getRow(tx, id, false)
+		} else if rev < revision {
+			break
+		}
+	}
+	return nil, nil
+}
+
+func getRow(tx *bbolt.Tx, id int64, values bool) (*logstructured.Row, error) {
+	data := tx.Bucket(revisionsBucket).Get(int64Key(id))
+	if data == nil {
+		return nil, nil
+	}
+	return decodeRow(id, data, values)
+}
+
+func (s *Log) After(ctx context.Context, key, rangeEnd string, revision, limit int64) (rev int64, events []*server.Event, err error) {
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		rev = currentRevision(tx)
+		if revision > 0 && revision < compactRevision(tx) {
+			return server.ErrCompacted
+		}
+		rows, err := after(tx, key, rangeEnd, revision, limit)
+		for _, row := range rows {
+			events = append(events, row.Event())
+		}
+		return err
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	return rev, events, nil
+}
+
+// after returns the rows of the range written after the revision in revision
+// order, at most limit of them unless it is zero
+func after(tx *bbolt.Tx, key, rangeEnd string, revision, limit int64) ([]*logstructured.Row, error) {
+	// rows of batches written after the revision may come before it by ID
+	var rows []*logstructured.Row
+	c := tx.Bucket(batchesBucket).Cursor()
+	for k, _ := c.Seek(int64Key(revision + 1)); k != nil; k, _ = c.Next() {
+		if id := int64At(k); id <= revision {
+			row, err := getRow(tx, id, true)
+			if err != nil {
+				return nil, err
+			}
+			if row != nil && logstructured.InRange(row.Name, key, rangeEnd) {
+				rows = append(rows, row)
+			}
+		}
+	}
+
+	// the revision of a row is never below its ID, once there are enough
+	// rows the ones with higher IDs come after all of them
+	var bound int64
+	c = tx.Bucket(revisionsBucket).Cursor()
+	for k, v := c.Seek(int64Key(revision + 1)); k != nil; k, v = c.Next() {
+		if limit > 0 && int64(len(rows)) >= limit && int64At(k) > bound {
+			break
+		}
+		row, err := decodeRow(int64At(k), v, true)
+		if err != nil {
+			return nil, err
+		}
+		if !logstructured.InRange(row.Name, key, rangeEnd) {
+			continue
+		}
+
+		rows = append(rows, row)
+		if row.Revision() > bound {
+			bound = row.Revision()
+		}
+	}
+
+	logstructured.SortRows(rows)
+	if limit > 0 && int64(len(rows)) > limit {
+		rows = rows[:limit]
+	}
+	return rows, nil
+}
+
+// rowsAfter returns the rows after the ID in ID order, at most limit of them
+// unless it is zero
+func rowsAfter(tx *bbolt.Tx, id, limit int64) ([]*logstructured.Row, error) {
+	var rows []*logstructured.Row
+	c := tx.Bucket(revisionsBucket).Cursor()
+	for k, v := c.Seek(int64Key(id + 1)); k != nil; k, v = c.Next() {
+		row, err := decodeRow(int64At(k), v, true)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, row)
+		if limit > 0 && int64(len(rows)) >= limit {
+			break
+		}
+	}
+	return rows, nil
+}
+
+func (s *Log) Append(ctx context.Context, event *server.Event) (int64, error) {
+	return s.AppendBatch(ctx, []*server.Event{event}, nil)
+}
+
+// AppendBatch appends all events in one bbolt transaction, after checking that
+// the latest revision of every key in checks, including deletes, is still the
+// expected one, zero meaning the key has no rows. A mismatch fails the batch
+// with server.ErrKeyExists.
+func (s *Log) AppendBatch(ctx context.Context, events []*server.Event, checks map[string]int64) (rev int64, err error) {
+	err = s.db.Update(func(tx *bbolt.Tx) error {
+		for key, expected := range checks {
+			latest, err := latestRow(tx, key)
+			if err != nil {
+				return err
+			}
+			if (latest == nil && expected != 0) || (latest != nil && latest.Revision() != expected) {
+				return server.ErrKeyExists
+			}
+		}
+
+		// the rows of a batch share the revision of the last one
+		var batch int64
+		if len(events) > 1 {
+			batch = currentRevision(tx) + int64(len(events))
+		}
+		for _, event := range events {
+			if err := insert(tx, event, batch); err != nil {
+				return err
+			}
+		}
+		rev = currentRevision(tx)
+		return nil
+	})
+	if err != nil {
+		return 0, translateErr(err)
+	}
+
+	if len(events) > 0 {
+		metrics.CurrentRevision.Set(float64(rev))
+		s.Notify(rev)
+	}
+	return rev, nil
+}
+
+// insert writes the event with the next ID as part of the batch, if it is not
+// zero. Like the unique index on the name and previous revision of the SQL
+// backends, an event fails with server.ErrKeyExists unless it follows the
+// latest row of the key, or for a create, the key has no rows or was deleted
+// last.
+func insert(tx *bbolt.Tx, event *server.Event, batch int64) error {
+	e := *event
+	if e.KV == nil {
+		e.KV = &server.KeyValue{}
+	}
+	if e.PrevKV == nil {
+		e.PrevKV = &server.KeyValue{}
+	}
+
+	row := &logstructured.Row{
+		Name:           e.KV.Key,
+		Created:        e.Create,
+		Deleted:        e.Delete,
+		CreateRevision: e.KV.CreateRevision,
+		PrevRevision:   e.PrevKV.ModRevision,
+		Lease:          e.KV.Lease,
+		Value:          e.KV.Value,
+		OldValue:       e.PrevKV.Value,
+		Version:        e.KV.Version,
+		OldLease:       e.PrevKV.Lease,
+	}
+
+	latest, err := latestRow(tx, row.Name)
+	if err != nil {
+		return err
+	}
+	if row.Created {
+		if latest != nil && (!latest.Deleted || latest.Revision() != row.PrevRevision) {
+			return server.ErrKeyExists
+		}
+	} else if latest == nil || latest.Deleted || latest.Revision() != row.PrevRevision {
+		return server.ErrKeyExists
+	}
+
+	revisions := tx.Bucket(revisionsBucket)
+	seq, err := revisions.NextSequence()
+	if err != nil {
+		return err
+	}
+	row.ID = int64(seq)
+	row.BatchRevision = batch
+
+	return putRow(tx, row, latest)
+}
+
+// putRow writes the row with its ID and indexes it, latest is the row of the
+// name it follows, if any
+func putRow(tx *bbolt.Tx, row, latest *logstructured.Row) error {
+	if err := tx.Bucket(revisionsBucket).Put(int64Key(row.ID), encodeRow(row)); err != nil {
+		return err
+	}
+
+	index := []byte{0}
+	if row.Deleted {
+		index[0] = 1
+	}
+	if row.BatchRevision != 0 {
+		index = append(index, int64Key(row.BatchRevision)...)
+		if err := tx.Bucket(batchesBucket).Put(batchKey(row.BatchRevision, row.ID), nil); err != nil {
+			return err
+		}
+	}
+	if err := tx.Bucket(namesBucket).Put(indexKey(row.Name, row.ID), index); err != nil {
+		return err
+	}
+
+	leaseKeys := tx.Bucket(leaseKeysBucket)
+	if latest != nil && !latest.Deleted && latest.Lease != 0 {
+		if err := leaseKeys.Delete(leaseKey(latest.Lease, row.Name)); err != nil {
+			return err
+		}
+	}
+	if !row.Deleted && row.Lease != 0 {
+		if err := leaseKeys.Put(leaseKey(row.Lease, row.Name), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,309 @@
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/rancher/kine/pkg/logstructured"
+	"github.com/rancher/kine/pkg/server"
+	"go.etcd.io/bbolt"
+)
+
+// testLog is a log on a database file that can be closed and opened again
+type testLog struct {
+	*Log
+	path   string
+	cancel func()
+}
+
+func newTestLog(t *testing.T) (*testLog, func()) {
+	dir, err := ioutil.TempDir("", "kine-bolt-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &testLog{path: filepath.Join(dir, "state.bolt")}
+	l.open(t)
+	return l, func() {
+		l.close()
+		os.RemoveAll(dir)
+	}
+}
+
+func (l *testLog) open(t *testing.T) {
+	log, err := open(l.path, logstructured.CompactConfig{Disable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := log.Start(ctx); err != nil {
+		cancel()
+		log.db.Close()
+		t.Fatal(err)
+	}
+	l.Log, l.cancel = log, cancel
+}
+
+func (l *testLog) close() {
+	l.cancel()
+	l.db.Close()
+}
+
+// restart closes the database and opens it again
+func (l *testLog) restart(t *testing.T) {
+	l.close()
+	l.open(t)
+}
+
+// put creates the key, or updates it if it exists, and returns the revision
+func (l *testLog) put(t *testing.T, key, value string) int64 {
+	event := &server.Event{Create: true, KV: &server.KeyValue{Key: key, Value: []byte(value)}}
+	if latest := l.latest(t, key); latest != nil && latest.Delete {
+		// a create follows the delete of the key
+		event.PrevKV = &server.KeyValue{ModRevision: latest.KV.ModRevision}
+	} else if latest != nil {
+		event.Create = false
+		event.KV.CreateRevision = latest.KV.CreateRevision
+		event.PrevKV = latest.KV
+	}
+	rev, err := l.Append(context.Background(), event)
+	if err != nil {
+		t.Fatalf("put %s: %v", key, err)
+	}
+	return rev
+}
+
+func (l *testLog) delete(t *testing.T, key string) int64 {
+	kv := l.get(t, key)
+	if kv == nil {
+		t.Fatalf("delete %s: not found", key)
+	}
+	rev, err := l.Append(context.Background(), &server.Event{
+		Delete: true,
+		KV:     &server.KeyValue{Key: key, CreateRevision: kv.CreateRevision},
+		PrevKV: kv,
+	})
+	if err != nil {
+		t.Fatalf("delete %s: %v", key, err)
+	}
+	return rev
+}
+
+func (l *testLog) get(t *testing.T, key string) *server.KeyValue {
+	if latest := l.latest(t, key); latest != nil && !latest.Delete {
+		return latest.KV
+	}
+	return nil
+}
+
+// latest returns the latest event of the key, including deletes
+func (l *testLog) latest(t *testing.T, key string) *server.Event {
+	_, events, err := l.List(context.Background(), key, "", 0, 0, true, server.ListOptions{})
+	if err != nil {
+		t.Fatalf("get %s: %v", key, err)
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	return events[0]
+}
+
+// keys returns the values of the keys in the range at the revision
+func (l *testLog) keys(t *testing.T, key, rangeEnd string, revision int64) (map[string]string, error) {
+	_, events, err := l.List(context.Background(), key, rangeEnd, 0, revision, false, server.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string]string{}
+	for _, event := range events {
+		keys[event.KV.Key] = string(event.KV.Value)
+	}
+	return keys, nil
+}
+
+func TestIndexOrder(t *testing.T) {
+	names := []string{"", "\x00", "\x00\x00", "\x00a", "/a", "/a\x00", "/a\x00b", "/a\x01", "/a/", "/ab", "/b", "\xff"}
+
+	var keys [][]byte
+	for i := len(names) - 1; i >= 0; i-- {
+		keys = append(keys, indexKey(names[i], 2), indexKey(names[i], 1))
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+
+	// the revisions of a name are next to each other, in names order
+	for i, name := range names {
+		for j, rev := range []int64{1, 2} {
+			if key := keys[2*i+j]; !bytes.Equal(key, indexKey(name, rev)) {
+				t.Fatalf("index key %d is %q, expected the key of %q at revision %d", 2*i+j, key, name, rev)
+			}
+		}
+	}
+
+	for _, tt := range []struct {
+		name          string
+		key, rangeEnd string
+		names         []string
+	}{
+		{name: "exact key", key: "/a", names: []string{"/a"}},
+		{name: "key with a NUL byte", key: "/a\x00", names: []string{"/a\x00"}},
+		{name: "prefix", key: "/a", rangeEnd: "/b", names: []string{"/a", "/a\x00", "/a\x00b", "/a\x01", "/a/", "/ab"}},
+		{name: "range", key: "/a\x00", rangeEnd: "/a/", names: []string{"/a\x00", "/a\x00b", "/a\x01"}},
+		{name: "from the key", key: "/b", rangeEnd: "\x00", names: []string{"/b", "\xff"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end := indexRange(tt.key, tt.rangeEnd)
+			var selected []string
+			for _, name := range names {
+				key := indexKey(name, 1)
+				if bytes.Compare(key, start) >= 0 && (end == nil || bytes.Compare(key, end) < 0) {
+					selected = append(selected, name)
+				}
+			}
+			if !reflect.DeepEqual(selected, tt.names) {
+				t.Fatalf("range selects %q, expected %q", selected, tt.names)
+			}
+		})
+	}
+}
+
+func TestRevisions(t *testing.T) {
+	l, done := newTestLog(t)
+	defer done()
+	ctx := context.Background()
+
+	createA := l.put(t, "/a", "1")
+	createB := l.put(t, "/b", "1")
+	updateA := l.put(t, "/a", "2")
+	deleteB := l.delete(t, "/b")
+	createB2 := l.put(t, "/b", "2")
+	if revs := []int64{createA, createB, updateA, deleteB, createB2}; !reflect.DeepEqual(revs, []int64{1, 2, 3, 4, 5}) {
+		t.Fatalf("wrote revisions %v, expected 1 to 5", revs)
+	}
+
+	// writes based on an outdated revision of the key fail
+	for _, event := range []*server.Event{
+		{Create: true, KV: &server.KeyValue{Key: "/a"}},
+		{KV: &server.KeyValue{Key: "/a", CreateRevision: createA}, PrevKV: &server.KeyValue{ModRevision: createA}},
+		{KV: &server.KeyValue{Key: "/c"}, PrevKV: &server.KeyValue{ModRevision: createA}},
+		{Create: true, KV: &server.KeyValue{Key: "/b"}, PrevKV: &server.KeyValue{ModRevision: createB}},
+	} {
+		if _, err := l.Append(ctx, event); err != server.ErrKeyExists {
+			t.Fatalf("appending %v got error %v, expected %v", event.KV.Key, err, server.ErrKeyExists)
+		}
+	}
+
+	_, events, err := l.After(ctx, "/a", "/c", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var history []string
+	for _, event := range events {
+		history = append(history, event.KV.Key+"="+string(event.KV.Value))
+	}
+	if expected := []string{"/a=1", "/b=1", "/a=2", "/b=", "/b=2"}; !reflect.DeepEqual(history, expected) {
+		t.Fatalf("history is %v, expected %v", history, expected)
+	}
+
+	for _, tt := range []struct {
+		revision int64
+		keys     map[string]string
+	}{
+		{revision: createA, keys: map[string]string{"/a": "1"}},
+		{revision: updateA, keys: map[string]string{"/a": "2", "/b": "1"}},
+		{revision: deleteB, keys: map[string]string{"/a": "2"}},
+		{revision: createB2, keys: map[string]string{"/a": "2", "/b": "2"}},
+	} {
+		if keys, err := l.keys(t, "/", "0", tt.revision); err != nil || !reflect.DeepEqual(keys, tt.keys) {
+			t.Fatalf("keys at revision %d are %v (%v), expected %v", tt.revision, keys, err, tt.keys)
+		}
+	}
+}
+
+func TestCompact(t *testing.T) {
+	l, done := newTestLog(t)
+	defer done()
+	ctx := context.Background()
+
+	l.put(t, "/a", "1")              // 1
+	l.put(t, "/a", "2")              // 2
+	l.put(t, "/b", "1")              // 3
+	deleted := l.delete(t, "/b")     // 4
+	compacted := l.put(t, "/a", "3") // 5
+	l.put(t, "/c", "1")              // 6
+
+	if _, err := l.Compact(ctx, compacted+2); err != server.ErrFutureRev {
+		t.Fatalf("compacting a future revision got error %v, expected %v", err, server.ErrFutureRev)
+	}
+	compactDone, err := l.Compact(ctx, compacted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-compactDone
+	if _, err := l.Compact(ctx, deleted); err != server.ErrCompacted {
+		t.Fatalf("compacting a compacted revision got error %v, expected %v", err, server.ErrCompacted)
+	}
+
+	// the superseded rows and the delete are gone, along with their index
+	// entries
+	var revisions, index []int64
+	err = l.db.View(func(tx *bbolt.Tx) error {
+		if err := tx.Bucket(revisionsBucket).ForEach(func(k, _ []byte) error {
+			revisions = append(revisions, int64At(k))
+			return nil
+		}); err != nil {
+			return err
+		}
+		return tx.Bucket(namesBucket).ForEach(func(k, _ []byte) error {
+			index = append(index, int64At(k))
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []int64{5, 6}; !reflect.DeepEqual(revisions, expected) || !reflect.DeepEqual(index, expected) {
+		t.Fatalf("rows %v and index %v are left, expected %v", revisions, index, expected)
+	}
+
+	if _, err := l.keys(t, "/", "0", deleted); err != server.ErrCompacted {
+		t.Fatalf("list below the compact revision got error %v, expected %v", err, server.ErrCompacted)
+	}
+	if keys, err := l.keys(t, "/", "0", compacted); err != nil || !reflect.DeepEqual(keys, map[string]string{"/a": "3"}) {
+		t.Fatalf("keys at the compact revision are %v (%v), expected /a", keys, err)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	l, done := newTestLog(t)
+	defer done()
+	ctx := context.Background()
+
+	l.put(t, "/a", "1")
+	l.put(t, "/a", "2")
+	last := l.put(t, "/b", "1")
+	compactDone, err := l.Compact(ctx, last-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-compactDone
+
+	l.restart(t)
+
+	if rev, err := l.CurrentRevision(ctx); err != nil || rev != last {
+		t.Fatalf("current revision is %d (%v) after restarting, expected %d", rev, err, last)
+	}
+	if rev, err := l.CompactRevision(ctx); err != nil || rev != last-1 {
+		t.Fatalf("compact revision is %d (%v) after restarting, expected %d", rev, err, last-1)
+	}
+	if rev := l.put(t, "/a", "3"); rev != last+1 {
+		t.Fatalf("wrote revision %d after restarting, expected %d", rev, last+1)
+	}
+	if keys, err := l.keys(t, "/", "0", 0); err != nil || !reflect.DeepEqual(keys, map[string]string{"/a": "3", "/b": "1"}) {
+		t.Fatalf("keys are %v (%v) after restarting", keys, err)
+	}
+}
@@ -0,0 +1,109 @@
+package bolt
+
+import (
+	"context"
+	"sort"
+
+	"github.com/rancher/kine/pkg/logstructured"
+	"go.etcd.io/bbolt"
+)
+
+// Compact records the revision as the compact revision and removes the history
+// before it in the background. The returned channel receives the error of the
+// removal and is closed once it is done.
+func (s *Log) Compact(ctx context.Context, revision int64) (<-chan error, error) {
+	return s.compactor.Compact(ctx, revision)
+}
+
+// SetCompactRevision records the compact revision.
+func (s *Log) SetCompactRevision(ctx context.Context, revision int64) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(metaBucket).Put(compactRevisionKey, int64Key(revision))
+	})
+}
+
+// CompactBatch deletes the rows superseded by the revisions in (start, end]
+// and the deletes among them.
+func (s *Log) CompactBatch(ctx context.Context, start, end int64) (deleted int64, err error) {
+	err = s.db.Update(func(tx *bbolt.Tx) error {
+		// the rows written in (start, end] are the ones after start by ID,
+		// and the rows of batches in it that come before start by ID
+		var rows []*logstructured.Row
+		c := tx.Bucket(revisionsBucket).Cursor()
+		for k, v := c.Seek(int64Key(start + 1)); k != nil && int64At(k) <= end; k, v = c.Next() {
+			row, err := decodeRow(int64At(k), v, false)
+			if err != nil {
+				return err
+			}
+			if row.Revision() <= end {
+				rows = append(rows, row)
+			}
+		}
+		c = tx.Bucket(batchesBucket).Cursor()
+		for k, _ := c.Seek(int64Key(start + 1)); k != nil && int64At(k[:8]) <= end; k, _ = c.Next() {
+			if id := int64At(k); id <= start {
+				row, err := getRow(tx, id, false)
+				if err != nil {
+					return err
+				}
+				rows = append(rows, row)
+			}
+		}
+
+		remove := map[int64]bool{}
+		for _, row := range rows {
+			// created rows reference the revision they were created at
+			// rather than a previous row of the key
+			if !row.Created && row.PrevRevision != 0 {
+				prev, err := rowAt(tx, row.Name, row.PrevRevision)
+				if err != nil {
+					return err
+				}
+				if prev != nil {
+					remove[prev.ID] = true
+				}
+			}
+			if row.Deleted {
+				remove[row.ID] = true
+			}
+		}
+
+		ids := make([]int64, 0, len(remove))
+		for id := range remove {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool {
+			return ids[i] < ids[j]
+		})
+		for _, id := range ids {
+			ok, err := deleteRow(tx, id)
+			if err != nil {
+				return err
+			}
+			if ok {
+				deleted++
+			}
+		}
+		return nil
+	})
+	return deleted, err
+}
+
+// deleteRow deletes the row with the ID along with its index entries, it
+// reports whether there was one
+func deleteRow(tx *bbolt.Tx, id int64) (bool, error) {
+	row, err := getRow(tx, id, false)
+	if err != nil || row == nil {
+		return false, err
+	}
+
+	if err := tx.Bucket(revisionsBucket).Delete(int64Key(id)); err != nil {
+		return false, err
+	}
+	if row.BatchRevision != 0 {
+		if err := tx.Bucket(batchesBucket).Delete(batchKey(row.BatchRevision, id)); err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Bucket(namesBucket).Delete(indexKey(row.Name, id))
+}
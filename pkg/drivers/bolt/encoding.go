@@ -0,0 +1,195 @@
+package bolt
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/rancher/kine/pkg/logstructured"
+)
+
+const (
+	rowCreated = 1 << iota
+	rowDeleted
+	// rowBatch marks rows written in a batch, their batch revision follows
+	// the flags
+	rowBatch
+	// rowVersion marks rows of keys at a version other than the first, the
+	// version follows the flags and the batch revision
+	rowVersion
+	// rowOldLease marks rows whose previous row had another lease, that
+	// lease follows the version
+	rowOldLease
+)
+
+// int64Key encodes revisions, lease IDs and times big endian, so that their
+// keys sort in numeric order
+func int64Key(v int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(v))
+	return key
+}
+
+// int64At decodes the int64 that the key ends in
+func int64At(key []byte) int64 {
+	return int64(binary.BigEndian.Uint64(key[len(key)-8:]))
+}
+
+// escapeName escapes the NUL bytes of a name as 0x00 0xff. Escaped names sort
+// as the names do.
+func escapeName(name string) []byte {
+	escaped := make([]byte, 0, len(name)+2)
+	for i := 0; i < len(name); i++ {
+		escaped = append(escaped, name[i])
+		if name[i] == 0 {
+			escaped = append(escaped, 0xff)
+		}
+	}
+	return escaped
+}
+
+// namePrefix is the prefix of the name index keys of a name, the escaped name
+// terminated by 0x00 0x01. No prefix starts with another and they sort as the
+// names do.
+func namePrefix(name string) []byte {
+	return append(escapeName(name), 0x00, 0x01)
+}
+
+// indexKey is the key of a row of a name in the name index
+func indexKey(name string, id int64) []byte {
+	return append(namePrefix(name), int64Key(id)...)
+}
+
+// indexRevision returns the revision of the row with the ID from its name
+// index value
+func indexRevision(id int64, value []byte) int64 {
+	if len(value) > 8 {
+		return int64At(value)
+	}
+	return id
+}
+
+// batchKey is the key of a row in the batch index
+func batchKey(batch, id int64) []byte {
+	return append(int64Key(batch), int64Key(id)...)
+}
+
+// indexRange returns the name index keys of the range [start, end), with the
+// meaning of an empty and a "\x00" rangeEnd of List. The end is nil if the
+// range has none.
+func indexRange(key, rangeEnd string) ([]byte, []byte) {
+	switch rangeEnd {
+	case "":
+		prefix := namePrefix(key)
+		end := append([]byte{}, prefix...)
+		end[len(end)-1]++
+		return prefix, end
+	case "\x00":
+		return escapeName(key), nil
+	}
+	return escapeName(key), escapeName(rangeEnd)
+}
+
+// encodeRow encodes a row without its ID, which is the key it is stored at
+func encodeRow(row *logstructured.Row) []byte {
+	buf := make([]byte, 0, 1+9*binary.MaxVarintLen64+len(row.Name)+len(row.Value)+len(row.OldValue))
+
+	var flags byte
+	if row.Created {
+		flags |= rowCreated
+	}
+	if row.Deleted {
+		flags |= rowDeleted
+	}
+	if row.BatchRevision != 0 {
+		flags |= rowBatch
+	}
+	if row.Version != 1 {
+		flags |= rowVersion
+	}
+	if row.OldLease != row.Lease {
+		flags |= rowOldLease
+	}
+	buf = append(buf, flags)
+	if row.BatchRevision != 0 {
+		buf = appendVarint(buf, row.BatchRevision)
+	}
+	if row.Version != 1 {
+		buf = appendVarint(buf, row.Version)
+	}
+	if row.OldLease != row.Lease {
+		buf = appendVarint(buf, row.OldLease)
+	}
+
+	for _, v := range []int64{row.CreateRevision, row.PrevRevision, row.Lease} {
+		buf = appendVarint(buf, v)
+	}
+	for _, b := range [][]byte{[]byte(row.Name), row.Value, row.OldValue} {
+		buf = appendVarint(buf, int64(len(b)))
+		buf = append(buf, b...)
+	}
+	return buf
+}
+
+func appendVarint(buf []byte, v int64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(b[:], v)
+	return append(buf, b[:n]...)
+}
+
+// decodeRow decodes the row stored with the ID. The data is only valid during
+// the transaction it was read in, so the values are copied, unless values is
+// false and they are left out.
+func decodeRow(id int64, data []byte, values bool) (*logstructured.Row, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("row %d is empty", id)
+	}
+
+	row := &logstructured.Row{
+		ID:      id,
+		Created: data[0]&rowCreated != 0,
+		Deleted: data[0]&rowDeleted != 0,
+		Version: 1,
+	}
+	var ints []*int64
+	if data[0]&rowBatch != 0 {
+		ints = append(ints, &row.BatchRevision)
+	}
+	if data[0]&rowVersion != 0 {
+		ints = append(ints, &row.Version)
+	}
+	oldLease := data[0]&rowOldLease != 0
+	if oldLease {
+		ints = append(ints, &row.OldLease)
+	}
+	ints = append(ints, &row.CreateRevision, &row.PrevRevision, &row.Lease)
+	data = data[1:]
+
+	for _, v := range ints {
+		n := 0
+		*v, n = binary.Varint(data)
+		if n <= 0 {
+			return nil, fmt.Errorf("row %d is corrupt", id)
+		}
+		data = data[n:]
+	}
+
+	var fields [3][]byte
+	for i := range fields {
+		size, n := binary.Varint(data)
+		if n <= 0 || size < 0 || int64(len(data)-n) < size {
+			return nil, fmt.Errorf("row %d is corrupt", id)
+		}
+		fields[i] = data[n : n+int(size)]
+		data = data[n+int(size):]
+	}
+
+	if !oldLease {
+		row.OldLease = row.Lease
+	}
+	row.Name = string(fields[0])
+	if values {
+		row.Value = append([]byte{}, fields[1]...)
+		row.OldValue = append([]byte{}, fields[2]...)
+	}
+	return row, nil
+}
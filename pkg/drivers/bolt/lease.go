@@ -0,0 +1,160 @@
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"sort"
+
+	"github.com/rancher/kine/pkg/server"
+	"go.etcd.io/bbolt"
+)
+
+// leaseKey is the key of a name in the lease keys index
+func leaseKey(lease int64, name string) []byte {
+	return append(int64Key(lease), name...)
+}
+
+// expiryKey is the key of a lease in the lease expiry index
+func expiryKey(lease *server.Lease) []byte {
+	return append(int64Key(lease.Expires), int64Key(lease.ID)...)
+}
+
+func encodeLease(lease *server.Lease) []byte {
+	data := make([]byte, 16)
+	binary.BigEndian.PutUint64(data, uint64(lease.TTL))
+	binary.BigEndian.PutUint64(data[8:], uint64(lease.Expires))
+	return data
+}
+
+func getLease(tx *bbolt.Tx, id int64) *server.Lease {
+	data := tx.Bucket(leasesBucket).Get(int64Key(id))
+	if len(data) != 16 {
+		return nil
+	}
+	return &server.Lease{
+		ID:      id,
+		TTL:     int64(binary.BigEndian.Uint64(data)),
+		Expires: int64(binary.BigEndian.Uint64(data[8:])),
+	}
+}
+
+func putLease(tx *bbolt.Tx, lease *server.Lease) error {
+	if err := tx.Bucket(leasesBucket).Put(int64Key(lease.ID), encodeLease(lease)); err != nil {
+		return err
+	}
+	return tx.Bucket(leaseExpiryBucket).Put(expiryKey(lease), nil)
+}
+
+func (s *Log) ListByLease(ctx context.Context, lease int64) (rev int64, events []*server.Event, err error) {
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		rev = currentRevision(tx)
+
+		prefix := int64Key(lease)
+		c := tx.Bucket(leaseKeysBucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			latest, err := latestRow(tx, string(k[len(prefix):]))
+			if err != nil {
+				return err
+			}
+			if latest == nil || latest.Deleted || latest.Lease != lease {
+				continue
+			}
+
+			row, err := getRow(tx, latest.ID, true)
+			if err != nil {
+				return err
+			}
+			events = append(events, row.Event())
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].KV.ModRevision < events[j].KV.ModRevision
+	})
+	return rev, events, nil
+}
+
+func (s *Log) CreateLease(ctx context.Context, lease *server.Lease) error {
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		if getLease(tx, lease.ID) != nil {
+			return server.ErrLeaseExists
+		}
+		return putLease(tx, lease)
+	})
+	return translateErr(err)
+}
+
+func (s *Log) GetLease(ctx context.Context, id int64) (lease *server.Lease, err error) {
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		lease = getLease(tx, id)
+		return nil
+	})
+	return
+}
+
+// UpdateLease stores the new expiry of the lease, as long as the lease has not
+// already expired at now.
+func (s *Log) UpdateLease(ctx context.Context, lease *server.Lease, now int64) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		current := getLease(tx, lease.ID)
+		if current == nil || current.Expires <= now {
+			return server.ErrLeaseNotFound
+		}
+
+		if err := tx.Bucket(leaseExpiryBucket).Delete(expiryKey(current)); err != nil {
+			return err
+		}
+		current.Expires = lease.Expires
+		return putLease(tx, current)
+	})
+}
+
+func (s *Log) DeleteLease(ctx context.Context, id int64) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		lease := getLease(tx, id)
+		if lease == nil {
+			return nil
+		}
+
+		if err := tx.Bucket(leaseExpiryBucket).Delete(expiryKey(lease)); err != nil {
+			return err
+		}
+		return tx.Bucket(leasesBucket).Delete(int64Key(id))
+	})
+}
+
+func (s *Log) ListLeases(ctx context.Context) (leases []*server.Lease, err error) {
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(leasesBucket).Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if lease := getLease(tx, int64At(k)); lease != nil {
+				leases = append(leases, lease)
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// ExpiredLeases returns up to limit leases that expired at or before now, the
+// earliest deadline first.
+func (s *Log) ExpiredLeases(ctx context.Context, now, limit int64) (leases []*server.Lease, err error) {
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(leaseExpiryBucket).Cursor()
+		for k, _ := c.First(); k != nil && int64At(k[:8]) <= now; k, _ = c.Next() {
+			if limit > 0 && int64(len(leases)) >= limit {
+				break
+			}
+			if lease := getLease(tx, int64At(k)); lease != nil {
+				leases = append(leases, lease)
+			}
+		}
+		return nil
+	})
+	return
+}
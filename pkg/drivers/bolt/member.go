@@ -0,0 +1,118 @@
+package bolt
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/rancher/kine/pkg/server"
+	"go.etcd.io/bbolt"
+)
+
+// ClusterID returns the cluster ID recorded in the file, recording id if there
+// is none. Only one process opens the file at a time, but its members keep the
+// same cluster ID across restarts.
+func (s *Log) ClusterID(ctx context.Context, id uint64) (clusterID uint64, err error) {
+	err = s.db.Update(func(tx *bbolt.Tx) error {
+		meta := tx.Bucket(metaBucket)
+		if data := meta.Get(clusterIDKey); len(data) == 8 {
+			clusterID = binary.BigEndian.Uint64(data)
+			return nil
+		}
+		clusterID = id
+		return meta.Put(clusterIDKey, int64Key(int64(id)))
+	})
+	return clusterID, translateErr(err)
+}
+
+func (s *Log) PutMember(ctx context.Context, member *server.Member) error {
+	return translateErr(s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(membersBucket).Put(int64Key(int64(member.ID)), encodeMember(member))
+	}))
+}
+
+func (s *Log) Members(ctx context.Context) (members []*server.Member, err error) {
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(membersBucket).ForEach(func(k, v []byte) error {
+			member, err := decodeMember(uint64(int64At(k)), v)
+			if err != nil {
+				return err
+			}
+			members = append(members, member)
+			return nil
+		})
+	})
+	return members, err
+}
+
+func (s *Log) DeleteMember(ctx context.Context, id uint64) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(membersBucket).Delete(int64Key(int64(id)))
+	})
+}
+
+func (s *Log) PutAlarm(ctx context.Context, alarm *server.Alarm) error {
+	return translateErr(s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(alarmsBucket).Put(alarmKey(alarm), nil)
+	}))
+}
+
+func (s *Log) Alarms(ctx context.Context) (alarms []*server.Alarm, err error) {
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(alarmsBucket).ForEach(func(k, v []byte) error {
+			if len(k) != 16 {
+				return fmt.Errorf("alarm key %x is corrupt", k)
+			}
+			alarms = append(alarms, &server.Alarm{
+				MemberID: uint64(int64At(k[:8])),
+				Type:     int32(int64At(k)),
+			})
+			return nil
+		})
+	})
+	return alarms, err
+}
+
+func (s *Log) DeleteAlarm(ctx context.Context, alarm *server.Alarm) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(alarmsBucket).Delete(alarmKey(alarm))
+	})
+}
+
+// alarmKey returns the key of an alarm, the member ID followed by the type
+func alarmKey(alarm *server.Alarm) []byte {
+	return append(int64Key(int64(alarm.MemberID)), int64Key(int64(alarm.Type))...)
+}
+
+// encodeMember encodes a member without its ID, which is the key it is stored
+// at, as its heartbeat followed by its name and client URLs
+func encodeMember(member *server.Member) []byte {
+	urls := strings.Join(member.ClientURLs, ",")
+	buf := make([]byte, 0, 8+binary.MaxVarintLen64+len(member.Name)+len(urls))
+	buf = append(buf, int64Key(member.Heartbeat)...)
+	buf = appendVarint(buf, int64(len(member.Name)))
+	buf = append(buf, member.Name...)
+	return append(buf, urls...)
+}
+
+func decodeMember(id uint64, data []byte) (*server.Member, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("member %x is corrupt", id)
+	}
+	member := &server.Member{
+		ID:        id,
+		Heartbeat: int64(binary.BigEndian.Uint64(data)),
+	}
+	data = data[8:]
+
+	size, n := binary.Varint(data)
+	if n <= 0 || size < 0 || int64(len(data)-n) < size {
+		return nil, fmt.Errorf("member %x is corrupt", id)
+	}
+	member.Name = string(data[n : n+int(size)])
+	if urls := string(data[n+int(size):]); urls != "" {
+		member.ClientURLs = strings.Split(urls, ",")
+	}
+	return member, nil
+}
@@ -0,0 +1,61 @@
+package bolt
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rancher/kine/pkg/logstructured"
+	"github.com/rancher/kine/pkg/server"
+	"go.etcd.io/bbolt"
+)
+
+func (s *Log) Rows(ctx context.Context, id, limit int64) (rows []*logstructured.Row, err error) {
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		rows, err = rowsAfter(tx, id, limit)
+		return err
+	})
+	return
+}
+
+// InsertRows writes the rows with their IDs and batch revisions in one bbolt
+// transaction, the current revision moves past their IDs until SetRevisions
+// moves it to the revision they were copied at.
+func (s *Log) InsertRows(ctx context.Context, rows []*logstructured.Row) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		revisions := tx.Bucket(revisionsBucket)
+		for _, row := range rows {
+			if revisions.Get(int64Key(row.ID)) != nil {
+				return server.ErrKeyExists
+			}
+			latest, err := latestRow(tx, row.Name)
+			if err != nil {
+				return err
+			}
+			if latest != nil && latest.ID > row.ID {
+				return fmt.Errorf("row %d of %q is before its latest row %d", row.ID, row.Name, latest.ID)
+			}
+
+			if err := putRow(tx, row, latest); err != nil {
+				return err
+			}
+			if int64(revisions.Sequence()) < row.ID {
+				if err := revisions.SetSequence(uint64(row.ID)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (s *Log) SetRevisions(ctx context.Context, current, compact int64) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		revisions := tx.Bucket(revisionsBucket)
+		if int64(revisions.Sequence()) < current {
+			if err := revisions.SetSequence(uint64(current)); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(metaBucket).Put(compactRevisionKey, int64Key(compact))
+	})
+}
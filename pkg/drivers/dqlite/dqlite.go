@@ -16,6 +16,7 @@ import (
 	"github.com/canonical/go-dqlite/driver"
 	"github.com/pkg/errors"
 	"github.com/rancher/kine/pkg/drivers/sqlite"
+	"github.com/rancher/kine/pkg/logstructured"
 	"github.com/rancher/kine/pkg/server"
 	"github.com/sirupsen/logrus"
 )
@@ -66,7 +67,7 @@ outer:
 	return nil
 }
 
-func New(ctx context.Context, datasourceName string) (server.Backend, error) {
+func New(ctx context.Context, datasourceName string, compact logstructured.CompactConfig) (server.Backend, error) {
 	opts, err := parseOpts(datasourceName)
 	if err != nil {
 		return nil, err
@@ -95,7 +96,7 @@ func New(ctx context.Context, datasourceName string) (server.Backend, error) {
 	}
 
 	sql.Register("dqlite", d)
-	backend, generic, err := sqlite.NewVariant(ctx, "dqlite", opts.dsn)
+	backend, generic, err := sqlite.NewVariant(ctx, "dqlite", opts.dsn, compact)
 	if err != nil {
 		return nil, errors.Wrap(err, "sqlite client")
 	}
@@ -114,6 +115,9 @@ func New(ctx context.Context, datasourceName string) (server.Backend, error) {
 		if strings.Contains(err.Error(), "UNIQUE constraint") {
 			return server.ErrKeyExists
 		}
+		if strings.Contains(err.Error(), "database or disk is full") {
+			return server.ErrNoSpace
+		}
 		return err
 	}
 
@@ -6,9 +6,10 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/rancher/kine/pkg/logstructured"
 	"github.com/rancher/kine/pkg/server"
 )
 
-func New(ctx context.Context, datasourceName string) (server.Backend, error) {
+func New(ctx context.Context, datasourceName string, compact logstructured.CompactConfig) (server.Backend, error) {
 	return nil, fmt.Errorf("dqlite is not support, compile with \"-tags dqlite\"")
 }
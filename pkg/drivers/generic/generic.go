@@ -12,48 +12,115 @@ import (
 
 	"github.com/Rican7/retry/backoff"
 	"github.com/Rican7/retry/strategy"
+	"github.com/rancher/kine/pkg/metrics"
+	"github.com/rancher/kine/pkg/server"
 	"github.com/sirupsen/logrus"
 )
 
 var (
-	columns = "kv.id as theid, kv.name, kv.created, kv.deleted, kv.create_revision, kv.prev_revision, kv.lease, kv.value, kv.old_value"
+	columns = "kv.id as theid, kv.batch_revision, kv.name, kv.created, kv.deleted, kv.create_revision, kv.prev_revision, kv.lease, kv.value, kv.old_value, kv.version, kv.old_lease"
 	revSQL  = `
 		SELECT rkv.id
 		FROM kine rkv
 		ORDER BY rkv.id
 		DESC LIMIT 1`
 
+	// keyColumns leaves out the values, for lists that only need the keys
+	keyColumns = "kv.id as theid, kv.batch_revision, kv.name, kv.created, kv.deleted, kv.create_revision, kv.prev_revision, kv.lease, NULL, NULL, kv.version, kv.old_lease"
+	// modRevision is the revision a row was written at, the rows written
+	// in a batch record the revision of the batch, the id of its last row
+	modRevision = "COALESCE(kv.batch_revision, kv.id)"
+	// createRevision is the revision a row's key was created at, create rows
+	// leave it at zero as it is their own revision
+	createRevision = "CASE WHEN kv.created = 1 THEN " + modRevision + " ELSE kv.create_revision END"
+	// version is the version of a row's key, rows written before versions
+	// were recorded are taken to be at the first
+	version = "COALESCE(kv.version, 1)"
+
 	compactRevSQL = `
 		SELECT crkv.prev_revision
 		FROM kine crkv
 		WHERE crkv.name = 'compact_rev_key'
 		ORDER BY crkv.id DESC LIMIT 1`
 
-	idOfKey = `
-		AND mkv.id <= ? AND mkv.id > (
-			SELECT ikv.id
-			FROM kine ikv
-			WHERE
-				ikv.name = ? AND
-				ikv.id <= ?
-			ORDER BY ikv.id DESC LIMIT 1)`
-
-	listSQL = fmt.Sprintf(`SELECT (%s), (%s), %s
+	listSQL = fmt.Sprintf(`SELECT (%s), (%s), %%s
 		FROM kine kv
 		JOIN (
 			SELECT MAX(mkv.id) as id
 			FROM kine mkv
 			WHERE
-				mkv.name LIKE ?
+				%%s
 				%%s
 			GROUP BY mkv.name) maxkv
 	    ON maxkv.id = kv.id
 		WHERE
 			  (kv.deleted = 0 OR ?)
-		ORDER BY kv.id ASC
-		`, revSQL, compactRevSQL, columns)
+			  %%s
+		ORDER BY %%s
+		`, revSQL, compactRevSQL)
+
+	countSQL = `
+		SELECT (%s), COUNT(c.theid)
+		FROM (
+			%s
+		) c`
+
+	// A range follows etcd, it is either a single key, every key from a key
+	// on, or the keys in [key, rangeEnd).
+	keyCondition   = "mkv.name = ?"
+	fromCondition  = "mkv.name >= ?"
+	rangeCondition = "mkv.name >= ? AND mkv.name < ?"
+
+	// A batch is only visible at its revision, the rows of a key are in the
+	// same order by id as by revision so the latest visible one has the
+	// highest id.
+	revisionCondition = "AND mkv.id <= ? AND (mkv.batch_revision IS NULL OR mkv.batch_revision <= ?)"
+	keyOrder          = "kv.name ASC"
+
+	afterSQL = `
+		SELECT (%s), (%s), %s
+		FROM kine kv
+		WHERE
+			%s
+			(kv.id > ? OR kv.batch_revision > ?)
+		ORDER BY COALESCE(kv.batch_revision, kv.id) ASC, kv.id ASC`
+
+	// compactedCondition selects the rows written at the revisions in
+	// (start, end] of a compaction, the arguments are start and end twice
+	compactedCondition = `(
+		(%[1]s.batch_revision IS NULL AND %[1]s.id > ? AND %[1]s.id <= ?) OR
+		(%[1]s.batch_revision > ? AND %[1]s.batch_revision <= ?))`
+
+	// compactedDeletedCondition selects the deletes to remove in a
+	// compaction. The latest row is kept, as the current revision is the
+	// highest id, and removed by the next compaction, which starts at its
+	// revision. The arguments are those of compactedCondition.
+	compactedDeletedCondition = `
+		%[1]s.id < (SELECT mid FROM (SELECT MAX(id) AS mid FROM kine) AS km) AND (
+		(%[1]s.batch_revision IS NULL AND %[1]s.id >= ? AND %[1]s.id <= ?) OR
+		(%[1]s.batch_revision >= ? AND %[1]s.batch_revision <= ?))`
 )
 
+// listQuery returns the query listing the latest row of every key matching
+// the condition
+func listQuery(columns, condition, revisionCondition, filter, order string) string {
+	return fmt.Sprintf(listSQL, columns, condition, revisionCondition, filter, order)
+}
+
+// afterQuery returns the query of the rows matching the condition written
+// after a revision. The range conditions name the table mkv as the list
+// queries do, here it is kv.
+func afterQuery(condition string) string {
+	if condition != "" {
+		condition = strings.Replace(condition, "mkv.", "kv.", -1) + " AND"
+	}
+	return fmt.Sprintf(afterSQL, revSQL, compactRevSQL, columns, condition)
+}
+
+// maxLegacyTTL is the lowest lease ID handed out by the lease registry, lease
+// column values below it were written by older releases as a TTL in seconds.
+const maxLegacyTTL = 1 << 24
+
 type Stripped string
 
 func (s Stripped) String() string {
@@ -70,20 +137,60 @@ type Generic struct {
 	LockWrites            bool
 	LastInsertID          bool
 	DB                    *sql.DB
-	GetCurrentSQL         string
 	GetRevisionSQL        string
 	RevisionSQL           string
-	ListRevisionStartSQL  string
-	GetRevisionAfterSQL   string
-	CountSQL              string
+	ListCurrentKeySQL     string
+	ListCurrentFromSQL    string
+	ListCurrentRangeSQL   string
+	ListRevisionKeySQL    string
+	ListRevisionFromSQL   string
+	ListRevisionRangeSQL  string
+	CountKeySQL           string
+	CountFromSQL          string
+	CountRangeSQL         string
 	AfterSQL              string
+	AfterKeySQL           string
+	AfterFromSQL          string
+	AfterRangeSQL         string
+	RowsAfterSQL          string
+	BatchStartIDSQL       string
+	SetBatchRevisionSQL   string
 	DeleteSQL             string
 	UpdateCompactSQL      string
+	CompactSupersededSQL  string
+	CompactDeletedSQL     string
 	InsertSQL             string
 	FillSQL               string
 	InsertLastInsertIDSQL string
+	KeyRevisionSQL        string
+	LockKeysSQL           string
+	ListByLeaseSQL        string
+	InsertLeaseSQL        string
+	GetLeaseSQL           string
+	UpdateLeaseSQL        string
+	DeleteLeaseSQL        string
+	ListLeasesSQL         string
+	ExpiredLeasesSQL      string
+	LegacyLeasesSQL       string
+	ResetSequenceSQL      string
+	DbSizeSQL             string
+	DefragmentSQL         []string
+	ClusterIDSQL          string
+	InsertClusterIDSQL    string
+	InsertMemberSQL       string
+	UpdateMemberSQL       string
+	ListMembersSQL        string
+	DeleteMemberSQL       string
+	InsertAlarmSQL        string
+	ListAlarmsSQL         string
+	DeleteAlarmSQL        string
 	Retry                 ErrRetry
 	TranslateErr          TranslateErr
+
+	paramCharacter string
+	numbered       bool
+	// listQueries caches the list queries built for ListOptions
+	listQueries sync.Map
 }
 
 func q(sql, param string, numbered bool) string {
@@ -103,22 +210,24 @@ func q(sql, param string, numbered bool) string {
 }
 
 func (d *Generic) Migrate(ctx context.Context) {
-	var (
-		count     = 0
-		countKV   = d.queryRow(ctx, "SELECT COUNT(*) FROM key_value")
-		countKine = d.queryRow(ctx, "SELECT COUNT(*) FROM kine")
-	)
+	d.migrateKeyValue(ctx)
+	d.migrateLeases(ctx)
+}
 
-	if err := countKV.Scan(&count); err != nil || count == 0 {
+func (d *Generic) migrateKeyValue(ctx context.Context) {
+	// a row holds its connection until it is scanned, and with it a read lock
+	// that blocks writers of a SQLite database not in WAL mode
+	count := 0
+	if err := d.queryRow(ctx, "Migrate", "SELECT COUNT(*) FROM key_value").Scan(&count); err != nil || count == 0 {
 		return
 	}
 
-	if err := countKine.Scan(&count); err != nil || count != 0 {
+	if err := d.queryRow(ctx, "Migrate", "SELECT COUNT(*) FROM kine").Scan(&count); err != nil || count != 0 {
 		return
 	}
 
 	logrus.Infof("Migrating content from old table")
-	_, err := d.execute(ctx,
+	_, err := d.execute(ctx, "Migrate",
 		`INSERT INTO kine(deleted, create_revision, prev_revision, name, value, created, lease)
 					SELECT 0, 0, 0, kv.name, kv.value, 1, CASE WHEN kv.ttl > 0 THEN 15 ELSE 0 END
 					FROM key_value kv
@@ -128,6 +237,39 @@ func (d *Generic) Migrate(ctx context.Context) {
 	}
 }
 
+// migrateLeases registers a lease for every TTL that older releases stored
+// directly in the lease column, so those keys expire through the lease table.
+// Lease IDs that are granted never fall below maxLegacyTTL.
+func (d *Generic) migrateLeases(ctx context.Context) {
+	rows, err := d.query(ctx, "LegacyLeases", d.LegacyLeasesSQL, maxLegacyTTL)
+	if err != nil {
+		logrus.Errorf("Lease migration failed: %v", err)
+		return
+	}
+
+	var ttls []int64
+	for rows.Next() {
+		var ttl int64
+		if err := rows.Scan(&ttl); err != nil {
+			rows.Close()
+			logrus.Errorf("Lease migration failed: %v", err)
+			return
+		}
+		ttls = append(ttls, ttl)
+	}
+	rows.Close()
+
+	if len(ttls) > 0 {
+		logrus.Infof("Migrating %d key TTLs to leases", len(ttls))
+	}
+	now := time.Now().Unix()
+	for _, ttl := range ttls {
+		if err := d.InsertLease(ctx, ttl, ttl, now+ttl); err != nil {
+			logrus.Errorf("Lease migration failed: %v", err)
+		}
+	}
+}
+
 func openAndTest(driverName, dataSourceName string) (*sql.DB, error) {
 	db, err := sql.Open(driverName, dataSourceName)
 	if err != nil {
@@ -167,30 +309,51 @@ func Open(ctx context.Context, driverName, dataSourceName string, paramCharacter
 	return &Generic{
 		DB: db,
 
+		paramCharacter: paramCharacter,
+		numbered:       numbered,
+
 		GetRevisionSQL: q(fmt.Sprintf(`
 			SELECT
 			0, 0, %s
 			FROM kine kv
 			WHERE kv.id = ?`, columns), paramCharacter, numbered),
 
-		GetCurrentSQL:        q(fmt.Sprintf(listSQL, ""), paramCharacter, numbered),
-		ListRevisionStartSQL: q(fmt.Sprintf(listSQL, "AND mkv.id <= ?"), paramCharacter, numbered),
-		GetRevisionAfterSQL:  q(fmt.Sprintf(listSQL, idOfKey), paramCharacter, numbered),
+		ListCurrentKeySQL:    q(listQuery(columns, keyCondition, "", "", keyOrder), paramCharacter, numbered),
+		ListCurrentFromSQL:   q(listQuery(columns, fromCondition, "", "", keyOrder), paramCharacter, numbered),
+		ListCurrentRangeSQL:  q(listQuery(columns, rangeCondition, "", "", keyOrder), paramCharacter, numbered),
+		ListRevisionKeySQL:   q(listQuery(columns, keyCondition, revisionCondition, "", keyOrder), paramCharacter, numbered),
+		ListRevisionFromSQL:  q(listQuery(columns, fromCondition, revisionCondition, "", keyOrder), paramCharacter, numbered),
+		ListRevisionRangeSQL: q(listQuery(columns, rangeCondition, revisionCondition, "", keyOrder), paramCharacter, numbered),
+
+		CountKeySQL:   q(fmt.Sprintf(countSQL, revSQL, listQuery(columns, keyCondition, "", "", keyOrder)), paramCharacter, numbered),
+		CountFromSQL:  q(fmt.Sprintf(countSQL, revSQL, listQuery(columns, fromCondition, "", "", keyOrder)), paramCharacter, numbered),
+		CountRangeSQL: q(fmt.Sprintf(countSQL, revSQL, listQuery(columns, rangeCondition, "", "", keyOrder)), paramCharacter, numbered),
 
-		CountSQL: q(fmt.Sprintf(`
-			SELECT (%s), COUNT(c.theid)
-			FROM (
-				%s
-			) c`, revSQL, fmt.Sprintf(listSQL, "")), paramCharacter, numbered),
+		AfterSQL:      q(afterQuery(""), paramCharacter, numbered),
+		AfterKeySQL:   q(afterQuery(keyCondition), paramCharacter, numbered),
+		AfterFromSQL:  q(afterQuery(fromCondition), paramCharacter, numbered),
+		AfterRangeSQL: q(afterQuery(rangeCondition), paramCharacter, numbered),
 
-		AfterSQL: q(fmt.Sprintf(`
+		RowsAfterSQL: q(fmt.Sprintf(`
 			SELECT (%s), (%s), %s
 			FROM kine kv
-			WHERE
-				kv.name LIKE ? AND
-				kv.id > ?
+			WHERE kv.id > ?
 			ORDER BY kv.id ASC`, revSQL, compactRevSQL, columns), paramCharacter, numbered),
 
+		BatchStartIDSQL: q(`
+			SELECT MIN(kv.id)
+			FROM kine kv
+			WHERE
+				kv.batch_revision > ? AND
+				kv.id <= ?`, paramCharacter, numbered),
+
+		// the ids are filled in for each batch, the statement is numbered
+		// then
+		SetBatchRevisionSQL: `
+			UPDATE kine
+			SET batch_revision = ?
+			WHERE id IN (%s)`,
+
 		DeleteSQL: q(`
 			DELETE FROM kine
 			WHERE id = ?`, paramCharacter, numbered),
@@ -200,32 +363,159 @@ func Open(ctx context.Context, driverName, dataSourceName string, paramCharacter
 			SET prev_revision = ?
 			WHERE name = 'compact_rev_key'`, paramCharacter, numbered),
 
-		InsertLastInsertIDSQL: q(`INSERT INTO kine(name, created, deleted, create_revision, prev_revision, lease, value, old_value)
-			values(?, ?, ?, ?, ?, ?, ?, ?)`, paramCharacter, numbered),
+		// Created rows reference the revision they were created at rather
+		// than a previous row of the key, so they supersede nothing.
+		CompactSupersededSQL: q(fmt.Sprintf(`
+			DELETE FROM kine
+			WHERE id IN (
+				SELECT id
+				FROM (
+					SELECT ks.id
+					FROM kine kp
+					JOIN kine ks ON
+						ks.name = kp.name AND
+						COALESCE(ks.batch_revision, ks.id) = kp.prev_revision
+					WHERE
+						kp.name != 'compact_rev_key' AND
+						kp.created = 0 AND
+						kp.prev_revision != 0 AND
+						%s
+				) AS kd
+			)`, fmt.Sprintf(compactedCondition, "kp")), paramCharacter, numbered),
+
+		CompactDeletedSQL: q(fmt.Sprintf(`
+			DELETE FROM kine
+			WHERE
+				deleted = 1 AND
+				%s`, fmt.Sprintf(compactedDeletedCondition, "kine")), paramCharacter, numbered),
+
+		InsertLastInsertIDSQL: q(`INSERT INTO kine(name, created, deleted, create_revision, prev_revision, lease, value, old_value, version, old_lease)
+			values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, paramCharacter, numbered),
 
-		InsertSQL: q(`INSERT INTO kine(name, created, deleted, create_revision, prev_revision, lease, value, old_value)
-			values(?, ?, ?, ?, ?, ?, ?, ?) RETURNING id`, paramCharacter, numbered),
+		InsertSQL: q(`INSERT INTO kine(name, created, deleted, create_revision, prev_revision, lease, value, old_value, version, old_lease)
+			values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING id`, paramCharacter, numbered),
 
-		FillSQL: q(`INSERT INTO kine(id, name, created, deleted, create_revision, prev_revision, lease, value, old_value)
-			values(?, ?, ?, ?, ?, ?, ?, ?, ?)`, paramCharacter, numbered),
+		FillSQL: q(`INSERT INTO kine(id, batch_revision, name, created, deleted, create_revision, prev_revision, lease, value, old_value, version, old_lease)
+			values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, paramCharacter, numbered),
+
+		KeyRevisionSQL: q(`
+			SELECT COALESCE(kv.batch_revision, kv.id)
+			FROM kine kv
+			WHERE kv.name = ?
+			ORDER BY kv.id DESC
+			LIMIT 1`, paramCharacter, numbered),
+
+		ListByLeaseSQL: q(fmt.Sprintf(`
+			SELECT (%s), (%s), %s
+			FROM kine kv
+			WHERE
+				kv.lease = ? AND
+				kv.deleted = 0 AND
+				kv.id = (
+					SELECT MAX(mkv.id)
+					FROM kine mkv
+					WHERE mkv.name = kv.name)
+			ORDER BY kv.id ASC`, revSQL, compactRevSQL, columns), paramCharacter, numbered),
+
+		InsertLeaseSQL: q(`INSERT INTO kine_lease(id, ttl, expires)
+			values(?, ?, ?)`, paramCharacter, numbered),
+
+		GetLeaseSQL: q(`
+			SELECT id, ttl, expires
+			FROM kine_lease
+			WHERE id = ?`, paramCharacter, numbered),
+
+		UpdateLeaseSQL: q(`
+			UPDATE kine_lease
+			SET expires = ?
+			WHERE
+				id = ? AND
+				expires > ?`, paramCharacter, numbered),
+
+		DeleteLeaseSQL: q(`
+			DELETE FROM kine_lease
+			WHERE id = ?`, paramCharacter, numbered),
+
+		ListLeasesSQL: `
+			SELECT id, ttl, expires
+			FROM kine_lease
+			ORDER BY id ASC`,
+
+		ExpiredLeasesSQL: q(`
+			SELECT id, ttl, expires
+			FROM kine_lease
+			WHERE expires <= ?
+			ORDER BY expires ASC`, paramCharacter, numbered),
+
+		LegacyLeasesSQL: q(`
+			SELECT DISTINCT kv.lease
+			FROM kine kv
+			WHERE
+				kv.lease > 0 AND
+				kv.lease < ? AND
+				kv.lease NOT IN (
+					SELECT l.id
+					FROM kine_lease l)`, paramCharacter, numbered),
+
+		ClusterIDSQL: `
+			SELECT MIN(id)
+			FROM kine_cluster`,
+
+		InsertClusterIDSQL: q(`INSERT INTO kine_cluster(id)
+			values(?)`, paramCharacter, numbered),
+
+		InsertMemberSQL: q(`INSERT INTO kine_member(id, name, client_urls, heartbeat)
+			values(?, ?, ?, ?)`, paramCharacter, numbered),
+
+		UpdateMemberSQL: q(`
+			UPDATE kine_member
+			SET
+				name = ?,
+				client_urls = ?,
+				heartbeat = ?
+			WHERE id = ?`, paramCharacter, numbered),
+
+		ListMembersSQL: `
+			SELECT id, name, client_urls, heartbeat
+			FROM kine_member`,
+
+		DeleteMemberSQL: q(`
+			DELETE FROM kine_member
+			WHERE id = ?`, paramCharacter, numbered),
+
+		InsertAlarmSQL: q(`INSERT INTO kine_alarm(member_id, alarm)
+			values(?, ?)`, paramCharacter, numbered),
+
+		ListAlarmsSQL: `
+			SELECT member_id, alarm
+			FROM kine_alarm`,
+
+		DeleteAlarmSQL: q(`
+			DELETE FROM kine_alarm
+			WHERE member_id = ? AND alarm = ?`, paramCharacter, numbered),
 	}, err
 }
 
-func (d *Generic) query(ctx context.Context, sql string, args ...interface{}) (*sql.Rows, error) {
+// query, queryRow and execute take the name of the statement they run, its
+// latency is reported under that name.
+func (d *Generic) query(ctx context.Context, name, sql string, args ...interface{}) (rows *sql.Rows, err error) {
+	defer func(start time.Time) { metrics.ObserveSQL(name, start, err) }(time.Now())
 	logrus.Tracef("QUERY %v : %s", args, Stripped(sql))
 	return d.DB.QueryContext(ctx, sql, args...)
 }
 
-func (d *Generic) queryRow(ctx context.Context, sql string, args ...interface{}) *sql.Row {
+func (d *Generic) queryRow(ctx context.Context, name, sql string, args ...interface{}) *sql.Row {
+	defer metrics.ObserveSQL(name, time.Now(), nil)
 	logrus.Tracef("QUERY ROW %v : %s", args, Stripped(sql))
 	return d.DB.QueryRowContext(ctx, sql, args...)
 }
 
-func (d *Generic) execute(ctx context.Context, sql string, args ...interface{}) (result sql.Result, err error) {
+func (d *Generic) execute(ctx context.Context, name, sql string, args ...interface{}) (result sql.Result, err error) {
 	if d.LockWrites {
 		d.Lock()
 		defer d.Unlock()
 	}
+	defer func(start time.Time) { metrics.ObserveSQL(name, start, err) }(time.Now())
 
 	wait := strategy.Backoff(backoff.Linear(100 + time.Millisecond))
 	for i := uint(0); i < 20; i++ {
@@ -246,7 +536,7 @@ func (d *Generic) execute(ctx context.Context, sql string, args ...interface{})
 
 func (d *Generic) GetCompactRevision(ctx context.Context) (int64, error) {
 	var id int64
-	row := d.queryRow(ctx, compactRevSQL)
+	row := d.queryRow(ctx, "GetCompactRevision", compactRevSQL)
 	err := row.Scan(&id)
 	if err == sql.ErrNoRows {
 		return 0, nil
@@ -255,57 +545,167 @@ func (d *Generic) GetCompactRevision(ctx context.Context) (int64, error) {
 }
 
 func (d *Generic) SetCompactRevision(ctx context.Context, revision int64) error {
-	_, err := d.execute(ctx, d.UpdateCompactSQL, revision)
+	_, err := d.execute(ctx, "UpdateCompact", d.UpdateCompactSQL, revision)
 	return err
 }
 
+// DbSize returns the bytes the tables take up, or zero if the dialect can't
+// tell.
+func (d *Generic) DbSize(ctx context.Context) (int64, error) {
+	if d.DbSizeSQL == "" {
+		return 0, nil
+	}
+	var size sql.NullInt64
+	row := d.queryRow(ctx, "DbSize", d.DbSizeSQL)
+	err := row.Scan(&size)
+	return size.Int64, err
+}
+
+// Defragment runs the statements that give the space of deleted rows back to
+// the database, one at a time as they can't run in a transaction.
+func (d *Generic) Defragment(ctx context.Context) error {
+	for _, stmt := range d.DefragmentSQL {
+		if _, err := d.execute(ctx, "Defragment", stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (d *Generic) GetRevision(ctx context.Context, revision int64) (*sql.Rows, error) {
-	return d.query(ctx, d.GetRevisionSQL, revision)
+	return d.query(ctx, "GetRevision", d.GetRevisionSQL, revision)
 }
 
 func (d *Generic) DeleteRevision(ctx context.Context, revision int64) error {
-	_, err := d.execute(ctx, d.DeleteSQL, revision)
+	_, err := d.execute(ctx, "Delete", d.DeleteSQL, revision)
 	return err
 }
 
-func (d *Generic) ListCurrent(ctx context.Context, prefix string, limit int64, includeDeleted bool) (*sql.Rows, error) {
-	sql := d.GetCurrentSQL
-	if limit > 0 {
-		sql = fmt.Sprintf("%s LIMIT %d", sql, limit)
+// rangeQuery returns the query matching the kind of range along with the
+// arguments that select the range
+func rangeQuery(key, rangeEnd, keySQL, fromSQL, rangeSQL string) (string, []interface{}) {
+	switch rangeEnd {
+	case "":
+		return keySQL, []interface{}{key}
+	case "\x00":
+		return fromSQL, []interface{}{key}
 	}
-	return d.query(ctx, sql, prefix, includeDeleted)
+	return rangeSQL, []interface{}{key, rangeEnd}
 }
 
-func (d *Generic) List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeleted bool) (*sql.Rows, error) {
-	if startKey == "" {
-		sql := d.ListRevisionStartSQL
-		if limit > 0 {
-			sql = fmt.Sprintf("%s LIMIT %d", sql, limit)
+// listOptionsQuery returns the list query for the options along with the
+// arguments of its filter. The options are applied by the database so that
+// values are not read for keys only lists and limits apply after sorting.
+func (d *Generic) listOptionsQuery(key, rangeEnd string, atRevision bool, opts server.ListOptions) (string, []interface{}, []interface{}) {
+	cols := columns
+	if opts.KeysOnly {
+		cols = keyColumns
+	}
+
+	condition, args := rangeQuery(key, rangeEnd, keyCondition, fromCondition, rangeCondition)
+
+	revCondition := ""
+	if atRevision {
+		revCondition = revisionCondition
+	}
+
+	var (
+		filter     string
+		filterArgs []interface{}
+	)
+	for _, bound := range []struct {
+		value int64
+		sql   string
+	}{
+		{opts.MinModRevision, "AND " + modRevision + " >= ?"},
+		{opts.MaxModRevision, "AND " + modRevision + " <= ?"},
+		{opts.MinCreateRevision, "AND " + createRevision + " >= ?"},
+		{opts.MaxCreateRevision, "AND " + createRevision + " <= ?"},
+	} {
+		if bound.value != 0 {
+			filter += " " + bound.sql
+			filterArgs = append(filterArgs, bound.value)
 		}
-		return d.query(ctx, sql, prefix, revision, includeDeleted)
 	}
 
-	sql := d.GetRevisionAfterSQL
+	direction := "ASC"
+	if opts.Descending {
+		direction = "DESC"
+	}
+	var order string
+	switch opts.SortTarget {
+	case server.SortByCreateRevision:
+		order = fmt.Sprintf("%s %s, kv.name ASC", createRevision, direction)
+	case server.SortByModRevision:
+		order = fmt.Sprintf("%s %s, kv.name ASC", modRevision, direction)
+	case server.SortByValue:
+		order = fmt.Sprintf("kv.value %s, kv.name ASC", direction)
+	case server.SortByVersion:
+		order = fmt.Sprintf("%s %s, kv.name ASC", version, direction)
+	default:
+		order = "kv.name " + direction
+	}
+
+	sql := listQuery(cols, condition, revCondition, filter, order)
+	if cached, ok := d.listQueries.Load(sql); ok {
+		return cached.(string), args, filterArgs
+	}
+	query := q(sql, d.paramCharacter, d.numbered)
+	d.listQueries.Store(sql, query)
+	return query, args, filterArgs
+}
+
+func (d *Generic) ListCurrent(ctx context.Context, key, rangeEnd string, limit int64, includeDeleted bool, opts server.ListOptions) (*sql.Rows, error) {
+	var (
+		sql        string
+		args       []interface{}
+		filterArgs []interface{}
+	)
+	if opts == (server.ListOptions{}) {
+		sql, args = rangeQuery(key, rangeEnd, d.ListCurrentKeySQL, d.ListCurrentFromSQL, d.ListCurrentRangeSQL)
+	} else {
+		sql, args, filterArgs = d.listOptionsQuery(key, rangeEnd, false, opts)
+	}
 	if limit > 0 {
 		sql = fmt.Sprintf("%s LIMIT %d", sql, limit)
 	}
-	return d.query(ctx, sql, prefix, revision, startKey, revision, includeDeleted)
+	args = append(args, includeDeleted)
+	return d.query(ctx, "ListCurrent", sql, append(args, filterArgs...)...)
 }
 
-func (d *Generic) Count(ctx context.Context, prefix string) (int64, int64, error) {
+func (d *Generic) List(ctx context.Context, key, rangeEnd string, limit, revision int64, includeDeleted bool, opts server.ListOptions) (*sql.Rows, error) {
+	var (
+		sql        string
+		args       []interface{}
+		filterArgs []interface{}
+	)
+	if opts == (server.ListOptions{}) {
+		sql, args = rangeQuery(key, rangeEnd, d.ListRevisionKeySQL, d.ListRevisionFromSQL, d.ListRevisionRangeSQL)
+	} else {
+		sql, args, filterArgs = d.listOptionsQuery(key, rangeEnd, true, opts)
+	}
+	if limit > 0 {
+		sql = fmt.Sprintf("%s LIMIT %d", sql, limit)
+	}
+	args = append(args, revision, revision, includeDeleted)
+	return d.query(ctx, "ListRevision", sql, append(args, filterArgs...)...)
+}
+
+func (d *Generic) Count(ctx context.Context, key, rangeEnd string) (int64, int64, error) {
 	var (
 		rev sql.NullInt64
 		id  int64
 	)
 
-	row := d.queryRow(ctx, d.CountSQL, prefix, false)
+	sql, args := rangeQuery(key, rangeEnd, d.CountKeySQL, d.CountFromSQL, d.CountRangeSQL)
+	row := d.queryRow(ctx, "Count", sql, append(args, false)...)
 	err := row.Scan(&rev, &id)
 	return rev.Int64, id, err
 }
 
 func (d *Generic) CurrentRevision(ctx context.Context) (int64, error) {
 	var id int64
-	row := d.queryRow(ctx, revSQL)
+	row := d.queryRow(ctx, "CurrentRevision", revSQL)
 	err := row.Scan(&id)
 	if err == sql.ErrNoRows {
 		return 0, nil
@@ -313,16 +713,40 @@ func (d *Generic) CurrentRevision(ctx context.Context) (int64, error) {
 	return id, err
 }
 
-func (d *Generic) After(ctx context.Context, prefix string, rev, limit int64) (*sql.Rows, error) {
-	sql := d.AfterSQL
+// After returns the rows of the range written after the revision in revision
+// order. Every key from "" on is read without a condition on the name, so that
+// the database doesn't scan the rows by name to find the latest ones.
+func (d *Generic) After(ctx context.Context, key, rangeEnd string, rev, limit int64) (*sql.Rows, error) {
+	sql, args := rangeQuery(key, rangeEnd, d.AfterKeySQL, d.AfterFromSQL, d.AfterRangeSQL)
+	if key == "" && rangeEnd == "\x00" {
+		sql, args = d.AfterSQL, nil
+	}
+	if limit > 0 {
+		sql = fmt.Sprintf("%s LIMIT %d", sql, limit)
+	}
+	return d.query(ctx, "After", sql, append(args, rev, rev)...)
+}
+
+// RowsAfter returns the rows after the id in id order, whatever their
+// revision.
+func (d *Generic) RowsAfter(ctx context.Context, id, limit int64) (*sql.Rows, error) {
+	sql := d.RowsAfterSQL
 	if limit > 0 {
 		sql = fmt.Sprintf("%s LIMIT %d", sql, limit)
 	}
-	return d.query(ctx, sql, prefix, rev)
+	return d.query(ctx, "RowsAfter", sql, id)
+}
+
+// BatchStartID returns the lowest id at or below the revision of a row written
+// in a batch after the revision, or zero if there is none.
+func (d *Generic) BatchStartID(ctx context.Context, revision int64) (int64, error) {
+	var id sql.NullInt64
+	err := d.queryRow(ctx, "BatchStartID", d.BatchStartIDSQL, revision, revision).Scan(&id)
+	return id.Int64, err
 }
 
-func (d *Generic) Fill(ctx context.Context, revision int64) error {
-	_, err := d.execute(ctx, d.FillSQL, revision, fmt.Sprintf("gap-%d", revision), 0, 1, 0, 0, 0, nil, nil)
+func (d *Generic) Fill(ctx context.Context, id int64) error {
+	_, err := d.execute(ctx, "Fill", d.FillSQL, id, nil, fmt.Sprintf("gap-%d", id), 0, 1, 0, 0, 0, nil, nil, nil, nil)
 	return err
 }
 
@@ -330,7 +754,7 @@ func (d *Generic) IsFill(key string) bool {
 	return strings.HasPrefix(key, "gap-")
 }
 
-func (d *Generic) Insert(ctx context.Context, key string, create, delete bool, createRevision, previousRevision int64, ttl int64, value, prevValue []byte) (id int64, err error) {
+func (d *Generic) Insert(ctx context.Context, key string, create, delete bool, createRevision, previousRevision int64, ttl int64, value, prevValue []byte, version, prevTTL int64) (id int64, err error) {
 	if d.TranslateErr != nil {
 		defer func() {
 			if err != nil {
@@ -349,14 +773,128 @@ func (d *Generic) Insert(ctx context.Context, key string, create, delete bool, c
 	}
 
 	if d.LastInsertID {
-		row, err := d.execute(ctx, d.InsertLastInsertIDSQL, key, cVal, dVal, createRevision, previousRevision, ttl, value, prevValue)
+		row, err := d.execute(ctx, "Insert", d.InsertLastInsertIDSQL, key, cVal, dVal, createRevision, previousRevision, ttl, value, prevValue, version, prevTTL)
 		if err != nil {
 			return 0, err
 		}
 		return row.LastInsertId()
 	}
 
-	row := d.queryRow(ctx, d.InsertSQL, key, cVal, dVal, createRevision, previousRevision, ttl, value, prevValue)
+	row := d.queryRow(ctx, "Insert", d.InsertSQL, key, cVal, dVal, createRevision, previousRevision, ttl, value, prevValue, version, prevTTL)
 	err = row.Scan(&id)
 	return id, err
 }
+
+func (d *Generic) ListByLease(ctx context.Context, lease int64) (*sql.Rows, error) {
+	return d.query(ctx, "ListByLease", d.ListByLeaseSQL, lease)
+}
+
+func (d *Generic) InsertLease(ctx context.Context, id, ttl, expires int64) (err error) {
+	if d.TranslateErr != nil {
+		defer func() {
+			if err != nil {
+				err = d.TranslateErr(err)
+			}
+		}()
+	}
+
+	_, err = d.execute(ctx, "InsertLease", d.InsertLeaseSQL, id, ttl, expires)
+	return err
+}
+
+func (d *Generic) GetLease(ctx context.Context, id int64) (*sql.Rows, error) {
+	return d.query(ctx, "GetLease", d.GetLeaseSQL, id)
+}
+
+func (d *Generic) UpdateLease(ctx context.Context, id, expires, now int64) (int64, error) {
+	result, err := d.execute(ctx, "UpdateLease", d.UpdateLeaseSQL, expires, id, now)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (d *Generic) DeleteLease(ctx context.Context, id int64) error {
+	_, err := d.execute(ctx, "DeleteLease", d.DeleteLeaseSQL, id)
+	return err
+}
+
+func (d *Generic) ListLeases(ctx context.Context) (*sql.Rows, error) {
+	return d.query(ctx, "ListLeases", d.ListLeasesSQL)
+}
+
+func (d *Generic) ExpiredLeases(ctx context.Context, now, limit int64) (*sql.Rows, error) {
+	sql := d.ExpiredLeasesSQL
+	if limit > 0 {
+		sql = fmt.Sprintf("%s LIMIT %d", sql, limit)
+	}
+	return d.query(ctx, "ExpiredLeases", sql, now)
+}
+
+// ClusterID returns the lowest ID in the cluster table, inserting id if the
+// table is empty. Instances that start together may each insert their own,
+// they all settle on the lowest.
+func (d *Generic) ClusterID(ctx context.Context, id int64) (int64, error) {
+	var clusterID sql.NullInt64
+	if err := d.queryRow(ctx, "ClusterID", d.ClusterIDSQL).Scan(&clusterID); err != nil || clusterID.Valid {
+		return clusterID.Int64, err
+	}
+
+	if _, err := d.execute(ctx, "InsertClusterID", d.InsertClusterIDSQL, id); err != nil && !d.isKeyExists(err) {
+		return 0, err
+	}
+	err := d.queryRow(ctx, "ClusterID", d.ClusterIDSQL).Scan(&clusterID)
+	return clusterID.Int64, err
+}
+
+// PutMember updates the row of the member, or inserts it if there is none.
+// MySQL only counts the rows an update changes, so a heartbeat that leaves the
+// row as it was goes on to insert it, and finds it already there.
+func (d *Generic) PutMember(ctx context.Context, id int64, name, clientURLs string, heartbeat int64) error {
+	result, err := d.execute(ctx, "UpdateMember", d.UpdateMemberSQL, name, clientURLs, heartbeat, id)
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil || updated > 0 {
+		return err
+	}
+
+	_, err = d.execute(ctx, "InsertMember", d.InsertMemberSQL, id, name, clientURLs, heartbeat)
+	if err != nil && d.isKeyExists(err) {
+		return nil
+	}
+	return err
+}
+
+func (d *Generic) ListMembers(ctx context.Context) (*sql.Rows, error) {
+	return d.query(ctx, "ListMembers", d.ListMembersSQL)
+}
+
+func (d *Generic) DeleteMember(ctx context.Context, id int64) error {
+	_, err := d.execute(ctx, "DeleteMember", d.DeleteMemberSQL, id)
+	return err
+}
+
+// InsertAlarm records the alarm of the member, an alarm that is already
+// recorded is left as it is.
+func (d *Generic) InsertAlarm(ctx context.Context, memberID int64, alarm int32) error {
+	_, err := d.execute(ctx, "InsertAlarm", d.InsertAlarmSQL, memberID, alarm)
+	if err != nil && d.isKeyExists(err) {
+		return nil
+	}
+	return err
+}
+
+func (d *Generic) ListAlarms(ctx context.Context) (*sql.Rows, error) {
+	return d.query(ctx, "ListAlarms", d.ListAlarmsSQL)
+}
+
+func (d *Generic) DeleteAlarm(ctx context.Context, memberID int64, alarm int32) error {
+	_, err := d.execute(ctx, "DeleteAlarm", d.DeleteAlarmSQL, memberID, alarm)
+	return err
+}
+
+// isKeyExists tells whether the error is the violation of a unique constraint
+func (d *Generic) isKeyExists(err error) bool {
+	return d.TranslateErr != nil && d.TranslateErr(err) == server.ErrKeyExists
+}
@@ -0,0 +1,215 @@
+package generic
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rancher/kine/pkg/logstructured"
+	"github.com/rancher/kine/pkg/logstructured/sqllog"
+	"github.com/rancher/kine/pkg/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// Tx is a database transaction that holds the write lock of its Generic, if
+// writes are locked, until it is committed or rolled back.
+type Tx struct {
+	x      *sql.Tx
+	d      *Generic
+	locked bool
+}
+
+func (d *Generic) BeginTx(ctx context.Context) (sqllog.Transaction, error) {
+	if d.LockWrites {
+		d.Lock()
+	}
+
+	logrus.Tracef("TX BEGIN")
+	x, err := d.DB.BeginTx(ctx, nil)
+	if err != nil {
+		if d.LockWrites {
+			d.Unlock()
+		}
+		return nil, err
+	}
+
+	return &Tx{
+		x:      x,
+		d:      d,
+		locked: d.LockWrites,
+	}, nil
+}
+
+func (t *Tx) Commit() error {
+	defer t.unlock()
+	logrus.Tracef("TX COMMIT")
+	err := t.x.Commit()
+	if err != nil && t.d.TranslateErr != nil {
+		err = t.d.TranslateErr(err)
+	}
+	return err
+}
+
+func (t *Tx) Rollback() error {
+	defer t.unlock()
+	logrus.Tracef("TX ROLLBACK")
+	return t.x.Rollback()
+}
+
+func (t *Tx) unlock() {
+	if t.locked {
+		t.locked = false
+		t.d.Unlock()
+	}
+}
+
+// LockKeys keeps other transactions from writing any key that this one checks
+// the revision of, until it ends.
+func (t *Tx) LockKeys(ctx context.Context) error {
+	if t.d.LockKeysSQL == "" {
+		return nil
+	}
+	_, err := t.execute(ctx, "LockKeys", t.d.LockKeysSQL)
+	return err
+}
+
+// KeyRevision returns the revision of the latest row for the key, including
+// deletes, or zero if the key has no rows.
+func (t *Tx) KeyRevision(ctx context.Context, key string) (int64, error) {
+	var rev int64
+	row := t.queryRow(ctx, "KeyRevision", t.d.KeyRevisionSQL, key)
+	err := row.Scan(&rev)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return rev, err
+}
+
+func (t *Tx) Insert(ctx context.Context, key string, create, delete bool, createRevision, previousRevision int64, ttl int64, value, prevValue []byte, version, prevTTL int64) (id int64, err error) {
+	if t.d.TranslateErr != nil {
+		defer func() {
+			if err != nil {
+				err = t.d.TranslateErr(err)
+			}
+		}()
+	}
+
+	cVal := 0
+	dVal := 0
+	if create {
+		cVal = 1
+	}
+	if delete {
+		dVal = 1
+	}
+
+	if t.d.LastInsertID {
+		row, err := t.execute(ctx, "Insert", t.d.InsertLastInsertIDSQL, key, cVal, dVal, createRevision, previousRevision, ttl, value, prevValue, version, prevTTL)
+		if err != nil {
+			return 0, err
+		}
+		return row.LastInsertId()
+	}
+
+	row := t.queryRow(ctx, "Insert", t.d.InsertSQL, key, cVal, dVal, createRevision, previousRevision, ttl, value, prevValue, version, prevTTL)
+	err = row.Scan(&id)
+	return id, err
+}
+
+// InsertRevision inserts the row with its id and batch revision rather than at
+// the next id.
+func (t *Tx) InsertRevision(ctx context.Context, row *logstructured.Row) (err error) {
+	if t.d.TranslateErr != nil {
+		defer func() {
+			if err != nil {
+				err = t.d.TranslateErr(err)
+			}
+		}()
+	}
+
+	cVal := 0
+	dVal := 0
+	if row.Created {
+		cVal = 1
+	}
+	if row.Deleted {
+		dVal = 1
+	}
+	var batch interface{}
+	if row.BatchRevision != 0 {
+		batch = row.BatchRevision
+	}
+
+	_, err = t.execute(ctx, "InsertRevision", t.d.FillSQL, row.ID, batch, row.Name, cVal, dVal, row.CreateRevision, row.PrevRevision, row.Lease, row.Value, row.OldValue, row.Version, row.OldLease)
+	return err
+}
+
+// setBatchRevisionChunk bounds the ids updated by one statement.
+const setBatchRevisionChunk = 500
+
+// SetBatchRevision records the revision as the batch revision of the rows.
+func (t *Tx) SetBatchRevision(ctx context.Context, revision int64, ids []int64) error {
+	for len(ids) > 0 {
+		chunk := ids
+		if len(chunk) > setBatchRevisionChunk {
+			chunk = chunk[:setBatchRevisionChunk]
+		}
+		ids = ids[len(chunk):]
+
+		args := make([]interface{}, 0, len(chunk)+1)
+		args = append(args, revision)
+		for _, id := range chunk {
+			args = append(args, id)
+		}
+		params := strings.TrimSuffix(strings.Repeat("?, ", len(chunk)), ", ")
+		sql := q(fmt.Sprintf(t.d.SetBatchRevisionSQL, params), t.d.paramCharacter, t.d.numbered)
+		if _, err := t.execute(ctx, "SetBatchRevision", sql, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ResetSequence moves the sequence the revisions are taken from past the rows
+// inserted with their IDs, on databases that don't do so themselves.
+func (t *Tx) ResetSequence(ctx context.Context) error {
+	if t.d.ResetSequenceSQL == "" {
+		return nil
+	}
+	_, err := t.execute(ctx, "ResetSequence", t.d.ResetSequenceSQL)
+	return err
+}
+
+// Compact deletes the rows superseded by the revisions in (start, end] as well
+// as the deletes among them, and returns the number of rows deleted.
+func (t *Tx) Compact(ctx context.Context, start, end int64) (int64, error) {
+	superseded, err := t.execute(ctx, "CompactSuperseded", t.d.CompactSupersededSQL, start, end, start, end)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := t.execute(ctx, "CompactDeleted", t.d.CompactDeletedSQL, start, end, start, end)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := superseded.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	m, err := deleted.RowsAffected()
+	return n + m, err
+}
+
+func (t *Tx) queryRow(ctx context.Context, name, sql string, args ...interface{}) *sql.Row {
+	defer metrics.ObserveSQL(name, time.Now(), nil)
+	logrus.Tracef("TX QUERY ROW %v : %s", args, Stripped(sql))
+	return t.x.QueryRowContext(ctx, sql, args...)
+}
+
+func (t *Tx) execute(ctx context.Context, name, sql string, args ...interface{}) (result sql.Result, err error) {
+	defer func(start time.Time) { metrics.ObserveSQL(name, start, err) }(time.Now())
+	logrus.Tracef("TX EXEC %v : %s", args, Stripped(sql))
+	return t.x.ExecContext(ctx, sql, args...)
+}
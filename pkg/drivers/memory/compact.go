@@ -0,0 +1,115 @@
+package memory
+
+import (
+	"context"
+	"sort"
+
+	"github.com/rancher/kine/pkg/logstructured"
+)
+
+// Compact records the revision as the compact revision and removes the history
+// before it in the background. The returned channel receives the error of the
+// removal and is closed once it is done.
+func (s *Log) Compact(ctx context.Context, revision int64) (<-chan error, error) {
+	return s.compactor.Compact(ctx, revision)
+}
+
+// SetCompactRevision records the compact revision.
+func (s *Log) SetCompactRevision(ctx context.Context, revision int64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.compactRevision = revision
+	return nil
+}
+
+// CompactBatch deletes the rows superseded by the revisions in (start, end]
+// and the deletes among them.
+func (s *Log) CompactBatch(ctx context.Context, start, end int64) (int64, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	// the rows written in (start, end] are the ones after start by ID, and
+	// the rows of batches in it that come before start by ID
+	var compacted []*logstructured.Row
+	for _, row := range s.rows[s.rowIndex(start+1):] {
+		if row.ID > end {
+			break
+		}
+		if row.Revision() <= end {
+			compacted = append(compacted, row)
+		}
+	}
+	for _, row := range s.batches[s.batchIndex(start):] {
+		if row.BatchRevision > end {
+			break
+		}
+		if row.ID <= start {
+			compacted = append(compacted, row)
+		}
+	}
+
+	remove := map[*logstructured.Row]bool{}
+	for _, row := range compacted {
+		// created rows reference the revision they were created at rather
+		// than a previous row of the key
+		if !row.Created && row.PrevRevision != 0 {
+			if prev := s.latestRow(row.Name, row.PrevRevision); prev != nil && prev.Revision() == row.PrevRevision {
+				remove[prev] = true
+			}
+		}
+		if row.Deleted {
+			remove[row] = true
+		}
+	}
+	if len(remove) == 0 {
+		return 0, nil
+	}
+
+	rows := s.rows[:0]
+	for _, row := range s.rows {
+		if !remove[row] {
+			rows = append(rows, row)
+		}
+	}
+	for i := len(rows); i < len(s.rows); i++ {
+		s.rows[i] = nil
+	}
+	s.rows = rows
+
+	batches := s.batches[:0]
+	for _, row := range s.batches {
+		if !remove[row] {
+			batches = append(batches, row)
+		}
+	}
+	for i := len(batches); i < len(s.batches); i++ {
+		s.batches[i] = nil
+	}
+	s.batches = batches
+
+	for row := range remove {
+		s.removeHistory(row)
+	}
+	return int64(len(remove)), nil
+}
+
+// removeHistory removes the row from the history of its name, and the name
+// once it has no rows left
+func (s *Log) removeHistory(row *logstructured.Row) {
+	history := s.history[row.Name]
+	for i, r := range history {
+		if r == row {
+			history = append(history[:i], history[i+1:]...)
+			break
+		}
+	}
+	if len(history) > 0 {
+		s.history[row.Name] = history
+		return
+	}
+
+	delete(s.history, row.Name)
+	i := sort.SearchStrings(s.names, row.Name)
+	s.names = append(s.names[:i], s.names[i+1:]...)
+}
@@ -0,0 +1,112 @@
+package memory
+
+import (
+	"context"
+	"sort"
+
+	"github.com/rancher/kine/pkg/server"
+)
+
+func (s *Log) ListByLease(ctx context.Context, lease int64) (int64, []*server.Event, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	var events []*server.Event
+	for name := range s.leaseKeys[lease] {
+		row := s.latestRow(name, s.currentRevision)
+		if row == nil || row.Deleted || row.Lease != lease {
+			continue
+		}
+		events = append(events, row.Event())
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].KV.ModRevision < events[j].KV.ModRevision
+	})
+	return s.currentRevision, events, nil
+}
+
+func (s *Log) CreateLease(ctx context.Context, lease *server.Lease) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.leases[lease.ID]; ok {
+		return server.ErrLeaseExists
+	}
+	stored := *lease
+	s.leases[lease.ID] = &stored
+	return nil
+}
+
+func (s *Log) GetLease(ctx context.Context, id int64) (*server.Lease, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	lease, ok := s.leases[id]
+	if !ok {
+		return nil, nil
+	}
+	result := *lease
+	return &result, nil
+}
+
+// UpdateLease stores the new expiry of the lease, as long as the lease has not
+// already expired at now.
+func (s *Log) UpdateLease(ctx context.Context, lease *server.Lease, now int64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	current, ok := s.leases[lease.ID]
+	if !ok || current.Expires <= now {
+		return server.ErrLeaseNotFound
+	}
+	current.Expires = lease.Expires
+	return nil
+}
+
+func (s *Log) DeleteLease(ctx context.Context, id int64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.leases, id)
+	return nil
+}
+
+func (s *Log) ListLeases(ctx context.Context) ([]*server.Lease, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.sortedLeases(func(*server.Lease) bool { return true }, func(a, b *server.Lease) bool {
+		return a.ID < b.ID
+	}), nil
+}
+
+// ExpiredLeases returns up to limit leases that expired at or before now, the
+// earliest deadline first.
+func (s *Log) ExpiredLeases(ctx context.Context, now, limit int64) ([]*server.Lease, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	leases := s.sortedLeases(func(lease *server.Lease) bool { return lease.Expires <= now }, func(a, b *server.Lease) bool {
+		return a.Expires < b.Expires || (a.Expires == b.Expires && a.ID < b.ID)
+	})
+	if limit > 0 && int64(len(leases)) > limit {
+		leases = leases[:limit]
+	}
+	return leases, nil
+}
+
+// sortedLeases returns copies of the leases that match in order
+func (s *Log) sortedLeases(match func(*server.Lease) bool, less func(a, b *server.Lease) bool) []*server.Lease {
+	var leases []*server.Lease
+	for _, lease := range s.leases {
+		if match(lease) {
+			result := *lease
+			leases = append(leases, &result)
+		}
+	}
+	sort.Slice(leases, func(i, j int) bool {
+		return less(leases[i], leases[j])
+	})
+	return leases
+}
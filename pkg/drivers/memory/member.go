@@ -0,0 +1,79 @@
+package memory
+
+import (
+	"context"
+
+	"github.com/rancher/kine/pkg/server"
+)
+
+// The members of the log are the servers of this process, no other process
+// can share it.
+
+func (s *Log) ClusterID(ctx context.Context, id uint64) (uint64, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.clusterID == 0 {
+		s.clusterID = id
+	}
+	return s.clusterID, nil
+}
+
+func (s *Log) PutMember(ctx context.Context, member *server.Member) error {
+	s.Lock()
+	defer s.Unlock()
+
+	stored := *member
+	stored.ClientURLs = append([]string(nil), member.ClientURLs...)
+	s.members[member.ID] = &stored
+	return nil
+}
+
+func (s *Log) Members(ctx context.Context) ([]*server.Member, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	var members []*server.Member
+	for _, member := range s.members {
+		result := *member
+		result.ClientURLs = append([]string(nil), member.ClientURLs...)
+		members = append(members, &result)
+	}
+	return members, nil
+}
+
+func (s *Log) DeleteMember(ctx context.Context, id uint64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.members, id)
+	return nil
+}
+
+func (s *Log) PutAlarm(ctx context.Context, alarm *server.Alarm) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.alarms[*alarm] = true
+	return nil
+}
+
+func (s *Log) Alarms(ctx context.Context) ([]*server.Alarm, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	var alarms []*server.Alarm
+	for alarm := range s.alarms {
+		alarm := alarm
+		alarms = append(alarms, &alarm)
+	}
+	return alarms, nil
+}
+
+func (s *Log) DeleteAlarm(ctx context.Context, alarm *server.Alarm) error {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.alarms, *alarm)
+	return nil
+}
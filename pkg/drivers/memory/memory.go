@@ -0,0 +1,407 @@
+// Package memory keeps the log in memory, for tests and throwaway clusters
+// that don't need their data to outlive the process.
+package memory
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/rancher/kine/pkg/logstructured"
+	"github.com/rancher/kine/pkg/metrics"
+	"github.com/rancher/kine/pkg/server"
+)
+
+// Log is a log held in memory. Writes take the lock in turn and every revision
+// is written in order, so watches are woken up by the writes and never see
+// gaps.
+type Log struct {
+	sync.RWMutex
+
+	poller    *logstructured.Poller
+	compactor *logstructured.Compactor
+
+	// rows holds every row in ID order, batches the rows written in a batch
+	// by batch revision and ID
+	rows    []*logstructured.Row
+	batches []*logstructured.Row
+	// names holds every name that has rows in order, history holds the rows
+	// of each name in order
+	names   []string
+	history map[string][]*logstructured.Row
+	// leaseKeys holds the keys attached to every lease
+	leaseKeys       map[int64]map[string]bool
+	leases          map[int64]*server.Lease
+	currentRevision int64
+	compactRevision int64
+	// clusterID is recorded by the first call of ClusterID
+	clusterID uint64
+	members   map[uint64]*server.Member
+	alarms    map[server.Alarm]bool
+}
+
+func New(ctx context.Context, compact logstructured.CompactConfig) (server.Backend, error) {
+	log := &Log{
+		history:   map[string][]*logstructured.Row{},
+		leaseKeys: map[int64]map[string]bool{},
+		leases:    map[int64]*server.Lease{},
+		members:   map[uint64]*server.Member{},
+		alarms:    map[server.Alarm]bool{},
+	}
+	log.poller = logstructured.NewPoller(log)
+	log.compactor = logstructured.NewCompactor(compact, log, log.poller)
+	return logstructured.New(log), nil
+}
+
+func (s *Log) Start(ctx context.Context) error {
+	s.poller.Start(ctx)
+	s.compactor.Start(ctx)
+	return nil
+}
+
+func (s *Log) CurrentRevision(ctx context.Context) (int64, error) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.currentRevision, nil
+}
+
+func (s *Log) CompactRevision(ctx context.Context) (int64, error) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.compactRevision, nil
+}
+
+// DbSize returns the bytes of the names and values of the rows, the memory
+// the log takes up beyond them isn't counted.
+func (s *Log) DbSize(ctx context.Context) (int64, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	var size int64
+	for _, row := range s.rows {
+		size += int64(len(row.Name) + len(row.Value) + len(row.OldValue))
+	}
+	return size, nil
+}
+
+// Defragment does nothing, the rows removed by compaction are already freed.
+func (s *Log) Defragment(ctx context.Context) error {
+	return nil
+}
+
+func (s *Log) List(ctx context.Context, key, rangeEnd string, limit, revision int64, includeDeleted bool, opts server.ListOptions) (int64, []*server.Event, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if revision > 0 && revision < s.compactRevision {
+		return 0, nil, server.ErrCompacted
+	}
+	at := revision
+	if at == 0 {
+		at = s.currentRevision
+	}
+
+	// names are in key order, the limit only applies right away if nothing
+	// else changes the order or filters them
+	sorted := opts.SortTarget == server.SortByKey && !opts.Descending
+	filtered := opts.MinModRevision != 0 || opts.MaxModRevision != 0 ||
+		opts.MinCreateRevision != 0 || opts.MaxCreateRevision != 0
+
+	var events []*server.Event
+	for _, name := range s.namesIn(key, rangeEnd) {
+		if sorted && !filtered && limit > 0 && int64(len(events)) >= limit {
+			break
+		}
+
+		row := s.latestRow(name, at)
+		if row == nil || (row.Deleted && !includeDeleted) {
+			continue
+		}
+
+		event := row.Event()
+		if !opts.InRevisionBounds(event.KV) {
+			continue
+		}
+		events = append(events, event)
+	}
+
+	if !sorted {
+		sort.Slice(events, func(i, j int) bool {
+			return opts.Less(events[i].KV, events[j].KV)
+		})
+	}
+	if limit > 0 && int64(len(events)) > limit {
+		events = events[:limit]
+	}
+	// values are left out once they are sorted by
+	if opts.KeysOnly {
+		for _, event := range events {
+			event.KV.Value = nil
+			if event.PrevKV != nil {
+				event.PrevKV.Value = nil
+			}
+		}
+	}
+	return s.currentRevision, events, nil
+}
+
+func (s *Log) Count(ctx context.Context, key, rangeEnd string) (int64, int64, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	var count int64
+	for _, name := range s.namesIn(key, rangeEnd) {
+		if row := s.latestRow(name, s.currentRevision); row != nil && !row.Deleted {
+			count++
+		}
+	}
+	return s.currentRevision, count, nil
+}
+
+// namesIn returns the names in the range, with the meaning of an empty and a
+// "\x00" rangeEnd of List
+func (s *Log) namesIn(key, rangeEnd string) []string {
+	start := sort.SearchStrings(s.names, key)
+	end := len(s.names)
+	switch rangeEnd {
+	case "":
+		if start < end && s.names[start] == key {
+			end = start + 1
+		} else {
+			end = start
+		}
+	case "\x00":
+	default:
+		end = sort.SearchStrings(s.names, rangeEnd)
+	}
+	if end < start {
+		return nil
+	}
+	return s.names[start:end]
+}
+
+// latestRow returns the latest row of the name at or below the revision, nil
+// if there is none
+func (s *Log) latestRow(name string, revision int64) *logstructured.Row {
+	history := s.history[name]
+	i := sort.Search(len(history), func(i int) bool {
+		return history[i].Revision() > revision
+	})
+	if i == 0 {
+		return nil
+	}
+	return history[i-1]
+}
+
+// row returns the row with the ID, nil if there is none
+func (s *Log) row(id int64) *logstructured.Row {
+	i := s.rowIndex(id)
+	if i < len(s.rows) && s.rows[i].ID == id {
+		return s.rows[i]
+	}
+	return nil
+}
+
+// rowIndex returns the index of the first row with the ID or a later one
+func (s *Log) rowIndex(id int64) int {
+	return sort.Search(len(s.rows), func(i int) bool {
+		return s.rows[i].ID >= id
+	})
+}
+
+// batchIndex returns the index of the first batch row written after the
+// revision
+func (s *Log) batchIndex(revision int64) int {
+	return sort.Search(len(s.batches), func(i int) bool {
+		return s.batches[i].BatchRevision > revision
+	})
+}
+
+func (s *Log) After(ctx context.Context, key, rangeEnd string, revision, limit int64) (int64, []*server.Event, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if revision > 0 && revision < s.compactRevision {
+		return 0, nil, server.ErrCompacted
+	}
+
+	var events []*server.Event
+	for _, row := range s.after(key, rangeEnd, revision, limit) {
+		events = append(events, row.Event())
+	}
+	return s.currentRevision, events, nil
+}
+
+// after returns the rows of the range written after the revision in revision
+// order, at most limit of them unless it is zero
+func (s *Log) after(key, rangeEnd string, revision, limit int64) []*logstructured.Row {
+	// rows of batches written after the revision may come before it by ID
+	var rows []*logstructured.Row
+	for _, row := range s.batches[s.batchIndex(revision):] {
+		if row.ID <= revision && logstructured.InRange(row.Name, key, rangeEnd) {
+			rows = append(rows, row)
+		}
+	}
+
+	// the revision of a row is never below its ID, once there are enough
+	// rows the ones with higher IDs come after all of them
+	var bound int64
+	for _, row := range s.rows[s.rowIndex(revision+1):] {
+		if limit > 0 && int64(len(rows)) >= limit && row.ID > bound {
+			break
+		}
+		if !logstructured.InRange(row.Name, key, rangeEnd) {
+			continue
+		}
+		rows = append(rows, row)
+		if row.Revision() > bound {
+			bound = row.Revision()
+		}
+	}
+
+	logstructured.SortRows(rows)
+	if limit > 0 && int64(len(rows)) > limit {
+		rows = rows[:limit]
+	}
+	return rows
+}
+
+func (s *Log) Append(ctx context.Context, event *server.Event) (int64, error) {
+	return s.AppendBatch(ctx, []*server.Event{event}, nil)
+}
+
+// AppendBatch appends all events or none of them, after checking that the
+// latest revision of every key in checks, including deletes, is still the
+// expected one, zero meaning the key has no rows. A mismatch fails the batch
+// with server.ErrKeyExists.
+func (s *Log) AppendBatch(ctx context.Context, events []*server.Event, checks map[string]int64) (int64, error) {
+	s.Lock()
+	rev, err := s.appendBatch(events, checks)
+	s.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	if len(events) > 0 {
+		metrics.CurrentRevision.Set(float64(rev))
+		s.Notify(rev)
+	}
+	return rev, nil
+}
+
+func (s *Log) appendBatch(events []*server.Event, checks map[string]int64) (int64, error) {
+	for key, expected := range checks {
+		var latest int64
+		if row := s.latestRow(key, s.currentRevision); row != nil {
+			latest = row.Revision()
+		}
+		if latest != expected {
+			return 0, server.ErrKeyExists
+		}
+	}
+
+	// every event is checked before any is written, the keys of a batch are
+	// distinct so the checks don't depend on each other
+	rows := make([]*logstructured.Row, 0, len(events))
+	for _, event := range events {
+		row, err := s.check(event)
+		if err != nil {
+			return 0, err
+		}
+		rows = append(rows, row)
+	}
+
+	// the rows of a batch share the revision of the last one
+	var batch int64
+	if len(rows) > 1 {
+		batch = s.currentRevision + int64(len(rows))
+	}
+	for _, row := range rows {
+		row.BatchRevision = batch
+		s.insert(row)
+	}
+	return s.currentRevision, nil
+}
+
+// check returns the row the event writes. Like the unique index on the name and
+// previous revision of the SQL backends, an event fails with
+// server.ErrKeyExists unless it follows the latest row of the key, or for a
+// create, the key has no rows or was deleted last.
+func (s *Log) check(event *server.Event) (*logstructured.Row, error) {
+	e := *event
+	if e.KV == nil {
+		e.KV = &server.KeyValue{}
+	}
+	if e.PrevKV == nil {
+		e.PrevKV = &server.KeyValue{}
+	}
+
+	row := &logstructured.Row{
+		Name:           e.KV.Key,
+		Created:        e.Create,
+		Deleted:        e.Delete,
+		CreateRevision: e.KV.CreateRevision,
+		PrevRevision:   e.PrevKV.ModRevision,
+		Lease:          e.KV.Lease,
+		Value:          append([]byte{}, e.KV.Value...),
+		OldValue:       append([]byte{}, e.PrevKV.Value...),
+		Version:        e.KV.Version,
+		OldLease:       e.PrevKV.Lease,
+	}
+
+	latest := s.latestRow(row.Name, s.currentRevision)
+	if row.Created {
+		if latest != nil && (!latest.Deleted || latest.Revision() != row.PrevRevision) {
+			return nil, server.ErrKeyExists
+		}
+	} else if latest == nil || latest.Deleted || latest.Revision() != row.PrevRevision {
+		return nil, server.ErrKeyExists
+	}
+	return row, nil
+}
+
+// insert writes the row with the next ID
+func (s *Log) insert(row *logstructured.Row) {
+	latest := s.latestRow(row.Name, s.currentRevision)
+
+	s.currentRevision++
+	row.ID = s.currentRevision
+	s.rows = append(s.rows, row)
+	s.index(row, latest)
+}
+
+// index adds the row to the names, batches and lease keys, latest is the row of
+// the name it follows, if any
+func (s *Log) index(row, latest *logstructured.Row) {
+	history, ok := s.history[row.Name]
+	if !ok {
+		i := sort.SearchStrings(s.names, row.Name)
+		s.names = append(s.names, "")
+		copy(s.names[i+1:], s.names[i:])
+		s.names[i] = row.Name
+	}
+	s.history[row.Name] = append(history, row)
+
+	if row.BatchRevision != 0 {
+		i := sort.Search(len(s.batches), func(i int) bool {
+			b := s.batches[i]
+			return b.BatchRevision > row.BatchRevision || (b.BatchRevision == row.BatchRevision && b.ID > row.ID)
+		})
+		s.batches = append(s.batches, nil)
+		copy(s.batches[i+1:], s.batches[i:])
+		s.batches[i] = row
+	}
+
+	if latest != nil && !latest.Deleted && latest.Lease != 0 {
+		delete(s.leaseKeys[latest.Lease], row.Name)
+		if len(s.leaseKeys[latest.Lease]) == 0 {
+			delete(s.leaseKeys, latest.Lease)
+		}
+	}
+	if !row.Deleted && row.Lease != 0 {
+		if s.leaseKeys[row.Lease] == nil {
+			s.leaseKeys[row.Lease] = map[string]bool{}
+		}
+		s.leaseKeys[row.Lease][row.Name] = true
+	}
+}
@@ -0,0 +1,89 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/rancher/kine/pkg/logstructured"
+	"github.com/rancher/kine/pkg/server"
+)
+
+func (s *Log) Rows(ctx context.Context, id, limit int64) ([]*logstructured.Row, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	var rows []*logstructured.Row
+	for _, row := range s.rows[s.rowIndex(id+1):] {
+		// rows are never changed once written, only the row itself is copied
+		copied := *row
+		rows = append(rows, &copied)
+		if limit > 0 && int64(len(rows)) >= limit {
+			break
+		}
+	}
+	return rows, nil
+}
+
+// InsertRows writes the rows with their IDs and batch revisions, the current
+// revision moves past their IDs until SetRevisions moves it to the revision
+// they were copied at.
+func (s *Log) InsertRows(ctx context.Context, rows []*logstructured.Row) error {
+	s.Lock()
+	defer s.Unlock()
+
+	// nothing is written unless every row can be, the rows are indexed in ID
+	// order
+	inserted := make([]*logstructured.Row, 0, len(rows))
+	for _, row := range rows {
+		copied := *row
+		copied.Value = append([]byte{}, row.Value...)
+		copied.OldValue = append([]byte{}, row.OldValue...)
+		inserted = append(inserted, &copied)
+	}
+	sort.Slice(inserted, func(i, j int) bool {
+		return inserted[i].ID < inserted[j].ID
+	})
+
+	latest := map[string]int64{}
+	for i, row := range inserted {
+		if s.row(row.ID) != nil || (i > 0 && inserted[i-1].ID == row.ID) {
+			return server.ErrKeyExists
+		}
+		last, ok := latest[row.Name]
+		if history := s.history[row.Name]; !ok && len(history) > 0 {
+			last = history[len(history)-1].ID
+		}
+		if last > row.ID {
+			return fmt.Errorf("row %d of %q is before its latest row %d", row.ID, row.Name, last)
+		}
+		latest[row.Name] = row.ID
+	}
+
+	s.rows = append(s.rows, inserted...)
+	sort.Slice(s.rows, func(i, j int) bool {
+		return s.rows[i].ID < s.rows[j].ID
+	})
+	for _, row := range inserted {
+		var latest *logstructured.Row
+		if history := s.history[row.Name]; len(history) > 0 {
+			latest = history[len(history)-1]
+		}
+		s.index(row, latest)
+		if s.currentRevision < row.ID {
+			s.currentRevision = row.ID
+		}
+	}
+	return nil
+}
+
+func (s *Log) SetRevisions(ctx context.Context, current, compact int64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.currentRevision < current {
+		s.currentRevision = current
+	}
+	s.compactRevision = compact
+	return nil
+}
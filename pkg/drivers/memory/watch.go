@@ -0,0 +1,36 @@
+package memory
+
+import (
+	"context"
+
+	"github.com/rancher/kine/pkg/logstructured"
+	"github.com/rancher/kine/pkg/server"
+)
+
+func (s *Log) Watch(ctx context.Context, key, rangeEnd string) <-chan server.WatchResult {
+	return s.poller.Watch(ctx, key, rangeEnd)
+}
+
+// Notify wakes up the watch poller to read the changes up to the revision.
+func (s *Log) Notify(revision int64) {
+	s.poller.Notify(revision)
+}
+
+// PollStart starts the watch poller at the current revision, watches list
+// what came before themselves. Batches are written whole, no rows of one come
+// before the current revision.
+func (s *Log) PollStart(ctx context.Context) (int64, int64, error) {
+	rev, err := s.CurrentRevision(ctx)
+	return rev, rev, err
+}
+
+func (s *Log) PollRows(ctx context.Context, id, limit int64) (int64, []*logstructured.Row, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	rows := s.rows[s.rowIndex(id+1):]
+	if limit > 0 && int64(len(rows)) > limit {
+		rows = rows[:limit]
+	}
+	return s.currentRevision, append([]*logstructured.Row{}, rows...), nil
+}
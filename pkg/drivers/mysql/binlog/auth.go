@@ -0,0 +1,156 @@
+package binlog
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+)
+
+const (
+	nativePassword       = "mysql_native_password"
+	cachingSHA2Password  = "caching_sha2_password"
+	cachingSHA2FastAuth  = 3
+	cachingSHA2FullAuth  = 4
+	cachingSHA2PublicKey = 2
+)
+
+func (c *Conn) authResponse(plugin string, scramble []byte) ([]byte, error) {
+	if c.config.Password == "" {
+		return nil, nil
+	}
+
+	switch plugin {
+	case nativePassword:
+		return scrambleNative(scramble, c.config.Password), nil
+	case cachingSHA2Password:
+		return scrambleSHA256(scramble, c.config.Password), nil
+	}
+	return nil, fmt.Errorf("binlog: unsupported authentication plugin %s", plugin)
+}
+
+// authResult completes the authentication once the handshake response is
+// sent, the server may switch to another method or ask for more
+func (c *Conn) authResult(plugin string, scramble []byte) error {
+	for {
+		data, err := c.readPacket()
+		if err != nil {
+			return err
+		}
+
+		switch data[0] {
+		case 0x00:
+			return nil
+		case 0xff:
+			return parseError(data)
+		case 0xfe:
+			r := reader{data: data, pos: 1}
+			plugin = r.cstring()
+			scramble = r.data[r.pos:]
+			if n := len(scramble); n > 0 && scramble[n-1] == 0 {
+				scramble = scramble[:n-1]
+			}
+			auth, err := c.authResponse(plugin, scramble)
+			if err != nil {
+				return err
+			}
+			if err := c.writePacket(auth); err != nil {
+				return err
+			}
+		case 0x01:
+			if plugin != cachingSHA2Password || len(data) < 2 {
+				return fmt.Errorf("binlog: unexpected authentication data for %s", plugin)
+			}
+			switch data[1] {
+			case cachingSHA2FastAuth:
+				// the result follows
+			case cachingSHA2FullAuth:
+				if err := c.fullAuth(scramble); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("binlog: unexpected authentication state %d", data[1])
+			}
+		default:
+			return fmt.Errorf("binlog: unexpected authentication packet 0x%02x", data[0])
+		}
+	}
+}
+
+// fullAuth sends the password when the server doesn't have it cached, in the
+// clear over a secure connection and encrypted with the key of the server
+// otherwise
+func (c *Conn) fullAuth(scramble []byte) error {
+	password := append([]byte(c.config.Password), 0)
+	if c.secure {
+		return c.writePacket(password)
+	}
+
+	if err := c.writePacket([]byte{cachingSHA2PublicKey}); err != nil {
+		return err
+	}
+	data, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+	if data[0] == 0xff {
+		return parseError(data)
+	}
+
+	block, _ := pem.Decode(data[1:])
+	if block == nil {
+		return fmt.Errorf("binlog: invalid public key of the server")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("binlog: public key of the server is not an RSA key")
+	}
+
+	for i := range password {
+		password[i] ^= scramble[i%len(scramble)]
+	}
+	encrypted, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, rsaKey, password, nil)
+	if err != nil {
+		return err
+	}
+	return c.writePacket(encrypted)
+}
+
+// scrambleNative is SHA1(password) XOR SHA1(scramble + SHA1(SHA1(password)))
+func scrambleNative(scramble []byte, password string) []byte {
+	stage1 := sha1.Sum([]byte(password))
+	stage2 := sha1.Sum(stage1[:])
+
+	h := sha1.New()
+	h.Write(scramble)
+	h.Write(stage2[:])
+	result := h.Sum(nil)
+
+	for i := range result {
+		result[i] ^= stage1[i]
+	}
+	return result
+}
+
+// scrambleSHA256 is SHA256(password) XOR SHA256(SHA256(SHA256(password)) + scramble)
+func scrambleSHA256(scramble []byte, password string) []byte {
+	stage1 := sha256.Sum256([]byte(password))
+	stage2 := sha256.Sum256(stage1[:])
+
+	h := sha256.New()
+	h.Write(stage2[:])
+	h.Write(scramble)
+	result := h.Sum(nil)
+
+	for i := range result {
+		result[i] ^= stage1[i]
+	}
+	return result
+}
@@ -0,0 +1,513 @@
+// Package binlogtest provides a stand-in for a MySQL server that streams its
+// binary log to replicas, for testing code that follows the binlog. It speaks
+// no more of the protocol than package binlog uses, and writes the events with
+// CRC32 checksums like a server of version 8.
+package binlogtest
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rancher/kine/pkg/drivers/mysql/binlog"
+)
+
+// capabilities are the protocol 4.1 with the authentication of version 8
+const capabilities = 0x00000001 | 0x00000004 | 0x00000200 | 0x00002000 | 0x00008000 | 0x00080000
+
+const (
+	comQuery      = 0x03
+	comBinlogDump = 0x12
+
+	// ErrPurged is the code of the error a dump from a position that is not
+	// in the binlog fails with
+	ErrPurged = 1236
+
+	serverVersion = "8.0.33-binlogtest"
+	serverID      = 1
+	// startOffset is where the events of a binlog file start, after its
+	// magic number
+	startOffset = 4
+)
+
+// Column is the type of a column and its metadata, as the table map event
+// describes it.
+type Column struct {
+	Type byte
+	Meta []byte
+}
+
+var (
+	// Long is an INTEGER column
+	Long = Column{Type: 3}
+	// LongLong is a BIGINT column
+	LongLong = Column{Type: 8}
+)
+
+// Varbinary is a VARCHAR or VARBINARY column of up to size bytes
+func Varbinary(size uint16) Column {
+	return Column{Type: 15, Meta: []byte{byte(size), byte(size >> 8)}}
+}
+
+// Blob is a BLOB column whose lengths take up the number of bytes, 3 for a
+// MEDIUMBLOB
+func Blob(lengthBytes byte) Column {
+	return Column{Type: 252, Meta: []byte{lengthBytes}}
+}
+
+// Server is a MySQL server listening on a local port, whose binary log is a
+// single file holding the events written to it. Replicas dumping the binlog
+// get the events from their position on, and then every event written until
+// they disconnect.
+type Server struct {
+	// Addr is the TCP address the server listens on
+	Addr string
+
+	listener net.Listener
+	user     string
+	password string
+
+	lock   sync.Mutex
+	cond   *sync.Cond
+	file   string
+	events []event
+	end    uint32
+	conns  map[net.Conn]bool
+	closed bool
+}
+
+// event is an event of the binlog with its checksum, along with the offset it
+// starts at
+type event struct {
+	start uint32
+	data  []byte
+}
+
+// NewServer starts a server that replicas log in to with the user and
+// password, and whose binlog is the file with no events yet.
+func NewServer(user, password, file string) (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		Addr:     listener.Addr().String(),
+		listener: listener,
+		user:     user,
+		password: password,
+		file:     file,
+		end:      startOffset,
+		conns:    map[net.Conn]bool{},
+	}
+	s.cond = sync.NewCond(&s.lock)
+	// the format description is the first event of every file
+	s.write(15, formatDescription())
+
+	go s.serve()
+	return s, nil
+}
+
+// Close stops the server and closes the connections of the replicas.
+func (s *Server) Close() error {
+	s.lock.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.cond.Broadcast()
+	s.lock.Unlock()
+
+	return s.listener.Close()
+}
+
+// Position returns the end of the binlog, where the next event is written.
+func (s *Server) Position() binlog.Position {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return binlog.Position{File: s.file, Offset: s.end}
+}
+
+// TableMap writes the table map event that maps the table ID to the table
+// with the columns.
+func (s *Server) TableMap(id uint64, schema, table string, columns ...Column) {
+	body := tableID(id)
+	body = append(body, 0, 0)
+	body = append(body, byte(len(schema)))
+	body = append(body, schema...)
+	body = append(body, 0, byte(len(table)))
+	body = append(body, table...)
+	body = append(body, 0, byte(len(columns)))
+
+	var meta []byte
+	for _, column := range columns {
+		body = append(body, column.Type)
+		meta = append(meta, column.Meta...)
+	}
+	body = append(body, byte(len(meta)))
+	body = append(body, meta...)
+	// the columns are nullable
+	body = append(body, bytes.Repeat([]byte{0xff}, (len(columns)+7)/8)...)
+	s.write(19, body)
+}
+
+// WriteRows writes a write rows event inserting the rows into the table with
+// the ID, which has the columns. Values are int64 for integer columns, []byte
+// or string for the others and nil for NULL.
+func (s *Server) WriteRows(id uint64, columns []Column, rows ...[]interface{}) error {
+	body := tableID(id)
+	// flags, then the length of the extra data which is only the length
+	body = append(body, 0, 0, 2, 0, byte(len(columns)))
+	body = append(body, bytes.Repeat([]byte{0xff}, (len(columns)+7)/8)...)
+
+	for _, row := range rows {
+		if len(row) != len(columns) {
+			return fmt.Errorf("row has %d values for %d columns", len(row), len(columns))
+		}
+
+		nulls := make([]byte, (len(columns)+7)/8)
+		var values []byte
+		for i, value := range row {
+			if value == nil {
+				nulls[i/8] |= 1 << uint(i%8)
+				continue
+			}
+			encoded, err := encodeValue(columns[i], value)
+			if err != nil {
+				return fmt.Errorf("column %d: %v", i, err)
+			}
+			values = append(values, encoded...)
+		}
+		body = append(body, nulls...)
+		body = append(body, values...)
+	}
+	s.write(30, body)
+	return nil
+}
+
+// UpdateRows writes an update rows event of the table with the ID, without
+// any rows as replicas of kine don't read them.
+func (s *Server) UpdateRows(id uint64) {
+	body := tableID(id)
+	s.write(31, append(body, 0, 0, 2, 0))
+}
+
+// XID writes the event that commits a transaction.
+func (s *Server) XID(xid uint64) {
+	body := make([]byte, 8)
+	binary.LittleEndian.PutUint64(body, xid)
+	s.write(16, body)
+}
+
+func encodeValue(column Column, value interface{}) ([]byte, error) {
+	var data []byte
+	switch v := value.(type) {
+	case int64:
+		data = make([]byte, 8)
+		binary.LittleEndian.PutUint64(data, uint64(v))
+	case int:
+		data = make([]byte, 8)
+		binary.LittleEndian.PutUint64(data, uint64(v))
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		return nil, fmt.Errorf("unsupported value %T", value)
+	}
+
+	switch column.Type {
+	case Long.Type:
+		return data[:4], nil
+	case LongLong.Type:
+		return data, nil
+	case 15:
+		size := int(column.Meta[0]) | int(column.Meta[1])<<8
+		if size > 255 {
+			return append([]byte{byte(len(data)), byte(len(data) >> 8)}, data...), nil
+		}
+		return append([]byte{byte(len(data))}, data...), nil
+	case 252:
+		length := make([]byte, 8)
+		binary.LittleEndian.PutUint64(length, uint64(len(data)))
+		return append(length[:column.Meta[0]], data...), nil
+	}
+	return nil, fmt.Errorf("unsupported column type %d", column.Type)
+}
+
+func tableID(id uint64) []byte {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, id)
+	return data[:6]
+}
+
+// formatDescription is the body of the format description event of a server
+// that checksums its events
+func formatDescription() []byte {
+	body := []byte{4, 0}
+	version := make([]byte, 50)
+	copy(version, serverVersion)
+	body = append(body, version...)
+	body = append(body, 0, 0, 0, 0, 19)
+	// the lengths of the post headers by event type, the table map event
+	// has a table ID of 6 bytes
+	lengths := make([]byte, 40)
+	lengths[19-1] = 8
+	body = append(body, lengths...)
+	// CRC32, the checksum of the event follows
+	return append(body, 1)
+}
+
+// write appends the event to the binlog and wakes up the replicas
+func (s *Server) write(t byte, body []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	start := s.end
+	s.end += uint32(19 + len(body) + 4)
+	s.events = append(s.events, event{
+		start: start,
+		data:  encodeEvent(t, s.end, 0, body),
+	})
+	s.cond.Broadcast()
+}
+
+// encodeEvent returns the event with its header and checksum, position is
+// where the next event starts
+func encodeEvent(t byte, position uint32, flags uint16, body []byte) []byte {
+	data := make([]byte, 19, 19+len(body)+4)
+	binary.LittleEndian.PutUint32(data, uint32(time.Now().Unix()))
+	data[4] = t
+	binary.LittleEndian.PutUint32(data[5:], serverID)
+	binary.LittleEndian.PutUint32(data[9:], uint32(19+len(body)+4))
+	binary.LittleEndian.PutUint32(data[13:], position)
+	binary.LittleEndian.PutUint16(data[17:], flags)
+	data = append(data, body...)
+
+	checksum := make([]byte, 4)
+	binary.LittleEndian.PutUint32(checksum, crc32.ChecksumIEEE(data))
+	return append(data, checksum...)
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.lock.Lock()
+		if s.closed {
+			s.lock.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = true
+		s.lock.Unlock()
+
+		go func() {
+			defer func() {
+				s.lock.Lock()
+				delete(s.conns, conn)
+				s.lock.Unlock()
+				conn.Close()
+			}()
+			c := &serverConn{conn: conn, r: bufio.NewReader(conn)}
+			if err := s.handle(c); err != nil {
+				return
+			}
+		}()
+	}
+}
+
+// serverConn is the connection of a replica
+type serverConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	seq  byte
+}
+
+func (s *Server) handle(c *serverConn) error {
+	scramble := make([]byte, 20)
+	if _, err := rand.Read(scramble); err != nil {
+		return err
+	}
+	// the scramble is sent without NUL bytes
+	for i := range scramble {
+		scramble[i] = scramble[i]%94 + 33
+	}
+
+	greeting := []byte{10}
+	greeting = append(greeting, serverVersion...)
+	greeting = append(greeting, 0, 1, 0, 0, 0)
+	greeting = append(greeting, scramble[:8]...)
+	var flags [4]byte
+	binary.LittleEndian.PutUint32(flags[:], capabilities)
+	// the lower flags, the charset, the status, the upper flags and the
+	// length of the scramble
+	greeting = append(greeting, 0, flags[0], flags[1], 33, 2, 0, flags[2], flags[3], 21)
+	greeting = append(greeting, make([]byte, 10)...)
+	greeting = append(greeting, scramble[8:]...)
+	greeting = append(greeting, 0)
+	greeting = append(greeting, "mysql_native_password"...)
+	greeting = append(greeting, 0)
+	if err := c.writePacket(greeting); err != nil {
+		return err
+	}
+
+	response, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+	if !s.authenticated(response, scramble) {
+		return c.writeError(1045, "Access denied")
+	}
+	if err := c.writeOK(); err != nil {
+		return err
+	}
+
+	for {
+		c.seq = 0
+		command, err := c.readPacket()
+		if err != nil {
+			return err
+		}
+		if len(command) == 0 {
+			return fmt.Errorf("empty command")
+		}
+
+		switch command[0] {
+		case comQuery:
+			err = c.writeOK()
+		case comBinlogDump:
+			return s.dump(c, command[1:])
+		default:
+			err = c.writeError(1047, "Unknown command")
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// authenticated checks the user and the password of the handshake response
+func (s *Server) authenticated(response, scramble []byte) bool {
+	if len(response) < 32 {
+		return false
+	}
+	data := response[32:]
+	i := bytes.IndexByte(data, 0)
+	if i < 0 || string(data[:i]) != s.user {
+		return false
+	}
+	data = data[i+1:]
+	if len(data) < 1 || len(data) < 1+int(data[0]) {
+		return false
+	}
+	auth := data[1 : 1+int(data[0])]
+
+	if s.password == "" {
+		return len(auth) == 0
+	}
+	stage1 := sha1.Sum([]byte(s.password))
+	stage2 := sha1.Sum(stage1[:])
+	h := sha1.New()
+	h.Write(scramble)
+	h.Write(stage2[:])
+	expected := h.Sum(nil)
+	for i := range expected {
+		expected[i] ^= stage1[i]
+	}
+	return bytes.Equal(auth, expected)
+}
+
+// dump streams the binlog from the position of the request, starting like a
+// server does with an artificial rotate event and the format description
+func (s *Server) dump(c *serverConn, request []byte) error {
+	if len(request) < 10 {
+		return fmt.Errorf("short dump request")
+	}
+	offset := binary.LittleEndian.Uint32(request)
+	file := string(request[10:])
+
+	s.lock.Lock()
+	current := s.file
+	s.lock.Unlock()
+	if file != current || offset < startOffset {
+		return c.writeError(ErrPurged, "Could not find first log file name in binary log index file")
+	}
+
+	rotate := make([]byte, 8, 8+len(file))
+	binary.LittleEndian.PutUint64(rotate, uint64(offset))
+	rotate = append(rotate, file...)
+	if err := c.writeEvent(encodeEvent(4, 0, 0x20, rotate)); err != nil {
+		return err
+	}
+	if offset > startOffset {
+		if err := c.writeEvent(encodeEvent(15, 0, 0, formatDescription())); err != nil {
+			return err
+		}
+	}
+
+	for i := 0; ; i++ {
+		s.lock.Lock()
+		for !s.closed && i >= len(s.events) {
+			s.cond.Wait()
+		}
+		if s.closed {
+			s.lock.Unlock()
+			return io.EOF
+		}
+		e := s.events[i]
+		s.lock.Unlock()
+
+		if e.start < offset {
+			continue
+		}
+		if err := c.writeEvent(e.data); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *serverConn) readPacket() ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return nil, err
+	}
+	length := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	c.seq = header[3] + 1
+
+	data := make([]byte, length)
+	_, err := io.ReadFull(c.r, data)
+	return data, err
+}
+
+func (c *serverConn) writePacket(data []byte) error {
+	packet := []byte{byte(len(data)), byte(len(data) >> 8), byte(len(data) >> 16), c.seq}
+	c.seq++
+	_, err := c.conn.Write(append(packet, data...))
+	return err
+}
+
+func (c *serverConn) writeOK() error {
+	return c.writePacket([]byte{0, 0, 0, 2, 0, 0, 0})
+}
+
+func (c *serverConn) writeError(code uint16, message string) error {
+	data := []byte{0xff, byte(code), byte(code >> 8)}
+	data = append(data, "#HY000"...)
+	return c.writePacket(append(data, message...))
+}
+
+func (c *serverConn) writeEvent(data []byte) error {
+	return c.writePacket(append([]byte{0}, data...))
+}
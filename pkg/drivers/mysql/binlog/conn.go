@@ -0,0 +1,357 @@
+// Package binlog follows the binary log of a MySQL server the way a replica
+// does. It decodes no more than kine needs, the rows inserted into one table.
+package binlog
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	maxPacketSize = 1<<24 - 1
+
+	comQuery      = 0x03
+	comBinlogDump = 0x12
+
+	clientLongPassword     = 0x00000001
+	clientLongFlag         = 0x00000004
+	clientProtocol41       = 0x00000200
+	clientSSL              = 0x00000800
+	clientTransactions     = 0x00002000
+	clientSecureConnection = 0x00008000
+	clientPluginAuth       = 0x00080000
+
+	charsetUTF8 = 33
+)
+
+// Config describes the connection to the server and the table to follow.
+type Config struct {
+	Network  string
+	Address  string
+	User     string
+	Password string
+	// TLS secures the connection if it is set
+	TLS *tls.Config
+	// ServerID identifies the connection as a replica, it has to be unique
+	// among the replicas of the server
+	ServerID uint32
+	// Heartbeat is the period the server sends heartbeats at while there are
+	// no events. A connection that stays silent for twice as long is taken
+	// to be gone. Zero leaves heartbeats to the server and waits forever.
+	Heartbeat time.Duration
+	// Schema and Table select the table whose rows are decoded, the rows
+	// events of other tables only carry their header.
+	Schema string
+	Table  string
+}
+
+// Position is a position in the binary log.
+type Position struct {
+	File   string
+	Offset uint32
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("%s:%d", p.File, p.Offset)
+}
+
+// Error is an error reported by the server.
+type Error struct {
+	Code    uint16
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("binlog: error %d: %s", e.Code, e.Message)
+}
+
+// Conn is a replication connection to a server.
+type Conn struct {
+	config Config
+	conn   net.Conn
+	r      *bufio.Reader
+	seq    byte
+	// version is the version of the server
+	version string
+	// secure is set if the password can be sent as is
+	secure bool
+
+	stream
+}
+
+// Dial connects and authenticates to the server.
+func Dial(ctx context.Context, config Config) (*Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, config.Network, config.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Conn{
+		config: config,
+		conn:   conn,
+		r:      bufio.NewReader(conn),
+		secure: config.Network == "unix",
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err := c.handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return c, nil
+}
+
+// Close closes the connection, which also interrupts a blocked Next.
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Conn) handshake() error {
+	data, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+	if data[0] == 0xff {
+		return parseError(data)
+	}
+	if data[0] != 10 {
+		return fmt.Errorf("binlog: unsupported protocol version %d", data[0])
+	}
+
+	r := reader{data: data, pos: 1}
+	c.version = r.cstring()
+	r.skip(4)
+	scramble := append([]byte(nil), r.bytes(8)...)
+	r.skip(1)
+	capabilities := uint32(r.uint(2))
+	plugin := "mysql_native_password"
+	if r.remaining() > 0 {
+		r.skip(3)
+		capabilities |= uint32(r.uint(2)) << 16
+		authLen := int(r.uint(1))
+		r.skip(10)
+		if capabilities&clientSecureConnection != 0 {
+			n := authLen - 8
+			if n < 13 {
+				n = 13
+			}
+			// without the trailing NUL
+			if part := r.bytes(n); len(part) > 0 {
+				scramble = append(scramble, part[:n-1]...)
+			}
+		}
+		if capabilities&clientPluginAuth != 0 {
+			plugin = r.cstring()
+		}
+	}
+	if r.err != nil {
+		return r.err
+	}
+	if capabilities&clientProtocol41 == 0 {
+		return fmt.Errorf("binlog: server %s is too old", c.version)
+	}
+
+	flags := uint32(clientLongPassword | clientLongFlag | clientProtocol41 | clientTransactions | clientSecureConnection | clientPluginAuth)
+
+	if c.config.TLS != nil {
+		if capabilities&clientSSL == 0 {
+			return fmt.Errorf("binlog: server does not support TLS")
+		}
+		flags |= clientSSL
+		if err := c.writePacket(handshakeHeader(flags)); err != nil {
+			return err
+		}
+
+		tlsConn := tls.Client(c.conn, c.tlsConfig())
+		if err := tlsConn.Handshake(); err != nil {
+			return err
+		}
+		c.conn = tlsConn
+		c.r = bufio.NewReader(tlsConn)
+		c.secure = true
+	}
+
+	auth, err := c.authResponse(plugin, scramble)
+	if err != nil {
+		return err
+	}
+
+	response := handshakeHeader(flags)
+	response = append(response, c.config.User...)
+	response = append(response, 0, byte(len(auth)))
+	response = append(response, auth...)
+	response = append(response, plugin...)
+	response = append(response, 0)
+	if err := c.writePacket(response); err != nil {
+		return err
+	}
+
+	return c.authResult(plugin, scramble)
+}
+
+func (c *Conn) tlsConfig() *tls.Config {
+	config := c.config.TLS.Clone()
+	if config.ServerName == "" && !config.InsecureSkipVerify {
+		if host, _, err := net.SplitHostPort(c.config.Address); err == nil {
+			config.ServerName = host
+		} else {
+			config.ServerName = c.config.Address
+		}
+	}
+	return config
+}
+
+// handshakeHeader is the start of the handshake response, which is all of the
+// request to switch to TLS
+func handshakeHeader(flags uint32) []byte {
+	header := make([]byte, 32)
+	binary.LittleEndian.PutUint32(header, flags)
+	binary.LittleEndian.PutUint32(header[4:], maxPacketSize)
+	header[8] = charsetUTF8
+	return header
+}
+
+// exec runs a statement without a result set
+func (c *Conn) exec(query string) error {
+	c.seq = 0
+	if err := c.writePacket(append([]byte{comQuery}, query...)); err != nil {
+		return err
+	}
+
+	data, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+	switch data[0] {
+	case 0x00:
+		return nil
+	case 0xff:
+		return parseError(data)
+	}
+	return fmt.Errorf("binlog: unexpected result of %q", query)
+}
+
+// Dump starts streaming the binary log from the position. The events are read
+// with Next.
+func (c *Conn) Dump(position Position) error {
+	if c.config.Heartbeat > 0 {
+		period := c.config.Heartbeat.Nanoseconds()
+		if err := c.exec(fmt.Sprintf("SET @master_heartbeat_period = %d, @source_heartbeat_period = %d", period, period)); err != nil {
+			return err
+		}
+	}
+	// events carry the checksum the server is configured with, which the
+	// format description event announces. MySQL 8.4 renamed the variables.
+	if err := c.exec("SET @master_binlog_checksum = @@global.binlog_checksum, @source_binlog_checksum = @@global.binlog_checksum"); err != nil {
+		return err
+	}
+
+	request := make([]byte, 11, 11+len(position.File))
+	request[0] = comBinlogDump
+	binary.LittleEndian.PutUint32(request[1:], position.Offset)
+	binary.LittleEndian.PutUint32(request[7:], c.config.ServerID)
+	request = append(request, position.File...)
+
+	c.seq = 0
+	if err := c.writePacket(request); err != nil {
+		return err
+	}
+
+	c.stream = stream{
+		schema:      c.config.Schema,
+		table:       c.config.Table,
+		position:    position,
+		tableIDSize: 6,
+		tables:      map[uint64]*Table{},
+	}
+	return nil
+}
+
+// Next returns the next event of the binary log, it blocks until there is one.
+func (c *Conn) Next() (*Event, error) {
+	if c.config.Heartbeat > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(2 * c.config.Heartbeat))
+	}
+
+	data, err := c.readPacket()
+	if err != nil {
+		return nil, err
+	}
+
+	switch data[0] {
+	case 0x00:
+	case 0xff:
+		return nil, parseError(data)
+	case 0xfe:
+		return nil, io.EOF
+	default:
+		return nil, fmt.Errorf("binlog: unexpected packet 0x%02x", data[0])
+	}
+
+	return c.decode(data[1:])
+}
+
+func (c *Conn) readPacket() ([]byte, error) {
+	var payload []byte
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(c.r, header[:]); err != nil {
+			return nil, err
+		}
+		length := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+		c.seq = header[3] + 1
+
+		data := make([]byte, length)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		payload = append(payload, data...)
+
+		// a payload of the maximum size continues in the next packet
+		if length < maxPacketSize {
+			if len(payload) == 0 {
+				return nil, fmt.Errorf("binlog: empty packet")
+			}
+			return payload, nil
+		}
+	}
+}
+
+func (c *Conn) writePacket(data []byte) error {
+	packet := make([]byte, 4, 4+len(data))
+	packet[0] = byte(len(data))
+	packet[1] = byte(len(data) >> 8)
+	packet[2] = byte(len(data) >> 16)
+	packet[3] = c.seq
+	c.seq++
+
+	_, err := c.conn.Write(append(packet, data...))
+	return err
+}
+
+func parseError(data []byte) error {
+	r := reader{data: data, pos: 1}
+	code := uint16(r.uint(2))
+	// the SQL state follows a marker
+	if r.remaining() > 0 && r.data[r.pos] == '#' {
+		r.skip(6)
+	}
+	if r.err != nil {
+		return fmt.Errorf("binlog: malformed error packet")
+	}
+	return &Error{
+		Code:    code,
+		Message: string(r.data[r.pos:]),
+	}
+}
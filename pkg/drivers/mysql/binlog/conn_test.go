@@ -0,0 +1,201 @@
+package binlog_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rancher/kine/pkg/drivers/mysql/binlog"
+	"github.com/rancher/kine/pkg/drivers/mysql/binlog/binlogtest"
+)
+
+var columns = []binlogtest.Column{binlogtest.LongLong, binlogtest.Varbinary(630), binlogtest.Long, binlogtest.Blob(3)}
+
+func dial(server *binlogtest.Server, password string) (*binlog.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return binlog.Dial(ctx, binlog.Config{
+		Network:   "tcp",
+		Address:   server.Addr,
+		User:      "repl",
+		Password:  password,
+		ServerID:  2,
+		Heartbeat: time.Second,
+		Schema:    "kine",
+		Table:     "kine",
+	})
+}
+
+func newServer(t *testing.T) *binlogtest.Server {
+	server, err := binlogtest.NewServer("repl", "secret", "binlog.000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func TestDial(t *testing.T) {
+	server := newServer(t)
+	defer server.Close()
+
+	for _, tt := range []struct {
+		name     string
+		password string
+		code     uint16
+	}{
+		{name: "password", password: "secret"},
+		{name: "wrong password", password: "wrong", code: 1045},
+		{name: "no password", code: 1045},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := dial(server, tt.password)
+			if tt.code == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				conn.Close()
+				return
+			}
+			if err, ok := err.(*binlog.Error); !ok || err.Code != tt.code {
+				t.Fatalf("got error %v, expected code %d", err, tt.code)
+			}
+		})
+	}
+}
+
+func TestDumpPurged(t *testing.T) {
+	server := newServer(t)
+	defer server.Close()
+
+	conn, err := dial(server, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := conn.Dump(binlog.Position{File: "binlog.000000", Offset: 4}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Next()
+	if err, ok := err.(*binlog.Error); !ok || err.Code != binlogtest.ErrPurged {
+		t.Fatalf("got error %v, expected code %d", err, binlogtest.ErrPurged)
+	}
+}
+
+func TestNext(t *testing.T) {
+	server := newServer(t)
+	defer server.Close()
+	start := server.Position()
+
+	server.TableMap(1, "kine", "kine_lease", binlogtest.LongLong)
+	if err := server.WriteRows(1, []binlogtest.Column{binlogtest.LongLong}, []interface{}{7}); err != nil {
+		t.Fatal(err)
+	}
+	server.XID(1)
+	server.TableMap(2, "kine", "kine", columns...)
+	if err := server.WriteRows(2, columns,
+		[]interface{}{1, "/a", 1, []byte("value")},
+		[]interface{}{2, "/b", nil, nil},
+	); err != nil {
+		t.Fatal(err)
+	}
+	server.UpdateRows(2)
+	server.XID(2)
+	end := server.Position()
+
+	type event struct {
+		Type  binlog.EventType
+		Table string
+		Rows  [][]interface{}
+	}
+	expected := []event{
+		{Type: binlog.RotateEvent},
+		{Type: binlog.FormatDescriptionEvent},
+		{Type: binlog.TableMapEvent, Table: "kine_lease"},
+		// rows of other tables are not decoded
+		{Type: binlog.WriteRowsEventV2},
+		{Type: binlog.XIDEvent},
+		{Type: binlog.TableMapEvent, Table: "kine"},
+		{Type: binlog.WriteRowsEventV2, Table: "kine", Rows: [][]interface{}{
+			{int64(1), []byte("/a"), int64(1), []byte("value")},
+			{int64(2), []byte("/b"), nil, nil},
+		}},
+		{Type: binlog.UpdateRowsEventV2, Table: "kine"},
+		{Type: binlog.XIDEvent},
+	}
+
+	for _, tt := range []struct {
+		name string
+		// skip is the number of events read before resuming, zero starts
+		// from the start
+		skip int
+	}{
+		{name: "from the start"},
+		{name: "from the second transaction", skip: 5},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			position := start
+			var events []event
+			if tt.skip > 0 {
+				position = positionAfter(t, server, start, tt.skip)
+				// a dump always starts with the rotate and the format
+				// description
+				events = append(events, expected[:2]...)
+			}
+
+			conn, err := dial(server, "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if err := conn.Dump(position); err != nil {
+				t.Fatal(err)
+			}
+
+			want := append(events, expected[tt.skip:]...)
+			var got []event
+			var last binlog.Position
+			for len(got) < len(want) {
+				e, err := conn.Next()
+				if err != nil {
+					t.Fatal(err)
+				}
+				ev := event{Type: e.Type, Rows: e.Rows}
+				if e.Table != nil && (e.Type == binlog.TableMapEvent || e.Table.Name == "kine") {
+					ev.Table = e.Table.Name
+				}
+				got = append(got, ev)
+				last = e.Position
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("got events %+v, expected %+v", got, want)
+			}
+			if last != end {
+				t.Fatalf("ended at %s, expected %s", last, end)
+			}
+		})
+	}
+}
+
+// positionAfter returns the position after the first n events read from the
+// position
+func positionAfter(t *testing.T, server *binlogtest.Server, position binlog.Position, n int) binlog.Position {
+	conn, err := dial(server, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := conn.Dump(position); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		e, err := conn.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		position = e.Position
+	}
+	return position
+}
@@ -0,0 +1,420 @@
+package binlog
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+)
+
+// EventType is the type of a binlog event.
+type EventType byte
+
+const (
+	QueryEvent             EventType = 2
+	RotateEvent            EventType = 4
+	FormatDescriptionEvent EventType = 15
+	XIDEvent               EventType = 16
+	TableMapEvent          EventType = 19
+	WriteRowsEventV1       EventType = 23
+	UpdateRowsEventV1      EventType = 24
+	HeartbeatEvent         EventType = 27
+	WriteRowsEventV2       EventType = 30
+	UpdateRowsEventV2      EventType = 31
+)
+
+const (
+	eventHeaderSize = 19
+	checksumSize    = 4
+	checksumCRC32   = 1
+	artificialEvent = 0x20
+)
+
+// column types as the table map event reports them
+const (
+	typeTiny       = 1
+	typeShort      = 2
+	typeLong       = 3
+	typeFloat      = 4
+	typeDouble     = 5
+	typeLongLong   = 8
+	typeInt24      = 9
+	typeVarchar    = 15
+	typeBit        = 16
+	typeTimestamp2 = 17
+	typeDatetime2  = 18
+	typeTime2      = 19
+	typeJSON       = 245
+	typeNewDecimal = 246
+	typeEnum       = 247
+	typeSet        = 248
+	typeBlob       = 252
+	typeVarString  = 253
+	typeString     = 254
+	typeGeometry   = 255
+)
+
+// Event is an event of the binary log.
+type Event struct {
+	Type EventType
+	// Position is where the event after this one starts, resuming there
+	// skips this event
+	Position Position
+	// Table is the table of a table map or write rows event, and of an
+	// update rows event of the selected table
+	Table *Table
+	// Rows are the rows inserted by a write rows event of the selected
+	// table. Values are int64 for integer columns, []byte for string and
+	// blob columns and nil for NULL.
+	Rows [][]interface{}
+}
+
+// Table is a table as the binary log describes it.
+type Table struct {
+	Schema  string
+	Name    string
+	Columns []byte
+	meta    []uint16
+}
+
+// stream is the state of a binary log being read
+type stream struct {
+	schema   string
+	table    string
+	position Position
+	// checksum is known once the format description event is read
+	checksum    bool
+	format      bool
+	tableIDSize int
+	tables      map[uint64]*Table
+}
+
+func (s *stream) decode(data []byte) (*Event, error) {
+	if len(data) < eventHeaderSize {
+		return nil, fmt.Errorf("binlog: short event")
+	}
+
+	header := reader{data: data}
+	header.skip(4)
+	event := &Event{Type: EventType(header.uint(1))}
+	header.skip(8)
+	logPos := uint32(header.uint(4))
+	flags := header.uint(2)
+
+	body := data[eventHeaderSize:]
+	if event.Type != FormatDescriptionEvent && s.hasChecksum(data) {
+		if len(body) < checksumSize {
+			return nil, fmt.Errorf("binlog: short event")
+		}
+		body = body[:len(body)-checksumSize]
+	}
+
+	var err error
+	switch event.Type {
+	case RotateEvent:
+		r := reader{data: body}
+		offset := r.uint(8)
+		s.position = Position{File: string(r.data[r.pos:]), Offset: uint32(offset)}
+		err = r.err
+	case FormatDescriptionEvent:
+		err = s.formatDescription(body)
+	case TableMapEvent:
+		event.Table, err = s.tableMap(body)
+	case WriteRowsEventV1, WriteRowsEventV2:
+		event.Table, event.Rows, err = s.writeRows(event.Type, body)
+	case UpdateRowsEventV1, UpdateRowsEventV2:
+		event.Table, err = s.updateRows(body)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// artificial events, such as the ones starting a dump, don't advance
+	// the position
+	if event.Type != RotateEvent && event.Type != HeartbeatEvent && logPos != 0 && flags&artificialEvent == 0 {
+		s.position.Offset = logPos
+	}
+	event.Position = s.position
+	return event, nil
+}
+
+// hasChecksum reports whether the event ends in a checksum. The rotate event
+// that starts a dump comes before the format description, whether it has one
+// is only known by checking.
+func (s *stream) hasChecksum(data []byte) bool {
+	if s.format {
+		return s.checksum
+	}
+	n := len(data) - checksumSize
+	return n >= eventHeaderSize && crc32.ChecksumIEEE(data[:n]) == binary.LittleEndian.Uint32(data[n:])
+}
+
+func (s *stream) formatDescription(body []byte) error {
+	r := reader{data: body}
+	r.skip(2)
+	version := r.bytes(50)
+	r.skip(5)
+	if r.err != nil {
+		return r.err
+	}
+	if i := strings.IndexByte(string(version), 0); i >= 0 {
+		version = version[:i]
+	}
+
+	// servers since 5.6.1 add the checksum algorithm and the checksum of
+	// the event itself
+	headerLengths := body[r.pos:]
+	s.checksum = false
+	if versionAtLeast(string(version), 5, 6, 1) {
+		if len(headerLengths) < 1+checksumSize {
+			return fmt.Errorf("binlog: short format description")
+		}
+		s.checksum = headerLengths[len(headerLengths)-1-checksumSize] == checksumCRC32
+		headerLengths = headerLengths[:len(headerLengths)-1-checksumSize]
+	}
+
+	s.format = true
+	s.tableIDSize = 6
+	if int(TableMapEvent) <= len(headerLengths) && headerLengths[TableMapEvent-1] == 6 {
+		s.tableIDSize = 4
+	}
+	return nil
+}
+
+func (s *stream) tableMap(body []byte) (*Table, error) {
+	r := reader{data: body}
+	id := r.uint(s.tableIDSize)
+	r.skip(2)
+	table := &Table{}
+	table.Schema = string(r.bytes(int(r.uint(1))))
+	r.skip(1)
+	table.Name = string(r.bytes(int(r.uint(1))))
+	r.skip(1)
+	table.Columns = r.bytes(int(r.lenenc()))
+	meta := r.bytes(int(r.lenenc()))
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	if table.Schema != s.schema || table.Name != s.table {
+		delete(s.tables, id)
+		return table, nil
+	}
+
+	m := reader{data: meta}
+	table.meta = make([]uint16, len(table.Columns))
+	for i, t := range table.Columns {
+		switch t {
+		case typeFloat, typeDouble, typeBlob, typeGeometry, typeJSON,
+			typeTimestamp2, typeDatetime2, typeTime2:
+			table.meta[i] = uint16(m.uint(1))
+		case typeVarchar, typeVarString, typeBit:
+			table.meta[i] = uint16(m.uint(2))
+		case typeNewDecimal, typeString, typeEnum, typeSet:
+			table.meta[i] = uint16(m.uint(1))<<8 | uint16(m.uint(1))
+		}
+	}
+	if m.err != nil {
+		return nil, m.err
+	}
+
+	s.tables[id] = table
+	return table, nil
+}
+
+// writeRows decodes the rows of a write rows event of the selected table,
+// other tables are left alone
+func (s *stream) writeRows(t EventType, body []byte) (*Table, [][]interface{}, error) {
+	r := reader{data: body}
+	id := r.uint(s.tableIDSize)
+	r.skip(2)
+	if t == WriteRowsEventV2 {
+		extra := int(r.uint(2))
+		r.skip(extra - 2)
+	}
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+
+	table, ok := s.tables[id]
+	if !ok {
+		return nil, nil, nil
+	}
+
+	n := int(r.lenenc())
+	if n != len(table.Columns) {
+		return nil, nil, fmt.Errorf("binlog: rows of %s.%s have %d columns, expected %d", table.Schema, table.Name, n, len(table.Columns))
+	}
+	present := r.bytes((n + 7) / 8)
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+
+	var count int
+	for i := 0; i < n; i++ {
+		if bit(present, i) {
+			count++
+		}
+	}
+
+	var rows [][]interface{}
+	for r.err == nil && r.remaining() > 0 {
+		nulls := r.bytes((count + 7) / 8)
+		if r.err != nil {
+			break
+		}
+		row := make([]interface{}, n)
+		k := 0
+		for i := 0; i < n; i++ {
+			if !bit(present, i) {
+				continue
+			}
+			if bit(nulls, k) {
+				k++
+				continue
+			}
+			k++
+
+			value, err := r.value(table.Columns[i], table.meta[i])
+			if err != nil {
+				return nil, nil, err
+			}
+			row[i] = value
+		}
+		rows = append(rows, row)
+	}
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+
+	return table, rows, nil
+}
+
+// updateRows returns the table of an update rows event if it is the selected
+// one, the rows themselves are not decoded
+func (s *stream) updateRows(body []byte) (*Table, error) {
+	r := reader{data: body}
+	id := r.uint(s.tableIDSize)
+	if r.err != nil {
+		return nil, r.err
+	}
+	return s.tables[id], nil
+}
+
+func bit(bitmap []byte, i int) bool {
+	return bitmap[i/8]&(1<<uint(i%8)) != 0
+}
+
+// versionAtLeast compares a version such as "8.0.33" or "10.5.9-MariaDB"
+func versionAtLeast(version string, want ...int) bool {
+	if i := strings.IndexByte(version, '-'); i >= 0 {
+		version = version[:i]
+	}
+	parts := strings.Split(version, ".")
+	for i, w := range want {
+		if i >= len(parts) {
+			return false
+		}
+		v, err := strconv.Atoi(parts[i])
+		if err != nil {
+			return false
+		}
+		if v != w {
+			return v > w
+		}
+	}
+	return true
+}
+
+// reader reads the little endian encoding of the protocol, the first read
+// past the end records an error that later reads keep
+type reader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *reader) remaining() int {
+	return len(r.data) - r.pos
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > r.remaining() {
+		r.err = fmt.Errorf("binlog: truncated data")
+		return nil
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *reader) skip(n int) {
+	r.bytes(n)
+}
+
+func (r *reader) uint(n int) uint64 {
+	var v uint64
+	for i, b := range r.bytes(n) {
+		v |= uint64(b) << (8 * uint(i))
+	}
+	return v
+}
+
+func (r *reader) lenenc() uint64 {
+	switch first := r.uint(1); first {
+	case 0xfc:
+		return r.uint(2)
+	case 0xfd:
+		return r.uint(3)
+	case 0xfe:
+		return r.uint(8)
+	default:
+		return first
+	}
+}
+
+func (r *reader) cstring() string {
+	if r.err != nil {
+		return ""
+	}
+	i := strings.IndexByte(string(r.data[r.pos:]), 0)
+	if i < 0 {
+		r.err = fmt.Errorf("binlog: truncated data")
+		return ""
+	}
+	s := string(r.data[r.pos : r.pos+i])
+	r.pos += i + 1
+	return s
+}
+
+func (r *reader) value(t byte, meta uint16) (interface{}, error) {
+	switch t {
+	case typeTiny:
+		return int64(int8(r.uint(1))), r.err
+	case typeShort:
+		return int64(int16(r.uint(2))), r.err
+	case typeInt24:
+		v := int64(r.uint(3))
+		if v&0x800000 != 0 {
+			v -= 1 << 24
+		}
+		return v, r.err
+	case typeLong:
+		return int64(int32(r.uint(4))), r.err
+	case typeLongLong:
+		return int64(r.uint(8)), r.err
+	case typeVarchar, typeVarString:
+		size := 1
+		if meta > 255 {
+			size = 2
+		}
+		return r.bytes(int(r.uint(size))), r.err
+	case typeBlob:
+		return r.bytes(int(r.uint(int(meta)))), r.err
+	}
+	return nil, fmt.Errorf("binlog: unsupported column type %d", t)
+}
@@ -0,0 +1,328 @@
+package mysql
+
+import (
+	"context"
+	cryptotls "crypto/tls"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/rancher/kine/pkg/drivers/mysql/binlog"
+	"github.com/rancher/kine/pkg/logstructured"
+	"github.com/rancher/kine/pkg/logstructured/sqllog"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// binlogParam is the DSN parameter that turns on following the binlog
+	binlogParam = "binlog"
+
+	// binlogPollInterval is the time between polls for changes while the
+	// binlog is followed, which only catches up on rows it missed
+	binlogPollInterval = 5 * time.Second
+	binlogHeartbeat    = 30 * time.Second
+	binlogRetry        = 5 * time.Second
+
+	// errBinlogPurged is reported when the position to resume from is no
+	// longer in the binlog
+	errBinlogPurged = 1236
+)
+
+// binlogFeed follows the binlog of the server for the rows inserted into kine
+// and feeds them to the log, so that writes of every kine instance reach the
+// watches right away without polling for them.
+type binlogFeed struct {
+	db     *sql.DB
+	config binlog.Config
+	log    feeder
+	// checkpoint is the position after the last transaction read from the
+	// binlog along with the revision it wrote up to
+	checkpoint binlogCheckpoint
+}
+
+// feeder is the log the rows read from the binlog are handed to
+type feeder interface {
+	Feed(rows []logstructured.Row)
+	Notify(revision int64)
+	CurrentRevision(ctx context.Context) (int64, error)
+}
+
+var _ feeder = (*sqllog.SQLLog)(nil)
+
+type binlogCheckpoint struct {
+	position binlog.Position
+	revision int64
+}
+
+func newBinlogFeed(ctx context.Context, db *sql.DB, config *mysql.Config, tlsConfig *cryptotls.Config, log feeder) (*binlogFeed, error) {
+	if err := checkBinlog(db); err != nil {
+		return nil, err
+	}
+
+	if tlsConfig == nil {
+		switch config.TLSConfig {
+		case "true":
+			tlsConfig = &cryptotls.Config{}
+		case "skip-verify", "preferred":
+			tlsConfig = &cryptotls.Config{InsecureSkipVerify: true}
+		}
+	}
+
+	f := &binlogFeed{
+		db: db,
+		config: binlog.Config{
+			Network:   config.Net,
+			Address:   config.Addr,
+			User:      config.User,
+			Password:  config.Passwd,
+			TLS:       tlsConfig,
+			ServerID:  1<<16 + rand.New(rand.NewSource(time.Now().UnixNano())).Uint32()>>1,
+			Heartbeat: binlogHeartbeat,
+			Schema:    config.DBName,
+			Table:     "kine",
+		},
+		log: log,
+	}
+	if err := f.rebuild(ctx); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// rebuild starts the checkpoint over at the end of the binlog, at the revision
+// the database is at by then. The checkpoint isn't stored, as every instance
+// follows the binlog on its own, and the rows written while no instance was
+// following it are in the database. The log is notified of the revision to
+// read them right away.
+func (f *binlogFeed) rebuild(ctx context.Context) error {
+	position, err := binlogPosition(f.db)
+	if err != nil {
+		return err
+	}
+	revision, err := f.log.CurrentRevision(ctx)
+	if err != nil {
+		return err
+	}
+
+	f.checkpoint = binlogCheckpoint{
+		position: position,
+		revision: revision,
+	}
+	f.log.Notify(revision)
+	return nil
+}
+
+// checkBinlog makes sure the binlog holds the rows as they are written
+func checkBinlog(db *sql.DB) error {
+	var (
+		logBin        bool
+		format, image string
+		compression   sql.NullBool
+	)
+	if err := db.QueryRow("SELECT @@GLOBAL.log_bin, @@GLOBAL.binlog_format, @@GLOBAL.binlog_row_image").Scan(&logBin, &format, &image); err != nil {
+		return err
+	}
+	if !logBin {
+		return fmt.Errorf("binary logging is disabled")
+	}
+	if format != "ROW" || image != "FULL" {
+		return fmt.Errorf("binlog_format is %s and binlog_row_image is %s, ROW and FULL are needed", format, image)
+	}
+
+	// only known to MySQL 8.0.20 and later
+	err := db.QueryRow("SELECT @@GLOBAL.binlog_transaction_compression").Scan(&compression)
+	if err == nil && compression.Bool {
+		return fmt.Errorf("binlog_transaction_compression is not supported")
+	}
+	return nil
+}
+
+// binlogPosition returns the current end of the binlog
+func binlogPosition(db *sql.DB) (binlog.Position, error) {
+	// SHOW MASTER STATUS was renamed in MySQL 8.2
+	rows, err := db.Query("SHOW BINARY LOG STATUS")
+	if err != nil {
+		rows, err = db.Query("SHOW MASTER STATUS")
+	}
+	if err != nil {
+		return binlog.Position{}, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return binlog.Position{}, err
+	}
+	if !rows.Next() || len(columns) < 2 {
+		if err := rows.Err(); err != nil {
+			return binlog.Position{}, err
+		}
+		return binlog.Position{}, fmt.Errorf("binary logging is disabled")
+	}
+
+	values := make([]interface{}, len(columns))
+	for i := range values {
+		values[i] = &sql.RawBytes{}
+	}
+	if err := rows.Scan(values...); err != nil {
+		return binlog.Position{}, err
+	}
+
+	offset, err := strconv.ParseUint(string(*values[1].(*sql.RawBytes)), 10, 32)
+	if err != nil {
+		return binlog.Position{}, err
+	}
+	return binlog.Position{
+		File:   string(*values[0].(*sql.RawBytes)),
+		Offset: uint32(offset),
+	}, nil
+}
+
+// run follows the binlog until the context is done, reconnecting from the
+// last checkpoint when the connection is lost. The log polls for the rows
+// that are not fed in the meantime.
+func (f *binlogFeed) run(ctx context.Context) {
+	for {
+		err := f.follow(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err, ok := err.(*binlog.Error); ok && err.Code == errBinlogPurged {
+			logrus.Warnf("Binlog position %s is gone, following the binlog from its end: %v", f.checkpoint.position, err)
+			if err := f.rebuild(ctx); err != nil {
+				logrus.Warnf("Failed to find the end of the binlog: %v", err)
+			}
+		} else {
+			logrus.Warnf("Lost the binlog stream at %s, polling for changes until it is back: %v", f.checkpoint.position, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(binlogRetry):
+		}
+	}
+}
+
+func (f *binlogFeed) follow(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	conn, err := binlog.Dial(ctx, f.config)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	if err := conn.Dump(f.checkpoint.position); err != nil {
+		return err
+	}
+	logrus.Infof("Following the binlog from %s", f.checkpoint.position)
+
+	var (
+		rows []logstructured.Row
+		// updated is set for transactions that set the batch revision of
+		// their rows after inserting them
+		updated bool
+	)
+	for {
+		event, err := conn.Next()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case event.Rows != nil:
+			for _, values := range event.Rows {
+				row, err := toRow(values)
+				if err != nil {
+					return err
+				}
+				rows = append(rows, row)
+			}
+		case event.Table != nil && (event.Type == binlog.UpdateRowsEventV1 || event.Type == binlog.UpdateRowsEventV2):
+			updated = true
+		case event.Type == binlog.XIDEvent:
+			// the transaction is committed, resuming from here neither
+			// repeats nor misses any of its rows
+			f.checkpoint.position = event.Position
+			if len(rows) == 0 {
+				updated = false
+				continue
+			}
+			for _, row := range rows {
+				if row.ID > f.checkpoint.revision {
+					f.checkpoint.revision = row.ID
+				}
+			}
+			// the rows of a batch as inserted lack their batch revision,
+			// the log reads them from the database instead
+			if updated {
+				f.log.Notify(f.checkpoint.revision)
+			} else {
+				f.log.Feed(rows)
+			}
+			logrus.Debugf("BINLOG position=%s, rows=%d, batch=%v => revision=%d", f.checkpoint.position, len(rows), updated, f.checkpoint.revision)
+			rows, updated = nil, false
+		}
+	}
+}
+
+// toRow converts the columns of a kine row, in the order of the schema. Tables
+// created by older releases lack the columns added since.
+func toRow(values []interface{}) (logstructured.Row, error) {
+	if len(values) < 9 || len(values) > 12 {
+		return logstructured.Row{}, fmt.Errorf("binlog rows of kine have %d columns, expected 12", len(values))
+	}
+
+	var (
+		row  logstructured.Row
+		ints [6]int64
+	)
+	for i, column := range []int{0, 2, 3, 4, 5, 6} {
+		switch v := values[column].(type) {
+		case int64:
+			ints[i] = v
+		case nil:
+		default:
+			return logstructured.Row{}, fmt.Errorf("binlog column %d of kine is %T, expected an integer", column, v)
+		}
+	}
+	row.ID = ints[0]
+	row.Created = ints[1] != 0
+	row.Deleted = ints[2] != 0
+	row.CreateRevision = ints[3]
+	row.PrevRevision = ints[4]
+	row.Lease = ints[5]
+
+	name, ok := values[1].([]byte)
+	if !ok {
+		return logstructured.Row{}, fmt.Errorf("binlog column 1 of kine is %T, expected a string", values[1])
+	}
+	row.Name = string(name)
+	row.Value, _ = values[7].([]byte)
+	row.OldValue, _ = values[8].([]byte)
+	if len(values) > 9 {
+		row.BatchRevision, _ = values[9].(int64)
+	}
+	row.Version = 1
+	if len(values) > 10 {
+		if version, ok := values[10].(int64); ok {
+			row.Version = version
+		}
+	}
+	row.OldLease = row.Lease
+	if len(values) > 11 {
+		if oldLease, ok := values[11].(int64); ok {
+			row.OldLease = oldLease
+		}
+	}
+	return row, nil
+}
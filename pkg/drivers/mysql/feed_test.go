@@ -0,0 +1,163 @@
+package mysql
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rancher/kine/pkg/drivers/mysql/binlog"
+	"github.com/rancher/kine/pkg/drivers/mysql/binlog/binlogtest"
+	"github.com/rancher/kine/pkg/logstructured"
+)
+
+// kineColumns are the columns of the kine table in the order of the schema
+var kineColumns = []binlogtest.Column{
+	binlogtest.Long, binlogtest.Varbinary(630), binlogtest.Long, binlogtest.Long,
+	binlogtest.Long, binlogtest.Long, binlogtest.Long, binlogtest.Blob(3), binlogtest.Blob(3),
+	binlogtest.Long, binlogtest.Long, binlogtest.Long,
+}
+
+// testLog records what the feed hands to the log
+type testLog struct {
+	fed      chan []logstructured.Row
+	notified chan int64
+}
+
+func (l *testLog) Feed(rows []logstructured.Row) {
+	l.fed <- rows
+}
+
+func (l *testLog) Notify(revision int64) {
+	l.notified <- revision
+}
+
+func (l *testLog) CurrentRevision(ctx context.Context) (int64, error) {
+	return 0, nil
+}
+
+func TestBinlogFeed(t *testing.T) {
+	server, err := binlogtest.NewServer("kine", "secret", "binlog.000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	log := &testLog{
+		fed:      make(chan []logstructured.Row, 10),
+		notified: make(chan int64, 10),
+	}
+	f := &binlogFeed{
+		config: binlog.Config{
+			Network:  "tcp",
+			Address:  server.Addr,
+			User:     "kine",
+			Password: "secret",
+			ServerID: 2,
+			Schema:   "kine",
+			Table:    "kine",
+		},
+		log:        log,
+		checkpoint: binlogCheckpoint{position: server.Position()},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- f.follow(ctx)
+	}()
+
+	server.TableMap(1, "kine", "kine", kineColumns...)
+	server.TableMap(2, "kine", "kine_lease", binlogtest.LongLong, binlogtest.LongLong, binlogtest.LongLong)
+	// a table created by a release without the version and old lease
+	server.TableMap(3, "kine", "kine", kineColumns[:9]...)
+
+	for i, tt := range []struct {
+		name  string
+		write func() error
+		// fed are the rows fed to the log, or if there are none the log is
+		// expected to be notified of the revision
+		fed      []logstructured.Row
+		notified int64
+	}{
+		{
+			name: "create",
+			write: func() error {
+				return server.WriteRows(1, kineColumns, []interface{}{1, "/a", 1, 0, 0, 0, 0, "v1", nil, nil, 1, 0})
+			},
+			fed: []logstructured.Row{
+				{ID: 1, Name: "/a", Created: true, Value: []byte("v1"), Version: 1},
+			},
+		},
+		{
+			name: "update with a lease",
+			write: func() error {
+				return server.WriteRows(1, kineColumns, []interface{}{2, "/a", 0, 0, 1, 1, 7, "v2", "v1", nil, 2, 0})
+			},
+			fed: []logstructured.Row{
+				{ID: 2, Name: "/a", CreateRevision: 1, PrevRevision: 1, Lease: 7, Value: []byte("v2"), OldValue: []byte("v1"), Version: 2},
+			},
+		},
+		{
+			name: "other tables",
+			write: func() error {
+				if err := server.WriteRows(2, []binlogtest.Column{binlogtest.LongLong, binlogtest.LongLong, binlogtest.LongLong}, []interface{}{7, 60, 0}); err != nil {
+					return err
+				}
+				server.XID(100)
+				return server.WriteRows(1, kineColumns, []interface{}{3, "/a", 0, 1, 1, 2, 0, nil, "v2", nil, 2, 7})
+			},
+			fed: []logstructured.Row{
+				{ID: 3, Name: "/a", Deleted: true, CreateRevision: 1, PrevRevision: 2, OldValue: []byte("v2"), Version: 2, OldLease: 7},
+			},
+		},
+		{
+			name: "batch",
+			write: func() error {
+				err := server.WriteRows(1, kineColumns,
+					[]interface{}{4, "/b", 1, 0, 0, 3, 0, "b", nil, nil, 1, 0},
+					[]interface{}{5, "/c", 1, 0, 0, 3, 0, "c", nil, nil, 1, 0},
+				)
+				server.UpdateRows(1)
+				return err
+			},
+			notified: 5,
+		},
+		{
+			name: "older schema",
+			write: func() error {
+				return server.WriteRows(3, kineColumns[:9], []interface{}{6, "/b", 0, 0, 4, 5, 3, "b2", "b"})
+			},
+			fed: []logstructured.Row{
+				{ID: 6, Name: "/b", CreateRevision: 4, PrevRevision: 5, Lease: 3, Value: []byte("b2"), OldValue: []byte("b"), Version: 1, OldLease: 3},
+			},
+		},
+	} {
+		if err := tt.write(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		server.XID(uint64(i))
+
+		select {
+		case rows := <-log.fed:
+			if !reflect.DeepEqual(rows, tt.fed) {
+				t.Fatalf("%s: fed %+v, expected %+v", tt.name, rows, tt.fed)
+			}
+		case revision := <-log.notified:
+			if tt.fed != nil || revision != tt.notified {
+				t.Fatalf("%s: notified of revision %d, expected rows %+v or revision %d", tt.name, revision, tt.fed, tt.notified)
+			}
+		case err := <-done:
+			t.Fatalf("%s: stopped following: %v", tt.name, err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: timed out", tt.name)
+		}
+	}
+
+	cancel()
+	<-done
+	if end := server.Position(); f.checkpoint.position != end || f.checkpoint.revision != 6 {
+		t.Fatalf("checkpoint is at %s revision %d, expected %s revision 6", f.checkpoint.position, f.checkpoint.revision, end)
+	}
+}
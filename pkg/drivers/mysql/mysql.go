@@ -4,13 +4,17 @@ import (
 	"context"
 	cryptotls "crypto/tls"
 	"database/sql"
+	"fmt"
+	"strconv"
 
 	"github.com/go-sql-driver/mysql"
+	"github.com/pkg/errors"
 	"github.com/rancher/kine/pkg/drivers/generic"
 	"github.com/rancher/kine/pkg/logstructured"
 	"github.com/rancher/kine/pkg/logstructured/sqllog"
 	"github.com/rancher/kine/pkg/server"
 	"github.com/rancher/kine/pkg/tls"
+	"github.com/sirupsen/logrus"
 )
 
 const (
@@ -23,7 +27,7 @@ var (
 		`create table if not exists kine
 			(
 				id INTEGER AUTO_INCREMENT,
-				name VARCHAR(630),
+				name VARBINARY(630),
 				created INTEGER,
 				deleted INTEGER,
 				create_revision INTEGER,
@@ -31,15 +35,109 @@ var (
 				lease INTEGER,
 				value MEDIUMBLOB,
 				old_value MEDIUMBLOB,
+				batch_revision INTEGER,
+				version INTEGER,
+				old_lease INTEGER,
 				PRIMARY KEY (id)
 			);`,
+		`create table if not exists kine_lease
+			(
+				id BIGINT,
+				ttl BIGINT,
+				expires BIGINT,
+				PRIMARY KEY (id)
+			);`,
+		`create table if not exists kine_member
+			(
+				id BIGINT,
+				name VARCHAR(255),
+				client_urls TEXT,
+				heartbeat BIGINT,
+				PRIMARY KEY (id)
+			);`,
+		`create table if not exists kine_cluster
+			(
+				id BIGINT,
+				PRIMARY KEY (id)
+			);`,
+		`create table if not exists kine_alarm
+			(
+				member_id BIGINT,
+				alarm INTEGER,
+				PRIMARY KEY (member_id, alarm)
+			);`,
 	}
 	nameIdx     = "create index kine_name_index on kine (name)"
 	revisionIdx = "create unique index kine_name_prev_revision_uindex on kine (name, prev_revision)"
+	leaseIdx    = "create index kine_lease_index on kine (lease)"
+	expiresIdx  = "create index kine_lease_expires_index on kine_lease (expires)"
+	batchIdx    = "create index kine_batch_revision_index on kine (batch_revision)"
 	createDB    = "create database if not exists "
+
+	// Tables created by older releases lack the columns added since.
+	addedColumns = []string{"batch_revision", "version", "old_lease"}
+	columnSQL    = `
+		SELECT COUNT(*)
+		FROM information_schema.COLUMNS
+		WHERE
+			TABLE_SCHEMA = DATABASE() AND
+			TABLE_NAME = 'kine' AND
+			COLUMN_NAME = ?`
+	addColumnSQL = "alter table kine add column %s INTEGER"
+
+	// Keys are ranged over byte by byte, which needs a binary column. Tables
+	// created by older releases store the name as text.
+	nameTypeSQL = `
+		SELECT DATA_TYPE
+		FROM information_schema.COLUMNS
+		WHERE
+			TABLE_SCHEMA = DATABASE() AND
+			TABLE_NAME = 'kine' AND
+			COLUMN_NAME = 'name'`
+	alterNameTypeSQL = "alter table kine modify name VARBINARY(630)"
+
+	// the tables share the database with others, only their size counts
+	dbSizeSQL = `
+		SELECT SUM(DATA_LENGTH + INDEX_LENGTH)
+		FROM information_schema.TABLES
+		WHERE
+			TABLE_SCHEMA = DATABASE() AND
+			TABLE_NAME IN ('kine', 'kine_lease')`
+	// OPTIMIZE TABLE rebuilds the tables without the rows freed by compaction
+	defragmentSQL = []string{"optimize table kine, kine_lease"}
+
+	// A locking read sees the latest committed row rather than the snapshot
+	// of the transaction, and locks the index range of the name, so that no
+	// other transaction writes the key until this one ends, even if the key
+	// has no rows yet.
+	keyRevisionSQL = `
+		SELECT COALESCE(kv.batch_revision, kv.id)
+		FROM kine kv
+		WHERE kv.name = ?
+		ORDER BY kv.id DESC
+		LIMIT 1
+		FOR UPDATE`
+
+	// Older MySQL releases run an IN subquery of a DELETE once per row, a
+	// join reads the superseded rows once.
+	compactSupersededSQL = `
+		DELETE kv FROM kine kv
+		INNER JOIN (
+			SELECT ks.id
+			FROM kine kp
+			JOIN kine ks ON
+				ks.name = kp.name AND
+				COALESCE(ks.batch_revision, ks.id) = kp.prev_revision
+			WHERE
+				kp.name != 'compact_rev_key' AND
+				kp.created = 0 AND
+				kp.prev_revision != 0 AND
+				((kp.batch_revision IS NULL AND kp.id > ? AND kp.id <= ?) OR
+				(kp.batch_revision > ? AND kp.batch_revision <= ?))
+		) kd ON kv.id = kd.id`
 )
 
-func New(ctx context.Context, dataSourceName string, tlsInfo tls.Config) (server.Backend, error) {
+func New(ctx context.Context, dataSourceName string, tlsInfo tls.Config, compact logstructured.CompactConfig) (server.Backend, error) {
 	tlsConfig, err := tlsInfo.ClientConfig()
 	if err != nil {
 		return nil, err
@@ -49,7 +147,7 @@ func New(ctx context.Context, dataSourceName string, tlsInfo tls.Config) (server
 		tlsConfig.MinVersion = cryptotls.VersionTLS11
 	}
 
-	parsedDSN, err := prepareDSN(dataSourceName, tlsConfig)
+	parsedDSN, followBinlog, err := prepareDSN(dataSourceName, tlsConfig)
 	if err != nil {
 		return nil, err
 	}
@@ -63,9 +161,21 @@ func New(ctx context.Context, dataSourceName string, tlsInfo tls.Config) (server
 		return nil, err
 	}
 	dialect.LastInsertID = true
+	dialect.CompactSupersededSQL = compactSupersededSQL
+	dialect.KeyRevisionSQL = keyRevisionSQL
+	dialect.DbSizeSQL = dbSizeSQL
+	dialect.DefragmentSQL = defragmentSQL
 	dialect.TranslateErr = func(err error) error {
-		if err, ok := err.(*mysql.MySQLError); ok && err.Number == 1062 {
-			return server.ErrKeyExists
+		if err, ok := err.(*mysql.MySQLError); ok {
+			switch err.Number {
+			// transactions that lock the same missing keys deadlock
+			// when they insert them, one of them conflicts
+			case 1062, 1213:
+				return server.ErrKeyExists
+			// the table or the disk is full
+			case 1114, 1021:
+				return server.ErrNoSpace
+			}
 		}
 		return err
 	}
@@ -74,7 +184,22 @@ func New(ctx context.Context, dataSourceName string, tlsInfo tls.Config) (server
 	}
 
 	dialect.Migrate(context.Background())
-	return logstructured.New(sqllog.New(dialect)), nil
+
+	log := sqllog.New(dialect, compact)
+	if followBinlog {
+		config, err := mysql.ParseDSN(parsedDSN)
+		if err != nil {
+			return nil, err
+		}
+		feed, err := newBinlogFeed(ctx, dialect.DB, config, tlsConfig, log)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to follow the binlog")
+		}
+		log.SetPollInterval(binlogPollInterval)
+		go feed.run(ctx)
+	}
+
+	return logstructured.New(log), nil
 }
 
 func setup(db *sql.DB) error {
@@ -84,10 +209,27 @@ func setup(db *sql.DB) error {
 			return err
 		}
 	}
+	for _, column := range addedColumns {
+		var n int
+		if err := db.QueryRow(columnSQL, column).Scan(&n); err != nil {
+			return err
+		}
+		if n > 0 {
+			continue
+		}
+		logrus.Infof("Adding kine.%s", column)
+		if _, err := db.Exec(fmt.Sprintf(addColumnSQL, column)); err != nil {
+			return err
+		}
+	}
+
 	// check if duplicate indexes
 	indexes := []string{
 		nameIdx,
-		revisionIdx}
+		revisionIdx,
+		leaseIdx,
+		expiresIdx,
+		batchIdx}
 
 	for _, idx := range indexes {
 		err := createIndex(db, idx)
@@ -95,6 +237,17 @@ func setup(db *sql.DB) error {
 			return err
 		}
 	}
+
+	var nameType string
+	if err := db.QueryRow(nameTypeSQL).Scan(&nameType); err != nil {
+		return err
+	}
+	if nameType != "varbinary" {
+		logrus.Infof("Changing the type of kine.name to VARBINARY")
+		if _, err := db.Exec(alterNameTypeSQL); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -127,7 +280,9 @@ func createDBIfNotExist(dataSourceName string) error {
 	return nil
 }
 
-func prepareDSN(dataSourceName string, tlsConfig *cryptotls.Config) (string, error) {
+// prepareDSN also reports whether the DSN asks to follow the binlog, the
+// parameter is kine's and is left out of the DSN passed to the driver
+func prepareDSN(dataSourceName string, tlsConfig *cryptotls.Config) (string, bool, error) {
 	if len(dataSourceName) == 0 {
 		dataSourceName = defaultUnixDSN
 		if tlsConfig != nil {
@@ -136,12 +291,22 @@ func prepareDSN(dataSourceName string, tlsConfig *cryptotls.Config) (string, err
 	}
 	config, err := mysql.ParseDSN(dataSourceName)
 	if err != nil {
-		return "", err
+		return "", false, err
 	}
+
+	var followBinlog bool
+	if value, ok := config.Params[binlogParam]; ok {
+		followBinlog, err = strconv.ParseBool(value)
+		if err != nil {
+			return "", false, errors.Wrapf(err, "invalid %s parameter", binlogParam)
+		}
+		delete(config.Params, binlogParam)
+	}
+
 	// setting up tlsConfig
 	if tlsConfig != nil {
 		if err := mysql.RegisterTLSConfig("kine", tlsConfig); err != nil {
-			return "", err
+			return "", false, err
 		}
 		config.TLSConfig = "kine"
 	}
@@ -152,7 +317,7 @@ func prepareDSN(dataSourceName string, tlsConfig *cryptotls.Config) (string, err
 	config.DBName = dbName
 	parsedDSN := config.FormatDSN()
 
-	return parsedDSN, nil
+	return parsedDSN, followBinlog, nil
 }
 
 func createIndex(db *sql.DB, indexStmt string) error {
@@ -0,0 +1,107 @@
+package pgsql
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/rancher/kine/pkg/logstructured/sqllog"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	notifyChannel = "kine"
+
+	// notifyPollInterval is the time between polls for changes while
+	// notifications are delivered, which only catches up on missed ones
+	notifyPollInterval = 5 * time.Second
+	listenerPing       = 90 * time.Second
+)
+
+var (
+	// every row inserted into kine, from any kine instance, is announced
+	// with its id once the transaction commits
+	notifySchema = []string{
+		`CREATE OR REPLACE FUNCTION kine_notify() RETURNS trigger AS $$
+			BEGIN
+				PERFORM pg_notify('` + notifyChannel + `', NEW.id::text);
+				RETURN NEW;
+			END;
+			$$ LANGUAGE plpgsql`,
+		`DO $$
+			BEGIN
+				IF NOT EXISTS (
+					SELECT 1 FROM pg_trigger
+					WHERE tgname = 'kine_notify' AND tgrelid = 'kine'::regclass
+				) THEN
+					CREATE TRIGGER kine_notify AFTER INSERT ON kine
+					FOR EACH ROW EXECUTE PROCEDURE kine_notify();
+				END IF;
+			END
+			$$`,
+	}
+)
+
+func setupNotify(db *sql.DB) error {
+	for _, stmt := range notifySchema {
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listen passes the revisions announced by the trigger to the log until the
+// context is done. The log only polls less often while the listener is
+// connected. The listener reconnects by itself, notifications sent in the
+// meantime are picked up by the regular polls of the log.
+func listen(ctx context.Context, dataSourceName string, log *sqllog.SQLLog) {
+	defer log.SetPollInterval(0)
+
+	listener := pq.NewListener(dataSourceName, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		switch event {
+		case pq.ListenerEventConnected:
+			log.SetPollInterval(notifyPollInterval)
+		case pq.ListenerEventDisconnected:
+			log.SetPollInterval(0)
+			logrus.Warnf("Lost the connection listening for changes, polling for them until it is back: %v", err)
+		case pq.ListenerEventReconnected:
+			log.SetPollInterval(notifyPollInterval)
+			logrus.Infof("Listening for changes again")
+		case pq.ListenerEventConnectionAttemptFailed:
+			logrus.Debugf("Failed to connect to listen for changes: %v", err)
+		}
+	})
+	defer listener.Close()
+
+	if err := listener.Listen(notifyChannel); err != nil {
+		logrus.Errorf("Failed to listen for changes, polling for them: %v", err)
+		return
+	}
+
+	ping := time.NewTicker(listenerPing)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case n := <-listener.Notify:
+			// nil after a reconnect
+			if n == nil {
+				continue
+			}
+			revision, err := strconv.ParseInt(n.Extra, 10, 64)
+			if err != nil {
+				logrus.Errorf("Invalid change notification %q: %v", n.Extra, err)
+				continue
+			}
+			log.Notify(revision)
+		case <-ping.C:
+			// detects a connection that went away silently
+			go listener.Ping()
+		}
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/rancher/kine/pkg/logstructured/sqllog"
 	"github.com/rancher/kine/pkg/server"
 	"github.com/rancher/kine/pkg/tls"
+	"github.com/sirupsen/logrus"
 )
 
 const (
@@ -25,22 +26,83 @@ var (
 		`create table if not exists kine
  			(
  				id SERIAL PRIMARY KEY,
-				name VARCHAR(630),
+				name VARCHAR(630) COLLATE "C",
 				created INTEGER,
 				deleted INTEGER,
  				create_revision INTEGER,
  				prev_revision INTEGER,
  				lease INTEGER,
  				value bytea,
- 				old_value bytea
+ 				old_value bytea,
+				batch_revision INTEGER,
+				version INTEGER,
+				old_lease INTEGER
  			);`,
 		`CREATE INDEX IF NOT EXISTS kine_name_index ON kine (name)`,
 		`CREATE UNIQUE INDEX IF NOT EXISTS kine_name_prev_revision_uindex ON kine (name, prev_revision)`,
+		`CREATE INDEX IF NOT EXISTS kine_lease_index ON kine (lease)`,
+		// tables created by older releases lack the columns added since
+		`ALTER TABLE kine ADD COLUMN IF NOT EXISTS batch_revision INTEGER`,
+		`ALTER TABLE kine ADD COLUMN IF NOT EXISTS version INTEGER`,
+		`ALTER TABLE kine ADD COLUMN IF NOT EXISTS old_lease INTEGER`,
+		`CREATE INDEX IF NOT EXISTS kine_batch_revision_index ON kine (batch_revision)`,
+		`create table if not exists kine_lease
+			(
+				id BIGINT PRIMARY KEY,
+				ttl BIGINT,
+				expires BIGINT
+			);`,
+		`CREATE INDEX IF NOT EXISTS kine_lease_expires_index ON kine_lease (expires)`,
+		`create table if not exists kine_member
+			(
+				id BIGINT PRIMARY KEY,
+				name VARCHAR(255),
+				client_urls TEXT,
+				heartbeat BIGINT
+			);`,
+		`create table if not exists kine_cluster
+			(
+				id BIGINT PRIMARY KEY
+			);`,
+		`create table if not exists kine_alarm
+			(
+				member_id BIGINT,
+				alarm INTEGER,
+				PRIMARY KEY (member_id, alarm)
+			);`,
 	}
 	createDB = "create database "
+
+	// Keys are ranged over byte by byte, which needs the C collation. Tables
+	// created by older releases use the collation of the database.
+	nameCollationSQL = `
+		SELECT collation_name
+		FROM information_schema.columns
+		WHERE
+			table_schema = current_schema() AND
+			table_name = 'kine' AND
+			column_name = 'name'`
+	alterNameCollationSQL = `ALTER TABLE kine ALTER COLUMN name TYPE VARCHAR(630) COLLATE "C"`
+	// the serial sequence of the ids doesn't move when a row is inserted
+	// with its id
+	resetSequenceSQL = `SELECT setval(pg_get_serial_sequence('kine', 'id'), (SELECT MAX(id) FROM kine))`
+
+	// Reading the latest revision of a key locks nothing, a transaction that
+	// checks keys holds off every other write to kine until it ends. Reads
+	// go on, and the checks see the rows committed before the lock.
+	lockKeysSQL = `LOCK TABLE kine IN SHARE ROW EXCLUSIVE MODE`
+
+	// the tables share the database with others, only their size counts
+	dbSizeSQL = `SELECT pg_total_relation_size('kine') + pg_total_relation_size('kine_lease')`
+	// VACUUM FULL rewrites the tables without the rows freed by compaction,
+	// holding an exclusive lock on each while it does
+	defragmentSQL = []string{
+		`VACUUM FULL kine`,
+		`VACUUM FULL kine_lease`,
+	}
 )
 
-func New(ctx context.Context, dataSourceName string, tlsInfo tls.Config) (server.Backend, error) {
+func New(ctx context.Context, dataSourceName string, tlsInfo tls.Config, compact logstructured.CompactConfig) (server.Backend, error) {
 	parsedDSN, err := prepareDSN(dataSourceName, tlsInfo)
 	if err != nil {
 		return nil, err
@@ -54,9 +116,18 @@ func New(ctx context.Context, dataSourceName string, tlsInfo tls.Config) (server
 	if err != nil {
 		return nil, err
 	}
+	dialect.ResetSequenceSQL = resetSequenceSQL
+	dialect.LockKeysSQL = lockKeysSQL
+	dialect.DbSizeSQL = dbSizeSQL
+	dialect.DefragmentSQL = defragmentSQL
 	dialect.TranslateErr = func(err error) error {
-		if err, ok := err.(*pq.Error); ok && err.Code == "23505" {
-			return server.ErrKeyExists
+		if err, ok := err.(*pq.Error); ok {
+			switch err.Code {
+			case "23505":
+				return server.ErrKeyExists
+			case "53100":
+				return server.ErrNoSpace
+			}
 		}
 		return err
 	}
@@ -66,7 +137,15 @@ func New(ctx context.Context, dataSourceName string, tlsInfo tls.Config) (server
 	}
 
 	dialect.Migrate(context.Background())
-	return logstructured.New(sqllog.New(dialect)), nil
+
+	log := sqllog.New(dialect, compact)
+	if err := setupNotify(dialect.DB); err != nil {
+		logrus.Warnf("Failed to set up change notifications, polling for changes: %v", err)
+	} else {
+		go listen(ctx, parsedDSN, log)
+	}
+
+	return logstructured.New(log), nil
 }
 
 func setup(db *sql.DB) error {
@@ -77,6 +156,17 @@ func setup(db *sql.DB) error {
 		}
 	}
 
+	var collation sql.NullString
+	if err := db.QueryRow(nameCollationSQL).Scan(&collation); err != nil {
+		return err
+	}
+	if collation.String != "C" {
+		logrus.Infof("Changing the collation of kine.name to C")
+		if _, err := db.Exec(alterNameCollationSQL); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
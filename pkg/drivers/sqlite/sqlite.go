@@ -1,23 +1,18 @@
-// +build cgo
-
 package sqlite
 
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"os"
 	"time"
 
-	"github.com/mattn/go-sqlite3"
 	"github.com/pkg/errors"
 	"github.com/rancher/kine/pkg/drivers/generic"
 	"github.com/rancher/kine/pkg/logstructured"
 	"github.com/rancher/kine/pkg/logstructured/sqllog"
 	"github.com/rancher/kine/pkg/server"
 	"github.com/sirupsen/logrus"
-
-	// sqlite db driver
-	_ "github.com/mattn/go-sqlite3"
 )
 
 var (
@@ -32,24 +27,62 @@ var (
 				prev_revision INTEGER,
 				lease INTEGER,
 				value BLOB,
-				old_value BLOB
+				old_value BLOB,
+				batch_revision INTEGER,
+				version INTEGER,
+				old_lease INTEGER
 			)`,
 		`CREATE INDEX IF NOT EXISTS kine_name_index ON kine (name)`,
 		`CREATE UNIQUE INDEX IF NOT EXISTS kine_name_prev_revision_uindex ON kine (name, prev_revision)`,
+		`CREATE INDEX IF NOT EXISTS kine_lease_index ON kine (lease)`,
+		`CREATE TABLE IF NOT EXISTS kine_lease
+			(
+				id INTEGER primary key,
+				ttl INTEGER,
+				expires INTEGER
+			)`,
+		`CREATE INDEX IF NOT EXISTS kine_lease_expires_index ON kine_lease (expires)`,
+		`CREATE TABLE IF NOT EXISTS kine_member
+			(
+				id INTEGER primary key,
+				name TEXT,
+				client_urls TEXT,
+				heartbeat INTEGER
+			)`,
+		`CREATE TABLE IF NOT EXISTS kine_cluster
+			(
+				id INTEGER primary key
+			)`,
+		`CREATE TABLE IF NOT EXISTS kine_alarm
+			(
+				member_id INTEGER,
+				alarm INTEGER,
+				PRIMARY KEY (member_id, alarm)
+			)`,
 	}
+
+	// Tables created by older releases lack the columns added since.
+	addedColumns          = []string{"batch_revision", "version", "old_lease"}
+	batchRevisionIndexSQL = `CREATE INDEX IF NOT EXISTS kine_batch_revision_index ON kine (batch_revision)`
+
+	dbSizeSQL = `SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()`
+	// VACUUM rebuilds the file without the pages freed by compaction
+	defragmentSQL = []string{`VACUUM`}
 )
 
-func New(ctx context.Context, dataSourceName string) (server.Backend, error) {
-	backend, _, err := NewVariant(ctx, "sqlite3", dataSourceName)
+func New(ctx context.Context, dataSourceName string, compact logstructured.CompactConfig) (server.Backend, error) {
+	backend, _, err := NewVariant(ctx, driverName, withBusyTimeout(dataSourceName), compact)
 	return backend, err
 }
 
-func NewVariant(ctx context.Context, driverName, dataSourceName string) (server.Backend, *generic.Generic, error) {
+// NewVariant opens the backend on a database/sql driver that speaks SQLite.
+// Binaries built with CGO use the SQLite library, others a pure Go port of it.
+func NewVariant(ctx context.Context, driverName, dataSourceName string, compact logstructured.CompactConfig) (server.Backend, *generic.Generic, error) {
 	if dataSourceName == "" {
 		if err := os.MkdirAll("./db", 0700); err != nil {
 			return nil, nil, err
 		}
-		dataSourceName = "./db/state.db?_journal=WAL&cache=shared"
+		dataSourceName = defaultDataSourceName
 	}
 
 	dialect, err := generic.Open(ctx, driverName, dataSourceName, "?", false)
@@ -57,10 +90,18 @@ func NewVariant(ctx context.Context, driverName, dataSourceName string) (server.
 		return nil, nil, err
 	}
 	dialect.LastInsertID = true
+	// SQLite allows a single writer, serialize transactions in process rather
+	// than failing them when they upgrade to a write lock
+	dialect.LockWrites = true
+	dialect.DbSizeSQL = dbSizeSQL
+	dialect.DefragmentSQL = defragmentSQL
 	dialect.TranslateErr = func(err error) error {
-		if err, ok := err.(sqlite3.Error); ok && err.ExtendedCode == sqlite3.ErrConstraintUnique {
+		if isConstraintUnique(err) {
 			return server.ErrKeyExists
 		}
+		if isFull(err) {
+			return server.ErrNoSpace
+		}
 		return err
 	}
 
@@ -87,7 +128,7 @@ func NewVariant(ctx context.Context, driverName, dataSourceName string) (server.
 	//}
 
 	dialect.Migrate(context.Background())
-	return logstructured.New(sqllog.New(dialect)), dialect, nil
+	return logstructured.New(sqllog.New(dialect, compact)), dialect, nil
 }
 
 func setup(db *sql.DB) error {
@@ -98,5 +139,17 @@ func setup(db *sql.DB) error {
 		}
 	}
 
-	return nil
+	for _, column := range addedColumns {
+		rows, err := db.Query(fmt.Sprintf(`SELECT %s FROM kine LIMIT 1`, column))
+		if err == nil {
+			rows.Close()
+			continue
+		}
+		logrus.Infof("Adding kine.%s", column)
+		if _, err := db.Exec(fmt.Sprintf(`ALTER TABLE kine ADD COLUMN %s INTEGER`, column)); err != nil {
+			return err
+		}
+	}
+	_, err := db.Exec(batchRevisionIndexSQL)
+	return err
 }
@@ -0,0 +1,38 @@
+//go:build cgo
+// +build cgo
+
+package sqlite
+
+import (
+	"github.com/mattn/go-sqlite3"
+)
+
+// driverName is the database/sql driver New opens
+const driverName = "sqlite3"
+
+// defaultDataSourceName is the database New opens if none is given
+const defaultDataSourceName = "./db/state.db?_journal=WAL&cache=shared"
+
+// withBusyTimeout returns the data source name as is, the driver waits five
+// seconds for a locked database unless _busy_timeout says otherwise
+func withBusyTimeout(dataSourceName string) string {
+	return dataSourceName
+}
+
+// isConstraintUnique reports whether the error is a violation of a unique
+// index or of a primary key, such as the id of a lease or of a row inserted
+// at its revision
+func isConstraintUnique(err error) bool {
+	if err, ok := err.(sqlite3.Error); ok {
+		return err.ExtendedCode == sqlite3.ErrConstraintUnique || err.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+	}
+	return false
+}
+
+// isFull reports whether the error is a write that found the disk full
+func isFull(err error) bool {
+	if err, ok := err.(sqlite3.Error); ok {
+		return err.Code == sqlite3.ErrFull
+	}
+	return false
+}
@@ -1,26 +1,53 @@
+//go:build !cgo
 // +build !cgo
 
 package sqlite
 
 import (
-	"context"
-	"database/sql"
-	"errors"
+	"strings"
 
-	"github.com/rancher/kine/pkg/drivers/generic"
-	"github.com/rancher/kine/pkg/server"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
 )
 
-var errNoCgo = errors.New("this binary is built without CGO, sqlite is disabled")
+// driverName is the database/sql driver New opens, without CGO the pure Go
+// port of SQLite
+const driverName = "sqlite"
 
-func New(ctx context.Context, dataSourceName string) (server.Backend, error) {
-	return nil, errNoCgo
+// defaultDataSourceName is the database New opens if none is given. The port
+// only applies the _pragma parameters of the data source name.
+const defaultDataSourceName = "./db/state.db?_pragma=journal_mode(WAL)&" + busyTimeout
+
+// busyTimeout is how long a connection waits for a locked database. The CGO
+// driver waits as long by default, the port fails right away.
+const busyTimeout = "_pragma=busy_timeout(5000)"
+
+// withBusyTimeout adds the busy timeout to the data source name unless it
+// sets one
+func withBusyTimeout(dataSourceName string) string {
+	if dataSourceName == "" || strings.Contains(dataSourceName, "busy_timeout") {
+		return dataSourceName
+	}
+	if strings.Contains(dataSourceName, "?") {
+		return dataSourceName + "&" + busyTimeout
+	}
+	return dataSourceName + "?" + busyTimeout
 }
 
-func NewVariant(driverName, dataSourceName string) (server.Backend, *generic.Generic, error) {
-	return nil, nil, errNoCgo
+// isConstraintUnique reports whether the error is a violation of a unique
+// index or of a primary key, such as the id of a lease or of a row inserted
+// at its revision
+func isConstraintUnique(err error) bool {
+	if err, ok := err.(*sqlite.Error); ok {
+		return err.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE || err.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY
+	}
+	return false
 }
 
-func setup(db *sql.DB) error {
-	return errNoCgo
+// isFull reports whether the error is a write that found the disk full
+func isFull(err error) bool {
+	if err, ok := err.(*sqlite.Error); ok {
+		return err.Code()&0xff == sqlite3.SQLITE_FULL
+	}
+	return false
 }
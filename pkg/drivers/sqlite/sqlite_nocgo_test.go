@@ -0,0 +1,21 @@
+//go:build !cgo
+// +build !cgo
+
+package sqlite
+
+import "testing"
+
+func TestWithBusyTimeout(t *testing.T) {
+	for _, tt := range []struct {
+		dataSourceName, expected string
+	}{
+		{"", ""},
+		{"state.db", "state.db?_pragma=busy_timeout(5000)"},
+		{"state.db?_pragma=journal_mode(WAL)", "state.db?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)"},
+		{"state.db?_pragma=busy_timeout(100)", "state.db?_pragma=busy_timeout(100)"},
+	} {
+		if dataSourceName := withBusyTimeout(tt.dataSourceName); dataSourceName != tt.expected {
+			t.Errorf("%q got the data source name %q, expected %q", tt.dataSourceName, dataSourceName, tt.expected)
+		}
+	}
+}
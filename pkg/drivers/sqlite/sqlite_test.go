@@ -0,0 +1,106 @@
+//go:build cgo
+// +build cgo
+
+package sqlite
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/rancher/kine/pkg/drivers/generic"
+	"github.com/rancher/kine/pkg/logstructured"
+)
+
+func newDialect(t *testing.T) (*generic.Generic, func()) {
+	dir, err := ioutil.TempDir("", "kine-sqlite-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	_, dialect, err := NewVariant(ctx, "sqlite3", filepath.Join(dir, "state.db?_journal=WAL&cache=shared"), logstructured.CompactConfig{Disable: true})
+	if err != nil {
+		cancel()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return dialect, func() {
+		dialect.DB.Close()
+		cancel()
+		os.RemoveAll(dir)
+	}
+}
+
+func ids(t *testing.T, d *generic.Generic) []int64 {
+	rows, err := d.DB.Query("SELECT id FROM kine WHERE name != 'compact_rev_key' ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestCompactSQL(t *testing.T) {
+	d, done := newDialect(t)
+	defer done()
+	ctx := context.Background()
+
+	for _, row := range []struct {
+		key            string
+		create, delete bool
+		prevRevision   int64
+		version        int64
+	}{
+		{key: "/a", create: true, version: 1},      // 1
+		{key: "/a", prevRevision: 1, version: 2},   // 2
+		{key: "/b", create: true, version: 1},      // 3
+		{key: "/b", delete: true, prevRevision: 3}, // 4
+		{key: "/a", prevRevision: 2, version: 3},   // 5
+		{key: "/c", create: true, version: 1},      // 6
+	} {
+		if _, err := d.Insert(ctx, row.key, row.create, row.delete, 0, row.prevRevision, 0, []byte("v"), nil, row.version, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		start, end int64
+		deleted    int64
+		ids        []int64
+	}{
+		// the rows superseded up to 4 and the delete at 4 are removed
+		{start: 0, end: 4, deleted: 3, ids: []int64{2, 5, 6}},
+		{start: 4, end: 5, deleted: 1, ids: []int64{5, 6}},
+		// the rows at the end of the range are kept
+		{start: 5, end: 6, deleted: 0, ids: []int64{5, 6}},
+	} {
+		tx, err := d.BeginTx(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deleted, err := tx.Compact(ctx, tt.start, tt.end)
+		if err != nil {
+			tx.Rollback()
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		if ids := ids(t, d); deleted != tt.deleted || !reflect.DeepEqual(ids, tt.ids) {
+			t.Fatalf("compacting %d to %d deleted %d rows leaving %v, expected %d leaving %v", tt.start, tt.end, deleted, ids, tt.deleted, tt.ids)
+		}
+	}
+}
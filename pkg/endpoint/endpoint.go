@@ -3,19 +3,30 @@ package endpoint
 import (
 	"context"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rancher/kine/pkg/drivers/bolt"
 	"github.com/rancher/kine/pkg/drivers/dqlite"
+	"github.com/rancher/kine/pkg/drivers/memory"
 	"github.com/rancher/kine/pkg/drivers/mysql"
 	"github.com/rancher/kine/pkg/drivers/pgsql"
 	"github.com/rancher/kine/pkg/drivers/sqlite"
+	"github.com/rancher/kine/pkg/logstructured"
+	"github.com/rancher/kine/pkg/metrics"
 	"github.com/rancher/kine/pkg/server"
+	"github.com/rancher/kine/pkg/snapshot"
 	"github.com/rancher/kine/pkg/tls"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 const (
@@ -25,12 +36,38 @@ const (
 	ETCDBackend     = "etcd3"
 	MySQLBackend    = "mysql"
 	PostgresBackend = "postgres"
+	BoltBackend     = "bolt"
+	MemoryBackend   = "memory"
 )
 
 type Config struct {
 	GRPCServer *grpc.Server
 	Listener   string
-	Endpoint   string
+	// AdvertiseAddress is the client URL the instance is listed under by the
+	// cluster service. If it is empty the URL is that of the listener, with
+	// the host name in place of an unspecified address.
+	AdvertiseAddress string
+	Endpoint         string
+	Compact          logstructured.CompactConfig
+	// NotifyInterval is the interval between progress notifications of
+	// watches that request them, ten minutes if zero
+	NotifyInterval time.Duration
+	// MetricsListener is the address Prometheus metrics are served on at
+	// /metrics, metrics are not served if it is empty
+	MetricsListener string
+	// ServerTLSConfig enables TLS on the listener if it has a certificate
+	// and key. Its CA verifies client certificates, which are required if
+	// ClientCertAuth is set. The embedded tls.Config only applies to the
+	// database connection.
+	ServerTLSConfig tls.Config
+	ClientCertAuth  bool
+	// ClientTLSConfig is the certificate and key that the returned
+	// ETCDConfig presents to the listener, and the CA that verifies the
+	// listener, that of ServerTLSConfig if it is empty. Without a
+	// certificate none is presented, unless ServerCertAsClientCert is set
+	// and the server certificate and key are presented instead.
+	ClientTLSConfig        tls.Config
+	ServerCertAsClientCert bool
 
 	tls.Config
 }
@@ -65,15 +102,35 @@ func Listen(ctx context.Context, config Config) (ETCDConfig, error) {
 		listen = KineSocket
 	}
 
-	b := server.New(backend)
-	grpcServer := grpcServer(config)
+	b := server.New(backend, config.NotifyInterval, func(ctx context.Context, w io.Writer) (int64, error) {
+		return snapshot.ExportEtcd(ctx, backend, w, 0)
+	})
+	grpcServer, err := grpcServer(config)
+	if err != nil {
+		return ETCDConfig{}, errors.Wrap(err, "creating GRPC server")
+	}
 	b.Register(grpcServer)
 
+	clientURL, err := advertiseURL(config, listen)
+	if err != nil {
+		return ETCDConfig{}, err
+	}
+	name, err := os.Hostname()
+	if err != nil {
+		return ETCDConfig{}, err
+	}
+
 	listener, err := createListener(listen)
 	if err != nil {
 		return ETCDConfig{}, err
 	}
 
+	// the instance is only listed as a member once it is listening
+	if err := b.Join(ctx, name, []string{clientURL}); err != nil {
+		listener.Close()
+		return ETCDConfig{}, errors.Wrap(err, "joining kine cluster")
+	}
+
 	go func() {
 		if err := grpcServer.Serve(listener); err != nil {
 			logrus.Errorf("Kine server shutdown: %v", err)
@@ -83,13 +140,108 @@ func Listen(ctx context.Context, config Config) (ETCDConfig, error) {
 		listener.Close()
 	}()
 
+	if config.MetricsListener != "" {
+		if err := serveMetrics(ctx, config.MetricsListener); err != nil {
+			return ETCDConfig{}, errors.Wrap(err, "starting metrics listener")
+		}
+	}
+
+	if !serverTLS(config) {
+		return ETCDConfig{
+			LeaderElect: leaderelect,
+			Endpoints:   []string{listen},
+			TLSConfig:   tls.Config{},
+		}, nil
+	}
+
 	return ETCDConfig{
 		LeaderElect: leaderelect,
-		Endpoints:   []string{listen},
-		TLSConfig:   tls.Config{},
+		Endpoints:   []string{secureEndpoint(listen)},
+		TLSConfig:   clientTLS(config),
 	}, nil
 }
 
+// clientTLS returns the TLS config clients of the listener use. The server
+// certificate only doubles as the client certificate if that is asked for, it
+// then has to be valid for client authentication if client certificates are
+// verified.
+func clientTLS(config Config) tls.Config {
+	client := config.ClientTLSConfig
+	if client.CAFile == "" {
+		client.CAFile = config.ServerTLSConfig.CAFile
+	}
+	if client.CertFile == "" && client.KeyFile == "" && config.ServerCertAsClientCert {
+		client.CertFile = config.ServerTLSConfig.CertFile
+		client.KeyFile = config.ServerTLSConfig.KeyFile
+	}
+	return client
+}
+
+// NewBackend returns the backend of the storage endpoint without starting or
+// serving it, for tools that work on the stored keys.
+func NewBackend(ctx context.Context, config Config) (server.Backend, error) {
+	driver, dsn := ParseStorageEndpoint(config.Endpoint)
+	if driver == ETCDBackend {
+		return nil, fmt.Errorf("etcd endpoints have no kine backend")
+	}
+
+	_, backend, err := getKineStorageBackend(ctx, driver, dsn, config)
+	if err != nil {
+		return nil, errors.Wrap(err, "building kine")
+	}
+	return backend, nil
+}
+
+func serverTLS(config Config) bool {
+	return config.ServerTLSConfig.CertFile != "" || config.ServerTLSConfig.KeyFile != ""
+}
+
+// secureEndpoint returns the listen address in a form etcd clients connect
+// to over TLS
+func secureEndpoint(listen string) string {
+	network, address := networkAndAddress(listen)
+	if network == "unix" {
+		return "unixs://" + address
+	}
+	return "https://" + address
+}
+
+// advertiseURL returns the URL that clients on other hosts reach the listener
+// on, unless an address to advertise is configured
+func advertiseURL(config Config, listen string) (string, error) {
+	if config.AdvertiseAddress != "" {
+		return config.AdvertiseAddress, nil
+	}
+
+	scheme := "http"
+	if serverTLS(config) {
+		scheme = "https"
+	}
+
+	network, address := networkAndAddress(listen)
+	if network == "unix" {
+		path, err := filepath.Abs(address)
+		if err != nil {
+			return "", err
+		}
+		if serverTLS(config) {
+			return "unixs://" + path, nil
+		}
+		return "unix://" + path, nil
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", errors.Wrapf(err, "listen address %s", listen)
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		if host, err = os.Hostname(); err != nil {
+			return "", err
+		}
+	}
+	return scheme + "://" + net.JoinHostPort(host, port), nil
+}
+
 func createListener(listen string) (ret net.Listener, rerr error) {
 	network, address := networkAndAddress(listen)
 
@@ -108,11 +260,48 @@ func createListener(listen string) (ret net.Listener, rerr error) {
 	return net.Listen(network, address)
 }
 
-func grpcServer(config Config) *grpc.Server {
+func grpcServer(config Config) (*grpc.Server, error) {
 	if config.GRPCServer != nil {
-		return config.GRPCServer
+		if serverTLS(config) {
+			return nil, fmt.Errorf("server TLS can't be applied to a provided GRPC server")
+		}
+		return config.GRPCServer, nil
 	}
-	return grpc.NewServer()
+
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(metrics.UnaryServerInterceptor),
+		grpc.StreamInterceptor(metrics.StreamServerInterceptor),
+	}
+	if serverTLS(config) {
+		tlsConfig, err := config.ServerTLSConfig.ServerConfig(config.ClientCertAuth)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	return grpc.NewServer(opts...), nil
+}
+
+func serveMetrics(ctx context.Context, listen string) error {
+	listener, err := createListener(listen)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{}))
+	server := &http.Server{Handler: mux}
+
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logrus.Errorf("Kine metrics server shutdown: %v", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	return nil
 }
 
 func getKineStorageBackend(ctx context.Context, driver, dsn string, cfg Config) (bool, server.Backend, error) {
@@ -124,13 +313,19 @@ func getKineStorageBackend(ctx context.Context, driver, dsn string, cfg Config)
 	switch driver {
 	case SQLiteBackend:
 		leaderElect = false
-		backend, err = sqlite.New(ctx, dsn)
+		backend, err = sqlite.New(ctx, dsn, cfg.Compact)
 	case DQLiteBackend:
-		backend, err = dqlite.New(ctx, dsn)
+		backend, err = dqlite.New(ctx, dsn, cfg.Compact)
 	case PostgresBackend:
-		backend, err = pgsql.New(ctx, dsn, cfg.Config)
+		backend, err = pgsql.New(ctx, dsn, cfg.Config, cfg.Compact)
 	case MySQLBackend:
-		backend, err = mysql.New(ctx, dsn, cfg.Config)
+		backend, err = mysql.New(ctx, dsn, cfg.Config, cfg.Compact)
+	case BoltBackend:
+		leaderElect = false
+		backend, err = bolt.New(ctx, dsn, cfg.Compact)
+	case MemoryBackend:
+		leaderElect = false
+		backend, err = memory.New(ctx, cfg.Compact)
 	default:
 		return false, nil, fmt.Errorf("storage backend is not defined")
 	}
@@ -0,0 +1,69 @@
+package endpoint
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kine-endpoint-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	socket := filepath.Join(dir, "metrics.sock")
+	if err := serveMetrics(ctx, "unix://"+socket); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	get := func(path string) (int, string) {
+		resp, err := client.Get("http://kine" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(body)
+	}
+
+	code, body := get("/metrics")
+	if code != http.StatusOK || !strings.Contains(body, "kine_current_revision") || !strings.Contains(body, "go_goroutines") {
+		t.Fatalf("/metrics returned %d with\n%s\nexpected the kine and runtime metrics", code, body)
+	}
+	if code, _ := get("/"); code != http.StatusNotFound {
+		t.Fatalf("/ returned %d, expected %d", code, http.StatusNotFound)
+	}
+
+	// the listener is closed along with the context
+	cancel()
+	for i := 0; ; i++ {
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if i == 100 {
+			t.Fatal("metrics are still served after the context is done")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,287 @@
+package logstructured
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/kine/pkg/metrics"
+	"github.com/rancher/kine/pkg/server"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultCompactInterval  = 5 * time.Minute
+	defaultCompactMinRetain = 1000
+	defaultCompactBatchSize = 1000
+)
+
+// CompactConfig controls the background compaction of the log. Zero values
+// select the defaults, except for MinRetain.
+type CompactConfig struct {
+	// Disable turns off background compaction, clients can still compact
+	// the log themselves.
+	Disable bool
+	// Interval is the time between background compactions.
+	Interval time.Duration
+	// MinRetain is the number of most recent revisions that are never
+	// compacted in the background. Zero retains none of them, a negative
+	// value selects the default.
+	MinRetain int64
+	// Retention keeps the revisions written within this duration as well,
+	// zero keeps revisions regardless of their age. Revisions are not
+	// timestamped, so their age is only known to within one Interval. The
+	// samples of their age are kept in memory and start over when kine
+	// restarts, after which nothing is compacted until it has been running
+	// for Retention.
+	Retention time.Duration
+	// BatchSize is the number of revisions compacted per transaction.
+	BatchSize int64
+}
+
+// WithDefaults returns the config with the zero values, and a negative
+// MinRetain, replaced by defaults.
+func (c CompactConfig) WithDefaults() CompactConfig {
+	if c.Interval <= 0 {
+		c.Interval = defaultCompactInterval
+	}
+	if c.MinRetain < 0 {
+		c.MinRetain = defaultCompactMinRetain
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = defaultCompactBatchSize
+	}
+	return c
+}
+
+// revisionSample is the current revision as seen at a point in time, every
+// revision up to it was written before then
+type revisionSample struct {
+	time     time.Time
+	revision int64
+}
+
+// Loop compacts a log in the background until the context is done. Every
+// Interval it calls compactTo with the revision to compact up to, which keeps
+// MinRetain revisions and, with a Retention, the revisions written within it.
+func (c CompactConfig) Loop(ctx context.Context, currentRevision func(context.Context) (int64, error), compactTo func(context.Context, int64) error) {
+	c = c.WithDefaults()
+	if c.Disable {
+		return
+	}
+
+	t := time.NewTicker(c.Interval)
+	defer t.Stop()
+
+	var samples []revisionSample
+	if rev, err := currentRevision(ctx); err == nil {
+		samples = append(samples, revisionSample{time: time.Now(), revision: rev})
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		currentRev, err := currentRevision(ctx)
+		if err != nil {
+			logrus.Errorf("failed to get current revision: %v", err)
+			continue
+		}
+
+		now := time.Now()
+		samples = append(samples, revisionSample{time: now, revision: currentRev})
+
+		end := currentRev - c.MinRetain
+		if c.Retention > 0 {
+			// the newest sample old enough to compact up to
+			cutoff := now.Add(-c.Retention)
+			i := sort.Search(len(samples), func(i int) bool {
+				return samples[i].time.After(cutoff)
+			})
+			if i == 0 {
+				continue
+			}
+			samples = samples[i-1:]
+			if samples[0].revision < end {
+				end = samples[0].revision
+			}
+		} else {
+			samples = samples[len(samples)-1:]
+		}
+
+		if err := compactTo(ctx, end); err != nil {
+			logrus.Errorf("failed to compact to revision %d: %v", end, err)
+		}
+	}
+}
+
+// CompactLog is a log that a Compactor compacts.
+type CompactLog interface {
+	CurrentRevision(ctx context.Context) (int64, error)
+	CompactRevision(ctx context.Context) (int64, error)
+	// SetCompactRevision records the compact revision, reads below it fail
+	// with ErrCompacted from then on.
+	SetCompactRevision(ctx context.Context, revision int64) error
+	// CompactBatch deletes the rows superseded by the revisions in
+	// (start, end] and the deletes among them. Either all of it happens or
+	// none of it does.
+	CompactBatch(ctx context.Context, start, end int64) (int64, error)
+}
+
+// Compactor compacts a log in the background and to the revisions clients
+// ask for. The compact revision is recorded first, the rows it makes obsolete
+// are then deleted in batches. The rows are only tracked as deleted in
+// memory, the ones left by a compaction that is interrupted by a restart are
+// not deleted later.
+type Compactor struct {
+	config CompactConfig
+	log    CompactLog
+	poller *Poller
+	ctx    context.Context
+	// lock orders the changes of the compact revision and guards deleted
+	lock sync.Mutex
+	// deleteLock is held while rows are deleted
+	deleteLock sync.Mutex
+	// deleted is the revision the rows are deleted up to, behind the
+	// compact revision while they are deleted. It is read from the compact
+	// revision before that first changes.
+	deleted       int64
+	deletedLoaded bool
+}
+
+// NewCompactor returns a compactor of the log. The rows the poller has not
+// read yet are left alone, it would take them for gaps.
+func NewCompactor(config CompactConfig, log CompactLog, poller *Poller) *Compactor {
+	return &Compactor{
+		config: config.WithDefaults(),
+		log:    log,
+		poller: poller,
+	}
+}
+
+// Start compacts the log in the background until the context is done, unless
+// background compaction is disabled.
+func (c *Compactor) Start(ctx context.Context) {
+	c.ctx = ctx
+	go c.config.Loop(ctx, c.log.CurrentRevision, c.compactTo)
+}
+
+// Compact records the revision as the compact revision, so reads below it
+// fail with ErrCompacted once Compact returns, and deletes the rows it makes
+// obsolete in the background. The returned channel receives the error of the
+// deletion, nil if it succeeded, and is closed once it is done.
+func (c *Compactor) Compact(ctx context.Context, revision int64) (<-chan error, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	compact, err := c.compactRevision(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if revision <= compact {
+		return nil, server.ErrCompacted
+	}
+
+	current, err := c.log.CurrentRevision(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if revision > current {
+		return nil, server.ErrFutureRev
+	}
+
+	if err := c.log.SetCompactRevision(ctx, revision); err != nil {
+		return nil, errors.Wrap(err, "failed to record compact revision")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		defer close(done)
+		err := c.deleteTo(c.ctx, revision)
+		if err != nil {
+			logrus.Errorf("failed to compact to revision %d: %v", revision, err)
+		}
+		done <- err
+	}()
+	return done, nil
+}
+
+// compactTo moves the compact revision up to end, unless it is past it
+// already, and deletes the rows that are obsolete at end.
+func (c *Compactor) compactTo(ctx context.Context, end int64) error {
+	c.lock.Lock()
+	compact, err := c.compactRevision(ctx)
+	if err == nil && compact < end {
+		err = c.log.SetCompactRevision(ctx, end)
+	}
+	c.lock.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "failed to record compact revision")
+	}
+
+	return c.deleteTo(ctx, end)
+}
+
+// compactRevision returns the compact revision of the log. The first call
+// also takes it as the revision the rows are deleted up to. c.lock must be
+// held.
+func (c *Compactor) compactRevision(ctx context.Context) (int64, error) {
+	compact, err := c.log.CompactRevision(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to get compact revision")
+	}
+	if !c.deletedLoaded {
+		c.deleted = compact
+		c.deletedLoaded = true
+	}
+	return compact, nil
+}
+
+// deleteTo deletes every row that is superseded or deleted at or before end,
+// reads at end are left intact.
+func (c *Compactor) deleteTo(ctx context.Context, end int64) error {
+	c.deleteLock.Lock()
+	defer c.deleteLock.Unlock()
+
+	if err := c.poller.WaitFor(ctx, end); err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	cursor := c.deleted
+	c.lock.Unlock()
+	if cursor < end {
+		metrics.CompactTargetRevision.Set(float64(end))
+	}
+
+	for cursor < end {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		batchEnd := cursor + c.config.BatchSize
+		if batchEnd > end {
+			batchEnd = end
+		}
+
+		deleted, err := c.log.CompactBatch(ctx, cursor, batchEnd)
+		if err != nil {
+			return errors.Wrapf(err, "failed to compact revisions %d to %d", cursor+1, batchEnd)
+		}
+
+		c.lock.Lock()
+		c.deleted = batchEnd
+		c.lock.Unlock()
+
+		metrics.CompactRevision.Set(float64(batchEnd))
+		metrics.CompactDeletedRows.Add(float64(deleted))
+		logrus.Debugf("COMPACT start=%d, end=%d => deleted=%d", cursor, batchEnd, deleted)
+		cursor = batchEnd
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package logstructured
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"time"
+
+	"github.com/rancher/kine/pkg/server"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Lease IDs are stored in the 32bit lease column of the log, and are
+	// kept above the range of plain TTLs that older releases wrote there.
+	minLeaseID = 1 << 24
+	maxLeaseID = 1<<31 - 1
+
+	// maxLeaseRetries bounds how often an operation is retried when it
+	// races with a concurrent writer.
+	maxLeaseRetries = 10
+
+	// expiredLeaseBatch is the number of expired leases read per scan
+	expiredLeaseBatch = 100
+)
+
+func (l *LogStructured) LeaseGrant(ctx context.Context, id, ttl int64) (revRet int64, leaseRet *server.Lease, errRet error) {
+	defer func() {
+		l.adjustRevision(ctx, &revRet)
+		logrus.Debugf("LEASEGRANT id=%d, ttl=%d => rev=%d, lease=%v, err=%v", id, ttl, revRet, leaseRet, errRet)
+	}()
+
+	// zero requests an ID to be generated
+	if id != 0 && (id < minLeaseID || id > maxLeaseID) {
+		return 0, nil, server.ErrLeaseIDOutOfRange
+	}
+
+	lease := &server.Lease{
+		ID:      id,
+		TTL:     ttl,
+		Expires: time.Now().Unix() + ttl,
+	}
+
+	for i := 0; ; i++ {
+		if id == 0 {
+			newID, err := newLeaseID()
+			if err != nil {
+				return 0, nil, err
+			}
+			lease.ID = newID
+		}
+
+		err := l.log.CreateLease(ctx, lease)
+		if err == server.ErrLeaseExists && id == 0 && i < maxLeaseRetries {
+			continue
+		} else if err != nil {
+			return 0, nil, err
+		}
+		return 0, lease, nil
+	}
+}
+
+func (l *LogStructured) LeaseRevoke(ctx context.Context, id int64) (revRet int64, errRet error) {
+	defer func() {
+		l.adjustRevision(ctx, &revRet)
+		logrus.Debugf("LEASEREVOKE id=%d => rev=%d, err=%v", id, revRet, errRet)
+	}()
+
+	lease, err := l.log.GetLease(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	if lease == nil {
+		return 0, server.ErrLeaseNotFound
+	}
+
+	return l.revoke(ctx, id)
+}
+
+func (l *LogStructured) LeaseKeepAlive(ctx context.Context, id int64) (revRet int64, leaseRet *server.Lease, errRet error) {
+	defer func() {
+		l.adjustRevision(ctx, &revRet)
+		logrus.Debugf("LEASEKEEPALIVE id=%d => rev=%d, lease=%v, err=%v", id, revRet, leaseRet, errRet)
+	}()
+
+	lease, err := l.log.GetLease(ctx, id)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	now := time.Now().Unix()
+	if lease == nil || lease.Expires <= now {
+		return 0, nil, server.ErrLeaseNotFound
+	}
+
+	lease.Expires = now + lease.TTL
+	if err := l.log.UpdateLease(ctx, lease, now); err != nil {
+		return 0, nil, err
+	}
+	return 0, lease, nil
+}
+
+func (l *LogStructured) LeaseTimeToLive(ctx context.Context, id int64) (revRet int64, leaseRet *server.Lease, keysRet []string, errRet error) {
+	defer func() {
+		l.adjustRevision(ctx, &revRet)
+		logrus.Debugf("LEASETIMETOLIVE id=%d => rev=%d, lease=%v, keys=%d, err=%v", id, revRet, leaseRet, len(keysRet), errRet)
+	}()
+
+	lease, err := l.log.GetLease(ctx, id)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if lease == nil {
+		return 0, nil, nil, server.ErrLeaseNotFound
+	}
+
+	rev, events, err := l.log.ListByLease(ctx, id)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	keys := make([]string, 0, len(events))
+	for _, event := range events {
+		keys = append(keys, event.KV.Key)
+	}
+	return rev, lease, keys, nil
+}
+
+func (l *LogStructured) LeaseLeases(ctx context.Context) (revRet int64, leasesRet []*server.Lease, errRet error) {
+	defer func() {
+		l.adjustRevision(ctx, &revRet)
+		logrus.Debugf("LEASELEASES => rev=%d, leases=%d, err=%v", revRet, len(leasesRet), errRet)
+	}()
+
+	leases, err := l.log.ListLeases(ctx)
+	return 0, leases, err
+}
+
+// revoke deletes the keys attached to the lease and then removes the lease
+// itself. Like in etcd all keys are deleted in one batch, at one revision. If
+// one of the keys is changed while the batch is built, possibly by another kine
+// instance expiring the same lease, the append fails on the unique revision
+// constraint and the batch is rebuilt. Keys attached to the lease while it is
+// revoked are deleted by a further batch.
+func (l *LogStructured) revoke(ctx context.Context, id int64) (int64, error) {
+	conflicts := 0
+	for {
+		rev, events, err := l.log.ListByLease(ctx, id)
+		if err != nil {
+			return 0, err
+		}
+
+		if len(events) == 0 {
+			return rev, l.log.DeleteLease(ctx, id)
+		}
+
+		deletes := make([]*server.Event, 0, len(events))
+		for _, event := range events {
+			deletes = append(deletes, &server.Event{
+				Delete: true,
+				KV:     event.KV,
+				PrevKV: event.KV,
+			})
+		}
+
+		rev, err = l.log.AppendBatch(ctx, deletes, nil)
+		if err == server.ErrKeyExists && conflicts < maxLeaseRetries {
+			conflicts++
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// leaseExpiry scans the lease table in expiry order once a second and revokes
+// every lease whose deadline has passed. Deadlines are stored with the lease so
+// they hold across restarts and are shared by all kine instances using the
+// same database.
+func (l *LogStructured) leaseExpiry(ctx context.Context) {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		for {
+			leases, err := l.log.ExpiredLeases(ctx, time.Now().Unix(), expiredLeaseBatch)
+			if err != nil {
+				logrus.Errorf("failed to list expired leases: %v", err)
+				break
+			}
+
+			failed := false
+			for _, lease := range leases {
+				if err := l.expire(ctx, lease.ID); err != nil {
+					logrus.Errorf("failed to expire lease %d: %v", lease.ID, err)
+					failed = true
+				}
+			}
+
+			// a failed lease would be listed again, so wait for the next tick
+			if failed || len(leases) < expiredLeaseBatch {
+				break
+			}
+		}
+	}
+}
+
+// expire revokes the lease if it is still expired, it may have been kept alive
+// since it was listed
+func (l *LogStructured) expire(ctx context.Context, id int64) error {
+	lease, err := l.log.GetLease(ctx, id)
+	if err != nil || lease == nil || lease.Expires > time.Now().Unix() {
+		return err
+	}
+
+	rev, err := l.revoke(ctx, id)
+	logrus.Debugf("LEASEEXPIRE id=%d => rev=%d, err=%v", id, rev, err)
+	return err
+}
+
+func (l *LogStructured) checkLease(ctx context.Context, id int64) error {
+	if id == 0 {
+		return nil
+	}
+
+	lease, err := l.log.GetLease(ctx, id)
+	if err != nil {
+		return err
+	}
+	if lease == nil {
+		return server.ErrLeaseNotFound
+	}
+	return nil
+}
+
+func newLeaseID() (int64, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	n := int64(binary.BigEndian.Uint64(b[:]) >> 1)
+	return minLeaseID + n%(maxLeaseID-minLeaseID+1), nil
+}
@@ -2,8 +2,7 @@ package logstructured
 
 import (
 	"context"
-	"sync"
-	"time"
+	"fmt"
 
 	"github.com/rancher/kine/pkg/server"
 	"github.com/sirupsen/logrus"
@@ -12,13 +11,46 @@ import (
 type Log interface {
 	Start(ctx context.Context) error
 	CurrentRevision(ctx context.Context) (int64, error)
-	List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeletes bool) (int64, []*server.Event, error)
-	After(ctx context.Context, prefix string, revision, limit int64) (int64, []*server.Event, error)
-	Watch(ctx context.Context, prefix string) <-chan []*server.Event
-	Count(ctx context.Context, prefix string) (int64, int64, error)
+	CompactRevision(ctx context.Context) (int64, error)
+	List(ctx context.Context, key, rangeEnd string, limit, revision int64, includeDeletes bool, opts server.ListOptions) (int64, []*server.Event, error)
+	After(ctx context.Context, key, rangeEnd string, revision, limit int64) (int64, []*server.Event, error)
+	Watch(ctx context.Context, key, rangeEnd string) <-chan server.WatchResult
+	Count(ctx context.Context, key, rangeEnd string) (int64, int64, error)
 	Append(ctx context.Context, event *server.Event) (int64, error)
+	// AppendBatch writes the events at a single revision, which it returns,
+	// if the latest revisions of the keys in checks are as expected.
+	AppendBatch(ctx context.Context, events []*server.Event, checks map[string]int64) (int64, error)
+	ListByLease(ctx context.Context, lease int64) (int64, []*server.Event, error)
+	CreateLease(ctx context.Context, lease *server.Lease) error
+	GetLease(ctx context.Context, id int64) (*server.Lease, error)
+	UpdateLease(ctx context.Context, lease *server.Lease, now int64) error
+	DeleteLease(ctx context.Context, id int64) error
+	ListLeases(ctx context.Context) ([]*server.Lease, error)
+	ExpiredLeases(ctx context.Context, now, limit int64) ([]*server.Lease, error)
+	Compact(ctx context.Context, revision int64) (<-chan error, error)
+	// Rows returns up to limit rows after the ID, as they are stored and in
+	// ID order, all of them if limit is zero.
+	Rows(ctx context.Context, id, limit int64) ([]*Row, error)
+	// InsertRows writes the rows at their IDs into a log that has not been
+	// started. The rows of a key must be inserted in order.
+	InsertRows(ctx context.Context, rows []*Row) error
+	// SetRevisions moves the current revision of a log that has not been
+	// started to at least current, and records the compact revision.
+	SetRevisions(ctx context.Context, current, compact int64) error
+	DbSize(ctx context.Context) (int64, error)
+	Defragment(ctx context.Context) error
+	ClusterID(ctx context.Context, id uint64) (uint64, error)
+	PutMember(ctx context.Context, member *server.Member) error
+	Members(ctx context.Context) ([]*server.Member, error)
+	DeleteMember(ctx context.Context, id uint64) error
+	PutAlarm(ctx context.Context, alarm *server.Alarm) error
+	Alarms(ctx context.Context) ([]*server.Alarm, error)
+	DeleteAlarm(ctx context.Context, alarm *server.Alarm) error
 }
 
+// restoreBatch is the number of rows a restore inserts at once
+const restoreBatch = 1000
+
 type LogStructured struct {
 	log Log
 }
@@ -34,7 +66,7 @@ func (l *LogStructured) Start(ctx context.Context) error {
 		return err
 	}
 	l.Create(ctx, "/registry/health", []byte(`{"health":"true"}`), 0)
-	go l.ttl(ctx)
+	go l.leaseExpiry(ctx)
 	return nil
 }
 
@@ -44,6 +76,19 @@ func (l *LogStructured) Get(ctx context.Context, key string, revision int64) (re
 		logrus.Debugf("GET %s, rev=%d => rev=%d, kv=%v, err=%v", key, revision, revRet, kvRet != nil, errRet)
 	}()
 
+	if revision != 0 {
+		// unlike writes, which read the latest revision, a read below the
+		// compact revision fails
+		_, events, err := l.log.List(ctx, key, "", 1, revision, false, server.ListOptions{})
+		if err != nil {
+			return 0, nil, err
+		}
+		if len(events) == 0 {
+			return revision, nil, nil
+		}
+		return revision, events[0].KV, nil
+	}
+
 	rev, event, err := l.get(ctx, key, revision, false)
 	if event == nil {
 		return rev, nil, err
@@ -52,7 +97,7 @@ func (l *LogStructured) Get(ctx context.Context, key string, revision int64) (re
 }
 
 func (l *LogStructured) get(ctx context.Context, key string, revision int64, includeDeletes bool) (int64, *server.Event, error) {
-	rev, events, err := l.log.List(ctx, key, "", 1, revision, includeDeletes)
+	rev, events, err := l.log.List(ctx, key, "", 1, revision, includeDeletes, server.ListOptions{})
 	if err == server.ErrCompacted {
 		// ignore compacted when getting by revision
 		err = nil
@@ -85,6 +130,10 @@ func (l *LogStructured) Create(ctx context.Context, key string, value []byte, le
 		logrus.Debugf("CREATE %s, size=%d, lease=%d => rev=%d, err=%v", key, len(value), lease, revRet, errRet)
 	}()
 
+	if err := l.checkLease(ctx, lease); err != nil {
+		return 0, err
+	}
+
 	rev, prevEvent, err := l.get(ctx, key, 0, true)
 	if err != nil {
 		return 0, err
@@ -92,9 +141,10 @@ func (l *LogStructured) Create(ctx context.Context, key string, value []byte, le
 	createEvent := &server.Event{
 		Create: true,
 		KV: &server.KeyValue{
-			Key:   key,
-			Value: value,
-			Lease: lease,
+			Key:     key,
+			Value:   value,
+			Lease:   lease,
+			Version: 1,
 		},
 		PrevKV: &server.KeyValue{
 			ModRevision: rev,
@@ -122,14 +172,10 @@ func (l *LogStructured) Delete(ctx context.Context, key string, revision int64)
 		return 0, nil, false, err
 	}
 
-	if event == nil {
+	if event == nil || event.Delete {
 		return rev, nil, true, nil
 	}
 
-	if event.Delete {
-		return rev, event.KV, true, nil
-	}
-
 	if revision != 0 && event.KV.ModRevision != revision {
 		return rev, event.KV, false, nil
 	}
@@ -153,12 +199,12 @@ func (l *LogStructured) Delete(ctx context.Context, key string, revision int64)
 	return rev, event.KV, true, err
 }
 
-func (l *LogStructured) List(ctx context.Context, prefix, startKey string, limit, revision int64) (revRet int64, kvRet []*server.KeyValue, errRet error) {
+func (l *LogStructured) List(ctx context.Context, key, rangeEnd string, limit, revision int64, opts server.ListOptions) (revRet int64, kvRet []*server.KeyValue, errRet error) {
 	defer func() {
-		logrus.Debugf("LIST %s, start=%s, limit=%d, rev=%d => rev=%d, kvs=%d, err=%v", prefix, startKey, limit, revision, revRet, len(kvRet), errRet)
+		logrus.Debugf("LIST %s, end=%s, limit=%d, rev=%d => rev=%d, kvs=%d, err=%v", key, rangeEnd, limit, revision, revRet, len(kvRet), errRet)
 	}()
 
-	rev, events, err := l.log.List(ctx, prefix, startKey, limit, revision, false)
+	rev, events, err := l.log.List(ctx, key, rangeEnd, limit, revision, false, opts)
 	if err != nil {
 		return 0, nil, err
 	}
@@ -171,7 +217,11 @@ func (l *LogStructured) List(ctx context.Context, prefix, startKey string, limit
 		if err != nil {
 			return 0, nil, err
 		}
-		return l.List(ctx, prefix, startKey, limit, currentRev)
+		if currentRev == 0 {
+			// nothing has been written to the log yet
+			return 0, nil, nil
+		}
+		return l.List(ctx, key, rangeEnd, limit, currentRev, opts)
 	} else if revision != 0 {
 		rev = revision
 	}
@@ -183,23 +233,21 @@ func (l *LogStructured) List(ctx context.Context, prefix, startKey string, limit
 	return rev, kvs, nil
 }
 
-func (l *LogStructured) Count(ctx context.Context, prefix string) (revRet int64, count int64, err error) {
+func (l *LogStructured) Count(ctx context.Context, key, rangeEnd string) (revRet int64, count int64, err error) {
 	defer func() {
-		logrus.Debugf("COUNT %s => rev=%d, count=%d, err=%v", prefix, revRet, count, err)
+		logrus.Debugf("COUNT %s, end=%s => rev=%d, count=%d, err=%v", key, rangeEnd, revRet, count, err)
 	}()
-	rev, count, err := l.log.Count(ctx, prefix)
+	rev, count, err := l.log.Count(ctx, key, rangeEnd)
 	if err != nil {
 		return 0, 0, err
 	}
 
-	if count == 0 {
-		// if count is zero, then so is revision, so now get the current revision and re-count at that revision
-		currentRev, err := l.log.CurrentRevision(ctx)
+	if rev == 0 {
+		// the count of an empty range can come without the revision
+		rev, err = l.log.CurrentRevision(ctx)
 		if err != nil {
 			return 0, 0, err
 		}
-		rev, rows, err := l.List(ctx, prefix, prefix, 1000, currentRev)
-		return rev, int64(len(rows)), err
 	}
 	return rev, count, nil
 }
@@ -214,6 +262,10 @@ func (l *LogStructured) Update(ctx context.Context, key string, value []byte, re
 		logrus.Debugf("UPDATE %s, value=%d, rev=%d, lease=%v => rev=%d, kvrev=%d, updated=%v, err=%v", key, len(value), revision, lease, revRet, kvRev, updateRet, errRet)
 	}()
 
+	if err := l.checkLease(ctx, lease); err != nil {
+		return 0, nil, false, err
+	}
+
 	rev, event, err := l.get(ctx, key, 0, false)
 	if err != nil {
 		return 0, nil, false, err
@@ -233,6 +285,7 @@ func (l *LogStructured) Update(ctx context.Context, key string, value []byte, re
 			CreateRevision: event.KV.CreateRevision,
 			Value:          value,
 			Lease:          lease,
+			Version:        event.KV.Version + 1,
 		},
 		PrevKV: event.KV,
 	}
@@ -250,98 +303,76 @@ func (l *LogStructured) Update(ctx context.Context, key string, value []byte, re
 	return rev, updateEvent.KV, true, err
 }
 
-func (l *LogStructured) ttlEvents(ctx context.Context) chan *server.Event {
-	result := make(chan *server.Event)
-	wg := sync.WaitGroup{}
-	wg.Add(2)
+func (l *LogStructured) Watch(ctx context.Context, key, rangeEnd string, revision int64) <-chan server.WatchResult {
+	logrus.Debugf("WATCH %s, rangeEnd=%s, revision=%d", key, rangeEnd, revision)
 
-	go func() {
-		wg.Wait()
-		close(result)
-	}()
-
-	go func() {
-		defer wg.Done()
-		rev, events, err := l.log.List(ctx, "/", "", 1000, 0, false)
-		for len(events) > 0 {
-			if err != nil {
-				logrus.Errorf("failed to read old events for ttl")
-				return
-			}
-
-			for _, event := range events {
-				if event.KV.Lease > 0 {
-					result <- event
-				}
-			}
-
-			_, events, err = l.log.List(ctx, "/", events[len(events)-1].KV.Key, 1000, rev, false)
-		}
-	}()
-
-	go func() {
-		defer wg.Done()
-		for events := range l.log.Watch(ctx, "/") {
-			for _, event := range events {
-				if event.KV.Lease > 0 {
-					result <- event
-				}
-			}
-		}
-	}()
+	// starting watching right away so we don't miss anything
+	ctx, cancel := context.WithCancel(ctx)
+	readChan := l.log.Watch(ctx, key, rangeEnd)
 
-	return result
-}
+	result := make(chan server.WatchResult, 100)
 
-func (l *LogStructured) ttl(ctx context.Context) {
-	// vary naive TTL support
-	for event := range l.ttlEvents(ctx) {
-		go func(event *server.Event) {
-			select {
-			case <-ctx.Done():
-				return
-			case <-time.After(time.Duration(event.KV.Lease) * time.Second):
-			}
-			l.Delete(ctx, event.KV.Key, event.KV.ModRevision)
-		}(event)
+	// compaction also removes the deletes at the compact revision, so a watch
+	// has to start after it
+	compacted, err := l.compactedBy(ctx, revision)
+	if err != nil {
+		logrus.Errorf("failed to get compact revision for watch %s: %v", key, err)
+		cancel()
+	}
+	if compacted > 0 {
+		go l.watchCompacted(cancel, readChan, result, compacted)
+		return result
 	}
-}
-
-func (l *LogStructured) Watch(ctx context.Context, prefix string, revision int64) <-chan []*server.Event {
-	logrus.Debugf("WATCH %s, revision=%d", prefix, revision)
-
-	// starting watching right away so we don't miss anything
-	ctx, cancel := context.WithCancel(ctx)
-	readChan := l.log.Watch(ctx, prefix)
 
 	// include the current revision in list
 	if revision > 0 {
 		revision -= 1
 	}
 
-	result := make(chan []*server.Event, 100)
+	// the list holds every matching event up to the revision current before
+	// it, the list itself only reports a revision if it found events
+	progress, err := l.log.CurrentRevision(ctx)
+	if err != nil {
+		logrus.Errorf("failed to get current revision for watch %s: %v", key, err)
+		cancel()
+	}
 
-	rev, kvs, err := l.log.After(ctx, prefix, revision, 0)
+	rev, kvs, err := l.log.After(ctx, key, rangeEnd, revision, 0)
+	if err == server.ErrCompacted {
+		// compacted since the check above
+		if compacted, err = l.log.CompactRevision(ctx); err == nil {
+			go l.watchCompacted(cancel, readChan, result, compacted)
+			return result
+		}
+	}
 	if err != nil {
-		logrus.Errorf("failed to list %s for revision %d", prefix, revision)
+		logrus.Errorf("failed to list %s for revision %d: %v", key, revision, err)
+		kvs = nil
 		cancel()
 	}
 
-	logrus.Debugf("WATCH LIST key=%s rev=%d => rev=%d kvs=%d", prefix, revision, rev, len(kvs))
+	logrus.Debugf("WATCH LIST key=%s, rangeEnd=%s, rev=%d => rev=%d kvs=%d", key, rangeEnd, revision, rev, len(kvs))
 
 	go func() {
 		lastRevision := revision
 		if len(kvs) > 0 {
 			lastRevision = rev
+			progress = rev
 		}
 
-		if len(kvs) > 0 {
-			result <- kvs
+		if ctx.Err() == nil {
+			result <- server.WatchResult{
+				Events:   kvs,
+				Revision: progress,
+			}
 		}
 
 		// always ensure we fully read the channel
 		for i := range readChan {
-			result <- filter(i, lastRevision)
+			result <- server.WatchResult{
+				Events:   filter(i.Events, lastRevision),
+				Revision: i.Revision,
+			}
 		}
 		close(result)
 		cancel()
@@ -350,6 +381,40 @@ func (l *LogStructured) Watch(ctx context.Context, prefix string, revision int64
 	return result
 }
 
+// compactedBy returns the compact revision if the revision is compacted, and
+// zero otherwise
+func (l *LogStructured) compactedBy(ctx context.Context, revision int64) (int64, error) {
+	if revision <= 0 {
+		return 0, nil
+	}
+	compact, err := l.log.CompactRevision(ctx)
+	if err != nil || revision > compact {
+		return 0, err
+	}
+	return compact, nil
+}
+
+// watchCompacted ends a watch that can't start because its revision is
+// compacted
+func (l *LogStructured) watchCompacted(cancel func(), readChan <-chan server.WatchResult, result chan<- server.WatchResult, compact int64) {
+	logrus.Debugf("WATCH COMPACTED compact=%d", compact)
+	cancel()
+	for range readChan {
+	}
+	result <- server.WatchResult{
+		CompactRevision: compact,
+	}
+	close(result)
+}
+
+func (l *LogStructured) CurrentRevision(ctx context.Context) (int64, error) {
+	return l.log.CurrentRevision(ctx)
+}
+
+func (l *LogStructured) CompactRevision(ctx context.Context) (int64, error) {
+	return l.log.CompactRevision(ctx)
+}
+
 func filter(events []*server.Event, rev int64) []*server.Event {
 	for len(events) > 0 && events[0].KV.ModRevision <= rev {
 		events = events[1:]
@@ -357,3 +422,191 @@ func filter(events []*server.Event, rev int64) []*server.Event {
 
 	return events
 }
+
+func (l *LogStructured) Compact(ctx context.Context, revision int64) (revRet int64, doneRet <-chan error, errRet error) {
+	defer func() {
+		l.adjustRevision(ctx, &revRet)
+		logrus.Debugf("COMPACT revision=%d => rev=%d, err=%v", revision, revRet, errRet)
+	}()
+
+	done, err := l.log.Compact(ctx, revision)
+	return 0, done, err
+}
+
+// Restore writes the keys as rows at their revisions and moves the current
+// and compact revisions to the revision. Keys that share a revision are
+// restored as a batch, the rows beyond the first take the lowest IDs that no
+// revision of the keys uses.
+func (l *LogStructured) Restore(ctx context.Context, revision int64, kvs []*server.KeyValue) (errRet error) {
+	defer func() {
+		logrus.Debugf("RESTORE revision=%d, kvs=%d => err=%v", revision, len(kvs), errRet)
+	}()
+
+	rows := make([]*Row, 0, len(kvs))
+	for _, kv := range kvs {
+		if kv.ModRevision <= 0 || kv.ModRevision > revision || kv.CreateRevision <= 0 || kv.CreateRevision > kv.ModRevision {
+			return fmt.Errorf("key %q has invalid revisions create=%d mod=%d for revision %d", kv.Key, kv.CreateRevision, kv.ModRevision, revision)
+		}
+
+		// a key that was updated since it was created is restored as an
+		// update of a row that was compacted
+		row := &Row{
+			ID:             kv.ModRevision,
+			Name:           kv.Key,
+			Created:        kv.CreateRevision == kv.ModRevision,
+			CreateRevision: kv.CreateRevision,
+			Lease:          kv.Lease,
+			OldLease:       kv.Lease,
+			Value:          kv.Value,
+			Version:        kv.Version,
+		}
+		if row.Created {
+			row.CreateRevision = 0
+		}
+		if row.Version <= 0 {
+			// snapshots that don't record versions
+			row.Version = 1
+		}
+		rows = append(rows, row)
+	}
+
+	if err := batchRows(rows); err != nil {
+		return err
+	}
+	for len(rows) > 0 {
+		n := len(rows)
+		if n > restoreBatch {
+			n = restoreBatch
+		}
+		if err := l.log.InsertRows(ctx, rows[:n]); err != nil {
+			return err
+		}
+		rows = rows[n:]
+	}
+	return l.log.SetRevisions(ctx, revision, revision)
+}
+
+// batchRows gives the rows that share their ID with others the lowest IDs
+// that are not taken, as rows of a batch at that revision. It fails if there
+// are not enough IDs below a revision.
+func batchRows(rows []*Row) error {
+	SortRows(rows)
+
+	taken := map[int64]bool{}
+	for _, row := range rows {
+		taken[row.ID] = true
+	}
+
+	free := int64(1)
+	for i := 0; i < len(rows); {
+		j := i + 1
+		for j < len(rows) && rows[j].ID == rows[i].ID {
+			j++
+		}
+
+		// the last row keeps the revision as its ID
+		revision := rows[i].ID
+		for _, row := range rows[i : j-1] {
+			for taken[free] {
+				free++
+			}
+			if free >= revision {
+				return fmt.Errorf("%d keys at revision %d leave no room for their rows", j-i, revision)
+			}
+			row.ID = free
+			free++
+		}
+		if j-i > 1 {
+			for _, row := range rows[i:j] {
+				row.BatchRevision = revision
+			}
+		}
+		i = j
+	}
+	return nil
+}
+
+// Rows returns the rows as they are stored. Together with InsertRows and
+// SetRevisions it copies a log with its history.
+func (l *LogStructured) Rows(ctx context.Context, id, limit int64) ([]*Row, error) {
+	return l.log.Rows(ctx, id, limit)
+}
+
+func (l *LogStructured) InsertRows(ctx context.Context, rows []*Row) (errRet error) {
+	defer func() {
+		logrus.Debugf("INSERTROWS rows=%d => err=%v", len(rows), errRet)
+	}()
+	return l.log.InsertRows(ctx, rows)
+}
+
+func (l *LogStructured) SetRevisions(ctx context.Context, current, compact int64) (errRet error) {
+	defer func() {
+		logrus.Debugf("SETREVISIONS current=%d, compact=%d => err=%v", current, compact, errRet)
+	}()
+	return l.log.SetRevisions(ctx, current, compact)
+}
+
+// InsertLeases stores the leases as they are, with the time they expire at,
+// leases that already exist are left as is.
+func (l *LogStructured) InsertLeases(ctx context.Context, leases []*server.Lease) (errRet error) {
+	defer func() {
+		logrus.Debugf("INSERTLEASES leases=%d => err=%v", len(leases), errRet)
+	}()
+	for _, lease := range leases {
+		if err := l.log.CreateLease(ctx, lease); err != nil && err != server.ErrLeaseExists {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *LogStructured) DbSize(ctx context.Context) (int64, error) {
+	return l.log.DbSize(ctx)
+}
+
+func (l *LogStructured) Defragment(ctx context.Context) (errRet error) {
+	defer func() {
+		logrus.Debugf("DEFRAGMENT => err=%v", errRet)
+	}()
+	return l.log.Defragment(ctx)
+}
+
+func (l *LogStructured) ClusterID(ctx context.Context, id uint64) (uint64, error) {
+	return l.log.ClusterID(ctx, id)
+}
+
+func (l *LogStructured) PutMember(ctx context.Context, member *server.Member) (errRet error) {
+	defer func() {
+		logrus.Debugf("PUTMEMBER id=%x, heartbeat=%d => err=%v", member.ID, member.Heartbeat, errRet)
+	}()
+	return l.log.PutMember(ctx, member)
+}
+
+func (l *LogStructured) Members(ctx context.Context) ([]*server.Member, error) {
+	return l.log.Members(ctx)
+}
+
+func (l *LogStructured) DeleteMember(ctx context.Context, id uint64) (errRet error) {
+	defer func() {
+		logrus.Debugf("DELETEMEMBER id=%x => err=%v", id, errRet)
+	}()
+	return l.log.DeleteMember(ctx, id)
+}
+
+func (l *LogStructured) PutAlarm(ctx context.Context, alarm *server.Alarm) (errRet error) {
+	defer func() {
+		logrus.Debugf("PUTALARM member=%x, alarm=%d => err=%v", alarm.MemberID, alarm.Type, errRet)
+	}()
+	return l.log.PutAlarm(ctx, alarm)
+}
+
+func (l *LogStructured) Alarms(ctx context.Context) ([]*server.Alarm, error) {
+	return l.log.Alarms(ctx)
+}
+
+func (l *LogStructured) DeleteAlarm(ctx context.Context, alarm *server.Alarm) (errRet error) {
+	defer func() {
+		logrus.Debugf("DELETEALARM member=%x, alarm=%d => err=%v", alarm.MemberID, alarm.Type, errRet)
+	}()
+	return l.log.DeleteAlarm(ctx, alarm)
+}
@@ -0,0 +1,334 @@
+package logstructured
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/rancher/kine/pkg/broadcaster"
+	"github.com/rancher/kine/pkg/metrics"
+	"github.com/rancher/kine/pkg/server"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultPollInterval is the time between reads of the latest changes
+	// when there is no notification of a write
+	defaultPollInterval = time.Second
+	// pollBatch is the most rows read for the watches at once
+	pollBatch = 500
+)
+
+// PollLog is a log that a Poller reads the changes of. The poller reads the
+// rows in ID order, and sends the rows of a batch once it has read up to the
+// revision of the batch, which is the ID of its last row.
+type PollLog interface {
+	// PollStart returns the revision the poller sends the changes after,
+	// and the ID it reads the rows after. The ID is below the revision if
+	// a batch written after the revision took IDs before it.
+	PollStart(ctx context.Context) (int64, int64, error)
+	// PollRows returns the current revision and the rows after the ID in
+	// ID order, at most limit of them.
+	PollRows(ctx context.Context, id, limit int64) (int64, []*Row, error)
+}
+
+// Filler is implemented by logs that can leave IDs out, such as when a writer
+// fails after taking its ID from a database sequence. The poller waits a
+// little for a missing ID to show up before it fills it, so that a row that is
+// committed late is not skipped.
+type Filler interface {
+	// Fill writes a placeholder row at the ID, which fails if a row made
+	// it there in the meantime.
+	Fill(ctx context.Context, id int64) error
+	// IsFill reports whether the row of the name is such a placeholder.
+	IsFill(name string) bool
+}
+
+// Poller reads the changes of a log in revision order and hands them to the
+// watches. It starts once the first watch begins and is woken up by the
+// notifications of writes, or otherwise polls at the interval set by
+// SetInterval.
+type Poller struct {
+	log         PollLog
+	broadcaster broadcaster.Broadcaster
+	ctx         context.Context
+	notify      chan int64
+	// polling is set once the poller runs, polled is the last revision it
+	// has read
+	polling int32
+	polled  int64
+	// interval is the time between polls, zero selects the default
+	interval int64
+}
+
+func NewPoller(log PollLog) *Poller {
+	return &Poller{
+		log:    log,
+		notify: make(chan int64, 1024),
+	}
+}
+
+// SetInterval sets the time between reads of the latest changes when there is
+// no notification of a write, zero selects one second. Logs can poll less
+// often while they are notified of the writes made by other processes, and
+// should go back to the default once they are not. A running poller picks up
+// the interval after its next read.
+func (p *Poller) SetInterval(interval time.Duration) {
+	atomic.StoreInt64(&p.interval, int64(interval))
+}
+
+func (p *Poller) pollInterval() time.Duration {
+	if interval := time.Duration(atomic.LoadInt64(&p.interval)); interval > 0 {
+		return interval
+	}
+	return defaultPollInterval
+}
+
+// Start sets the context the poller runs in once the first watch begins.
+func (p *Poller) Start(ctx context.Context) {
+	p.ctx = ctx
+}
+
+// Notify wakes up the poller to read the changes up to the revision, rather
+// than waiting for the next poll. Notifications that can't be taken right away
+// are dropped, the poller reads the changes eventually.
+func (p *Poller) Notify(revision int64) {
+	select {
+	case p.notify <- revision:
+	default:
+	}
+}
+
+// Watch returns the changes of the range from the time of the call until the
+// context is done. Results without events report the progress of the log,
+// they are only sent if the watch keeps up as a later result reports it
+// anyway.
+func (p *Poller) Watch(ctx context.Context, key, rangeEnd string) <-chan server.WatchResult {
+	res := make(chan server.WatchResult, 100)
+	values, err := p.broadcaster.Subscribe(ctx, p.start)
+	if err != nil {
+		return nil
+	}
+
+	go func() {
+		defer close(res)
+		for i := range values {
+			result := i.(server.WatchResult)
+			events := eventsInRange(result.Events, key, rangeEnd)
+			if len(events) > 0 {
+				res <- server.WatchResult{Events: events, Revision: result.Revision}
+				continue
+			}
+
+			select {
+			case res <- server.WatchResult{Revision: result.Revision}:
+			default:
+			}
+		}
+	}()
+
+	return res
+}
+
+// WaitFor waits until the poller, if it is running, has read up to the
+// revision. Compaction waits for it before removing rows, which the poller
+// would otherwise take for missing revisions.
+func (p *Poller) WaitFor(ctx context.Context, revision int64) error {
+	t := time.NewTicker(100 * time.Millisecond)
+	defer t.Stop()
+
+	for atomic.LoadInt32(&p.polling) == 1 && atomic.LoadInt64(&p.polled) < revision {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+	return nil
+}
+
+func (p *Poller) start() (chan interface{}, error) {
+	start, id, err := p.log.PollStart(p.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c := make(chan interface{})
+	atomic.StoreInt64(&p.polled, start)
+	atomic.StoreInt32(&p.polling, 1)
+	go p.poll(c, start, id)
+	return c, nil
+}
+
+// poll reads the rows after the ID and sends the ones written after the start
+// revision. IDs up to the start revision can be missing as they may have been
+// compacted, the ones after it have to be read in order.
+func (p *Poller) poll(result chan interface{}, start, last int64) {
+	var (
+		skip        int64
+		skipTime    time.Time
+		waitForMore = true
+		// pending holds the rows read whose batch has rows that are not
+		// read yet
+		pending []*Row
+	)
+
+	filler, _ := p.log.(Filler)
+	interval := p.pollInterval()
+	wait := time.NewTicker(interval)
+	defer func() {
+		wait.Stop()
+	}()
+	defer close(result)
+
+	for {
+		if next := p.pollInterval(); next != interval {
+			interval = next
+			wait.Stop()
+			wait = time.NewTicker(interval)
+		}
+		if waitForMore {
+			select {
+			case <-p.ctx.Done():
+				return
+			case check := <-p.notify:
+				if check <= last {
+					continue
+				}
+			case <-wait.C:
+			}
+		}
+		waitForMore = true
+
+		current, rows, err := p.log.PollRows(p.ctx, last, pollBatch)
+		if err != nil {
+			logrus.Errorf("fail to list latest changes: %v", err)
+			continue
+		}
+
+		if len(rows) == 0 {
+			metrics.PollLag.Set(0)
+			continue
+		}
+		metrics.CurrentRevision.Set(float64(current))
+
+		waitForMore = len(rows) < pollBatch
+
+		id := last
+		saveLast := false
+		for _, row := range rows {
+			next := id + 1
+			if next <= start {
+				next = start + 1
+			}
+			// Ensure that we are notifying events in a sequential fashion. For example if we find row 4 before 3
+			// we don't want to notify row 4 because 3 is essentially dropped forever.
+			if filler != nil && row.ID > next {
+				if canSkipRevision(next, skip, skipTime) {
+					// This situation should never happen, but we have it here as a fallback just for unknown reasons
+					// we don't want to pause all watches forever
+					logrus.Errorf("GAP %s, revision=%d, delete=%v, next=%d", row.Name, row.ID, row.Deleted, next)
+				} else if skip != next {
+					// This is the first time we have encountered this missing revision, so record time start
+					// and trigger a quick retry for simple out of order events
+					skip = next
+					skipTime = time.Now()
+					p.Notify(next)
+					break
+				} else {
+					if err := filler.Fill(p.ctx, next); err == nil {
+						metrics.Fills.Inc()
+						logrus.Debugf("FILL, revision=%d, err=%v", next, err)
+						p.Notify(next)
+					} else {
+						logrus.Debugf("FILL FAILED, revision=%d, err=%v", next, err)
+					}
+					break
+				}
+			}
+
+			// we have done something now that we should save the last revision.  We don't save here now because
+			// the next loop could fail leading to saving the reported revision without reporting it.  In practice this
+			// loop right now has no error exit so the next loop shouldn't fail, but if we for some reason add a method
+			// that returns error, that would be a tricky bug to find.  So instead we only save the last revision at
+			// the same time we write to the channel.
+			saveLast = true
+			id = row.ID
+			if row.Revision() <= start {
+				continue
+			}
+			if filler != nil && filler.IsFill(row.Name) {
+				logrus.Debugf("NOT TRIGGER FILL %s, revision=%d, delete=%v", row.Name, row.ID, row.Deleted)
+			} else {
+				pending = append(pending, row)
+			}
+		}
+
+		if saveLast {
+			last = id
+			// every row up to the last ID is read, so are the batches of
+			// the revisions up to it
+			var ready []*Row
+			ready, pending = rowsUpTo(pending, last)
+
+			sequential := make([]*server.Event, 0, len(ready))
+			for _, row := range ready {
+				sequential = append(sequential, row.Event())
+				logrus.Debugf("TRIGGERED %s, revision=%d, delete=%v", row.Name, row.Revision(), row.Deleted)
+			}
+
+			revision := last
+			if revision < start {
+				revision = start
+			}
+			result <- server.WatchResult{
+				Events:   sequential,
+				Revision: revision,
+			}
+			atomic.StoreInt64(&p.polled, revision)
+		}
+		metrics.PollLag.Set(float64(current - last))
+	}
+}
+
+// rowsUpTo splits the rows into the ones at or below the revision, sorted by
+// revision, and the others.
+func rowsUpTo(rows []*Row, revision int64) ([]*Row, []*Row) {
+	var ready, rest []*Row
+	for _, row := range rows {
+		if row.Revision() <= revision {
+			ready = append(ready, row)
+		} else {
+			rest = append(rest, row)
+		}
+	}
+	SortRows(ready)
+	return ready, rest
+}
+
+func canSkipRevision(rev, skip int64, skipTime time.Time) bool {
+	return rev == skip && time.Now().Sub(skipTime) > time.Second
+}
+
+// eventsInRange returns the events of the keys in the range
+func eventsInRange(events []*server.Event, key, rangeEnd string) []*server.Event {
+	filtered := make([]*server.Event, 0, len(events))
+	for _, event := range events {
+		if InRange(event.KV.Key, key, rangeEnd) {
+			filtered = append(filtered, event)
+		}
+	}
+	return filtered
+}
+
+// InRange reports whether key is selected by the range [start, end), with the
+// same meaning of an empty and a "\x00" end as List
+func InRange(key, start, end string) bool {
+	switch end {
+	case "":
+		return key == start
+	case "\x00":
+		return key >= start
+	}
+	return key >= start && key < end
+}
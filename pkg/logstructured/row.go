@@ -0,0 +1,94 @@
+package logstructured
+
+import (
+	"sort"
+
+	"github.com/rancher/kine/pkg/server"
+)
+
+// Row is a row of the log as it is stored by a Log. Rows are copied between
+// logs as they are, along with their history.
+//
+// The ID of a row orders it among the rows of the log, and is also its
+// revision unless the row was written as part of a batch. All rows of a batch
+// share the revision of the batch, the ID of its last row, which they record
+// as their BatchRevision. The revision of a row is thus never below its ID,
+// and the rows of a key are in the same order by ID as by revision.
+type Row struct {
+	ID int64
+	// BatchRevision is the revision of the batch the row was written in,
+	// zero for rows written on their own
+	BatchRevision  int64
+	Name           string
+	Created        bool
+	Deleted        bool
+	CreateRevision int64
+	PrevRevision   int64
+	Lease          int64
+	Value          []byte
+	OldValue       []byte
+	// Version is the version of the key the row writes, for deletes the
+	// version of the key it deletes
+	Version int64
+	// OldLease is the lease of the previous row of the key
+	OldLease int64
+}
+
+// Revision returns the revision the row was written at.
+func (r *Row) Revision() int64 {
+	if r.BatchRevision != 0 {
+		return r.BatchRevision
+	}
+	return r.ID
+}
+
+// Event returns the event the row records, with the previous value of the key
+// for rows that are not creates. Like in etcd the key of a delete only has its
+// name and the revision it was deleted at.
+func (r *Row) Event() *server.Event {
+	event := &server.Event{
+		Create: r.Created,
+		Delete: r.Deleted,
+		KV: &server.KeyValue{
+			Key:            r.Name,
+			CreateRevision: r.CreateRevision,
+			ModRevision:    r.Revision(),
+			Value:          r.Value,
+			Lease:          r.Lease,
+			Version:        r.Version,
+		},
+	}
+
+	if event.Create {
+		event.KV.CreateRevision = event.KV.ModRevision
+	} else {
+		// the previous row is of the same key and generation
+		event.PrevKV = &server.KeyValue{
+			Key:            r.Name,
+			CreateRevision: r.CreateRevision,
+			ModRevision:    r.PrevRevision,
+			Value:          r.OldValue,
+			Lease:          r.OldLease,
+			Version:        r.Version - 1,
+		}
+	}
+	if event.Delete {
+		event.PrevKV.Version = r.Version
+		event.KV = &server.KeyValue{
+			Key:         r.Name,
+			ModRevision: r.Revision(),
+		}
+	}
+
+	return event
+}
+
+// SortRows sorts the rows by revision, and the rows of a batch by ID.
+func SortRows(rows []*Row) {
+	sort.Slice(rows, func(i, j int) bool {
+		if ri, rj := rows[i].Revision(), rows[j].Revision(); ri != rj {
+			return ri < rj
+		}
+		return rows[i].ID < rows[j].ID
+	})
+}
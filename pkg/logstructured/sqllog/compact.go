@@ -0,0 +1,38 @@
+package sqllog
+
+import (
+	"context"
+)
+
+// Compact records the revision as the compact revision and removes the history
+// before it in the background. The returned channel receives the error of the
+// removal and is closed once it is done.
+func (s *SQLLog) Compact(ctx context.Context, revision int64) (<-chan error, error) {
+	return s.compactor.Compact(ctx, revision)
+}
+
+// SetCompactRevision records the compact revision in the compact_rev_key row.
+func (s *SQLLog) SetCompactRevision(ctx context.Context, revision int64) error {
+	return s.d.SetCompactRevision(ctx, revision)
+}
+
+// CompactBatch deletes the rows superseded by the revisions in (start, end]
+// and the deletes among them. It all happens in one transaction, an
+// interrupted batch is redone from start.
+func (s *SQLLog) CompactBatch(ctx context.Context, start, end int64) (int64, error) {
+	tx, err := s.d.BeginTx(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	deleted, err := tx.Compact(ctx, start, end)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
@@ -0,0 +1,68 @@
+package sqllog
+
+import (
+	"github.com/rancher/kine/pkg/logstructured"
+	"github.com/sirupsen/logrus"
+)
+
+// maxFed bounds the rows kept for the watch poller. Once it falls that far
+// behind, or while it isn't running, the rows kept are dropped and it reads
+// them from the database instead.
+const maxFed = 10000
+
+// Feed hands rows that were committed to the database to the watch poller,
+// for drivers that follow the changes of the database, such as through its
+// replication stream. The poller sends rows it was fed without reading them
+// back and reads any it was not fed as usual, so rows can be missed but have
+// to be complete.
+func (s *SQLLog) Feed(rows []logstructured.Row) {
+	if len(rows) == 0 {
+		return
+	}
+
+	var last int64
+	for i := range rows {
+		if rows[i].ID > last {
+			last = rows[i].ID
+		}
+	}
+
+	s.fedLock.Lock()
+	if len(s.fed)+len(rows) > maxFed {
+		logrus.Debugf("FEED dropped %d rows up to revision=%d, polling for them", len(s.fed)+len(rows), last)
+		s.fed = map[int64]*logstructured.Row{}
+	} else {
+		for i := range rows {
+			row := rows[i]
+			s.fed[row.ID] = &row
+		}
+	}
+	s.fedLock.Unlock()
+
+	// whether or not they were kept, the poller reads up to the last row
+	s.Notify(last)
+}
+
+// fedAfter returns the fed rows that directly follow the revision, at most
+// limit of them, and forgets the ones up to it
+func (s *SQLLog) fedAfter(revision, limit int64) []*logstructured.Row {
+	s.fedLock.Lock()
+	defer s.fedLock.Unlock()
+
+	for id := range s.fed {
+		if id <= revision {
+			delete(s.fed, id)
+		}
+	}
+
+	var rows []*logstructured.Row
+	for int64(len(rows)) < limit {
+		row, ok := s.fed[revision+1]
+		if !ok {
+			break
+		}
+		rows = append(rows, row)
+		revision++
+	}
+	return rows
+}
@@ -0,0 +1,86 @@
+package sqllog
+
+import (
+	"testing"
+
+	"github.com/rancher/kine/pkg/logstructured"
+)
+
+func feedRows(from, to int64) []logstructured.Row {
+	var rows []logstructured.Row
+	for id := from; id <= to; id++ {
+		rows = append(rows, logstructured.Row{ID: id, Name: "/a"})
+	}
+	return rows
+}
+
+func TestFeed(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		fed  [][]logstructured.Row
+		// after and limit select the rows that are read back
+		after, limit int64
+		ids          []int64
+	}{
+		{
+			name:  "in order",
+			fed:   [][]logstructured.Row{feedRows(1, 2), feedRows(3, 3)},
+			limit: 10,
+			ids:   []int64{1, 2, 3},
+		},
+		{
+			name:  "limit",
+			fed:   [][]logstructured.Row{feedRows(1, 5)},
+			limit: 2,
+			ids:   []int64{1, 2},
+		},
+		{
+			name:  "after a revision",
+			fed:   [][]logstructured.Row{feedRows(1, 5)},
+			after: 3,
+			limit: 10,
+			ids:   []int64{4, 5},
+		},
+		{
+			// the poller reads the missing row from the database
+			name:  "gap",
+			fed:   [][]logstructured.Row{feedRows(1, 2), feedRows(4, 5)},
+			after: 2,
+			limit: 10,
+		},
+		{
+			// the poller fell behind, it reads every row from the database
+			// until it catches up with the rows fed since
+			name:  "overflow",
+			fed:   [][]logstructured.Row{feedRows(1, maxFed-1), feedRows(maxFed, maxFed+1), feedRows(maxFed+2, maxFed+2)},
+			after: maxFed + 1,
+			limit: 10,
+			ids:   []int64{maxFed + 2},
+		},
+		{
+			name:  "overflow dropped",
+			fed:   [][]logstructured.Row{feedRows(1, maxFed-1), feedRows(maxFed, maxFed+1)},
+			limit: 10,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(nil, logstructured.CompactConfig{})
+			for _, rows := range tt.fed {
+				s.Feed(rows)
+			}
+
+			var ids []int64
+			for _, row := range s.fedAfter(tt.after, tt.limit) {
+				ids = append(ids, row.ID)
+			}
+			if len(ids) != len(tt.ids) {
+				t.Fatalf("read %v, expected %v", ids, tt.ids)
+			}
+			for i := range ids {
+				if ids[i] != tt.ids[i] {
+					t.Fatalf("read %v, expected %v", ids, tt.ids)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package sqllog
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/rancher/kine/pkg/server"
+)
+
+func (s *SQLLog) ListByLease(ctx context.Context, lease int64) (int64, []*server.Event, error) {
+	rows, err := s.d.ListByLease(ctx, lease)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	rev, _, result, err := RowsToEvents(rows)
+	return rev, result, err
+}
+
+func (s *SQLLog) CreateLease(ctx context.Context, lease *server.Lease) error {
+	err := s.d.InsertLease(ctx, lease.ID, lease.TTL, lease.Expires)
+	if err == server.ErrKeyExists {
+		return server.ErrLeaseExists
+	}
+	return err
+}
+
+func (s *SQLLog) GetLease(ctx context.Context, id int64) (*server.Lease, error) {
+	rows, err := s.d.GetLease(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	leases, err := RowsToLeases(rows)
+	if err != nil || len(leases) == 0 {
+		return nil, err
+	}
+	return leases[0], nil
+}
+
+// UpdateLease stores the new expiry of the lease, as long as the lease has not
+// already expired at now.
+func (s *SQLLog) UpdateLease(ctx context.Context, lease *server.Lease, now int64) error {
+	updated, err := s.d.UpdateLease(ctx, lease.ID, lease.Expires, now)
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return server.ErrLeaseNotFound
+	}
+	return nil
+}
+
+func (s *SQLLog) DeleteLease(ctx context.Context, id int64) error {
+	return s.d.DeleteLease(ctx, id)
+}
+
+func (s *SQLLog) ListLeases(ctx context.Context) ([]*server.Lease, error) {
+	rows, err := s.d.ListLeases(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return RowsToLeases(rows)
+}
+
+// ExpiredLeases returns up to limit leases that expired at or before now, the
+// earliest deadline first.
+func (s *SQLLog) ExpiredLeases(ctx context.Context, now, limit int64) ([]*server.Lease, error) {
+	rows, err := s.d.ExpiredLeases(ctx, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	return RowsToLeases(rows)
+}
+
+func RowsToLeases(rows *sql.Rows) ([]*server.Lease, error) {
+	var result []*server.Lease
+	defer rows.Close()
+
+	for rows.Next() {
+		lease := &server.Lease{}
+		if err := rows.Scan(&lease.ID, &lease.TTL, &lease.Expires); err != nil {
+			return nil, err
+		}
+		result = append(result, lease)
+	}
+
+	return result, rows.Err()
+}
@@ -0,0 +1,86 @@
+package sqllog
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/rancher/kine/pkg/server"
+)
+
+// IDs are stored in signed columns, so IDs with the top bit set are stored as
+// negative numbers and converted back when they are read.
+
+func (s *SQLLog) ClusterID(ctx context.Context, id uint64) (uint64, error) {
+	clusterID, err := s.d.ClusterID(ctx, int64(id))
+	return uint64(clusterID), err
+}
+
+func (s *SQLLog) PutMember(ctx context.Context, member *server.Member) error {
+	return s.d.PutMember(ctx, int64(member.ID), member.Name, strings.Join(member.ClientURLs, ","), member.Heartbeat)
+}
+
+func (s *SQLLog) Members(ctx context.Context) ([]*server.Member, error) {
+	rows, err := s.d.ListMembers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return RowsToMembers(rows)
+}
+
+func (s *SQLLog) DeleteMember(ctx context.Context, id uint64) error {
+	return s.d.DeleteMember(ctx, int64(id))
+}
+
+func RowsToMembers(rows *sql.Rows) ([]*server.Member, error) {
+	var result []*server.Member
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			id         int64
+			clientURLs string
+			member     = &server.Member{}
+		)
+		if err := rows.Scan(&id, &member.Name, &clientURLs, &member.Heartbeat); err != nil {
+			return nil, err
+		}
+		member.ID = uint64(id)
+		if clientURLs != "" {
+			member.ClientURLs = strings.Split(clientURLs, ",")
+		}
+		result = append(result, member)
+	}
+
+	return result, rows.Err()
+}
+
+func (s *SQLLog) PutAlarm(ctx context.Context, alarm *server.Alarm) error {
+	return s.d.InsertAlarm(ctx, int64(alarm.MemberID), alarm.Type)
+}
+
+func (s *SQLLog) Alarms(ctx context.Context) ([]*server.Alarm, error) {
+	rows, err := s.d.ListAlarms(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []*server.Alarm
+	for rows.Next() {
+		var (
+			memberID int64
+			alarm    = &server.Alarm{}
+		)
+		if err := rows.Scan(&memberID, &alarm.Type); err != nil {
+			return nil, err
+		}
+		alarm.MemberID = uint64(memberID)
+		result = append(result, alarm)
+	}
+	return result, rows.Err()
+}
+
+func (s *SQLLog) DeleteAlarm(ctx context.Context, alarm *server.Alarm) error {
+	return s.d.DeleteAlarm(ctx, int64(alarm.MemberID), alarm.Type)
+}
@@ -0,0 +1,113 @@
+package sqllog
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/rancher/kine/pkg/logstructured"
+)
+
+// Rows returns the rows after the ID as they are stored, including the
+// compact_rev_key row and the rows that fill gaps.
+func (s *SQLLog) Rows(ctx context.Context, id, limit int64) ([]*logstructured.Row, error) {
+	rows, err := s.d.RowsAfter(ctx, id, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	_, result, err := RowsToRows(rows)
+	return result, err
+}
+
+// RowsToRows returns the current revision and the rows as they are stored.
+func RowsToRows(rows *sql.Rows) (int64, []*logstructured.Row, error) {
+	defer rows.Close()
+
+	var (
+		result       []*logstructured.Row
+		rev, compact int64
+	)
+	for rows.Next() {
+		row := &logstructured.Row{}
+		if err := scanRow(rows, &rev, &compact, row); err != nil {
+			return 0, nil, err
+		}
+		result = append(result, row)
+	}
+	return rev, result, rows.Err()
+}
+
+// InsertRows writes the rows with their ids in a single transaction.
+func (s *SQLLog) InsertRows(ctx context.Context, rows []*logstructured.Row) error {
+	tx, err := s.d.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		if err := tx.InsertRevision(ctx, row); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.ResetSequence(ctx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SetRevisions records the compact revision in the compact_rev_key row. A log
+// without one gets it after the current revision, so new rows follow it,
+// otherwise a gap is filled at the current revision if the rows end before.
+func (s *SQLLog) SetRevisions(ctx context.Context, current, compact int64) error {
+	latest, err := s.d.CurrentRevision(ctx)
+	if err != nil {
+		return err
+	}
+
+	rows, err := s.d.After(ctx, "compact_rev_key", "", 0, 1)
+	if err != nil {
+		return err
+	}
+	_, _, events, err := RowsToEvents(rows)
+	if err != nil {
+		return err
+	}
+
+	if len(events) > 0 {
+		if latest < current {
+			if err := s.d.Fill(ctx, current); err != nil {
+				return err
+			}
+			if err := s.resetSequence(ctx); err != nil {
+				return err
+			}
+		}
+		return s.d.SetCompactRevision(ctx, compact)
+	}
+
+	if current < latest {
+		current = latest
+	}
+	return s.InsertRows(ctx, []*logstructured.Row{{
+		ID:           current + 1,
+		Name:         "compact_rev_key",
+		Created:      true,
+		PrevRevision: compact,
+		Value:        []byte(""),
+	}})
+}
+
+func (s *SQLLog) resetSequence(ctx context.Context) error {
+	tx, err := s.d.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+	if err := tx.ResetSequence(ctx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
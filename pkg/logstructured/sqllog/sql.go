@@ -4,50 +4,105 @@ import (
 	"context"
 	"database/sql"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/rancher/kine/pkg/broadcaster"
+	"github.com/rancher/kine/pkg/logstructured"
+	"github.com/rancher/kine/pkg/metrics"
 	"github.com/rancher/kine/pkg/server"
-	"github.com/sirupsen/logrus"
 )
 
 type SQLLog struct {
-	d           Dialect
-	broadcaster broadcaster.Broadcaster
-	ctx         context.Context
-	notify      chan int64
+	d         Dialect
+	poller    *logstructured.Poller
+	compactor *logstructured.Compactor
+	fedLock   sync.Mutex
+	fed       map[int64]*logstructured.Row
 }
 
-func New(d Dialect) *SQLLog {
+func New(d Dialect, compact logstructured.CompactConfig) *SQLLog {
 	l := &SQLLog{
-		d:      d,
-		notify: make(chan int64, 1024),
+		d:   d,
+		fed: map[int64]*logstructured.Row{},
 	}
+	l.poller = logstructured.NewPoller(l)
+	l.compactor = logstructured.NewCompactor(compact, l, l.poller)
 	return l
 }
 
 type Dialect interface {
-	ListCurrent(ctx context.Context, prefix string, limit int64, includeDeleted bool) (*sql.Rows, error)
-	List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeleted bool) (*sql.Rows, error)
-	Count(ctx context.Context, prefix string) (int64, int64, error)
+	ListCurrent(ctx context.Context, key, rangeEnd string, limit int64, includeDeleted bool, opts server.ListOptions) (*sql.Rows, error)
+	List(ctx context.Context, key, rangeEnd string, limit, revision int64, includeDeleted bool, opts server.ListOptions) (*sql.Rows, error)
+	Count(ctx context.Context, key, rangeEnd string) (int64, int64, error)
 	CurrentRevision(ctx context.Context) (int64, error)
-	After(ctx context.Context, prefix string, rev, limit int64) (*sql.Rows, error)
-	Insert(ctx context.Context, key string, create, delete bool, createRevision, previousRevision int64, ttl int64, value, prevValue []byte) (int64, error)
+	After(ctx context.Context, key, rangeEnd string, rev, limit int64) (*sql.Rows, error)
+	RowsAfter(ctx context.Context, id, limit int64) (*sql.Rows, error)
+	BatchStartID(ctx context.Context, revision int64) (int64, error)
+	Insert(ctx context.Context, key string, create, delete bool, createRevision, previousRevision int64, ttl int64, value, prevValue []byte, version, prevTTL int64) (int64, error)
 	GetRevision(ctx context.Context, revision int64) (*sql.Rows, error)
 	DeleteRevision(ctx context.Context, revision int64) error
 	GetCompactRevision(ctx context.Context) (int64, error)
 	SetCompactRevision(ctx context.Context, revision int64) error
-	Fill(ctx context.Context, revision int64) error
+	Fill(ctx context.Context, id int64) error
 	IsFill(key string) bool
+	BeginTx(ctx context.Context) (Transaction, error)
+	ListByLease(ctx context.Context, lease int64) (*sql.Rows, error)
+	InsertLease(ctx context.Context, id, ttl, expires int64) error
+	GetLease(ctx context.Context, id int64) (*sql.Rows, error)
+	UpdateLease(ctx context.Context, id, expires, now int64) (int64, error)
+	DeleteLease(ctx context.Context, id int64) error
+	ListLeases(ctx context.Context) (*sql.Rows, error)
+	ExpiredLeases(ctx context.Context, now, limit int64) (*sql.Rows, error)
+	DbSize(ctx context.Context) (int64, error)
+	Defragment(ctx context.Context) error
+	ClusterID(ctx context.Context, id int64) (int64, error)
+	PutMember(ctx context.Context, id int64, name, clientURLs string, heartbeat int64) error
+	ListMembers(ctx context.Context) (*sql.Rows, error)
+	DeleteMember(ctx context.Context, id int64) error
+	InsertAlarm(ctx context.Context, memberID int64, alarm int32) error
+	ListAlarms(ctx context.Context) (*sql.Rows, error)
+	DeleteAlarm(ctx context.Context, memberID int64, alarm int32) error
 }
 
-func (s *SQLLog) Start(ctx context.Context) (err error) {
-	s.ctx = ctx
-	return
+type Transaction interface {
+	// LockKeys keeps other transactions from writing the keys checked by
+	// KeyRevision until the transaction ends.
+	LockKeys(ctx context.Context) error
+	KeyRevision(ctx context.Context, key string) (int64, error)
+	Insert(ctx context.Context, key string, create, delete bool, createRevision, previousRevision int64, ttl int64, value, prevValue []byte, version, prevTTL int64) (int64, error)
+	InsertRevision(ctx context.Context, row *logstructured.Row) error
+	SetBatchRevision(ctx context.Context, revision int64, ids []int64) error
+	ResetSequence(ctx context.Context) error
+	Compact(ctx context.Context, start, end int64) (int64, error)
+	Commit() error
+	Rollback() error
+}
+
+type inserter interface {
+	Insert(ctx context.Context, key string, create, delete bool, createRevision, previousRevision int64, ttl int64, value, prevValue []byte, version, prevTTL int64) (int64, error)
+}
+
+// Start makes sure the compact revision is recorded before anything can be
+// compacted, and starts compacting the log. The watch poller starts from the
+// compact revision once the first watch begins.
+func (s *SQLLog) Start(ctx context.Context) error {
+	if err := s.compactStart(ctx); err != nil {
+		return err
+	}
+
+	compact, err := s.d.GetCompactRevision(ctx)
+	if err != nil {
+		return err
+	}
+	metrics.CompactRevision.Set(float64(compact))
+
+	s.poller.Start(ctx)
+	s.compactor.Start(ctx)
+	return nil
 }
 
 func (s *SQLLog) compactStart(ctx context.Context) error {
-	rows, err := s.d.After(ctx, "compact_rev_key", 0, 0)
+	rows, err := s.d.After(ctx, "compact_rev_key", "", 0, 0)
 	if err != nil {
 		return err
 	}
@@ -92,118 +147,24 @@ func (s *SQLLog) compactStart(ctx context.Context) error {
 	return nil
 }
 
-func (s *SQLLog) compact() {
-	var (
-		nextEnd int64
-	)
-	t := time.NewTicker(5 * time.Minute)
-	nextEnd, _ = s.d.CurrentRevision(s.ctx)
-
-outer:
-	for {
-		select {
-		case <-s.ctx.Done():
-			return
-		case <-t.C:
-		}
-
-		currentRev, err := s.d.CurrentRevision(s.ctx)
-		if err != nil {
-			logrus.Errorf("failed to get current revision: %v", err)
-			continue
-		}
-
-		end := nextEnd
-		nextEnd = currentRev
-
-		cursor, err := s.d.GetCompactRevision(s.ctx)
-		if err != nil {
-			logrus.Errorf("failed to get compact revision: %v", err)
-			continue
-		}
-
-		// leave the last 1000
-		end = end - 1000
-
-		savedCursor := cursor
-		// Purposefully start at the current and redo the current as
-		// it could have failed before actually compacting
-		for ; cursor <= end; cursor++ {
-			rows, err := s.d.GetRevision(s.ctx, cursor)
-			if err != nil {
-				logrus.Errorf("failed to get revision %d: %v", cursor, err)
-				continue outer
-			}
-
-			_, _, events, err := RowsToEvents(rows)
-			if err != nil {
-				logrus.Errorf("failed to convert to events: %v", err)
-				continue outer
-			}
-
-			if len(events) == 0 {
-				continue
-			}
-
-			event := events[0]
-
-			if event.KV.Key == "compact_rev_key" {
-				// don't compact the compact key
-				continue
-			}
-
-			setRev := false
-			if event.PrevKV != nil && event.PrevKV.ModRevision != 0 {
-				if savedCursor != cursor {
-					if err := s.d.SetCompactRevision(s.ctx, cursor); err != nil {
-						logrus.Errorf("failed to record compact revision: %v", err)
-						continue outer
-					}
-					savedCursor = cursor
-					setRev = true
-				}
-
-				if err := s.d.DeleteRevision(s.ctx, event.PrevKV.ModRevision); err != nil {
-					logrus.Errorf("failed to delete revision %d: %v", event.PrevKV.ModRevision, err)
-					continue outer
-				}
-			}
-
-			if event.Delete {
-				if !setRev && savedCursor != cursor {
-					if err := s.d.SetCompactRevision(s.ctx, cursor); err != nil {
-						logrus.Errorf("failed to record compact revision: %v", err)
-						continue outer
-					}
-					savedCursor = cursor
-				}
-
-				if err := s.d.DeleteRevision(s.ctx, cursor); err != nil {
-					logrus.Errorf("failed to delete current revision %d: %v", cursor, err)
-					continue outer
-				}
-			}
-		}
+func (s *SQLLog) CurrentRevision(ctx context.Context) (int64, error) {
+	return s.d.CurrentRevision(ctx)
+}
 
-		if savedCursor != cursor {
-			if err := s.d.SetCompactRevision(s.ctx, cursor); err != nil {
-				logrus.Errorf("failed to record compact revision: %v", err)
-				continue outer
-			}
-		}
-	}
+func (s *SQLLog) CompactRevision(ctx context.Context) (int64, error) {
+	return s.d.GetCompactRevision(ctx)
 }
 
-func (s *SQLLog) CurrentRevision(ctx context.Context) (int64, error) {
-	return s.d.CurrentRevision(ctx)
+func (s *SQLLog) DbSize(ctx context.Context) (int64, error) {
+	return s.d.DbSize(ctx)
 }
 
-func (s *SQLLog) After(ctx context.Context, prefix string, revision, limit int64) (int64, []*server.Event, error) {
-	if strings.HasSuffix(prefix, "/") {
-		prefix += "%"
-	}
+func (s *SQLLog) Defragment(ctx context.Context) error {
+	return s.d.Defragment(ctx)
+}
 
-	rows, err := s.d.After(ctx, prefix, revision, limit)
+func (s *SQLLog) After(ctx context.Context, key, rangeEnd string, revision, limit int64) (int64, []*server.Event, error) {
+	rows, err := s.d.After(ctx, key, rangeEnd, revision, limit)
 	if err != nil {
 		return 0, nil, err
 	}
@@ -216,28 +177,27 @@ func (s *SQLLog) After(ctx context.Context, prefix string, revision, limit int64
 	return rev, result, err
 }
 
-func (s *SQLLog) List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeleted bool) (int64, []*server.Event, error) {
+func (s *SQLLog) List(ctx context.Context, key, rangeEnd string, limit, revision int64, includeDeleted bool, opts server.ListOptions) (int64, []*server.Event, error) {
 	var (
 		rows *sql.Rows
 		err  error
 	)
 
-	// It's assumed that when there is a start key that that key exists.
-	if strings.HasSuffix(prefix, "/") {
-		// In the situation of a list start the startKey will not exist so set to ""
-		if prefix == startKey {
-			startKey = ""
+	// Clients continue a range at the last key they have seen followed by a
+	// NUL byte, which not every database accepts in a string. The range is
+	// read from the last key instead and that key is dropped from the result.
+	after := rangeEnd != "" && strings.HasSuffix(key, "\x00")
+	if after {
+		key = strings.TrimSuffix(key, "\x00")
+		if limit > 0 {
+			limit++
 		}
-		prefix += "%"
-	} else {
-		// Also if this isn't a list there is no reason to pass startKey
-		startKey = ""
 	}
 
 	if revision == 0 {
-		rows, err = s.d.ListCurrent(ctx, prefix, limit, includeDeleted)
+		rows, err = s.d.ListCurrent(ctx, key, rangeEnd, limit, includeDeleted, opts)
 	} else {
-		rows, err = s.d.List(ctx, prefix, startKey, limit, revision, includeDeleted)
+		rows, err = s.d.List(ctx, key, rangeEnd, limit, revision, includeDeleted, opts)
 	}
 	if err != nil {
 		return 0, nil, err
@@ -248,6 +208,18 @@ func (s *SQLLog) List(ctx context.Context, prefix, startKey string, limit, revis
 		return 0, nil, err
 	}
 
+	if after {
+		for i, event := range result {
+			if event.KV.Key == key {
+				result = append(result[:i], result[i+1:]...)
+				break
+			}
+		}
+		if limit > 0 && int64(len(result)) == limit {
+			result = result[:limit-1]
+		}
+	}
+
 	if revision > 0 && len(result) == 0 {
 		// a zero length result won't have the compact revision so get it manually
 		compact, err = s.d.GetCompactRevision(ctx)
@@ -260,10 +232,7 @@ func (s *SQLLog) List(ctx context.Context, prefix, startKey string, limit, revis
 		return rev, result, server.ErrCompacted
 	}
 
-	select {
-	case s.notify <- rev:
-	default:
-	}
+	s.Notify(rev)
 
 	return rev, result, err
 }
@@ -287,178 +256,153 @@ func RowsToEvents(rows *sql.Rows) (int64, int64, []*server.Event, error) {
 	return rev, compact, result, nil
 }
 
-func (s *SQLLog) Watch(ctx context.Context, prefix string) <-chan []*server.Event {
-	res := make(chan []*server.Event, 100)
-	values, err := s.broadcaster.Subscribe(ctx, s.startWatch)
-	if err != nil {
-		return nil
-	}
+func (s *SQLLog) Watch(ctx context.Context, key, rangeEnd string) <-chan server.WatchResult {
+	return s.poller.Watch(ctx, key, rangeEnd)
+}
 
-	checkPrefix := strings.HasSuffix(prefix, "/")
+// SetPollInterval sets the time between reads of the latest changes when there
+// is no notification of a write, zero selects one second. Drivers that notify
+// the log of writes made by other processes can poll less often while they
+// do.
+func (s *SQLLog) SetPollInterval(interval time.Duration) {
+	s.poller.SetInterval(interval)
+}
 
-	go func() {
-		defer close(res)
-		for i := range values {
-			events, ok := filter(i, checkPrefix, prefix)
-			if ok {
-				res <- events
-			}
-		}
-	}()
+// Notify wakes up the watch poller to read the changes up to the revision,
+// rather than waiting for the next poll.
+func (s *SQLLog) Notify(revision int64) {
+	s.poller.Notify(revision)
+}
 
-	return res
+// PollStart starts the watch poller at the compact revision, reading the rows
+// from the first one of a batch that took IDs up to the compact revision but
+// was written after it.
+func (s *SQLLog) PollStart(ctx context.Context) (int64, int64, error) {
+	compact, err := s.d.GetCompactRevision(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	id, err := s.d.BatchStartID(ctx, compact)
+	if err != nil {
+		return 0, 0, err
+	}
+	if id > 0 {
+		return compact, id - 1, nil
+	}
+	return compact, compact, nil
 }
 
-func filter(events interface{}, checkPrefix bool, prefix string) ([]*server.Event, bool) {
-	eventList := events.([]*server.Event)
-	filteredEventList := make([]*server.Event, 0, len(eventList))
+// PollRows returns the rows after the ID, from the ones the log was fed if it
+// was fed the next one, and from the database otherwise
+func (s *SQLLog) PollRows(ctx context.Context, id, limit int64) (int64, []*logstructured.Row, error) {
+	if rows := s.fedAfter(id, limit); len(rows) > 0 {
+		return rows[len(rows)-1].ID, rows, nil
+	}
 
-	for _, event := range eventList {
-		if (checkPrefix && strings.HasPrefix(event.KV.Key, prefix)) || event.KV.Key == prefix {
-			filteredEventList = append(filteredEventList, event)
-		}
+	rows, err := s.d.RowsAfter(ctx, id, limit)
+	if err != nil {
+		return 0, nil, err
 	}
+	return RowsToRows(rows)
+}
+
+func (s *SQLLog) Fill(ctx context.Context, id int64) error {
+	return s.d.Fill(ctx, id)
+}
 
-	return filteredEventList, len(filteredEventList) > 0
+func (s *SQLLog) IsFill(name string) bool {
+	return s.d.IsFill(name)
 }
 
-func (s *SQLLog) startWatch() (chan interface{}, error) {
-	if err := s.compactStart(s.ctx); err != nil {
-		return nil, err
+func (s *SQLLog) Count(ctx context.Context, key, rangeEnd string) (int64, int64, error) {
+	if rangeEnd == "" || !strings.HasSuffix(key, "\x00") {
+		return s.d.Count(ctx, key, rangeEnd)
 	}
 
-	pollStart, err := s.d.GetCompactRevision(s.ctx)
+	// as in List, count from the last key and leave it out
+	key = strings.TrimSuffix(key, "\x00")
+	rev, count, err := s.d.Count(ctx, key, rangeEnd)
 	if err != nil {
-		return nil, err
+		return 0, 0, err
 	}
+	_, exists, err := s.d.Count(ctx, key, "")
+	return rev, count - exists, err
+}
 
-	c := make(chan interface{})
-	// start compaction and polling at the same time to watch starts
-	// at the oldest revision, but compaction doesn't create gaps
-	go s.compact()
-	go s.poll(c, pollStart)
-	return c, nil
+func (s *SQLLog) Append(ctx context.Context, event *server.Event) (int64, error) {
+	rev, err := insert(ctx, s.d, event)
+	if err != nil {
+		return 0, err
+	}
+	metrics.CurrentRevision.Set(float64(rev))
+	s.Notify(rev)
+	return rev, nil
 }
 
-func (s *SQLLog) poll(result chan interface{}, pollStart int64) {
-	var (
-		last        = pollStart
-		skip        int64
-		skipTime    time.Time
-		waitForMore = true
-	)
+// AppendBatch appends all events in a single database transaction, either all
+// of them are written or none are. Before anything is written the latest
+// revision of every key in checks, including deletes, must still match the
+// expected revision, zero meaning the key has no rows at all. A mismatch fails
+// the batch with server.ErrKeyExists, just like a conflicting insert does.
+// The checked keys are locked until the batch is written, so that they can't
+// change in between. The events share the revision of the batch, the ID of its
+// last row, which is returned.
+func (s *SQLLog) AppendBatch(ctx context.Context, events []*server.Event, checks map[string]int64) (int64, error) {
+	tx, err := s.d.BeginTx(ctx)
+	if err != nil {
+		return 0, err
+	}
 
-	wait := time.NewTicker(time.Second)
-	defer wait.Stop()
-	defer close(result)
-
-	for {
-		if waitForMore {
-			select {
-			case <-s.ctx.Done():
-				return
-			case check := <-s.notify:
-				if check <= last {
-					continue
-				}
-			case <-wait.C:
-			}
+	if len(checks) > 0 {
+		if err := tx.LockKeys(ctx); err != nil {
+			tx.Rollback()
+			return 0, err
 		}
-		waitForMore = true
-
-		rows, err := s.d.After(s.ctx, "%", last, 500)
+	}
+	for key, expected := range checks {
+		rev, err := tx.KeyRevision(ctx, key)
 		if err != nil {
-			logrus.Errorf("fail to list latest changes: %v", err)
-			continue
+			tx.Rollback()
+			return 0, err
 		}
-
-		_, _, events, err := RowsToEvents(rows)
-		if err != nil {
-			logrus.Errorf("fail to convert rows changes: %v", err)
-			continue
+		if rev != expected {
+			tx.Rollback()
+			return 0, server.ErrKeyExists
 		}
+	}
 
-		if len(events) == 0 {
-			continue
-		}
-
-		waitForMore = len(events) < 100
-
-		rev := last
-		var (
-			sequential []*server.Event
-			saveLast   bool
-		)
-
-		for _, event := range events {
-			next := rev + 1
-			// Ensure that we are notifying events in a sequential fashion. For example if we find row 4 before 3
-			// we don't want to notify row 4 because 3 is essentially dropped forever.
-			if event.KV.ModRevision != next {
-				if canSkipRevision(next, skip, skipTime) {
-					// This situation should never happen, but we have it here as a fallback just for unknown reasons
-					// we don't want to pause all watches forever
-					logrus.Errorf("GAP %s, revision=%d, delete=%v, next=%d", event.KV.Key, event.KV.ModRevision, event.Delete, next)
-				} else if skip != next {
-					// This is the first time we have encountered this missing revision, so record time start
-					// and trigger a quick retry for simple out of order events
-					skip = next
-					skipTime = time.Now()
-					select {
-					case s.notify <- next:
-					default:
-					}
-					break
-				} else {
-					if err := s.d.Fill(s.ctx, next); err == nil {
-						logrus.Debugf("FILL, revision=%d, err=%v", next, err)
-						select {
-						case s.notify <- next:
-						default:
-						}
-					} else {
-						logrus.Debugf("FILL FAILED, revision=%d, err=%v", next, err)
-					}
-					break
-				}
-			}
-
-			// we have done something now that we should save the last revision.  We don't save here now because
-			// the next loop could fail leading to saving the reported revision without reporting it.  In practice this
-			// loop right now has no error exit so the next loop shouldn't fail, but if we for some reason add a method
-			// that returns error, that would be a tricky bug to find.  So instead we only save the last revision at
-			// the same time we write to the channel.
-			saveLast = true
-			rev = event.KV.ModRevision
-			if s.d.IsFill(event.KV.Key) {
-				logrus.Debugf("NOT TRIGGER FILL %s, revision=%d, delete=%v", event.KV.Key, event.KV.ModRevision, event.Delete)
-			} else {
-				sequential = append(sequential, event)
-				logrus.Debugf("TRIGGERED %s, revision=%d, delete=%v", event.KV.Key, event.KV.ModRevision, event.Delete)
-			}
+	ids := make([]int64, 0, len(events))
+	for _, event := range events {
+		id, err := insert(ctx, tx, event)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
 		}
+		ids = append(ids, id)
+	}
 
-		if saveLast {
-			last = rev
-			if len(sequential) > 0 {
-				result <- sequential
-			}
+	var rev int64
+	if len(ids) > 0 {
+		rev = ids[len(ids)-1]
+	}
+	if len(ids) > 1 {
+		if err := tx.SetBatchRevision(ctx, rev, ids); err != nil {
+			tx.Rollback()
+			return 0, err
 		}
 	}
-}
-
-func canSkipRevision(rev, skip int64, skipTime time.Time) bool {
-	return rev == skip && time.Now().Sub(skipTime) > time.Second
-}
 
-func (s *SQLLog) Count(ctx context.Context, prefix string) (int64, int64, error) {
-	if strings.HasSuffix(prefix, "/") {
-		prefix += "%"
+	if err := tx.Commit(); err != nil {
+		return 0, err
 	}
-	return s.d.Count(ctx, prefix)
+	if rev > 0 {
+		metrics.CurrentRevision.Set(float64(rev))
+		s.Notify(rev)
+	}
+	return rev, nil
 }
 
-func (s *SQLLog) Append(ctx context.Context, event *server.Event) (int64, error) {
+func insert(ctx context.Context, i inserter, event *server.Event) (int64, error) {
 	e := *event
 	if e.KV == nil {
 		e.KV = &server.KeyValue{}
@@ -467,7 +411,7 @@ func (s *SQLLog) Append(ctx context.Context, event *server.Event) (int64, error)
 		e.PrevKV = &server.KeyValue{}
 	}
 
-	rev, err := s.d.Insert(ctx, e.KV.Key,
+	return i.Insert(ctx, e.KV.Key,
 		e.Create,
 		e.Delete,
 		e.KV.CreateRevision,
@@ -475,45 +419,54 @@ func (s *SQLLog) Append(ctx context.Context, event *server.Event) (int64, error)
 		e.KV.Lease,
 		e.KV.Value,
 		e.PrevKV.Value,
+		e.KV.Version,
+		e.PrevKV.Lease,
 	)
-	if err != nil {
-		return 0, err
-	}
-	select {
-	case s.notify <- rev:
-	default:
-	}
-	return rev, nil
 }
 
 func scan(rows *sql.Rows, rev *int64, compact *int64, event *server.Event) error {
-	event.KV = &server.KeyValue{}
-	event.PrevKV = &server.KeyValue{}
-
-	c := &sql.NullInt64{}
+	var row logstructured.Row
+	if err := scanRow(rows, rev, compact, &row); err != nil {
+		return err
+	}
+	*event = *row.Event()
+	return nil
+}
 
+func scanRow(rows *sql.Rows, rev *int64, compact *int64, row *logstructured.Row) error {
+	var c, batch, version, oldLease sql.NullInt64
 	err := rows.Scan(
 		rev,
-		c,
-		&event.KV.ModRevision,
-		&event.KV.Key,
-		&event.Create,
-		&event.Delete,
-		&event.KV.CreateRevision,
-		&event.PrevKV.ModRevision,
-		&event.KV.Lease,
-		&event.KV.Value,
-		&event.PrevKV.Value,
+		&c,
+		&row.ID,
+		&batch,
+		&row.Name,
+		&row.Created,
+		&row.Deleted,
+		&row.CreateRevision,
+		&row.PrevRevision,
+		&row.Lease,
+		&row.Value,
+		&row.OldValue,
+		&version,
+		&oldLease,
 	)
 	if err != nil {
 		return err
 	}
 
-	if event.Create {
-		event.KV.CreateRevision = event.KV.ModRevision
-		event.PrevKV = nil
-	}
-
 	*compact = c.Int64
+	row.BatchRevision = batch.Int64
+	row.Version = version.Int64
+	if !version.Valid {
+		// rows written before versions were recorded
+		row.Version = 1
+	}
+	row.OldLease = oldLease.Int64
+	if !oldLease.Valid {
+		// rows written before previous leases were recorded, the lease is
+		// taken to be unchanged
+		row.OldLease = row.Lease
+	}
 	return nil
 }
@@ -0,0 +1,267 @@
+package logstructured
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/rancher/kine/pkg/server"
+	"github.com/sirupsen/logrus"
+)
+
+// txn reads the log at the revision that was current when it began and
+// buffers its writes. On commit the writes are appended as one batch, which
+// only succeeds if none of the keys the transaction read or wrote have
+// changed since.
+type txn struct {
+	l        *LogStructured
+	revision int64
+	// checks holds the latest revision, including deletes, of every key the
+	// transaction depends on. Zero means the key had no rows at all.
+	checks map[string]int64
+	latest map[string]*server.Event
+	writes map[string]*server.Event
+	events []*server.Event
+}
+
+func (l *LogStructured) BeginTx(ctx context.Context) (server.Transaction, error) {
+	rev, err := l.log.CurrentRevision(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &txn{
+		l:        l,
+		revision: rev,
+		checks:   map[string]int64{},
+		latest:   map[string]*server.Event{},
+		writes:   map[string]*server.Event{},
+	}, nil
+}
+
+// read returns the latest event for the key as of the transaction revision and
+// records it as a dependency of the transaction.
+func (t *txn) read(ctx context.Context, key string) (*server.Event, error) {
+	if event, ok := t.latest[key]; ok {
+		return event, nil
+	}
+
+	_, event, err := t.l.get(ctx, key, t.revision, true)
+	if err != nil {
+		return nil, err
+	}
+
+	t.latest[key] = event
+	if event == nil {
+		t.checks[key] = 0
+	} else {
+		t.checks[key] = event.KV.ModRevision
+	}
+	return event, nil
+}
+
+func (t *txn) Get(ctx context.Context, key string, revision int64) (int64, *server.KeyValue, error) {
+	if revision != 0 {
+		return t.l.Get(ctx, key, revision)
+	}
+
+	if event, ok := t.writes[key]; ok {
+		if event.Delete {
+			return t.revision, nil, nil
+		}
+		return t.revision, event.KV, nil
+	}
+
+	event, err := t.read(ctx, key)
+	if err != nil || event == nil || event.Delete {
+		return t.revision, nil, err
+	}
+	return t.revision, event.KV, nil
+}
+
+func (t *txn) List(ctx context.Context, key, rangeEnd string, limit, revision int64, opts server.ListOptions) (int64, []*server.KeyValue, error) {
+	if revision != 0 {
+		return t.l.List(ctx, key, rangeEnd, limit, revision, opts)
+	}
+
+	var writes []*server.Event
+	for _, event := range t.events {
+		if InRange(event.KV.Key, key, rangeEnd) {
+			writes = append(writes, event)
+		}
+	}
+
+	if len(writes) == 0 {
+		_, kvs, err := t.l.List(ctx, key, rangeEnd, limit, t.revision, opts)
+		t.depend(kvs)
+		return t.revision, kvs, err
+	}
+
+	// The revisions of buffered writes are not known until they are committed,
+	// so they can't be sorted or filtered by revision.
+	if opts.SortTarget != server.SortByKey || opts.Descending ||
+		opts.MinModRevision != 0 || opts.MaxModRevision != 0 ||
+		opts.MinCreateRevision != 0 || opts.MaxCreateRevision != 0 {
+		return 0, nil, fmt.Errorf("sorting or filtering keys written in the same transaction is not supported")
+	}
+
+	// the buffered writes can add and remove keys, so list everything and
+	// apply the limit afterwards
+	_, kvs, err := t.l.List(ctx, key, rangeEnd, 0, t.revision, opts)
+	if err != nil {
+		return 0, nil, err
+	}
+	t.depend(kvs)
+
+	result := make([]*server.KeyValue, 0, len(kvs)+len(writes))
+	for _, kv := range kvs {
+		if _, ok := t.writes[kv.Key]; !ok {
+			result = append(result, kv)
+		}
+	}
+	for _, event := range writes {
+		if event.Delete {
+			continue
+		}
+		kv := event.KV
+		if opts.KeysOnly {
+			keyOnly := *kv
+			keyOnly.Value = nil
+			kv = &keyOnly
+		}
+		result = append(result, kv)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Key < result[j].Key
+	})
+
+	if limit > 0 && int64(len(result)) > limit {
+		result = result[:limit]
+	}
+	return t.revision, result, nil
+}
+
+// depend records listed keys as dependencies of the transaction, so that a
+// commit fails if any of them changed. Keys added to the range in the meantime
+// are not detected.
+func (t *txn) depend(kvs []*server.KeyValue) {
+	for _, kv := range kvs {
+		if _, ok := t.checks[kv.Key]; !ok {
+			t.checks[kv.Key] = kv.ModRevision
+		}
+	}
+}
+
+// Count counts the keys at the revision of the transaction, with its writes
+// applied. The counted keys become dependencies of the transaction like the
+// listed ones do.
+func (t *txn) Count(ctx context.Context, key, rangeEnd string) (int64, int64, error) {
+	_, kvs, err := t.List(ctx, key, rangeEnd, 0, 0, server.ListOptions{KeysOnly: true})
+	if err != nil {
+		return 0, 0, err
+	}
+	return t.revision, int64(len(kvs)), nil
+}
+
+func (t *txn) Put(ctx context.Context, key string, value []byte, lease int64) (*server.KeyValue, error) {
+	if _, ok := t.writes[key]; ok {
+		return nil, fmt.Errorf("key %s is written twice in one transaction", key)
+	}
+
+	if err := t.l.checkLease(ctx, lease); err != nil {
+		return nil, err
+	}
+
+	latest, err := t.read(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	event := &server.Event{
+		KV: &server.KeyValue{
+			Key:     key,
+			Value:   value,
+			Lease:   lease,
+			Version: 1,
+		},
+	}
+
+	var prevKV *server.KeyValue
+	if latest == nil {
+		event.Create = true
+		event.PrevKV = &server.KeyValue{
+			ModRevision: t.revision,
+		}
+	} else if latest.Delete {
+		event.Create = true
+		event.PrevKV = latest.KV
+	} else {
+		prevKV = latest.KV
+		event.KV.CreateRevision = prevKV.CreateRevision
+		event.KV.Version = prevKV.Version + 1
+		event.PrevKV = prevKV
+	}
+
+	t.write(event)
+	return prevKV, nil
+}
+
+func (t *txn) Delete(ctx context.Context, key string) (*server.KeyValue, error) {
+	if event, ok := t.writes[key]; ok {
+		if event.Delete {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("key %s is written twice in one transaction", key)
+	}
+
+	latest, err := t.read(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if latest == nil || latest.Delete {
+		return nil, nil
+	}
+
+	t.write(&server.Event{
+		Delete: true,
+		KV:     latest.KV,
+		PrevKV: latest.KV,
+	})
+	return latest.KV, nil
+}
+
+func (t *txn) write(event *server.Event) {
+	t.writes[event.KV.Key] = event
+	t.events = append(t.events, event)
+}
+
+func (t *txn) Commit(ctx context.Context) (revRet int64, errRet error) {
+	defer func() {
+		logrus.Debugf("TXN rev=%d, writes=%d, checks=%d => rev=%d, err=%v", t.revision, len(t.events), len(t.checks), revRet, errRet)
+	}()
+
+	if len(t.events) == 0 {
+		return t.revision, nil
+	}
+
+	rev, err := t.l.log.AppendBatch(ctx, t.events, t.checks)
+	if err != nil {
+		return 0, err
+	}
+
+	// Writes were handed out as part of responses before the commit, fill in
+	// the revision they were written at. Deletes reference the previous
+	// value and are left untouched.
+	for _, event := range t.events {
+		if event.Delete {
+			continue
+		}
+		event.KV.ModRevision = rev
+		if event.Create {
+			event.KV.CreateRevision = rev
+		}
+	}
+
+	return rev, nil
+}
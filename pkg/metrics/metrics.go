@@ -0,0 +1,132 @@
+package metrics
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// Registry holds every kine metric. It is kept apart from the default
+// registry so embedding kine doesn't clash with the metrics of the host.
+var Registry = prometheus.NewRegistry()
+
+var (
+	GRPCRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kine_grpc_requests_total",
+		Help: "Number of gRPC requests handled, by method and status code.",
+	}, []string{"grpc_method", "grpc_code"})
+
+	GRPCDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "kine_grpc_request_duration_seconds",
+		Help:    "Latency of unary gRPC requests, by method.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 16),
+	}, []string{"grpc_method"})
+
+	SQLDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "kine_sql_duration_seconds",
+		Help:    "Latency of SQL statements, by statement.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 16),
+	}, []string{"statement"})
+
+	SQLErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kine_sql_errors_total",
+		Help: "Number of failed SQL statements, by statement.",
+	}, []string{"statement"})
+
+	CurrentRevision = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kine_current_revision",
+		Help: "Latest revision seen by kine.",
+	})
+
+	CompactRevision = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kine_compact_revision",
+		Help: "Revision the log is compacted up to.",
+	})
+
+	CompactTargetRevision = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kine_compact_target_revision",
+		Help: "Revision the last started compaction compacts up to.",
+	})
+
+	CompactDeletedRows = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kine_compact_deleted_rows_total",
+		Help: "Number of rows deleted by compaction.",
+	})
+
+	PollLag = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kine_poll_lag_revisions",
+		Help: "Number of revisions written but not yet delivered to watchers by the poll loop.",
+	})
+
+	Fills = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kine_poll_fills_total",
+		Help: "Number of gaps in the revisions filled by the poll loop.",
+	})
+
+	ActiveWatches = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kine_active_watches",
+		Help: "Number of active watches.",
+	})
+
+	BroadcasterDrops = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kine_broadcaster_dropped_subscribers_total",
+		Help: "Number of watch subscribers dropped for consuming events too slowly.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		GRPCRequests,
+		GRPCDuration,
+		SQLDuration,
+		SQLErrors,
+		CurrentRevision,
+		CompactRevision,
+		CompactTargetRevision,
+		CompactDeletedRows,
+		PollLag,
+		Fills,
+		ActiveWatches,
+		BroadcasterDrops,
+	)
+}
+
+// ObserveSQL records the latency and the outcome of a statement that started
+// at start.
+func ObserveSQL(statement string, start time.Time, err error) {
+	SQLDuration.WithLabelValues(statement).Observe(time.Since(start).Seconds())
+	if err != nil {
+		SQLErrors.WithLabelValues(statement).Inc()
+	}
+}
+
+// UnaryServerInterceptor records the latency and status of unary requests.
+// It is installed on the gRPC server kine creates, embedders passing their
+// own server can install it themselves.
+func UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	method := methodName(info.FullMethod)
+	GRPCDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	GRPCRequests.WithLabelValues(method, status.Code(err).String()).Inc()
+	return resp, err
+}
+
+// StreamServerInterceptor records the status of streams, such as watches and
+// lease keep alives, once they end.
+func StreamServerInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	err := handler(srv, ss)
+	GRPCRequests.WithLabelValues(methodName(info.FullMethod), status.Code(err).String()).Inc()
+	return err
+}
+
+// methodName returns the method of a full "/service/method" name
+func methodName(fullMethod string) string {
+	return fullMethod[strings.LastIndex(fullMethod, "/")+1:]
+}
@@ -0,0 +1,128 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// sampleCount returns the number of observations of the histogram with the
+// label value in the registry
+func sampleCount(t *testing.T, name, label, value string) uint64 {
+	families, err := Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, pair := range metric.GetLabel() {
+				if pair.GetName() == label && pair.GetValue() == value {
+					return metric.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/etcdserverpb.KV/Range"}
+	ok := testutil.ToFloat64(GRPCRequests.WithLabelValues("Range", "OK"))
+	outOfRange := testutil.ToFloat64(GRPCRequests.WithLabelValues("Range", "OutOfRange"))
+	observed := sampleCount(t, "kine_grpc_request_duration_seconds", "grpc_method", "Range")
+
+	resp, err := UnaryServerInterceptor(context.Background(), "request", info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "response", nil
+	})
+	if resp != "response" || err != nil {
+		t.Fatalf("got %v, %v from the interceptor, expected the response of the handler", resp, err)
+	}
+	failed := status.Error(codes.OutOfRange, "compacted")
+	if _, err := UnaryServerInterceptor(context.Background(), "request", info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, failed
+	}); err != failed {
+		t.Fatalf("got error %v from the interceptor, expected %v", err, failed)
+	}
+
+	if n := testutil.ToFloat64(GRPCRequests.WithLabelValues("Range", "OK")) - ok; n != 1 {
+		t.Fatalf("counted %v successful requests, expected 1", n)
+	}
+	if n := testutil.ToFloat64(GRPCRequests.WithLabelValues("Range", "OutOfRange")) - outOfRange; n != 1 {
+		t.Fatalf("counted %v failed requests, expected 1", n)
+	}
+	if n := sampleCount(t, "kine_grpc_request_duration_seconds", "grpc_method", "Range") - observed; n != 2 {
+		t.Fatalf("observed the latency of %d requests, expected 2", n)
+	}
+}
+
+func TestStreamServerInterceptor(t *testing.T) {
+	info := &grpc.StreamServerInfo{FullMethod: "/etcdserverpb.Watch/Watch", IsServerStream: true}
+	canceled := testutil.ToFloat64(GRPCRequests.WithLabelValues("Watch", "Canceled"))
+
+	err := StreamServerInterceptor(nil, nil, info, func(srv interface{}, stream grpc.ServerStream) error {
+		return status.Error(codes.Canceled, "canceled")
+	})
+	if status.Code(err) != codes.Canceled {
+		t.Fatalf("got error %v from the interceptor, expected the error of the handler", err)
+	}
+	if n := testutil.ToFloat64(GRPCRequests.WithLabelValues("Watch", "Canceled")) - canceled; n != 1 {
+		t.Fatalf("counted %v canceled streams, expected 1", n)
+	}
+}
+
+func TestObserveSQL(t *testing.T) {
+	failed := testutil.ToFloat64(SQLErrors.WithLabelValues("test"))
+	observed := sampleCount(t, "kine_sql_duration_seconds", "statement", "test")
+
+	ObserveSQL("test", time.Now(), nil)
+	ObserveSQL("test", time.Now(), errors.New("failed"))
+
+	if n := testutil.ToFloat64(SQLErrors.WithLabelValues("test")) - failed; n != 1 {
+		t.Fatalf("counted %v failed statements, expected 1", n)
+	}
+	if n := sampleCount(t, "kine_sql_duration_seconds", "statement", "test") - observed; n != 2 {
+		t.Fatalf("observed the latency of %d statements, expected 2", n)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	CurrentRevision.Set(1)
+
+	gathered := func(g prometheus.Gatherer) (kine, other bool) {
+		families, err := g.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, family := range families {
+			if strings.HasPrefix(family.GetName(), "kine_") {
+				kine = true
+			} else {
+				other = true
+			}
+		}
+		return kine, other
+	}
+
+	if kine, other := gathered(Registry); !kine || !other {
+		t.Fatalf("kine registry has kine metrics %v and runtime metrics %v, expected both", kine, other)
+	}
+	// embedders registering the same collectors on the default registry
+	// don't clash with kine
+	if kine, _ := gathered(prometheus.DefaultGatherer); kine {
+		t.Fatal("kine metrics are registered on the default registry")
+	}
+	if err := prometheus.DefaultRegisterer.Register(prometheus.NewGauge(prometheus.GaugeOpts{Name: "kine_current_revision"})); err != nil {
+		t.Fatalf("registering a kine metric on the default registry: %v", err)
+	}
+}
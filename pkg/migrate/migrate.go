@@ -0,0 +1,264 @@
+// Package migrate copies the log of one backend into a backend of another
+// driver, either with its whole history or as a snapshot of the keys.
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/kine/pkg/logstructured"
+	"github.com/rancher/kine/pkg/server"
+	"github.com/rancher/kine/pkg/snapshot"
+	"github.com/sirupsen/logrus"
+)
+
+// batchSize is the number of rows read and written at once
+const batchSize = 1000
+
+// Log is a backend that gives access to the rows of its log as they are
+// stored, the backends of every driver are.
+type Log interface {
+	server.Backend
+	CompactRevision(ctx context.Context) (int64, error)
+	Rows(ctx context.Context, id, limit int64) ([]*logstructured.Row, error)
+	InsertRows(ctx context.Context, rows []*logstructured.Row) error
+	SetRevisions(ctx context.Context, current, compact int64) error
+	InsertLeases(ctx context.Context, leases []*server.Lease) error
+}
+
+// History copies every row of the log of from into to with its revision, as
+// well as the leases with the time they expire at, and then moves to to the
+// current and compact revisions of from. Neither backend may be started, and from must not change while it
+// is copied.
+//
+// A copy that was interrupted continues after the last row it copied, to
+// must not have any other rows. Once the rows are copied, the rows of both
+// logs are counted and checksummed and a mismatch fails the copy.
+func History(ctx context.Context, from, to server.Backend) error {
+	src, err := asLog(from)
+	if err != nil {
+		return err
+	}
+	dst, err := asLog(to)
+	if err != nil {
+		return err
+	}
+
+	current, err := src.CurrentRevision(ctx)
+	if err != nil {
+		return err
+	}
+	compact, err := src.CompactRevision(ctx)
+	if err != nil {
+		return err
+	}
+
+	start, err := resumeRevision(ctx, src, dst, current)
+	if err != nil {
+		return err
+	}
+	if start > 0 {
+		logrus.Infof("Resuming migration after revision %d of %d", start, current)
+	} else {
+		logrus.Infof("Migrating revisions up to %d, compacted at %d", current, compact)
+	}
+
+	for revision := start; revision < current; {
+		rows, err := src.Rows(ctx, revision, batchSize)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read rows after revision %d", revision)
+		}
+		rows = upTo(rows, current)
+		if len(rows) == 0 {
+			break
+		}
+		if err := dst.InsertRows(ctx, rows); err != nil {
+			return errors.Wrapf(err, "failed to write rows after revision %d", revision)
+		}
+		revision = rows[len(rows)-1].ID
+		logrus.Debugf("Migrated revisions up to %d of %d", revision, current)
+	}
+
+	if err := copyLeases(ctx, src, dst); err != nil {
+		return err
+	}
+
+	srcCount, srcSum, err := checksum(ctx, src, current)
+	if err != nil {
+		return errors.Wrap(err, "failed to checksum the source rows")
+	}
+	dstCount, dstSum, err := checksum(ctx, dst, current)
+	if err != nil {
+		return errors.Wrap(err, "failed to checksum the migrated rows")
+	}
+	if srcCount != dstCount {
+		return fmt.Errorf("migrated %d rows of %d", dstCount, srcCount)
+	}
+	if !bytes.Equal(srcSum, dstSum) {
+		return fmt.Errorf("checksum of the %d migrated rows is %x rather than %x", dstCount, dstSum, srcSum)
+	}
+
+	if err := dst.SetRevisions(ctx, current, compact); err != nil {
+		return errors.Wrap(err, "failed to set the revisions")
+	}
+	logrus.Infof("Migrated %d rows up to revision %d, checksum %x", srcCount, current, srcSum)
+	return nil
+}
+
+// Snapshot copies the keys of from at its current revision into to, which
+// must be empty, through a snapshot, and returns the revision. The history
+// before the revision is not copied. Snapshots of both backends at the
+// revision have to match once it is copied.
+func Snapshot(ctx context.Context, from, to server.Backend) (int64, error) {
+	r, w := io.Pipe()
+	go func() {
+		_, err := snapshot.Save(ctx, from, w, 0)
+		w.CloseWithError(err)
+	}()
+
+	revision, err := snapshot.Restore(ctx, to, r)
+	if err != nil {
+		r.CloseWithError(err)
+		return 0, err
+	}
+
+	srcSum, err := snapshotChecksum(ctx, from, revision)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to checksum the source keys")
+	}
+	dstSum, err := snapshotChecksum(ctx, to, revision)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to checksum the migrated keys")
+	}
+	if !bytes.Equal(srcSum, dstSum) {
+		return 0, fmt.Errorf("checksum of the migrated keys is %x rather than %x", dstSum, srcSum)
+	}
+
+	logrus.Infof("Migrated the keys at revision %d, checksum %x", revision, srcSum)
+	return revision, nil
+}
+
+func asLog(backend server.Backend) (Log, error) {
+	log, ok := backend.(Log)
+	if !ok {
+		return nil, fmt.Errorf("backend %T has no access to its rows", backend)
+	}
+	return log, nil
+}
+
+// resumeRevision returns the revision the copy continues after, the last
+// revision of dst if its row matches the one of src. A dst without a row at
+// its last revision was not written by a copy and fails it.
+func resumeRevision(ctx context.Context, src, dst Log, current int64) (int64, error) {
+	last, err := dst.CurrentRevision(ctx)
+	if err != nil || last == 0 {
+		return 0, err
+	}
+	// a copy that is complete is at or past the source once its revisions are
+	// set, the checksums tell whether it matches
+	if last >= current {
+		return current, nil
+	}
+
+	dstRows, err := dst.Rows(ctx, last-1, 1)
+	if err != nil {
+		return 0, err
+	}
+	srcRows, err := src.Rows(ctx, last-1, 1)
+	if err != nil {
+		return 0, err
+	}
+	if len(dstRows) == 0 || dstRows[0].ID != last ||
+		len(srcRows) == 0 || srcRows[0].ID != last || !bytes.Equal(encodeRow(srcRows[0]), encodeRow(dstRows[0])) {
+		return 0, fmt.Errorf("destination has rows up to revision %d that are not from the source", last)
+	}
+	return last, nil
+}
+
+// upTo returns the rows at or before the revision
+func upTo(rows []*logstructured.Row, revision int64) []*logstructured.Row {
+	for i, row := range rows {
+		if row.ID > revision {
+			return rows[:i]
+		}
+	}
+	return rows
+}
+
+// copyLeases stores the leases of src in dst with the time they expire at,
+// so that they run out when they would have on src. Leases that are already
+// there were copied before.
+func copyLeases(ctx context.Context, src, dst Log) error {
+	_, leases, err := src.LeaseLeases(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to list leases")
+	}
+	return errors.Wrap(dst.InsertLeases(ctx, leases), "failed to copy leases")
+}
+
+// checksum returns the number and the SHA-256 of the rows of the log up to
+// the revision
+func checksum(ctx context.Context, log Log, revision int64) (int64, []byte, error) {
+	var (
+		count int64
+		h     = sha256.New()
+	)
+	for last := int64(0); last < revision; {
+		rows, err := log.Rows(ctx, last, batchSize)
+		if err != nil {
+			return 0, nil, err
+		}
+		rows = upTo(rows, revision)
+		if len(rows) == 0 {
+			break
+		}
+		for _, row := range rows {
+			h.Write(encodeRow(row))
+		}
+		count += int64(len(rows))
+		last = rows[len(rows)-1].ID
+	}
+	return count, h.Sum(nil), nil
+}
+
+// snapshotChecksum returns the SHA-256 of a snapshot of the backend at the
+// revision
+func snapshotChecksum(ctx context.Context, backend server.Backend, revision int64) ([]byte, error) {
+	h := sha256.New()
+	if _, err := snapshot.Save(ctx, backend, h, revision); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// encodeRow encodes every column of the row, so that rows that are stored the
+// same encode the same whatever the driver
+func encodeRow(row *logstructured.Row) []byte {
+	var flags int64
+	if row.Created {
+		flags |= 1
+	}
+	if row.Deleted {
+		flags |= 2
+	}
+
+	data := make([]byte, 0, 11*binary.MaxVarintLen64+len(row.Name)+len(row.Value)+len(row.OldValue))
+	for _, v := range []int64{row.ID, row.BatchRevision, flags, row.CreateRevision, row.PrevRevision, row.Lease, row.Version, row.OldLease} {
+		data = appendVarint(data, v)
+	}
+	for _, v := range [][]byte{[]byte(row.Name), row.Value, row.OldValue} {
+		data = appendVarint(data, int64(len(v)))
+		data = append(data, v...)
+	}
+	return data
+}
+
+func appendVarint(data []byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(data, buf[:binary.PutVarint(buf[:], v)]...)
+}
@@ -0,0 +1,372 @@
+package migrate_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rancher/kine/pkg/drivers/bolt"
+	"github.com/rancher/kine/pkg/drivers/memory"
+	"github.com/rancher/kine/pkg/drivers/sqlite"
+	"github.com/rancher/kine/pkg/logstructured"
+	"github.com/rancher/kine/pkg/migrate"
+	"github.com/rancher/kine/pkg/server"
+)
+
+// backends are the backends logs are copied into, each opened in the
+// directory
+var backends = []struct {
+	name string
+	new  func(ctx context.Context, dir string) (server.Backend, error)
+	// compactRow is set for backends that record the compact revision in a
+	// row of its own, after the rows that were copied
+	compactRow bool
+}{
+	{
+		name: "bolt",
+		new: func(ctx context.Context, dir string) (server.Backend, error) {
+			return bolt.New(ctx, filepath.Join(dir, "state.bolt"), logstructured.CompactConfig{Disable: true})
+		},
+	},
+	{
+		name: "memory",
+		new: func(ctx context.Context, dir string) (server.Backend, error) {
+			return memory.New(ctx, logstructured.CompactConfig{Disable: true})
+		},
+	},
+	{
+		name: "sqlite",
+		new: func(ctx context.Context, dir string) (server.Backend, error) {
+			return sqlite.New(ctx, filepath.Join(dir, "state.db?_journal=WAL&cache=shared"), logstructured.CompactConfig{Disable: true})
+		},
+		compactRow: true,
+	},
+}
+
+// source is a memory backend with updated, deleted and leased keys, and keys
+// written together in a transaction, compacted up to the revision it returns.
+// One of its leases runs out before its TTL, as if it was kept alive a while
+// ago.
+func source(ctx context.Context, t *testing.T) (migrate.Log, int64) {
+	backend, err := memory.New(ctx, logstructured.CompactConfig{Disable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	_, lease, err := backend.LeaseGrant(ctx, 0, 600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.(migrate.Log).InsertLeases(ctx, []*server.Lease{{
+		ID:      lease.ID ^ 1,
+		TTL:     600,
+		Expires: time.Now().Unix() + 60,
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	rev, err := backend.Create(ctx, "/a", []byte("1"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev, _, _, err = backend.Update(ctx, "/a", []byte("2"), rev, 0); err != nil {
+		t.Fatal(err)
+	}
+	if rev, err = backend.Create(ctx, "/b", []byte("1"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err = backend.Delete(ctx, "/b", rev); err != nil {
+		t.Fatal(err)
+	}
+	compact, err := backend.Create(ctx, "/c", []byte("1"), lease.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := backend.BeginTx(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"/a", "/d", "/e"} {
+		if _, err := tx.Put(ctx, key, []byte("2"), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := tx.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.Create(ctx, "/b", []byte("2"), lease.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	_, done, err := backend.Compact(ctx, compact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	return backend.(migrate.Log), compact
+}
+
+// newDestination opens the backend in a new directory, done closes it and
+// removes the directory
+func newDestination(ctx context.Context, t *testing.T, new func(ctx context.Context, dir string) (server.Backend, error)) (migrate.Log, func()) {
+	dir, err := ioutil.TempDir("", "kine-migrate-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	backend, err := new(ctx, dir)
+	if err != nil {
+		cancel()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return backend.(migrate.Log), func() {
+		cancel()
+		os.RemoveAll(dir)
+	}
+}
+
+// rows returns every row of the log up to the revision
+func rows(ctx context.Context, t *testing.T, log migrate.Log, revision int64) []*logstructured.Row {
+	rows, err := log.Rows(ctx, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, row := range rows {
+		if row.ID > revision {
+			return rows[:i]
+		}
+	}
+	return rows
+}
+
+// list returns every key of the backend at the revision, but the
+// compact_rev_key row of the SQL backends
+func list(ctx context.Context, t *testing.T, backend server.Backend, revision int64) []*server.KeyValue {
+	_, kvs, err := backend.List(ctx, "", "\x00", 0, revision, server.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, kv := range kvs {
+		if kv.Key == "compact_rev_key" {
+			return append(kvs[:i], kvs[i+1:]...)
+		}
+	}
+	return kvs
+}
+
+// leases returns every lease of the backend
+func leases(ctx context.Context, t *testing.T, backend server.Backend) []server.Lease {
+	_, leases, err := backend.LeaseLeases(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make([]server.Lease, 0, len(leases))
+	for _, lease := range leases {
+		values = append(values, *lease)
+	}
+	return values
+}
+
+// checkMigrated checks that dst holds the rows, keys and leases of src up to
+// the current revision of src, compacted like src
+func checkMigrated(ctx context.Context, t *testing.T, src, dst migrate.Log, compactRow bool) {
+	current, err := src.CurrentRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compact, err := src.CompactRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := current
+	if compactRow {
+		expected++
+	}
+	if rev, err := dst.CurrentRevision(ctx); err != nil || rev != expected {
+		t.Fatalf("migrated current revision is %d (%v), expected %d", rev, err, expected)
+	}
+	if rev, err := dst.CompactRevision(ctx); err != nil || rev != compact {
+		t.Fatalf("migrated compact revision is %d (%v), expected %d", rev, err, compact)
+	}
+	if migrated := rows(ctx, t, dst, current); !reflect.DeepEqual(migrated, rows(ctx, t, src, current)) {
+		t.Fatalf("migrated rows differ from the source rows")
+	}
+	for _, revision := range []int64{compact, current} {
+		if kvs := list(ctx, t, dst, revision); !reflect.DeepEqual(kvs, list(ctx, t, src, revision)) {
+			t.Fatalf("migrated keys at revision %d differ from the source keys", revision)
+		}
+	}
+
+	if leases, srcLeases := leases(ctx, t, dst), leases(ctx, t, src); len(leases) != 2 || !reflect.DeepEqual(leases, srcLeases) {
+		t.Fatalf("migrated leases %v, expected %v", leases, srcLeases)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	src, _ := source(ctx, t)
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			dst, done := newDestination(ctx, t, b.new)
+			defer done()
+
+			if err := migrate.History(ctx, src, dst); err != nil {
+				t.Fatal(err)
+			}
+			checkMigrated(ctx, t, src, dst, b.compactRow)
+
+			// a complete copy is left as is
+			if err := migrate.History(ctx, src, dst); err != nil {
+				t.Fatalf("migrating again: %v", err)
+			}
+		})
+	}
+}
+
+func TestHistoryResume(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	src, _ := source(ctx, t)
+	srcRows := rows(ctx, t, src, 1<<62)
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			dst, done := newDestination(ctx, t, b.new)
+			defer done()
+
+			// an interrupted copy left the first rows
+			if err := dst.InsertRows(ctx, srcRows[:len(srcRows)/2]); err != nil {
+				t.Fatal(err)
+			}
+			if err := migrate.History(ctx, src, dst); err != nil {
+				t.Fatal(err)
+			}
+			checkMigrated(ctx, t, src, dst, b.compactRow)
+		})
+	}
+}
+
+func TestHistoryMismatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	src, _ := source(ctx, t)
+	srcRows := rows(ctx, t, src, 1<<62)
+	changed := func(row *logstructured.Row) *logstructured.Row {
+		copied := *row
+		copied.Value = []byte("changed")
+		return &copied
+	}
+
+	for _, tt := range []struct {
+		name string
+		// rows are in the destination before the copy
+		rows func() []*logstructured.Row
+		// current is the revision the destination is moved to, if set
+		current int64
+		err     string
+	}{
+		{
+			name: "last row differs",
+			rows: func() []*logstructured.Row {
+				rows := append([]*logstructured.Row{}, srcRows[:2]...)
+				return append(rows, changed(srcRows[2]))
+			},
+			err: "not from the source",
+		},
+		{
+			name: "last row missing",
+			rows: func() []*logstructured.Row {
+				return append([]*logstructured.Row{}, srcRows[:2]...)
+			},
+			current: srcRows[2].ID,
+			err:     "not from the source",
+		},
+		{
+			name: "earlier row differs",
+			rows: func() []*logstructured.Row {
+				rows := append([]*logstructured.Row{}, srcRows[:3]...)
+				rows[1] = changed(rows[1])
+				return rows
+			},
+			err: "checksum",
+		},
+	} {
+		for _, b := range backends {
+			t.Run(tt.name+"/"+b.name, func(t *testing.T) {
+				dst, done := newDestination(ctx, t, b.new)
+				defer done()
+
+				if err := dst.InsertRows(ctx, tt.rows()); err != nil {
+					t.Fatal(err)
+				}
+				if tt.current > 0 {
+					if err := dst.SetRevisions(ctx, tt.current, 0); err != nil {
+						t.Fatal(err)
+					}
+				}
+				err := migrate.History(ctx, src, dst)
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("migrating got error %v, expected one about the %s", err, tt.err)
+				}
+			})
+		}
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	src, _ := source(ctx, t)
+	current, err := src.CurrentRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			dst, done := newDestination(ctx, t, b.new)
+			defer done()
+
+			rev, err := migrate.Snapshot(ctx, src, dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rev != current {
+				t.Fatalf("migrated revision %d, expected %d", rev, current)
+			}
+			if err := dst.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if kvs := list(ctx, t, dst, 0); !reflect.DeepEqual(kvs, list(ctx, t, src, 0)) {
+				t.Fatalf("migrated keys differ from the source keys")
+			}
+			// the history before the revision is not copied
+			if _, _, err := dst.List(ctx, "", "\x00", 0, current-1, server.ListOptions{}); err != server.ErrCompacted {
+				t.Fatalf("listing before the revision got error %v, expected %v", err, server.ErrCompacted)
+			}
+
+			// only empty backends are migrated into
+			if _, err := migrate.Snapshot(ctx, src, dst); err == nil {
+				t.Fatal("migrated into a backend with keys")
+			}
+		})
+	}
+}
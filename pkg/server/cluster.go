@@ -0,0 +1,201 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.etcd.io/etcd/etcdserver/etcdserverpb"
+)
+
+var _ etcdserverpb.ClusterServer = (*KVServerBridge)(nil)
+
+const (
+	// heartbeatInterval is the time between the heartbeats of a member
+	heartbeatInterval = 5 * time.Second
+	// memberTTL is how long a member is listed after its last heartbeat, it
+	// has to miss a few heartbeats in a row to drop out
+	memberTTL = 3 * heartbeatInterval
+)
+
+// header fills in the fields of response headers that identify the cluster
+// and the member, as etcd does for the responses of every service. They stay
+// zero until the server joins its cluster.
+type header struct {
+	clusterID uint64
+	memberID  uint64
+}
+
+func (h header) fill(rh *etcdserverpb.ResponseHeader) {
+	if rh == nil {
+		return
+	}
+	rh.ClusterId = h.clusterID
+	rh.MemberId = h.memberID
+}
+
+// at returns the header of a response at the revision
+func (h header) at(rev int64) *etcdserverpb.ResponseHeader {
+	rh := txnHeader(rev)
+	h.fill(rh)
+	return rh
+}
+
+// Join registers the server as a member of the cluster of kine instances that
+// share the backend, reachable on the client URLs, and keeps it registered
+// with a heartbeat until the context is done. From then on, response headers
+// carry the IDs of the cluster and member. It must be called before the server
+// is serving.
+func (k *KVServerBridge) Join(ctx context.Context, name string, clientURLs []string) error {
+	backend := k.limited.backend
+
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return err
+	}
+	// IDs are never zero, which etcd reads as no ID
+	clusterID, err := backend.ClusterID(ctx, binary.BigEndian.Uint64(id[:])|1)
+	if err != nil {
+		return err
+	}
+
+	member := Member{
+		ID:         memberID(clusterID, name, clientURLs),
+		Name:       name,
+		ClientURLs: clientURLs,
+		Heartbeat:  time.Now().Unix(),
+	}
+	if err := backend.PutMember(ctx, &member); err != nil {
+		return err
+	}
+	logrus.Infof("Joined cluster %x as member %x", clusterID, member.ID)
+
+	k.header = header{
+		clusterID: clusterID,
+		memberID:  member.ID,
+	}
+	if err := k.alarms.reload(ctx, backend); err != nil {
+		return err
+	}
+	go k.heartbeat(ctx, member)
+	return nil
+}
+
+// heartbeat renews the registration of the member and removes the members that
+// stopped renewing theirs, whether they were stopped or lost the storage. It
+// also reloads the alarms, which any member may have raised or cleared.
+func (k *KVServerBridge) heartbeat(ctx context.Context, member Member) {
+	backend := k.limited.backend
+	t := time.NewTicker(heartbeatInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		if err := k.alarms.reload(ctx, backend); err != nil {
+			logrus.Errorf("Failed to reload alarms: %v", err)
+		}
+
+		member.Heartbeat = time.Now().Unix()
+		if err := backend.PutMember(ctx, &member); err != nil {
+			logrus.Errorf("Failed to renew member %x: %v", member.ID, err)
+			continue
+		}
+
+		members, err := backend.Members(ctx)
+		if err != nil {
+			logrus.Errorf("Failed to list members: %v", err)
+			continue
+		}
+		for _, m := range members {
+			if expired(m, member.Heartbeat) {
+				logrus.Infof("Removing member %x, its last heartbeat was at %s", m.ID, time.Unix(m.Heartbeat, 0))
+				if err := backend.DeleteMember(ctx, m.ID); err != nil {
+					logrus.Errorf("Failed to remove member %x: %v", m.ID, err)
+				}
+			}
+		}
+	}
+}
+
+// MemberList lists the members that sent a heartbeat recently. Every member
+// serves reads and writes, they have no peer URLs as they don't talk to each
+// other.
+func (k *KVServerBridge) MemberList(ctx context.Context, r *etcdserverpb.MemberListRequest) (*etcdserverpb.MemberListResponse, error) {
+	rev, err := k.limited.backend.CurrentRevision(ctx)
+	if err != nil {
+		return nil, err
+	}
+	members, err := k.limited.backend.Members(ctx)
+	if err != nil {
+		logrus.Errorf("error in member list: %v", err)
+		return nil, err
+	}
+
+	resp := &etcdserverpb.MemberListResponse{
+		Header: k.header.at(rev),
+	}
+	now := time.Now().Unix()
+	for _, m := range members {
+		if expired(m, now) {
+			continue
+		}
+		resp.Members = append(resp.Members, &etcdserverpb.Member{
+			ID:         m.ID,
+			Name:       m.Name,
+			ClientURLs: m.ClientURLs,
+		})
+	}
+	sort.Slice(resp.Members, func(i, j int) bool {
+		return resp.Members[i].ID < resp.Members[j].ID
+	})
+	return resp, nil
+}
+
+func (k *KVServerBridge) MemberAdd(ctx context.Context, r *etcdserverpb.MemberAddRequest) (*etcdserverpb.MemberAddResponse, error) {
+	return nil, unsupported("memberAdd")
+}
+
+func (k *KVServerBridge) MemberRemove(ctx context.Context, r *etcdserverpb.MemberRemoveRequest) (*etcdserverpb.MemberRemoveResponse, error) {
+	return nil, unsupported("memberRemove")
+}
+
+func (k *KVServerBridge) MemberUpdate(ctx context.Context, r *etcdserverpb.MemberUpdateRequest) (*etcdserverpb.MemberUpdateResponse, error) {
+	return nil, unsupported("memberUpdate")
+}
+
+func (k *KVServerBridge) MemberPromote(ctx context.Context, r *etcdserverpb.MemberPromoteRequest) (*etcdserverpb.MemberPromoteResponse, error) {
+	return nil, unsupported("memberPromote")
+}
+
+// expired tells whether the member missed its heartbeats up to now
+func expired(member *Member, now int64) bool {
+	return member.Heartbeat <= now-int64(memberTTL/time.Second)
+}
+
+// memberID derives the ID of a member from its name and client URLs, so that
+// it keeps its ID across restarts, like etcd derives it from the peer URLs.
+func memberID(clusterID uint64, name string, clientURLs []string) uint64 {
+	urls := append([]string(nil), clientURLs...)
+	sort.Strings(urls)
+
+	h := sha1.New()
+	h.Write([]byte(name))
+	for _, url := range urls {
+		h.Write([]byte{0})
+		h.Write([]byte(url))
+	}
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], clusterID)
+	h.Write(buf[:])
+
+	return binary.BigEndian.Uint64(h.Sum(nil)[:8]) | 1
+}
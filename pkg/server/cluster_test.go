@@ -0,0 +1,182 @@
+package server_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rancher/kine/pkg/logstructured"
+	"github.com/rancher/kine/pkg/server"
+	"go.etcd.io/etcd/etcdserver/etcdserverpb"
+)
+
+// newClusterServer starts a server that joins the cluster of its backend as
+// the member
+func newClusterServer(t *testing.T, b testBackend, member string) *testServer {
+	return newTestServerConfig(t, b, testConfig{
+		compact: logstructured.CompactConfig{Disable: true},
+		member:  member,
+	})
+}
+
+// members lists the members of the cluster, with the header of the response
+func (s *testServer) members(t *testing.T) (*etcdserverpb.ResponseHeader, []*etcdserverpb.Member) {
+	resp, err := s.cluster.MemberList(context.Background(), &etcdserverpb.MemberListRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.Header, resp.Members
+}
+
+// memberNames returns the names of the members in ID order
+func memberNames(members []*etcdserverpb.Member) []string {
+	var names []string
+	for _, m := range members {
+		names = append(names, m.Name)
+	}
+	return names
+}
+
+func TestMemberList(t *testing.T) {
+	for _, b := range testBackends {
+		t.Run(b.name, func(t *testing.T) {
+			s := newClusterServer(t, b, "kine-a")
+			defer s.close()
+			ctx := context.Background()
+
+			header, members := s.members(t)
+			if len(members) != 1 || members[0].Name != "kine-a" {
+				t.Fatalf("members are %v, expected kine-a", members)
+			}
+			self := members[0]
+			if url := "http://" + s.conn.Target(); !reflect.DeepEqual(self.ClientURLs, []string{url}) || len(self.PeerURLs) != 0 {
+				t.Fatalf("member has client URLs %v and peer URLs %v, expected client URL %s", self.ClientURLs, self.PeerURLs, url)
+			}
+			if header.ClusterId == 0 || header.MemberId != self.ID {
+				t.Fatalf("member list has cluster %x and member %x, expected member %x", header.ClusterId, header.MemberId, self.ID)
+			}
+
+			// another instance that keeps up its heartbeat is listed, one that
+			// stopped 15 seconds ago is not
+			now := time.Now().Unix()
+			for _, m := range []*server.Member{
+				{ID: 2, Name: "kine-b", ClientURLs: []string{"http://kine-b:2379"}, Heartbeat: now},
+				{ID: 4, Name: "kine-c", ClientURLs: []string{"http://kine-c:2379"}, Heartbeat: now - 15},
+			} {
+				if err := s.backend.PutMember(ctx, m); err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, members = s.members(t)
+			if names := memberNames(members); len(names) != 2 || names[0] != "kine-b" {
+				t.Fatalf("members are %v, expected kine-b and kine-a", names)
+			}
+
+			// the expired instance is removed from the storage by the next
+			// heartbeat
+			waitFor(t, func() bool {
+				registered, err := s.backend.Members(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, m := range registered {
+					if m.Name == "kine-c" {
+						return false
+					}
+				}
+				return len(registered) == 2
+			})
+
+			if b.volatile {
+				return
+			}
+			// the cluster keeps its ID across restarts, the member is listed
+			// under its new client URL
+			s.restart(t)
+			restarted, members := s.members(t)
+			if restarted.ClusterId != header.ClusterId {
+				t.Fatalf("restarted in cluster %x, expected cluster %x", restarted.ClusterId, header.ClusterId)
+			}
+			var listed bool
+			for _, m := range members {
+				listed = listed || m.ID == restarted.MemberId
+			}
+			if !listed {
+				t.Fatalf("restarted member %x is not among the members %v", restarted.MemberId, memberNames(members))
+			}
+		})
+	}
+}
+
+func TestClusterHeader(t *testing.T) {
+	s := newClusterServer(t, testBackends[0], "kine-a")
+	defer s.close()
+	ctx := context.Background()
+
+	expected, _ := s.members(t)
+	check := func(t *testing.T, name string, header *etcdserverpb.ResponseHeader) {
+		if header == nil || header.ClusterId != expected.ClusterId || header.MemberId != expected.MemberId {
+			t.Fatalf("%s has header %v, expected cluster %x and member %x", name, header, expected.ClusterId, expected.MemberId)
+		}
+	}
+
+	w := s.startWatch(t, &etcdserverpb.WatchCreateRequest{Key: []byte("/a")})
+	defer w.close()
+	created := w.next(t)
+	check(t, "watch create", created.Header)
+	if created.Header.Revision == 0 {
+		t.Fatalf("watch create has header %v, expected the current revision", created.Header)
+	}
+
+	put, err := s.kv.Put(ctx, &etcdserverpb.PutRequest{Key: []byte("/a"), Value: []byte("1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, "put", put.Header)
+	check(t, "watch event", w.next(t).Header)
+
+	rng, err := s.kv.Range(ctx, &etcdserverpb.RangeRequest{Key: []byte("/a")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, "range", rng.Header)
+
+	txn, err := s.kv.Txn(ctx, &etcdserverpb.TxnRequest{
+		Success: []*etcdserverpb.RequestOp{{Request: &etcdserverpb.RequestOp_RequestRange{RequestRange: &etcdserverpb.RangeRequest{Key: []byte("/a")}}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, "txn", txn.Header)
+
+	w.send(t, &etcdserverpb.WatchRequest{RequestUnion: &etcdserverpb.WatchRequest_CancelRequest{
+		CancelRequest: &etcdserverpb.WatchCancelRequest{WatchId: created.WatchId},
+	}})
+	canceled := w.next(t)
+	check(t, "watch cancel", canceled.Header)
+	if !canceled.Canceled || canceled.Header.Revision != put.Header.Revision {
+		t.Fatalf("got response %v, expected the watch canceled at revision %d", canceled, put.Header.Revision)
+	}
+
+	del, err := s.kv.DeleteRange(ctx, &etcdserverpb.DeleteRangeRequest{Key: []byte("/a")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, "delete", del.Header)
+
+	grant, err := s.lease.LeaseGrant(ctx, &etcdserverpb.LeaseGrantRequest{TTL: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, "lease grant", grant.Header)
+
+	status, err := s.maintenance.Status(ctx, &etcdserverpb.StatusRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, "status", status.Header)
+	if status.Leader != expected.MemberId {
+		t.Fatalf("status has leader %x, expected member %x", status.Leader, expected.MemberId)
+	}
+}
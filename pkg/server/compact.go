@@ -6,6 +6,12 @@ import (
 	"go.etcd.io/etcd/etcdserver/etcdserverpb"
 )
 
+// compactRevKey is the key older releases of kine compacted through, the SQL
+// backends record the compact revision in it
+const compactRevKey = "compact_rev_key"
+
+// isCompact reports whether the transaction is the one that guards a
+// compaction by comparing the version of compactRevKey
 func isCompact(txn *etcdserverpb.TxnRequest) bool {
 	return len(txn.Compare) == 1 &&
 		txn.Compare[0].Target == etcdserverpb.Compare_VERSION &&
@@ -14,21 +20,55 @@ func isCompact(txn *etcdserverpb.TxnRequest) bool {
 		txn.Success[0].GetRequestPut() != nil &&
 		len(txn.Failure) == 1 &&
 		txn.Failure[0].GetRequestRange() != nil &&
-		string(txn.Compare[0].Key) == "compact_rev_key"
+		string(txn.Compare[0].Key) == compactRevKey
 }
 
+// compact answers the transaction clients such as the Kubernetes API server
+// run before each compaction to agree on who compacts. The SQL backends keep
+// the compact revision in compactRevKey themselves, so the put is not applied
+// and the transaction always succeeds, at the current revision. The
+// compaction itself is requested separately and handled by compactRevision.
 func (l *LimitedServer) compact(ctx context.Context) (*etcdserverpb.TxnResponse, error) {
+	rev, err := l.backend.CurrentRevision(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	return &etcdserverpb.TxnResponse{
-		Header:    &etcdserverpb.ResponseHeader{},
+		Header:    txnHeader(rev),
 		Succeeded: true,
 		Responses: []*etcdserverpb.ResponseOp{
 			{
 				Response: &etcdserverpb.ResponseOp_ResponsePut{
 					ResponsePut: &etcdserverpb.PutResponse{
-						Header: &etcdserverpb.ResponseHeader{},
+						Header: txnHeader(rev),
 					},
 				},
 			},
 		},
 	}, nil
 }
+
+// compactRevision discards the history before the revision. A physical
+// compaction only returns once the history is removed.
+func (l *LimitedServer) compactRevision(ctx context.Context, r *etcdserverpb.CompactionRequest) (*etcdserverpb.CompactionResponse, error) {
+	rev, done, err := l.backend.Compact(ctx, r.Revision)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.Physical {
+		select {
+		case err := <-done:
+			if err != nil {
+				return nil, err
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	return &etcdserverpb.CompactionResponse{
+		Header: txnHeader(rev),
+	}, nil
+}
@@ -0,0 +1,279 @@
+package server_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rancher/kine/pkg/logstructured"
+	"github.com/rancher/kine/pkg/server"
+	"go.etcd.io/etcd/etcdserver/api/v3rpc/rpctypes"
+	"go.etcd.io/etcd/etcdserver/etcdserverpb"
+)
+
+func TestCompact(t *testing.T) {
+	for _, b := range testBackends {
+		t.Run(b.name, func(t *testing.T) {
+			s := newTestServer(t, b)
+			defer s.close()
+
+			s.put(t, "/k/a", "1", 0)
+			first := s.put(t, "/k/a", "2", 0)
+			s.put(t, "/k/b", "b", 0)
+			s.put(t, "/k/a", "3", 0)
+			compacted := s.put(t, "/k/b", "b2", 0)
+			last := s.put(t, "/k/a", "4", 0)
+
+			// the compact revision is recorded before the response, the
+			// checks below don't wait for the history to be removed
+			for _, tt := range []struct {
+				name     string
+				revision int64
+				err      error
+			}{
+				{name: "future revision", revision: last + 1, err: rpctypes.ErrGRPCFutureRev},
+				{name: "revision", revision: compacted},
+				{name: "compacted revision", revision: compacted, err: rpctypes.ErrGRPCCompacted},
+				{name: "older revision", revision: first, err: rpctypes.ErrGRPCCompacted},
+			} {
+				t.Run(tt.name, func(t *testing.T) {
+					resp, err := s.kv.Compact(context.Background(), &etcdserverpb.CompactionRequest{Revision: tt.revision})
+					if tt.err != nil {
+						if err == nil || err.Error() != tt.err.Error() {
+							t.Fatalf("got error %v, expected %v", err, tt.err)
+						}
+						return
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+					if resp.Header.Revision != last {
+						t.Fatalf("compacted at revision %d, expected %d", resp.Header.Revision, last)
+					}
+				})
+			}
+
+			for _, tt := range []struct {
+				name     string
+				revision int64
+				keys     map[string]string
+				err      error
+			}{
+				{name: "current revision", keys: map[string]string{"/k/a": "4", "/k/b": "b2"}},
+				{name: "compacted revision", revision: compacted, keys: map[string]string{"/k/a": "3", "/k/b": "b2"}},
+				{name: "before the compacted revision", revision: compacted - 1, err: rpctypes.ErrGRPCCompacted},
+				{name: "oldest revision", revision: first, err: rpctypes.ErrGRPCCompacted},
+			} {
+				t.Run("range at "+tt.name, func(t *testing.T) {
+					if tt.err != nil {
+						for _, r := range []*etcdserverpb.RangeRequest{
+							{Key: []byte("/k/"), RangeEnd: []byte("/k0"), Revision: tt.revision},
+							{Key: []byte("/k/a"), Revision: tt.revision},
+						} {
+							_, err := s.kv.Range(context.Background(), r)
+							if err == nil || err.Error() != tt.err.Error() {
+								t.Fatalf("range of %s got error %v, expected %v", r.Key, err, tt.err)
+							}
+						}
+						return
+					}
+					if keys := s.keys(t, "/k/", "/k0", tt.revision); !reflect.DeepEqual(keys, tt.keys) {
+						t.Fatalf("keys are %v, expected %v", keys, tt.keys)
+					}
+				})
+			}
+
+			for _, tt := range []struct {
+				name     string
+				revision int64
+				// canceled watches report the compact revision, the others
+				// get the events from the revision on. Deletes at the compact
+				// revision are compacted too, so a watch can't start at it.
+				canceled bool
+				values   []string
+			}{
+				{name: "after the compacted revision", revision: compacted + 1, values: []string{"4"}},
+				{name: "at the compacted revision", revision: compacted, canceled: true},
+				{name: "before the compacted revision", revision: compacted - 1, canceled: true},
+				{name: "oldest revision", revision: first, canceled: true},
+			} {
+				t.Run("watch from "+tt.name, func(t *testing.T) {
+					w := s.startWatch(t, &etcdserverpb.WatchCreateRequest{Key: []byte("/k/"), RangeEnd: []byte("/k0"), StartRevision: tt.revision})
+					defer w.close()
+
+					created := w.next(t)
+					if !created.Created {
+						t.Fatalf("got response %v, expected the watch to be created", created)
+					}
+					if tt.canceled {
+						resp := w.next(t)
+						if !resp.Canceled || resp.CompactRevision != compacted || resp.WatchId != created.WatchId {
+							t.Fatalf("got response %v, expected the watch to be canceled at compact revision %d", resp, compacted)
+						}
+						return
+					}
+
+					var values []string
+					for _, e := range w.events(t, len(tt.values)) {
+						values = append(values, string(e.Kv.Value))
+					}
+					if !reflect.DeepEqual(values, tt.values) {
+						t.Fatalf("got values %v, expected %v", values, tt.values)
+					}
+					w.idle(t, 100*time.Millisecond)
+				})
+			}
+		})
+	}
+}
+
+// failingCompactBackend fails the removal of the history of every compaction
+type failingCompactBackend struct {
+	server.Backend
+}
+
+func (b *failingCompactBackend) Compact(ctx context.Context, revision int64) (int64, <-chan error, error) {
+	rev, done, err := b.Backend.Compact(ctx, revision)
+	if err != nil {
+		return rev, done, err
+	}
+	<-done
+	failed := make(chan error, 1)
+	failed <- errors.New("removal failed")
+	close(failed)
+	return rev, failed, nil
+}
+
+func TestCompactPhysical(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		// fail fails the removal of the history
+		fail bool
+	}{
+		{name: "removed"},
+		{name: "removal failed", fail: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServerConfig(t, testBackends[0], testConfig{
+				compact: logstructured.CompactConfig{Disable: true},
+				wrap: func(b server.Backend) server.Backend {
+					if tt.fail {
+						return &failingCompactBackend{Backend: b}
+					}
+					return b
+				},
+			})
+			defer s.close()
+
+			rev := s.put(t, "/k/a", "1", 0)
+			s.put(t, "/k/a", "2", 0)
+
+			// a physical compaction reports the error of the removal
+			_, err := s.kv.Compact(context.Background(), &etcdserverpb.CompactionRequest{Revision: rev, Physical: true})
+			if tt.fail != (err != nil) {
+				t.Fatalf("physical compaction got error %v, expected an error: %v", err, tt.fail)
+			}
+		})
+	}
+}
+
+func TestCompactGuard(t *testing.T) {
+	for _, b := range testBackends {
+		t.Run(b.name, func(t *testing.T) {
+			s := newTestServer(t, b)
+			defer s.close()
+
+			rev := s.put(t, "/k/a", "1", 0)
+
+			// the transaction the Kubernetes API server runs before each
+			// compaction always succeeds, at the current revision
+			resp, err := s.kv.Txn(context.Background(), &etcdserverpb.TxnRequest{
+				Compare: []*etcdserverpb.Compare{compareVersion("compact_rev_key", "", etcdserverpb.Compare_EQUAL, 0)},
+				Success: []*etcdserverpb.RequestOp{opPut("compact_rev_key", strconv.FormatInt(rev, 10))},
+				Failure: []*etcdserverpb.RequestOp{opRange("compact_rev_key")},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !resp.Succeeded || resp.Header.Revision != rev || len(resp.Responses) != 1 {
+				t.Fatalf("guard transaction is %v, expected it to succeed at revision %d", resp, rev)
+			}
+			if put := resp.Responses[0].GetResponsePut(); put == nil || put.Header.Revision != rev {
+				t.Fatalf("guard put response is %v, expected revision %d", put, rev)
+			}
+		})
+	}
+}
+
+func TestBackgroundCompaction(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		retention time.Duration
+		// compacted is whether the old revisions are compacted
+		compacted bool
+	}{
+		{name: "min retain", compacted: true},
+		{name: "retention", retention: time.Hour},
+	} {
+		for _, b := range testBackends {
+			t.Run(b.name+"/"+tt.name, func(t *testing.T) {
+				s := newTestServerConfig(t, b, testConfig{
+					compact: logstructured.CompactConfig{
+						Interval:  100 * time.Millisecond,
+						MinRetain: 2,
+						Retention: tt.retention,
+					},
+				})
+				defer s.close()
+
+				// background compaction runs along with the watch poller,
+				// which starts with the first watch
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				watch, err := etcdserverpb.NewWatchClient(s.conn).Watch(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := watch.Send(&etcdserverpb.WatchRequest{RequestUnion: &etcdserverpb.WatchRequest_CreateRequest{
+					CreateRequest: &etcdserverpb.WatchCreateRequest{Key: []byte("/k/"), RangeEnd: []byte("/k0")},
+				}}); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := watch.Recv(); err != nil {
+					t.Fatal(err)
+				}
+
+				first := s.put(t, "/k/a", "1", 0)
+				for i := 2; i < 6; i++ {
+					s.put(t, "/k/a", strconv.Itoa(i), 0)
+				}
+				last := s.put(t, "/k/a", "6", 0)
+
+				rangeAt := func(rev int64) error {
+					_, err := s.kv.Range(context.Background(), &etcdserverpb.RangeRequest{Key: []byte("/k/"), RangeEnd: []byte("/k0"), Revision: rev})
+					return err
+				}
+
+				if !tt.compacted {
+					time.Sleep(time.Second)
+					if err := rangeAt(first); err != nil {
+						t.Fatalf("range at the first revision got error %v", err)
+					}
+					return
+				}
+
+				waitFor(t, func() bool { return rangeAt(first) != nil })
+				if err := rangeAt(first); err.Error() != rpctypes.ErrGRPCCompacted.Error() {
+					t.Fatalf("range at the first revision got error %v, expected %v", err, rpctypes.ErrGRPCCompacted)
+				}
+				// the most recent revisions are retained
+				if err := rangeAt(last - 1); err != nil {
+					t.Fatalf("range at revision %d got error %v", last-1, err)
+				}
+			})
+		}
+	}
+}
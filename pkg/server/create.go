@@ -1,6 +1,7 @@
 package server
 
 import (
+	"bytes"
 	"context"
 
 	"go.etcd.io/etcd/etcdserver/etcdserverpb"
@@ -11,23 +12,26 @@ func isCreate(txn *etcdserverpb.TxnRequest) *etcdserverpb.PutRequest {
 		txn.Compare[0].Target == etcdserverpb.Compare_MOD &&
 		txn.Compare[0].Result == etcdserverpb.Compare_EQUAL &&
 		txn.Compare[0].GetModRevision() == 0 &&
+		len(txn.Compare[0].RangeEnd) == 0 &&
 		len(txn.Failure) == 0 &&
 		len(txn.Success) == 1 &&
-		txn.Success[0].GetRequestPut() != nil {
+		isPlainPut(txn.Success[0].GetRequestPut(), txn.Compare[0].Key) {
 		return txn.Success[0].GetRequestPut()
 	}
 	return nil
 }
 
-func (l *LimitedServer) create(ctx context.Context, put *etcdserverpb.PutRequest, txn *etcdserverpb.TxnRequest) (*etcdserverpb.TxnResponse, error) {
-	if put.IgnoreLease {
-		return nil, unsupported("ignoreLease")
-	} else if put.IgnoreValue {
-		return nil, unsupported("ignoreValue")
-	} else if put.PrevKv {
-		return nil, unsupported("prevKv")
-	}
+// isPlainPut returns true if the put writes the given key without any of the
+// options that need the general transaction path
+func isPlainPut(put *etcdserverpb.PutRequest, key []byte) bool {
+	return put != nil &&
+		bytes.Equal(put.Key, key) &&
+		!put.PrevKv &&
+		!put.IgnoreValue &&
+		!put.IgnoreLease
+}
 
+func (l *LimitedServer) create(ctx context.Context, put *etcdserverpb.PutRequest, txn *etcdserverpb.TxnRequest) (*etcdserverpb.TxnResponse, error) {
 	rev, err := l.backend.Create(ctx, string(put.Key), put.Value, put.Lease)
 	if err == ErrKeyExists {
 		return &etcdserverpb.TxnResponse{
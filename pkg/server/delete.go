@@ -1,6 +1,7 @@
 package server
 
 import (
+	"bytes"
 	"context"
 
 	"go.etcd.io/etcd/etcdserver/etcdserverpb"
@@ -11,22 +12,32 @@ func isDelete(txn *etcdserverpb.TxnRequest) (int64, string, bool) {
 		len(txn.Failure) == 0 &&
 		len(txn.Success) == 2 &&
 		txn.Success[0].GetRequestRange() != nil &&
-		txn.Success[1].GetRequestDeleteRange() != nil {
+		isPlainDelete(txn.Success[1].GetRequestDeleteRange(), txn.Success[0].GetRequestRange().Key) &&
+		isPlainGet(txn.Success[0].GetRequestRange(), txn.Success[1].GetRequestDeleteRange().Key) {
 		rng := txn.Success[1].GetRequestDeleteRange()
 		return 0, string(rng.Key), true
 	}
 	if len(txn.Compare) == 1 &&
 		txn.Compare[0].Target == etcdserverpb.Compare_MOD &&
 		txn.Compare[0].Result == etcdserverpb.Compare_EQUAL &&
+		len(txn.Compare[0].RangeEnd) == 0 &&
 		len(txn.Failure) == 1 &&
-		txn.Failure[0].GetRequestRange() != nil &&
+		isPlainGet(txn.Failure[0].GetRequestRange(), txn.Compare[0].Key) &&
 		len(txn.Success) == 1 &&
-		txn.Success[0].GetRequestDeleteRange() != nil {
+		isPlainDelete(txn.Success[0].GetRequestDeleteRange(), txn.Compare[0].Key) {
 		return txn.Compare[0].GetModRevision(), string(txn.Success[0].GetRequestDeleteRange().Key), true
 	}
 	return 0, "", false
 }
 
+// isPlainDelete returns true if the request deletes only the given key
+func isPlainDelete(del *etcdserverpb.DeleteRangeRequest, key []byte) bool {
+	return del != nil &&
+		bytes.Equal(del.Key, key) &&
+		len(del.RangeEnd) == 0 &&
+		!del.PrevKv
+}
+
 func (l *LimitedServer) delete(ctx context.Context, key string, revision int64) (*etcdserverpb.TxnResponse, error) {
 	rev, kv, ok, err := l.backend.Delete(ctx, key, revision)
 	if err != nil {
@@ -48,3 +59,21 @@ func (l *LimitedServer) delete(ctx context.Context, key string, revision int64)
 		Succeeded: ok,
 	}, nil
 }
+
+// deleteRange deletes a single key or every key in [key, rangeEnd) as a
+// transaction with a single operation
+func (l *LimitedServer) deleteRange(ctx context.Context, r *etcdserverpb.DeleteRangeRequest) (*etcdserverpb.DeleteRangeResponse, error) {
+	resp, err := l.txn(ctx, &etcdserverpb.TxnRequest{
+		Success: []*etcdserverpb.RequestOp{
+			{
+				Request: &etcdserverpb.RequestOp_RequestDeleteRange{
+					RequestDeleteRange: r,
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Responses[0].GetResponseDeleteRange(), nil
+}
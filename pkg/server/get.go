@@ -1,18 +1,19 @@
 package server
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 
 	"go.etcd.io/etcd/etcdserver/etcdserverpb"
 )
 
-func (l *LimitedServer) get(ctx context.Context, r *etcdserverpb.RangeRequest) (*RangeResponse, error) {
+func get(ctx context.Context, b reader, r *etcdserverpb.RangeRequest) (*RangeResponse, error) {
 	if r.Limit != 0 {
 		return nil, fmt.Errorf("invalid combination of rangeEnd and limit, limit should be 0 got %d", r.Limit)
 	}
 
-	rev, kv, err := l.backend.Get(ctx, string(r.Key), r.Revision)
+	rev, kv, err := b.Get(ctx, string(r.Key), r.Revision)
 	if err != nil {
 		return nil, err
 	}
@@ -20,8 +21,28 @@ func (l *LimitedServer) get(ctx context.Context, r *etcdserverpb.RangeRequest) (
 	resp := &RangeResponse{
 		Header: txnHeader(rev),
 	}
-	if kv != nil {
+
+	opts := listOptions(r)
+	if kv != nil && opts.InRevisionBounds(kv) {
+		if opts.KeysOnly {
+			keyOnly := *kv
+			keyOnly.Value = nil
+			kv = &keyOnly
+		}
 		resp.Kvs = []*KeyValue{kv}
 	}
+	resp.Count = int64(len(resp.Kvs))
+	if r.CountOnly {
+		resp.Kvs = nil
+	}
 	return resp, nil
 }
+
+// isPlainGet returns true if the request reads only the latest value of the
+// given key
+func isPlainGet(r *etcdserverpb.RangeRequest, key []byte) bool {
+	return r != nil &&
+		bytes.Equal(r.Key, key) &&
+		len(r.RangeEnd) == 0 &&
+		r.Revision == 0
+}
@@ -0,0 +1,131 @@
+package server_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"go.etcd.io/etcd/etcdserver/api/v3rpc/rpctypes"
+	"go.etcd.io/etcd/etcdserver/etcdserverpb"
+)
+
+func TestPut(t *testing.T) {
+	for _, b := range testBackends {
+		t.Run(b.name, func(t *testing.T) {
+			s := newTestServer(t, b)
+			defer s.close()
+
+			id := s.grant(t, 0, 60)
+
+			created, err := s.kv.Put(context.Background(), &etcdserverpb.PutRequest{Key: []byte("/k/a"), Value: []byte("1"), PrevKv: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if created.PrevKv != nil {
+				t.Fatalf("created key has the previous value %v", created.PrevKv)
+			}
+			if kv := s.get(t, "/k/a"); kv == nil || string(kv.Value) != "1" || kv.ModRevision != created.Header.Revision {
+				t.Fatalf("/k/a is %v, expected 1 at revision %d", kv, created.Header.Revision)
+			}
+
+			updated, err := s.kv.Put(context.Background(), &etcdserverpb.PutRequest{Key: []byte("/k/a"), Value: []byte("2"), Lease: id, PrevKv: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if updated.Header.Revision <= created.Header.Revision || updated.PrevKv == nil || string(updated.PrevKv.Value) != "1" {
+				t.Fatalf("update is %v, expected the previous value 1 after revision %d", updated, created.Header.Revision)
+			}
+
+			// ignoring the value changes only the lease, and ignoring the
+			// lease only the value
+			if _, err := s.kv.Put(context.Background(), &etcdserverpb.PutRequest{Key: []byte("/k/a"), IgnoreValue: true}); err != nil {
+				t.Fatal(err)
+			}
+			if kv := s.get(t, "/k/a"); kv == nil || string(kv.Value) != "2" || kv.Lease != 0 {
+				t.Fatalf("/k/a is %v, expected 2 without a lease", kv)
+			}
+			if _, err := s.kv.Put(context.Background(), &etcdserverpb.PutRequest{Key: []byte("/k/a"), Lease: id}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.kv.Put(context.Background(), &etcdserverpb.PutRequest{Key: []byte("/k/a"), Value: []byte("3"), IgnoreLease: true}); err != nil {
+				t.Fatal(err)
+			}
+			if kv := s.get(t, "/k/a"); kv == nil || string(kv.Value) != "3" || kv.Lease != id || kv.Version != 5 {
+				t.Fatalf("/k/a is %v, expected 3 on lease %d at version 5", kv, id)
+			}
+
+			_, err = s.kv.Put(context.Background(), &etcdserverpb.PutRequest{Key: []byte("/k/b"), IgnoreValue: true})
+			if err == nil || err.Error() != rpctypes.ErrGRPCKeyNotFound.Error() {
+				t.Fatalf("ignoring the value of a missing key got error %v, expected %v", err, rpctypes.ErrGRPCKeyNotFound)
+			}
+		})
+	}
+}
+
+func TestDeleteRange(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		key      string
+		rangeEnd string
+		deleted  []string
+		// keys are the keys left after the delete
+		keys map[string]string
+	}{
+		{
+			name:    "key",
+			key:     "/k/b",
+			deleted: []string{"/k/b"},
+			keys:    map[string]string{"/k/a": "a", "/k/c": "c", "/k/d": "d"},
+		},
+		{
+			name: "missing key",
+			key:  "/k/e",
+			keys: map[string]string{"/k/a": "a", "/k/b": "b", "/k/c": "c", "/k/d": "d"},
+		},
+		{
+			name:     "range",
+			key:      "/k/b",
+			rangeEnd: "/k/d",
+			deleted:  []string{"/k/b", "/k/c"},
+			keys:     map[string]string{"/k/a": "a", "/k/d": "d"},
+		},
+		{
+			name:     "prefix",
+			key:      "/k/",
+			rangeEnd: "/k0",
+			deleted:  []string{"/k/a", "/k/b", "/k/c", "/k/d"},
+			keys:     map[string]string{},
+		},
+	} {
+		for _, b := range testBackends {
+			t.Run(b.name+"/"+tt.name, func(t *testing.T) {
+				s := newTestServer(t, b)
+				defer s.close()
+
+				for _, key := range []string{"a", "b", "c", "d"} {
+					s.put(t, "/k/"+key, key, 0)
+				}
+
+				resp, err := s.kv.DeleteRange(context.Background(), &etcdserverpb.DeleteRangeRequest{
+					Key:      []byte(tt.key),
+					RangeEnd: []byte(tt.rangeEnd),
+					PrevKv:   true,
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				var deleted []string
+				for _, kv := range resp.PrevKvs {
+					deleted = append(deleted, string(kv.Key))
+				}
+				if resp.Deleted != int64(len(tt.deleted)) || !reflect.DeepEqual(deleted, tt.deleted) {
+					t.Fatalf("deleted %d keys %v, expected %v", resp.Deleted, deleted, tt.deleted)
+				}
+				if keys := s.keys(t, "/k/", "/k0", 0); !reflect.DeepEqual(keys, tt.keys) {
+					t.Fatalf("keys are %v, expected %v", keys, tt.keys)
+				}
+			})
+		}
+	}
+}
@@ -2,31 +2,137 @@ package server
 
 import (
 	"context"
-	"fmt"
+	"io"
+	"time"
 
+	"github.com/sirupsen/logrus"
+	"go.etcd.io/etcd/etcdserver/api/v3rpc/rpctypes"
 	"go.etcd.io/etcd/etcdserver/etcdserverpb"
 )
 
+const (
+	// minLeaseTTL matches the lower bound etcd places on a granted TTL with
+	// its default election timeout, shorter TTLs are raised to it
+	minLeaseTTL = 2
+	// maxLeaseTTL matches the upper bound etcd places on a granted TTL
+	maxLeaseTTL = 9000000000
+)
+
 func (s *KVServerBridge) LeaseGrant(ctx context.Context, req *etcdserverpb.LeaseGrantRequest) (*etcdserverpb.LeaseGrantResponse, error) {
+	if req.TTL > maxLeaseTTL {
+		return nil, rpctypes.ErrGRPCLeaseTTLTooLarge
+	}
+	if s.alarms.noSpace() {
+		return nil, ErrNoSpace
+	}
+
+	ttl := req.TTL
+	if ttl < minLeaseTTL {
+		ttl = minLeaseTTL
+	}
+
+	rev, l, err := s.limited.backend.LeaseGrant(ctx, req.ID, ttl)
+	if err != nil {
+		s.checkSpace(ctx, err)
+		return nil, err
+	}
+
 	return &etcdserverpb.LeaseGrantResponse{
-		Header: &etcdserverpb.ResponseHeader{},
-		ID:     req.TTL,
-		TTL:    req.TTL,
+		Header: s.header.at(rev),
+		ID:     l.ID,
+		TTL:    l.TTL,
 	}, nil
 }
 
-func (s *KVServerBridge) LeaseRevoke(context.Context, *etcdserverpb.LeaseRevokeRequest) (*etcdserverpb.LeaseRevokeResponse, error) {
-	return nil, fmt.Errorf("lease revoke is not supported")
+func (s *KVServerBridge) LeaseRevoke(ctx context.Context, req *etcdserverpb.LeaseRevokeRequest) (*etcdserverpb.LeaseRevokeResponse, error) {
+	rev, err := s.limited.backend.LeaseRevoke(ctx, req.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &etcdserverpb.LeaseRevokeResponse{
+		Header: s.header.at(rev),
+	}, nil
 }
 
-func (s *KVServerBridge) LeaseKeepAlive(etcdserverpb.Lease_LeaseKeepAliveServer) error {
-	return fmt.Errorf("lease keep alive is not supported")
+func (s *KVServerBridge) LeaseKeepAlive(ls etcdserverpb.Lease_LeaseKeepAliveServer) error {
+	for {
+		req, err := ls.Recv()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		rev, l, err := s.limited.backend.LeaseKeepAlive(ls.Context(), req.ID)
+		resp := &etcdserverpb.LeaseKeepAliveResponse{
+			Header: s.header.at(rev),
+			ID:     req.ID,
+		}
+		if err == ErrLeaseNotFound {
+			// etcd reports an unknown or expired lease with a TTL of zero
+			// rather than failing the stream
+			resp.TTL = 0
+		} else if err != nil {
+			logrus.Errorf("error in lease keep alive %d: %v", req.ID, err)
+			return err
+		} else {
+			resp.TTL = l.TTL
+		}
+
+		if err := ls.Send(resp); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *KVServerBridge) LeaseTimeToLive(ctx context.Context, req *etcdserverpb.LeaseTimeToLiveRequest) (*etcdserverpb.LeaseTimeToLiveResponse, error) {
+	rev, l, keys, err := s.limited.backend.LeaseTimeToLive(ctx, req.ID)
+	if err == ErrLeaseNotFound {
+		return &etcdserverpb.LeaseTimeToLiveResponse{
+			Header: s.header.at(rev),
+			ID:     req.ID,
+			TTL:    -1,
+		}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	resp := &etcdserverpb.LeaseTimeToLiveResponse{
+		Header:     s.header.at(rev),
+		ID:         l.ID,
+		GrantedTTL: l.TTL,
+		TTL:        remainingTTL(l),
+	}
+	if req.Keys {
+		for _, key := range keys {
+			resp.Keys = append(resp.Keys, []byte(key))
+		}
+	}
+	return resp, nil
 }
 
-func (s *KVServerBridge) LeaseTimeToLive(context.Context, *etcdserverpb.LeaseTimeToLiveRequest) (*etcdserverpb.LeaseTimeToLiveResponse, error) {
-	return nil, fmt.Errorf("lease time to live is not supported")
+func (s *KVServerBridge) LeaseLeases(ctx context.Context, req *etcdserverpb.LeaseLeasesRequest) (*etcdserverpb.LeaseLeasesResponse, error) {
+	rev, leases, err := s.limited.backend.LeaseLeases(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &etcdserverpb.LeaseLeasesResponse{
+		Header: s.header.at(rev),
+	}
+	for _, l := range leases {
+		resp.Leases = append(resp.Leases, &etcdserverpb.LeaseStatus{
+			ID: l.ID,
+		})
+	}
+	return resp, nil
 }
 
-func (s *KVServerBridge) LeaseLeases(context.Context, *etcdserverpb.LeaseLeasesRequest) (*etcdserverpb.LeaseLeasesResponse, error) {
-	return nil, fmt.Errorf("lease leases is not supported")
+func remainingTTL(l *Lease) int64 {
+	ttl := l.Expires - time.Now().Unix()
+	if ttl < 0 {
+		return 0
+	}
+	return ttl
 }
@@ -0,0 +1,255 @@
+package server_test
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/rancher/kine/pkg/server"
+	"go.etcd.io/etcd/etcdserver/api/v3rpc/rpctypes"
+	"go.etcd.io/etcd/etcdserver/etcdserverpb"
+	"go.etcd.io/etcd/mvcc/mvccpb"
+	"google.golang.org/grpc/status"
+)
+
+func (s *testServer) grant(t *testing.T, id, ttl int64) int64 {
+	resp, err := s.lease.LeaseGrant(context.Background(), &etcdserverpb.LeaseGrantRequest{ID: id, TTL: ttl})
+	if err != nil {
+		t.Fatalf("grant lease %d: %v", id, err)
+	}
+	return resp.ID
+}
+
+func TestLeaseGrant(t *testing.T) {
+	for _, b := range testBackends {
+		t.Run(b.name, func(t *testing.T) {
+			s := newTestServer(t, b)
+			defer s.close()
+
+			for _, tt := range []struct {
+				name string
+				id   int64
+				ttl  int64
+				// granted is the TTL granted, if it is not ttl
+				granted int64
+				err     error
+			}{
+				{name: "generated ID", ttl: 60},
+				{name: "requested ID", id: 1<<24 + 1, ttl: 60},
+				{name: "requested ID that exists", id: 1<<24 + 1, ttl: 60, err: rpctypes.ErrGRPCLeaseExist},
+				{name: "TTL too large", ttl: 9000000001, err: rpctypes.ErrGRPCLeaseTTLTooLarge},
+				{name: "TTL too small", ttl: 1, granted: 2},
+				{name: "no TTL", granted: 2},
+				{name: "ID below the lease IDs", id: 1<<24 - 1, ttl: 60, err: server.ErrLeaseIDOutOfRange},
+				{name: "ID above the lease IDs", id: 1 << 31, ttl: 60, err: server.ErrLeaseIDOutOfRange},
+				{name: "negative ID", id: -1, ttl: 60, err: server.ErrLeaseIDOutOfRange},
+			} {
+				t.Run(tt.name, func(t *testing.T) {
+					resp, err := s.lease.LeaseGrant(context.Background(), &etcdserverpb.LeaseGrantRequest{ID: tt.id, TTL: tt.ttl})
+					if tt.err != nil {
+						if status.Code(err) != status.Code(tt.err) || err.Error() != tt.err.Error() {
+							t.Fatalf("got error %v, expected %v", err, tt.err)
+						}
+						return
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+					granted := tt.ttl
+					if tt.granted != 0 {
+						granted = tt.granted
+					}
+					if resp.ID == 0 || (tt.id != 0 && resp.ID != tt.id) || resp.TTL != granted {
+						t.Fatalf("granted lease %d with TTL %d, expected lease %d with TTL %d", resp.ID, resp.TTL, tt.id, granted)
+					}
+				})
+			}
+
+			_, err := s.kv.Put(context.Background(), &etcdserverpb.PutRequest{Key: []byte("/a"), Lease: 1<<24 + 2})
+			if err == nil || err.Error() != rpctypes.ErrGRPCLeaseNotFound.Error() {
+				t.Fatalf("put with an unknown lease got error %v, expected %v", err, rpctypes.ErrGRPCLeaseNotFound)
+			}
+		})
+	}
+}
+
+func TestLeaseRevoke(t *testing.T) {
+	for _, b := range testBackends {
+		for _, tt := range []struct {
+			name string
+			ttl  int64
+			// revoke revokes the lease, otherwise it is left to expire
+			revoke bool
+		}{
+			{name: "revoke", ttl: 60, revoke: true},
+			{name: "expire", ttl: 2},
+		} {
+			t.Run(b.name+"/"+tt.name, func(t *testing.T) {
+				s := newTestServer(t, b)
+				defer s.close()
+
+				id := s.grant(t, 0, tt.ttl)
+				other := s.grant(t, 0, 60)
+				s.put(t, "/a", "a", id)
+				s.put(t, "/b", "b", id)
+				s.put(t, "/b", "b2", id)
+				s.put(t, "/c", "c", other)
+				rev := s.put(t, "/d", "d", 0)
+
+				w := s.startWatch(t, &etcdserverpb.WatchCreateRequest{Key: []byte("/"), RangeEnd: []byte("0"), StartRevision: rev + 1, PrevKv: true})
+				defer w.close()
+				w.next(t)
+
+				if tt.revoke {
+					resp, err := s.lease.LeaseRevoke(context.Background(), &etcdserverpb.LeaseRevokeRequest{ID: id})
+					if err != nil {
+						t.Fatal(err)
+					}
+					if resp.Header.Revision <= rev {
+						t.Fatalf("revoked at revision %d, expected a revision after %d", resp.Header.Revision, rev)
+					}
+				} else {
+					waitFor(t, func() bool { return s.get(t, "/a") == nil && s.get(t, "/b") == nil })
+				}
+
+				// every key of the lease is deleted at the same revision
+				events := w.events(t, 2)
+				var keys []string
+				for _, e := range events {
+					if e.Type != mvccpb.DELETE || e.Kv.ModRevision != events[0].Kv.ModRevision || e.PrevKv == nil || e.PrevKv.Lease != id {
+						t.Fatalf("got event %v, expected the keys of lease %d deleted at revision %d", e, id, events[0].Kv.ModRevision)
+					}
+					keys = append(keys, string(e.Kv.Key))
+				}
+				sort.Strings(keys)
+				if !reflect.DeepEqual(keys, []string{"/a", "/b"}) || events[0].Kv.ModRevision <= rev {
+					t.Fatalf("deleted %v at revision %d, expected /a and /b after revision %d", keys, events[0].Kv.ModRevision, rev)
+				}
+				w.idle(t, 100*time.Millisecond)
+
+				for _, key := range []string{"/a", "/b"} {
+					if kv := s.get(t, key); kv != nil {
+						t.Fatalf("%s of lease %d is left as %v", key, id, kv)
+					}
+				}
+				if kv := s.get(t, "/c"); kv == nil || kv.Lease != other {
+					t.Fatalf("/c of lease %d is %v", other, kv)
+				}
+				if kv := s.get(t, "/d"); kv == nil {
+					t.Fatal("/d without a lease is gone")
+				}
+
+				ttl, err := s.lease.LeaseTimeToLive(context.Background(), &etcdserverpb.LeaseTimeToLiveRequest{ID: id})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ttl.TTL != -1 {
+					t.Fatalf("revoked lease has TTL %d, expected -1", ttl.TTL)
+				}
+				if _, err := s.lease.LeaseRevoke(context.Background(), &etcdserverpb.LeaseRevokeRequest{ID: id}); err == nil || err.Error() != rpctypes.ErrGRPCLeaseNotFound.Error() {
+					t.Fatalf("second revoke got error %v, expected %v", err, rpctypes.ErrGRPCLeaseNotFound)
+				}
+			})
+		}
+	}
+}
+
+func TestLeaseKeepAlive(t *testing.T) {
+	for _, b := range testBackends {
+		t.Run(b.name, func(t *testing.T) {
+			s := newTestServer(t, b)
+			defer s.close()
+
+			id := s.grant(t, 0, 2)
+			s.put(t, "/a", "a", id)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			stream, err := s.lease.LeaseKeepAlive(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// kept alive past its TTL the lease doesn't expire
+			for i := 0; i < 4; i++ {
+				if err := stream.Send(&etcdserverpb.LeaseKeepAliveRequest{ID: id}); err != nil {
+					t.Fatal(err)
+				}
+				resp, err := stream.Recv()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if resp.ID != id || resp.TTL != 2 {
+					t.Fatalf("kept lease %d alive with TTL %d, expected lease %d with TTL 2", resp.ID, resp.TTL, id)
+				}
+				time.Sleep(time.Second)
+			}
+			if kv := s.get(t, "/a"); kv == nil || kv.Lease != id {
+				t.Fatalf("/a is %v, expected it attached to lease %d", kv, id)
+			}
+
+			ttl, err := s.lease.LeaseTimeToLive(context.Background(), &etcdserverpb.LeaseTimeToLiveRequest{ID: id, Keys: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ttl.GrantedTTL != 2 || ttl.TTL < 0 || ttl.TTL > 2 || len(ttl.Keys) != 1 || string(ttl.Keys[0]) != "/a" {
+				t.Fatalf("time to live is %v, expected TTL 2 and the key /a", ttl)
+			}
+			leases, err := s.lease.LeaseLeases(context.Background(), &etcdserverpb.LeaseLeasesRequest{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(leases.Leases) != 1 || leases.Leases[0].ID != id {
+				t.Fatalf("leases are %v, expected %d", leases.Leases, id)
+			}
+
+			// an unknown lease is reported with a TTL of zero
+			if err := stream.Send(&etcdserverpb.LeaseKeepAliveRequest{ID: id + 1}); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := stream.Recv()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.ID != id+1 || resp.TTL != 0 {
+				t.Fatalf("kept lease %d alive with TTL %d, expected lease %d with TTL 0", resp.ID, resp.TTL, id+1)
+			}
+		})
+	}
+}
+
+func TestLeaseExpiryRestart(t *testing.T) {
+	for _, b := range testBackends {
+		if b.volatile {
+			continue
+		}
+		t.Run(b.name, func(t *testing.T) {
+			s := newTestServer(t, b)
+			defer s.close()
+
+			granted := time.Now()
+			id := s.grant(t, 0, 3)
+			s.put(t, "/a", "a", id)
+
+			// the deadline is stored with the lease, so a restart doesn't
+			// start the TTL over
+			time.Sleep(2 * time.Second)
+			s.restart(t)
+
+			ttl, err := s.lease.LeaseTimeToLive(context.Background(), &etcdserverpb.LeaseTimeToLiveRequest{ID: id})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ttl.GrantedTTL != 3 || ttl.TTL > 1 {
+				t.Fatalf("lease has TTL %d of %d after restarting, expected at most 1 of 3", ttl.TTL, ttl.GrantedTTL)
+			}
+
+			waitFor(t, func() bool { return s.get(t, "/a") == nil })
+			if elapsed := time.Since(granted); elapsed > 5500*time.Millisecond {
+				t.Fatalf("lease expired %v after it was granted with a TTL of 3s", elapsed)
+			}
+		})
+	}
+}
@@ -2,7 +2,6 @@ package server
 
 import (
 	"context"
-	"fmt"
 
 	"go.etcd.io/etcd/etcdserver/etcdserverpb"
 )
@@ -11,11 +10,22 @@ type LimitedServer struct {
 	backend Backend
 }
 
+// reader is the read side shared by the Backend and a Transaction
+type reader interface {
+	Get(ctx context.Context, key string, revision int64) (int64, *KeyValue, error)
+	List(ctx context.Context, key, rangeEnd string, limit, revision int64, opts ListOptions) (int64, []*KeyValue, error)
+	Count(ctx context.Context, key, rangeEnd string) (int64, int64, error)
+}
+
 func (l *LimitedServer) Range(ctx context.Context, r *etcdserverpb.RangeRequest) (*RangeResponse, error) {
+	return readRange(ctx, l.backend, r)
+}
+
+func readRange(ctx context.Context, b reader, r *etcdserverpb.RangeRequest) (*RangeResponse, error) {
 	if len(r.RangeEnd) == 0 {
-		return l.get(ctx, r)
+		return get(ctx, b, r)
 	}
-	return l.list(ctx, r)
+	return list(ctx, b, r)
 }
 
 func txnHeader(rev int64) *etcdserverpb.ResponseHeader {
@@ -37,7 +47,7 @@ func (l *LimitedServer) Txn(ctx context.Context, txn *etcdserverpb.TxnRequest) (
 	if isCompact(txn) {
 		return l.compact(ctx)
 	}
-	return nil, fmt.Errorf("unsupported transaction: %v", txn)
+	return l.txn(ctx, txn)
 }
 
 type ResponseHeader struct {
@@ -4,24 +4,21 @@ import (
 	"bytes"
 	"context"
 	"fmt"
-	"strings"
 
 	"go.etcd.io/etcd/etcdserver/etcdserverpb"
 )
 
-func (l *LimitedServer) list(ctx context.Context, r *etcdserverpb.RangeRequest) (*RangeResponse, error) {
+func list(ctx context.Context, b reader, r *etcdserverpb.RangeRequest) (*RangeResponse, error) {
 	if len(r.RangeEnd) == 0 {
 		return nil, fmt.Errorf("invalid range end length of 0")
 	}
 
-	prefix := string(append(r.RangeEnd[:len(r.RangeEnd)-1], r.RangeEnd[len(r.RangeEnd)-1]-1))
-	if !strings.HasSuffix(prefix, "/") {
-		prefix = prefix + "/"
-	}
-	start := string(bytes.TrimRight(r.Key, "\x00"))
+	key, rangeEnd := string(r.Key), string(r.RangeEnd)
+	opts := listOptions(r)
 
-	if r.CountOnly {
-		rev, count, err := l.backend.Count(ctx, prefix)
+	// the backend counts the latest keys, others are counted as they are listed
+	if r.CountOnly && r.Revision == 0 && !opts.hasRevisionBounds() {
+		rev, count, err := b.Count(ctx, key, rangeEnd)
 		if err != nil {
 			return nil, err
 		}
@@ -35,11 +32,21 @@ func (l *LimitedServer) list(ctx context.Context, r *etcdserverpb.RangeRequest)
 	if limit > 0 {
 		limit++
 	}
+	if r.CountOnly {
+		limit = 0
+		opts.KeysOnly = true
+	}
 
-	rev, kvs, err := l.backend.List(ctx, prefix, start, limit, r.Revision)
+	rev, kvs, err := b.List(ctx, key, rangeEnd, limit, r.Revision, opts)
 	if err != nil {
 		return nil, err
 	}
+	if r.CountOnly {
+		return &RangeResponse{
+			Header: txnHeader(rev),
+			Count:  int64(len(kvs)),
+		}, nil
+	}
 
 	resp := &RangeResponse{
 		Header: txnHeader(rev),
@@ -54,3 +61,81 @@ func (l *LimitedServer) list(ctx context.Context, r *etcdserverpb.RangeRequest)
 
 	return resp, nil
 }
+
+func listOptions(r *etcdserverpb.RangeRequest) ListOptions {
+	opts := ListOptions{
+		KeysOnly:          r.KeysOnly,
+		Descending:        r.SortOrder == etcdserverpb.RangeRequest_DESCEND,
+		MinModRevision:    r.MinModRevision,
+		MaxModRevision:    r.MaxModRevision,
+		MinCreateRevision: r.MinCreateRevision,
+		MaxCreateRevision: r.MaxCreateRevision,
+	}
+
+	// Like etcd a sort target other than the key is applied even without a
+	// sort order.
+	switch r.SortTarget {
+	case etcdserverpb.RangeRequest_CREATE:
+		opts.SortTarget = SortByCreateRevision
+	case etcdserverpb.RangeRequest_MOD:
+		opts.SortTarget = SortByModRevision
+	case etcdserverpb.RangeRequest_VALUE:
+		opts.SortTarget = SortByValue
+	case etcdserverpb.RangeRequest_VERSION:
+		opts.SortTarget = SortByVersion
+	}
+
+	return opts
+}
+
+// InRevisionBounds reports whether the key was modified and created within the
+// bounds of the options
+func (opts ListOptions) InRevisionBounds(kv *KeyValue) bool {
+	return (opts.MinModRevision == 0 || kv.ModRevision >= opts.MinModRevision) &&
+		(opts.MaxModRevision == 0 || kv.ModRevision <= opts.MaxModRevision) &&
+		(opts.MinCreateRevision == 0 || kv.CreateRevision >= opts.MinCreateRevision) &&
+		(opts.MaxCreateRevision == 0 || kv.CreateRevision <= opts.MaxCreateRevision)
+}
+
+// hasRevisionBounds reports whether the options bound the revisions of keys
+func (opts ListOptions) hasRevisionBounds() bool {
+	return opts.MinModRevision != 0 || opts.MaxModRevision != 0 ||
+		opts.MinCreateRevision != 0 || opts.MaxCreateRevision != 0
+}
+
+// Less reports whether a is listed before b in the order of the options, keys
+// that tie on the sort target are in key order
+func (opts ListOptions) Less(a, b *KeyValue) bool {
+	var c int
+	switch opts.SortTarget {
+	case SortByCreateRevision:
+		c = compareRevisions(a.CreateRevision, b.CreateRevision)
+	case SortByModRevision:
+		c = compareRevisions(a.ModRevision, b.ModRevision)
+	case SortByValue:
+		c = bytes.Compare(a.Value, b.Value)
+	case SortByVersion:
+		c = compareRevisions(a.Version, b.Version)
+	}
+	if opts.Descending {
+		c = -c
+	}
+	if c != 0 {
+		return c < 0
+	}
+
+	if opts.SortTarget == SortByKey && opts.Descending {
+		return a.Key > b.Key
+	}
+	return a.Key < b.Key
+}
+
+func compareRevisions(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
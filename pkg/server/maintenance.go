@@ -0,0 +1,395 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"go.etcd.io/etcd/etcdserver/etcdserverpb"
+	"go.etcd.io/etcd/version"
+)
+
+var _ etcdserverpb.MaintenanceServer = (*KVServerBridge)(nil)
+
+const (
+	// hashBatch is the number of keys listed at once while hashing
+	hashBatch = 1000
+	// snapshotChunkSize matches the size of the chunks etcd streams
+	// snapshots in
+	snapshotChunkSize = 32 * 1024
+)
+
+// SnapshotFunc writes a backup of the backend that etcdctl can restore, and
+// returns its revision.
+type SnapshotFunc func(ctx context.Context, w io.Writer) (int64, error)
+
+// Status reports the current revision and the size of the storage. Without a
+// raft log the revision stands in for its index, so that it moves with every
+// write. Active alarms are listed as errors, as etcd does.
+func (k *KVServerBridge) Status(ctx context.Context, r *etcdserverpb.StatusRequest) (*etcdserverpb.StatusResponse, error) {
+	rev, err := k.limited.backend.CurrentRevision(ctx)
+	if err != nil {
+		return nil, err
+	}
+	size, err := k.limited.backend.DbSize(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := k.alarms.reload(ctx, k.limited.backend); err != nil {
+		return nil, err
+	}
+
+	resp := &etcdserverpb.StatusResponse{
+		Header:           k.header.at(rev),
+		Version:          version.Version,
+		Leader:           k.header.memberID,
+		DbSize:           size,
+		DbSizeInUse:      size,
+		RaftIndex:        uint64(rev),
+		RaftAppliedIndex: uint64(rev),
+	}
+	for _, alarm := range k.alarms.list(etcdserverpb.AlarmType_NONE) {
+		resp.Errors = append(resp.Errors, fmt.Sprintf("memberID:%d alarm:%s", alarm.MemberID, alarm.Alarm))
+	}
+	return resp, nil
+}
+
+// HashKV hashes the keys at the revision, or the current revision if it is
+// zero. Unlike etcd, which hashes every revision of the keys from its compact
+// revision on, only the keys at the revision are hashed and not their history.
+// Backends with the same keys hash the same whatever they compacted, and as no
+// compact revision is involved none is reported. The hash can't be compared
+// with the one of an etcd member.
+func (k *KVServerBridge) HashKV(ctx context.Context, r *etcdserverpb.HashKVRequest) (*etcdserverpb.HashKVResponse, error) {
+	rev, hash, err := hashKV(ctx, k.limited.backend, r.Revision)
+	if err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.HashKVResponse{
+		Header: k.header.at(rev),
+		Hash:   hash,
+	}, nil
+}
+
+// Hash hashes the keys at the current revision, there is nothing else in the
+// backend that replicas would share.
+func (k *KVServerBridge) Hash(ctx context.Context, r *etcdserverpb.HashRequest) (*etcdserverpb.HashResponse, error) {
+	rev, hash, err := hashKV(ctx, k.limited.backend, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.HashResponse{
+		Header: k.header.at(rev),
+		Hash:   hash,
+	}, nil
+}
+
+func (k *KVServerBridge) Defragment(ctx context.Context, r *etcdserverpb.DefragmentRequest) (*etcdserverpb.DefragmentResponse, error) {
+	if err := k.limited.backend.Defragment(ctx); err != nil {
+		logrus.Errorf("error in defragment: %v", err)
+		return nil, err
+	}
+	rev, err := k.limited.backend.CurrentRevision(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.DefragmentResponse{
+		Header: k.header.at(rev),
+	}, nil
+}
+
+// Snapshot streams a backup of the backend in chunks, as etcd does.
+func (k *KVServerBridge) Snapshot(r *etcdserverpb.SnapshotRequest, ss etcdserverpb.Maintenance_SnapshotServer) error {
+	if k.snapshot == nil {
+		return unsupported("snapshot")
+	}
+
+	w := &snapshotWriter{ss: ss}
+	rev, err := k.snapshot(ss.Context(), w)
+	if err == nil {
+		err = w.flush()
+	}
+	if err != nil {
+		logrus.Errorf("error in snapshot: %v", err)
+		return err
+	}
+	logrus.Infof("Sent snapshot at revision %d, %d bytes", rev, w.sent)
+	return nil
+}
+
+// Alarm lists, raises and clears the alarms of the members. They are stored in
+// the backend, so every member reports the same alarms.
+func (k *KVServerBridge) Alarm(ctx context.Context, r *etcdserverpb.AlarmRequest) (*etcdserverpb.AlarmResponse, error) {
+	backend := k.limited.backend
+	rev, err := backend.CurrentRevision(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := k.alarms.reload(ctx, backend); err != nil {
+		return nil, err
+	}
+
+	resp := &etcdserverpb.AlarmResponse{
+		Header: k.header.at(rev),
+	}
+	var changed bool
+	switch r.Action {
+	case etcdserverpb.AlarmRequest_GET:
+		resp.Alarms = k.alarms.list(r.Alarm)
+	case etcdserverpb.AlarmRequest_ACTIVATE:
+		if r.Alarm != etcdserverpb.AlarmType_NONE {
+			changed, err = k.alarms.activate(ctx, backend, r.MemberID, r.Alarm)
+		}
+	case etcdserverpb.AlarmRequest_DEACTIVATE:
+		changed, err = k.alarms.deactivate(ctx, backend, r.MemberID, r.Alarm)
+	}
+	if err != nil {
+		logrus.Errorf("error in alarm %s %s of member %x: %v", r.Action, r.Alarm, r.MemberID, err)
+		return nil, err
+	}
+	if changed {
+		resp.Alarms = []*etcdserverpb.AlarmMember{{MemberID: r.MemberID, Alarm: r.Alarm}}
+	}
+	return resp, nil
+}
+
+func (k *KVServerBridge) MoveLeader(ctx context.Context, r *etcdserverpb.MoveLeaderRequest) (*etcdserverpb.MoveLeaderResponse, error) {
+	return nil, unsupported("moveLeader")
+}
+
+// checkSpace raises the NOSPACE alarm once a write finds the storage full. It
+// stays raised until it is deactivated, like the alarm of etcd, and until then
+// every member rejects the writes that add keys or leases. Deletes and
+// compaction are still served, so that space can be freed.
+func (k *KVServerBridge) checkSpace(ctx context.Context, err error) {
+	if err != ErrNoSpace {
+		return
+	}
+	raised, err := k.alarms.activate(ctx, k.limited.backend, k.header.memberID, etcdserverpb.AlarmType_NOSPACE)
+	if raised {
+		logrus.Errorf("Storage is out of space, raised the NOSPACE alarm")
+	}
+	if err != nil {
+		logrus.Errorf("Failed to store the NOSPACE alarm, will retry: %v", err)
+	}
+}
+
+// hashKV returns the revision and the CRC-32 of the keys at it, as they are
+// listed in key order.
+func hashKV(ctx context.Context, backend Backend, revision int64) (int64, uint32, error) {
+	if revision == 0 {
+		current, err := backend.CurrentRevision(ctx)
+		if err != nil {
+			return 0, 0, err
+		}
+		revision = current
+	}
+
+	var (
+		h   = crc32.New(crc32.MakeTable(crc32.Castagnoli))
+		buf []byte
+	)
+	for key := ""; revision > 0; {
+		_, kvs, err := backend.List(ctx, key, "\x00", hashBatch, revision, ListOptions{})
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, kv := range kvs {
+			if kv.Key == compactRevKey {
+				continue
+			}
+			buf = buf[:0]
+			for _, v := range []int64{int64(len(kv.Key)), kv.CreateRevision, kv.ModRevision, kv.Lease, int64(len(kv.Value))} {
+				buf = appendVarint(buf, v)
+			}
+			buf = append(buf, kv.Key...)
+			buf = append(buf, kv.Value...)
+			h.Write(buf)
+		}
+		if len(kvs) < hashBatch {
+			break
+		}
+		key = kvs[len(kvs)-1].Key + "\x00"
+	}
+	return revision, h.Sum32(), nil
+}
+
+func appendVarint(data []byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(data, buf[:binary.PutVarint(buf[:], v)]...)
+}
+
+// alarms caches the alarms the members raised, which the backend stores so
+// that every member sees them. Writes check the cache rather than the backend,
+// it is reloaded with every heartbeat and before alarms are listed or changed.
+// An alarm that can't be stored, as the storage it reports on is full, stays
+// in the cache and is stored again by the following reloads.
+type alarms struct {
+	sync.Mutex
+	active  map[alarmKey]bool
+	unsaved map[alarmKey]bool
+}
+
+type alarmKey struct {
+	member uint64
+	alarm  etcdserverpb.AlarmType
+}
+
+func (key alarmKey) stored() *Alarm {
+	return &Alarm{
+		MemberID: key.member,
+		Type:     int32(key.alarm),
+	}
+}
+
+// reload stores the alarms that couldn't be stored yet, and replaces the
+// cache with the alarms of the backend.
+func (a *alarms) reload(ctx context.Context, backend Backend) error {
+	a.Lock()
+	var unsaved []alarmKey
+	for key := range a.unsaved {
+		unsaved = append(unsaved, key)
+	}
+	a.Unlock()
+
+	for _, key := range unsaved {
+		if err := backend.PutAlarm(ctx, key.stored()); err != nil {
+			return err
+		}
+		a.Lock()
+		delete(a.unsaved, key)
+		a.Unlock()
+	}
+
+	stored, err := backend.Alarms(ctx)
+	if err != nil {
+		return err
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	a.active = map[alarmKey]bool{}
+	for _, alarm := range stored {
+		a.active[alarmKey{member: alarm.MemberID, alarm: etcdserverpb.AlarmType(alarm.Type)}] = true
+	}
+	for key := range a.unsaved {
+		a.active[key] = true
+	}
+	return nil
+}
+
+// activate raises the alarm and reports whether it wasn't raised yet. It is
+// raised even if the backend fails to store it.
+func (a *alarms) activate(ctx context.Context, backend Backend, member uint64, alarm etcdserverpb.AlarmType) (bool, error) {
+	key := alarmKey{member: member, alarm: alarm}
+	err := backend.PutAlarm(ctx, key.stored())
+
+	a.Lock()
+	defer a.Unlock()
+	if a.active == nil {
+		a.active = map[alarmKey]bool{}
+	}
+	if err != nil {
+		if a.unsaved == nil {
+			a.unsaved = map[alarmKey]bool{}
+		}
+		a.unsaved[key] = true
+	}
+	raised := !a.active[key]
+	a.active[key] = true
+	return raised, err
+}
+
+// deactivate clears the alarm and reports whether it was raised.
+func (a *alarms) deactivate(ctx context.Context, backend Backend, member uint64, alarm etcdserverpb.AlarmType) (bool, error) {
+	key := alarmKey{member: member, alarm: alarm}
+	if err := backend.DeleteAlarm(ctx, key.stored()); err != nil {
+		return false, err
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	cleared := a.active[key]
+	delete(a.active, key)
+	delete(a.unsaved, key)
+	return cleared, nil
+}
+
+// noSpace tells whether any member raised the NOSPACE alarm
+func (a *alarms) noSpace() bool {
+	a.Lock()
+	defer a.Unlock()
+
+	for key := range a.active {
+		if key.alarm == etcdserverpb.AlarmType_NOSPACE {
+			return true
+		}
+	}
+	return false
+}
+
+// list returns the active alarms of the type, or every active alarm for
+// AlarmType_NONE
+func (a *alarms) list(alarm etcdserverpb.AlarmType) []*etcdserverpb.AlarmMember {
+	a.Lock()
+	defer a.Unlock()
+
+	var result []*etcdserverpb.AlarmMember
+	for key := range a.active {
+		if alarm == etcdserverpb.AlarmType_NONE || key.alarm == alarm {
+			result = append(result, &etcdserverpb.AlarmMember{
+				MemberID: key.member,
+				Alarm:    key.alarm,
+			})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].MemberID != result[j].MemberID {
+			return result[i].MemberID < result[j].MemberID
+		}
+		return result[i].Alarm < result[j].Alarm
+	})
+	return result
+}
+
+// snapshotWriter sends what is written to it in chunks on the stream
+type snapshotWriter struct {
+	ss   etcdserverpb.Maintenance_SnapshotServer
+	buf  []byte
+	sent int64
+}
+
+func (w *snapshotWriter) Write(data []byte) (int, error) {
+	n := len(data)
+	for len(data) > 0 {
+		if w.buf == nil {
+			w.buf = make([]byte, 0, snapshotChunkSize)
+		}
+		copied := copy(w.buf[len(w.buf):cap(w.buf)], data)
+		w.buf = w.buf[:len(w.buf)+copied]
+		data = data[copied:]
+		if len(w.buf) == cap(w.buf) {
+			if err := w.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (w *snapshotWriter) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	if err := w.ss.Send(&etcdserverpb.SnapshotResponse{Blob: w.buf}); err != nil {
+		return err
+	}
+	w.sent += int64(len(w.buf))
+	w.buf = nil
+	return nil
+}
@@ -0,0 +1,275 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/rancher/kine/pkg/drivers/memory"
+	"github.com/rancher/kine/pkg/logstructured"
+	"github.com/rancher/kine/pkg/server"
+	"github.com/rancher/kine/pkg/snapshot"
+	"go.etcd.io/etcd/etcdserver/etcdserverpb"
+	"google.golang.org/grpc/status"
+)
+
+// fullBackend fails writes with server.ErrNoSpace while full is set
+type fullBackend struct {
+	server.Backend
+	full int32
+}
+
+func (b *fullBackend) Create(ctx context.Context, key string, value []byte, lease int64) (int64, error) {
+	if atomic.LoadInt32(&b.full) != 0 {
+		return 0, server.ErrNoSpace
+	}
+	return b.Backend.Create(ctx, key, value, lease)
+}
+
+func (b *fullBackend) Update(ctx context.Context, key string, value []byte, revision, lease int64) (int64, *server.KeyValue, bool, error) {
+	if atomic.LoadInt32(&b.full) != 0 {
+		return 0, nil, false, server.ErrNoSpace
+	}
+	return b.Backend.Update(ctx, key, value, revision, lease)
+}
+
+func (b *fullBackend) BeginTx(ctx context.Context) (server.Transaction, error) {
+	tx, err := b.Backend.BeginTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &fullTx{Transaction: tx, backend: b}, nil
+}
+
+// fullTx fails the puts of a transaction of a fullBackend
+type fullTx struct {
+	server.Transaction
+	backend *fullBackend
+}
+
+func (t *fullTx) Put(ctx context.Context, key string, value []byte, lease int64) (*server.KeyValue, error) {
+	if atomic.LoadInt32(&t.backend.full) != 0 {
+		return nil, server.ErrNoSpace
+	}
+	return t.Transaction.Put(ctx, key, value, lease)
+}
+
+func (s *testServer) alarms(t *testing.T) []*etcdserverpb.AlarmMember {
+	resp, err := s.maintenance.Alarm(context.Background(), &etcdserverpb.AlarmRequest{Action: etcdserverpb.AlarmRequest_GET})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.Alarms
+}
+
+func TestStatus(t *testing.T) {
+	for _, b := range testBackends {
+		t.Run(b.name, func(t *testing.T) {
+			s := newTestServer(t, b)
+			defer s.close()
+
+			s.put(t, "/a", "1", 0)
+			rev := s.put(t, "/a", "2", 0)
+
+			resp, err := s.maintenance.Status(context.Background(), &etcdserverpb.StatusRequest{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Header.Revision != rev || resp.RaftIndex != uint64(rev) || resp.RaftAppliedIndex != uint64(rev) {
+				t.Fatalf("status is at revision %d, raft index %d and applied index %d, expected %d", resp.Header.Revision, resp.RaftIndex, resp.RaftAppliedIndex, rev)
+			}
+			if resp.DbSize <= 0 || resp.DbSizeInUse != resp.DbSize {
+				t.Fatalf("status has a database of %d bytes, %d in use", resp.DbSize, resp.DbSizeInUse)
+			}
+			if resp.Version == "" || len(resp.Errors) != 0 {
+				t.Fatalf("status has version %q and errors %v", resp.Version, resp.Errors)
+			}
+		})
+	}
+}
+
+func TestAlarm(t *testing.T) {
+	s := newTestServer(t, testBackends[0])
+	defer s.close()
+	ctx := context.Background()
+
+	nospace := &etcdserverpb.AlarmMember{MemberID: 1, Alarm: etcdserverpb.AlarmType_NOSPACE}
+	corrupt := &etcdserverpb.AlarmMember{MemberID: 2, Alarm: etcdserverpb.AlarmType_CORRUPT}
+	for _, tt := range []struct {
+		name   string
+		action etcdserverpb.AlarmRequest_AlarmAction
+		member *etcdserverpb.AlarmMember
+		// changed is the alarm the response reports, if it changed
+		changed bool
+		active  []*etcdserverpb.AlarmMember
+	}{
+		{name: "activate", action: etcdserverpb.AlarmRequest_ACTIVATE, member: nospace, changed: true, active: []*etcdserverpb.AlarmMember{nospace}},
+		{name: "activate again", action: etcdserverpb.AlarmRequest_ACTIVATE, member: nospace, active: []*etcdserverpb.AlarmMember{nospace}},
+		{name: "activate another", action: etcdserverpb.AlarmRequest_ACTIVATE, member: corrupt, changed: true, active: []*etcdserverpb.AlarmMember{nospace, corrupt}},
+		{name: "deactivate", action: etcdserverpb.AlarmRequest_DEACTIVATE, member: nospace, changed: true, active: []*etcdserverpb.AlarmMember{corrupt}},
+		{name: "deactivate again", action: etcdserverpb.AlarmRequest_DEACTIVATE, member: nospace, active: []*etcdserverpb.AlarmMember{corrupt}},
+		{name: "deactivate another", action: etcdserverpb.AlarmRequest_DEACTIVATE, member: corrupt, changed: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := s.maintenance.Alarm(ctx, &etcdserverpb.AlarmRequest{
+				Action:   tt.action,
+				MemberID: tt.member.MemberID,
+				Alarm:    tt.member.Alarm,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var changed []*etcdserverpb.AlarmMember
+			if tt.changed {
+				changed = []*etcdserverpb.AlarmMember{tt.member}
+			}
+			if !reflect.DeepEqual(resp.Alarms, changed) {
+				t.Fatalf("alarm changed %v, expected %v", resp.Alarms, changed)
+			}
+			if active := s.alarms(t); !reflect.DeepEqual(active, tt.active) {
+				t.Fatalf("active alarms are %v, expected %v", active, tt.active)
+			}
+
+			// the status lists the active alarms as errors
+			status, err := s.maintenance.Status(ctx, &etcdserverpb.StatusRequest{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(status.Errors) != len(tt.active) {
+				t.Fatalf("status has errors %v, expected one for each of %v", status.Errors, tt.active)
+			}
+		})
+	}
+}
+
+func TestNoSpace(t *testing.T) {
+	var backend *fullBackend
+	s := newTestServerConfig(t, testBackends[0], testConfig{
+		compact: logstructured.CompactConfig{Disable: true},
+		wrap: func(b server.Backend) server.Backend {
+			backend = &fullBackend{Backend: b}
+			return backend
+		},
+	})
+	defer s.close()
+	ctx := context.Background()
+
+	s.put(t, "/a", "1", 0)
+	if alarms := s.alarms(t); len(alarms) != 0 {
+		t.Fatalf("alarms %v are active before the storage is full", alarms)
+	}
+
+	atomic.StoreInt32(&backend.full, 1)
+	for _, key := range []string{"/a", "/b"} {
+		_, err := s.kv.Put(ctx, &etcdserverpb.PutRequest{Key: []byte(key), Value: []byte("2")})
+		if status.Convert(err).Message() != status.Convert(server.ErrNoSpace).Message() {
+			t.Fatalf("put %s on a full storage got error %v, expected %v", key, err, server.ErrNoSpace)
+		}
+	}
+	nospace := []*etcdserverpb.AlarmMember{{Alarm: etcdserverpb.AlarmType_NOSPACE}}
+	if alarms := s.alarms(t); !reflect.DeepEqual(alarms, nospace) {
+		t.Fatalf("alarms %v are active once the storage is full, expected %v", alarms, nospace)
+	}
+
+	// the alarm stays raised once there is room again, and writes are
+	// rejected until it is deactivated
+	atomic.StoreInt32(&backend.full, 0)
+	if _, err := s.kv.Put(ctx, &etcdserverpb.PutRequest{Key: []byte("/b"), Value: []byte("1")}); status.Convert(err).Message() != status.Convert(server.ErrNoSpace).Message() {
+		t.Fatalf("put /b while the alarm is raised got error %v, expected %v", err, server.ErrNoSpace)
+	}
+	if alarms := s.alarms(t); !reflect.DeepEqual(alarms, nospace) {
+		t.Fatalf("alarms %v are active once there is room, expected %v", alarms, nospace)
+	}
+	if _, err := s.maintenance.Alarm(ctx, &etcdserverpb.AlarmRequest{
+		Action: etcdserverpb.AlarmRequest_DEACTIVATE,
+		Alarm:  etcdserverpb.AlarmType_NOSPACE,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if alarms := s.alarms(t); len(alarms) != 0 {
+		t.Fatalf("alarms %v are active once deactivated", alarms)
+	}
+	s.put(t, "/b", "1", 0)
+}
+
+func TestSnapshot(t *testing.T) {
+	for _, b := range testBackends {
+		t.Run(b.name, func(t *testing.T) {
+			s := newTestServer(t, b)
+			defer s.close()
+
+			// values large enough for the snapshot to take several chunks
+			value := strings.Repeat("v", 16*1024)
+			for _, key := range []string{"/a", "/b", "/c", "/d"} {
+				s.put(t, key, value, 0)
+			}
+			rev := s.put(t, "/a", "1", 0)
+
+			stream, err := s.maintenance.Snapshot(context.Background(), &etcdserverpb.SnapshotRequest{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var (
+				buf    bytes.Buffer
+				chunks []int
+			)
+			for {
+				resp, err := stream.Recv()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				chunks = append(chunks, len(resp.Blob))
+				buf.Write(resp.Blob)
+			}
+			if len(chunks) < 2 {
+				t.Fatalf("snapshot came in %d chunks, expected several", len(chunks))
+			}
+			for _, size := range chunks[:len(chunks)-1] {
+				if size != 32*1024 {
+					t.Fatalf("snapshot came in chunks of %v bytes, expected 32KiB but the last", chunks)
+				}
+			}
+
+			// the snapshot is the one etcdctl saves, it imports into another
+			// backend
+			dir, err := ioutil.TempDir("", "kine-server-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "snapshot.db")
+			if err := ioutil.WriteFile(path, buf.Bytes(), 0600); err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			backend, err := memory.New(ctx, logstructured.CompactConfig{Disable: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			imported, err := snapshot.ImportEtcd(ctx, backend, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if imported != rev {
+				t.Fatalf("imported the snapshot at revision %d, expected %d", imported, rev)
+			}
+			if err := backend.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			_, kv, err := backend.Get(ctx, "/d", 0)
+			if err != nil || kv == nil || string(kv.Value) != value {
+				t.Fatalf("imported /d as %v (%v)", kv, err)
+			}
+		})
+	}
+}
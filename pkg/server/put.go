@@ -0,0 +1,26 @@
+package server
+
+import (
+	"context"
+
+	"go.etcd.io/etcd/etcdserver/etcdserverpb"
+)
+
+// put writes the key unconditionally, it is run as a transaction with a single
+// operation so that prevKv, ignoreValue and ignoreLease read the same revision
+// the write replaces
+func (l *LimitedServer) put(ctx context.Context, r *etcdserverpb.PutRequest) (*etcdserverpb.PutResponse, error) {
+	resp, err := l.txn(ctx, &etcdserverpb.TxnRequest{
+		Success: []*etcdserverpb.RequestOp{
+			{
+				Request: &etcdserverpb.RequestOp_RequestPut{
+					RequestPut: r,
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Responses[0].GetResponsePut(), nil
+}
@@ -0,0 +1,247 @@
+package server_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"go.etcd.io/etcd/etcdserver/etcdserverpb"
+)
+
+func TestRange(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		key      string
+		rangeEnd string
+		limit    int64
+		// old reads at the revision before /k/b was changed
+		old  bool
+		more bool
+		keys []string
+		// count is the number of keys in the range regardless of the limit
+		count int64
+	}{
+		{name: "key", key: "/k/b", keys: []string{"/k/b"}, count: 1},
+		{name: "missing key", key: "/k/e"},
+		{name: "prefix", key: "/k/", rangeEnd: "/k0", keys: []string{"/k/a", "/k/b", "/k/c", "/k/d"}, count: 4},
+		{name: "range", key: "/k/b", rangeEnd: "/k/d", keys: []string{"/k/b", "/k/c"}, count: 2},
+		{name: "range without slashes", key: "x", rangeEnd: "z", keys: []string{"x", "y"}, count: 2},
+		{name: "from key", key: "x", rangeEnd: "\x00", keys: []string{"x", "y", "z"}, count: 3},
+		{name: "wildcards are literal", key: "/k_/", rangeEnd: "/k_0", keys: []string{"/k_/a"}, count: 1},
+		{name: "limit", key: "/k/", rangeEnd: "/k0", limit: 2, more: true, keys: []string{"/k/a", "/k/b"}, count: 4},
+		{name: "limit of every key", key: "/k/", rangeEnd: "/k0", limit: 4, keys: []string{"/k/a", "/k/b", "/k/c", "/k/d"}, count: 4},
+		{name: "revision", key: "/k/", rangeEnd: "/k0", old: true, keys: []string{"/k/a", "/k/b", "/k/c"}, count: 3},
+		{name: "key at a revision", key: "/k/d", old: true},
+	} {
+		for _, b := range testBackends {
+			t.Run(b.name+"/"+tt.name, func(t *testing.T) {
+				s := newTestServer(t, b)
+				defer s.close()
+
+				for _, key := range []string{"/k/a", "/k/b", "/k/c", "/k_/a", "/kx/a", "x", "y", "z"} {
+					s.put(t, key, key, 0)
+				}
+				old := s.put(t, "/k/b", "changed", 0) - 1
+				s.put(t, "/k/d", "/k/d", 0)
+
+				r := &etcdserverpb.RangeRequest{
+					Key:      []byte(tt.key),
+					RangeEnd: []byte(tt.rangeEnd),
+					Limit:    tt.limit,
+				}
+				if tt.old {
+					r.Revision = old
+				}
+				resp, err := s.kv.Range(context.Background(), r)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				var keys []string
+				for _, kv := range resp.Kvs {
+					keys = append(keys, string(kv.Key))
+					if tt.old && string(kv.Key) == "/k/b" && string(kv.Value) != "/k/b" {
+						t.Fatalf("/k/b is %s at revision %d", kv.Value, old)
+					}
+				}
+				if !reflect.DeepEqual(keys, tt.keys) || resp.More != tt.more {
+					t.Fatalf("range is %v with more %v, expected %v with more %v", keys, resp.More, tt.keys, tt.more)
+				}
+
+				count, err := s.kv.Range(context.Background(), &etcdserverpb.RangeRequest{
+					Key:       r.Key,
+					RangeEnd:  r.RangeEnd,
+					Revision:  r.Revision,
+					CountOnly: true,
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if count.Count != tt.count || len(count.Kvs) != 0 {
+					t.Fatalf("count is %d with %d keys, expected %d without keys", count.Count, len(count.Kvs), tt.count)
+				}
+			})
+		}
+	}
+}
+
+func TestRangeOptions(t *testing.T) {
+	// revs are the revisions of the writes, /k/c is created first and
+	// changed last so that key, create and mod order all differ
+	type revs struct {
+		createC, createA, createB, updateC int64
+	}
+
+	for _, tt := range []struct {
+		name string
+		// request builds the request once the revisions are known
+		request func(r revs) *etcdserverpb.RangeRequest
+		keys    []string
+		more    bool
+	}{
+		{
+			name: "descending keys",
+			request: func(revs) *etcdserverpb.RangeRequest {
+				return &etcdserverpb.RangeRequest{SortTarget: etcdserverpb.RangeRequest_KEY, SortOrder: etcdserverpb.RangeRequest_DESCEND}
+			},
+			keys: []string{"/k/c", "/k/b", "/k/a"},
+		},
+		{
+			name: "create revision",
+			request: func(revs) *etcdserverpb.RangeRequest {
+				return &etcdserverpb.RangeRequest{SortTarget: etcdserverpb.RangeRequest_CREATE, SortOrder: etcdserverpb.RangeRequest_ASCEND}
+			},
+			keys: []string{"/k/c", "/k/a", "/k/b"},
+		},
+		{
+			name: "create revision without an order",
+			request: func(revs) *etcdserverpb.RangeRequest {
+				return &etcdserverpb.RangeRequest{SortTarget: etcdserverpb.RangeRequest_CREATE}
+			},
+			keys: []string{"/k/c", "/k/a", "/k/b"},
+		},
+		{
+			name: "descending create revision",
+			request: func(revs) *etcdserverpb.RangeRequest {
+				return &etcdserverpb.RangeRequest{SortTarget: etcdserverpb.RangeRequest_CREATE, SortOrder: etcdserverpb.RangeRequest_DESCEND}
+			},
+			keys: []string{"/k/b", "/k/a", "/k/c"},
+		},
+		{
+			name: "mod revision",
+			request: func(revs) *etcdserverpb.RangeRequest {
+				return &etcdserverpb.RangeRequest{SortTarget: etcdserverpb.RangeRequest_MOD, SortOrder: etcdserverpb.RangeRequest_ASCEND}
+			},
+			keys: []string{"/k/a", "/k/b", "/k/c"},
+		},
+		{
+			name: "descending mod revision with a limit",
+			request: func(revs) *etcdserverpb.RangeRequest {
+				return &etcdserverpb.RangeRequest{SortTarget: etcdserverpb.RangeRequest_MOD, SortOrder: etcdserverpb.RangeRequest_DESCEND, Limit: 1}
+			},
+			keys: []string{"/k/c"},
+			more: true,
+		},
+		{
+			name: "descending mod revision at a revision",
+			request: func(r revs) *etcdserverpb.RangeRequest {
+				return &etcdserverpb.RangeRequest{SortTarget: etcdserverpb.RangeRequest_MOD, SortOrder: etcdserverpb.RangeRequest_DESCEND, Revision: r.createB}
+			},
+			keys: []string{"/k/b", "/k/a", "/k/c"},
+		},
+		{
+			name: "value",
+			request: func(revs) *etcdserverpb.RangeRequest {
+				return &etcdserverpb.RangeRequest{SortTarget: etcdserverpb.RangeRequest_VALUE, SortOrder: etcdserverpb.RangeRequest_ASCEND}
+			},
+			keys: []string{"/k/b", "/k/a", "/k/c"},
+		},
+		{
+			name: "min mod revision",
+			request: func(r revs) *etcdserverpb.RangeRequest {
+				return &etcdserverpb.RangeRequest{MinModRevision: r.createB}
+			},
+			keys: []string{"/k/b", "/k/c"},
+		},
+		{
+			name: "max mod revision",
+			request: func(r revs) *etcdserverpb.RangeRequest {
+				return &etcdserverpb.RangeRequest{MaxModRevision: r.createB}
+			},
+			keys: []string{"/k/a", "/k/b"},
+		},
+		{
+			name: "min mod revision of the last write",
+			request: func(r revs) *etcdserverpb.RangeRequest {
+				return &etcdserverpb.RangeRequest{MinModRevision: r.updateC}
+			},
+			keys: []string{"/k/c"},
+		},
+		{
+			name: "min create revision",
+			request: func(r revs) *etcdserverpb.RangeRequest {
+				return &etcdserverpb.RangeRequest{MinCreateRevision: r.createA}
+			},
+			keys: []string{"/k/a", "/k/b"},
+		},
+		{
+			name: "max create revision",
+			request: func(r revs) *etcdserverpb.RangeRequest {
+				return &etcdserverpb.RangeRequest{MaxCreateRevision: r.createA}
+			},
+			keys: []string{"/k/a", "/k/c"},
+		},
+		{
+			name: "key outside the revision bounds",
+			request: func(r revs) *etcdserverpb.RangeRequest {
+				return &etcdserverpb.RangeRequest{Key: []byte("/k/a"), MinModRevision: r.createB}
+			},
+		},
+		{
+			name: "key within the revision bounds",
+			request: func(r revs) *etcdserverpb.RangeRequest {
+				return &etcdserverpb.RangeRequest{Key: []byte("/k/a"), MaxCreateRevision: r.createA}
+			},
+			keys: []string{"/k/a"},
+		},
+	} {
+		for _, b := range testBackends {
+			t.Run(b.name+"/"+tt.name, func(t *testing.T) {
+				s := newTestServer(t, b)
+				defer s.close()
+
+				var r revs
+				r.createC = s.put(t, "/k/c", "1", 0)
+				r.createA = s.put(t, "/k/a", "3", 0)
+				r.createB = s.put(t, "/k/b", "2", 0)
+				r.updateC = s.put(t, "/k/c", "4", 0)
+
+				req := tt.request(r)
+				if req.Key == nil {
+					req.Key, req.RangeEnd = []byte("/k/"), []byte("/k0")
+				}
+				for _, keysOnly := range []bool{false, true} {
+					req.KeysOnly = keysOnly
+					resp, err := s.kv.Range(context.Background(), req)
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					var keys []string
+					for _, kv := range resp.Kvs {
+						keys = append(keys, string(kv.Key))
+						if keysOnly != (len(kv.Value) == 0) {
+							t.Fatalf("%s has the value %q with keys only %v", kv.Key, kv.Value, keysOnly)
+						}
+						if kv.ModRevision == 0 || kv.CreateRevision == 0 {
+							t.Fatalf("%s is missing its revisions", kv.Key)
+						}
+					}
+					if !reflect.DeepEqual(keys, tt.keys) || resp.More != tt.more {
+						t.Fatalf("range is %v with more %v, expected %v with more %v", keys, resp.More, tt.keys, tt.more)
+					}
+				}
+			})
+		}
+	}
+}
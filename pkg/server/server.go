@@ -3,6 +3,7 @@ package server
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"go.etcd.io/etcd/etcdserver/etcdserverpb"
@@ -17,15 +18,32 @@ var (
 	_ etcdserverpb.WatchServer = (*KVServerBridge)(nil)
 )
 
+// defaultNotifyInterval matches how often etcd sends progress notifications
+// to watches that asked for them
+const defaultNotifyInterval = 10 * time.Minute
+
 type KVServerBridge struct {
-	limited *LimitedServer
+	limited        *LimitedServer
+	notifyInterval time.Duration
+	snapshot       SnapshotFunc
+	alarms         alarms
+	header         header
 }
 
-func New(backend Backend) *KVServerBridge {
+// New returns the gRPC server of the backend. Watches that asked for progress
+// notifications get one every notifyInterval, or every ten minutes if it is
+// zero. The maintenance service streams the backups written by snapshot, it
+// doesn't serve snapshots if it is nil.
+func New(backend Backend, notifyInterval time.Duration, snapshot SnapshotFunc) *KVServerBridge {
+	if notifyInterval <= 0 {
+		notifyInterval = defaultNotifyInterval
+	}
 	return &KVServerBridge{
 		limited: &LimitedServer{
 			backend: backend,
 		},
+		notifyInterval: notifyInterval,
+		snapshot:       snapshot,
 	}
 }
 
@@ -33,6 +51,8 @@ func (k *KVServerBridge) Register(server *grpc.Server) {
 	etcdserverpb.RegisterLeaseServer(server, k)
 	etcdserverpb.RegisterWatchServer(server, k)
 	etcdserverpb.RegisterKVServer(server, k)
+	etcdserverpb.RegisterMaintenanceServer(server, k)
+	etcdserverpb.RegisterClusterServer(server, k)
 
 	hsrv := health.NewServer()
 	hsrv.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
@@ -40,44 +60,8 @@ func (k *KVServerBridge) Register(server *grpc.Server) {
 }
 
 func (k *KVServerBridge) Range(ctx context.Context, r *etcdserverpb.RangeRequest) (*etcdserverpb.RangeResponse, error) {
-	if r.KeysOnly {
-		return nil, unsupported("keysOnly")
-	}
-
-	if r.MaxCreateRevision != 0 {
-		return nil, unsupported("maxCreateRevision")
-	}
-
-	if r.SortOrder != 0 {
-		return nil, unsupported("sortOrder")
-	}
-
-	if r.SortTarget != 0 {
-		return nil, unsupported("sortTarget")
-	}
-
-	if r.Serializable {
-		return nil, unsupported("serializable")
-	}
-
-	if r.KeysOnly {
-		return nil, unsupported("keysOnly")
-	}
-
-	if r.MinModRevision != 0 {
-		return nil, unsupported("minModRevision")
-	}
-
-	if r.MinCreateRevision != 0 {
-		return nil, unsupported("minCreateRevision")
-	}
-
-	if r.MaxCreateRevision != 0 {
-		return nil, unsupported("maxCreateRevision")
-	}
-
-	if r.MaxModRevision != 0 {
-		return nil, unsupported("maxModRevision")
+	if err := checkRange(r); err != nil {
+		return nil, err
 	}
 
 	resp, err := k.limited.Range(ctx, r)
@@ -92,10 +76,19 @@ func (k *KVServerBridge) Range(ctx context.Context, r *etcdserverpb.RangeRequest
 		Header: resp.Header,
 		Kvs:    toKVs(resp.Kvs...),
 	}
+	k.header.fill(rangeResponse.Header)
 
 	return rangeResponse, nil
 }
 
+func checkRange(r *etcdserverpb.RangeRequest) error {
+	if r.Serializable {
+		return unsupported("serializable")
+	}
+
+	return nil
+}
+
 func toKVs(kvs ...*KeyValue) []*mvccpb.KeyValue {
 	if len(kvs) == 0 || kvs[0] == nil {
 		return nil
@@ -121,31 +114,63 @@ func toKV(kv *KeyValue) *mvccpb.KeyValue {
 		Lease:          kv.Lease,
 		CreateRevision: kv.CreateRevision,
 		ModRevision:    kv.ModRevision,
+		Version:        kv.Version,
 	}
 }
 
 func (k *KVServerBridge) Put(ctx context.Context, r *etcdserverpb.PutRequest) (*etcdserverpb.PutResponse, error) {
-	return nil, fmt.Errorf("put is not supported")
+	if k.alarms.noSpace() {
+		return nil, ErrNoSpace
+	}
+
+	res, err := k.limited.put(ctx, r)
+	if err != nil {
+		logrus.Errorf("error in put %s: %v", r.Key, err)
+		k.checkSpace(ctx, err)
+	}
+	if res != nil {
+		k.header.fill(res.Header)
+	}
+	return res, err
 }
 
 func (k *KVServerBridge) DeleteRange(ctx context.Context, r *etcdserverpb.DeleteRangeRequest) (*etcdserverpb.DeleteRangeResponse, error) {
-	return nil, fmt.Errorf("delete is not supported")
+	res, err := k.limited.deleteRange(ctx, r)
+	if err != nil {
+		logrus.Errorf("error in delete range %s %s: %v", r.Key, r.RangeEnd, err)
+		k.checkSpace(ctx, err)
+	}
+	if res != nil {
+		k.header.fill(res.Header)
+	}
+	return res, err
 }
 
 func (k *KVServerBridge) Txn(ctx context.Context, r *etcdserverpb.TxnRequest) (*etcdserverpb.TxnResponse, error) {
+	if hasPut(r) && k.alarms.noSpace() {
+		return nil, ErrNoSpace
+	}
+
 	res, err := k.limited.Txn(ctx, r)
 	if err != nil {
 		logrus.Errorf("error in txn: %v", err)
+		k.checkSpace(ctx, err)
+	}
+	if res != nil {
+		k.header.fill(res.Header)
 	}
 	return res, err
 }
 
 func (k *KVServerBridge) Compact(ctx context.Context, r *etcdserverpb.CompactionRequest) (*etcdserverpb.CompactionResponse, error) {
-	return &etcdserverpb.CompactionResponse{
-		Header: &etcdserverpb.ResponseHeader{
-			Revision: r.Revision,
-		},
-	}, nil
+	res, err := k.limited.compactRevision(ctx, r)
+	if err != nil {
+		logrus.Errorf("error in compact %d: %v", r.Revision, err)
+	}
+	if res != nil {
+		k.header.fill(res.Header)
+	}
+	return res, err
 }
 
 func unsupported(field string) error {
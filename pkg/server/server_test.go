@@ -0,0 +1,332 @@
+package server_test
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rancher/kine/pkg/drivers/bolt"
+	"github.com/rancher/kine/pkg/drivers/memory"
+	"github.com/rancher/kine/pkg/drivers/sqlite"
+	"github.com/rancher/kine/pkg/logstructured"
+	"github.com/rancher/kine/pkg/server"
+	"github.com/rancher/kine/pkg/snapshot"
+	"go.etcd.io/etcd/etcdserver/etcdserverpb"
+	"go.etcd.io/etcd/mvcc/mvccpb"
+	"google.golang.org/grpc"
+)
+
+// testBackend opens a backend in the directory for the server tests
+type testBackend struct {
+	name string
+	new  func(ctx context.Context, dir string, compact logstructured.CompactConfig) (server.Backend, error)
+	// volatile backends lose their log when they are stopped
+	volatile bool
+}
+
+// testBackends are the backends every server test runs against
+var testBackends = []testBackend{
+	{
+		name: "bolt",
+		new: func(ctx context.Context, dir string, compact logstructured.CompactConfig) (server.Backend, error) {
+			return bolt.New(ctx, filepath.Join(dir, "state.bolt"), compact)
+		},
+	},
+	{
+		name: "memory",
+		new: func(ctx context.Context, dir string, compact logstructured.CompactConfig) (server.Backend, error) {
+			return memory.New(ctx, compact)
+		},
+		volatile: true,
+	},
+	{
+		name: "sqlite",
+		new: func(ctx context.Context, dir string, compact logstructured.CompactConfig) (server.Backend, error) {
+			return sqlite.New(ctx, filepath.Join(dir, "state.db?_journal=WAL&cache=shared"), compact)
+		},
+	},
+}
+
+// testServer serves a backend over gRPC, as kine serves its clients
+type testServer struct {
+	backend     server.Backend
+	kv          etcdserverpb.KVClient
+	lease       etcdserverpb.LeaseClient
+	watch       etcdserverpb.WatchClient
+	maintenance etcdserverpb.MaintenanceClient
+	cluster     etcdserverpb.ClusterClient
+
+	b      testBackend
+	config testConfig
+	dir    string
+	cancel func()
+	grpc   *grpc.Server
+	conn   *grpc.ClientConn
+}
+
+// testConfig configures the backend of a test server
+type testConfig struct {
+	compact        logstructured.CompactConfig
+	notifyInterval time.Duration
+	// wrap returns the backend the server serves in place of the one
+	// opened, if it is set
+	wrap func(server.Backend) server.Backend
+	// member is the name the server joins the cluster of its backend under,
+	// it doesn't join if it is empty
+	member string
+}
+
+// newTestServer starts a server on a new backend that is only compacted
+// when a client asks for it
+func newTestServer(t *testing.T, b testBackend) *testServer {
+	return newTestServerConfig(t, b, testConfig{
+		// small batches so that compactions span several of them
+		compact: logstructured.CompactConfig{Disable: true, BatchSize: 2},
+	})
+}
+
+func newTestServerConfig(t *testing.T, b testBackend, config testConfig) *testServer {
+	dir, err := ioutil.TempDir("", "kine-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testServer{b: b, config: config, dir: dir}
+	if err := s.start(); err != nil {
+		s.close()
+		t.Fatal(err)
+	}
+	return s
+}
+
+func (s *testServer) start() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+
+	backend, err := s.b.new(ctx, s.dir, s.config.compact)
+	if err != nil {
+		return err
+	}
+	if err := backend.Start(ctx); err != nil {
+		return err
+	}
+	if s.config.wrap != nil {
+		backend = s.config.wrap(backend)
+	}
+	s.backend = backend
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	s.grpc = grpc.NewServer()
+	b := server.New(backend, s.config.notifyInterval, func(ctx context.Context, w io.Writer) (int64, error) {
+		return snapshot.ExportEtcd(ctx, backend, w, 0)
+	})
+	b.Register(s.grpc)
+	if s.config.member != "" {
+		if err := b.Join(ctx, s.config.member, []string{"http://" + listener.Addr().String()}); err != nil {
+			listener.Close()
+			return err
+		}
+	}
+	go s.grpc.Serve(listener)
+
+	s.conn, err = grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		return err
+	}
+	s.kv = etcdserverpb.NewKVClient(s.conn)
+	s.lease = etcdserverpb.NewLeaseClient(s.conn)
+	s.watch = etcdserverpb.NewWatchClient(s.conn)
+	s.maintenance = etcdserverpb.NewMaintenanceClient(s.conn)
+	s.cluster = etcdserverpb.NewClusterClient(s.conn)
+	return nil
+}
+
+func (s *testServer) stop() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	if s.grpc != nil {
+		s.grpc.Stop()
+		s.grpc = nil
+	}
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
+
+// restart stops the server and starts it again on the same database
+func (s *testServer) restart(t *testing.T) {
+	s.stop()
+	if err := s.start(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (s *testServer) close() {
+	s.stop()
+	os.RemoveAll(s.dir)
+}
+
+// put writes the key if it is unchanged since it was read, as Kubernetes
+// does, and returns the revision it was written at
+func (s *testServer) put(t *testing.T, key, value string, lease int64) int64 {
+	var modRevision int64
+	if kv := s.get(t, key); kv != nil {
+		modRevision = kv.ModRevision
+	}
+
+	resp, err := s.kv.Txn(context.Background(), &etcdserverpb.TxnRequest{
+		Compare: []*etcdserverpb.Compare{{
+			Key:         []byte(key),
+			Target:      etcdserverpb.Compare_MOD,
+			Result:      etcdserverpb.Compare_EQUAL,
+			TargetUnion: &etcdserverpb.Compare_ModRevision{ModRevision: modRevision},
+		}},
+		Success: []*etcdserverpb.RequestOp{{Request: &etcdserverpb.RequestOp_RequestPut{RequestPut: &etcdserverpb.PutRequest{
+			Key:   []byte(key),
+			Value: []byte(value),
+			Lease: lease,
+		}}}},
+		Failure: []*etcdserverpb.RequestOp{{Request: &etcdserverpb.RequestOp_RequestRange{RequestRange: &etcdserverpb.RangeRequest{
+			Key: []byte(key),
+		}}}},
+	})
+	if err != nil {
+		t.Fatalf("put %s: %v", key, err)
+	}
+	if !resp.Succeeded {
+		t.Fatalf("put %s: changed concurrently", key)
+	}
+	return resp.Header.Revision
+}
+
+// get returns the key, or nil if it doesn't exist
+func (s *testServer) get(t *testing.T, key string) *mvccpb.KeyValue {
+	resp, err := s.kv.Range(context.Background(), &etcdserverpb.RangeRequest{Key: []byte(key)})
+	if err != nil {
+		t.Fatalf("get %s: %v", key, err)
+	}
+	if len(resp.Kvs) == 0 {
+		return nil
+	}
+	return resp.Kvs[0]
+}
+
+// keys returns the values of the keys in the range at the revision
+func (s *testServer) keys(t *testing.T, key, rangeEnd string, rev int64) map[string]string {
+	resp, err := s.kv.Range(context.Background(), &etcdserverpb.RangeRequest{
+		Key:      []byte(key),
+		RangeEnd: []byte(rangeEnd),
+		Revision: rev,
+	})
+	if err != nil {
+		t.Fatalf("range %s to %s: %v", key, rangeEnd, err)
+	}
+	keys := map[string]string{}
+	for _, kv := range resp.Kvs {
+		keys[string(kv.Key)] = string(kv.Value)
+	}
+	return keys
+}
+
+// testWatch receives the responses of a watch stream in the background, so
+// that the tests can wait for them with a timeout
+type testWatch struct {
+	stream    etcdserverpb.Watch_WatchClient
+	cancel    func()
+	responses chan *etcdserverpb.WatchResponse
+	err       chan error
+}
+
+// startWatch opens a watch stream and creates a watch with the request on it
+func (s *testServer) startWatch(t *testing.T, req *etcdserverpb.WatchCreateRequest) *testWatch {
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := s.watch.Watch(ctx)
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+
+	w := &testWatch{
+		stream:    stream,
+		cancel:    cancel,
+		responses: make(chan *etcdserverpb.WatchResponse, 100),
+		err:       make(chan error, 1),
+	}
+	go func() {
+		for {
+			resp, err := stream.Recv()
+			if err != nil {
+				w.err <- err
+				return
+			}
+			w.responses <- resp
+		}
+	}()
+
+	w.send(t, &etcdserverpb.WatchRequest{RequestUnion: &etcdserverpb.WatchRequest_CreateRequest{CreateRequest: req}})
+	return w
+}
+
+func (w *testWatch) send(t *testing.T, req *etcdserverpb.WatchRequest) {
+	if err := w.stream.Send(req); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// next returns the next response of the stream
+func (w *testWatch) next(t *testing.T) *etcdserverpb.WatchResponse {
+	select {
+	case resp := <-w.responses:
+		return resp
+	case err := <-w.err:
+		t.Fatalf("watch stream failed: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a watch response")
+	}
+	return nil
+}
+
+// events returns the events of the responses until there are at least n
+func (w *testWatch) events(t *testing.T, n int) []*mvccpb.Event {
+	var events []*mvccpb.Event
+	for len(events) < n {
+		events = append(events, w.next(t).Events...)
+	}
+	return events
+}
+
+// idle fails the test if the stream sends a response within the duration
+func (w *testWatch) idle(t *testing.T, d time.Duration) {
+	select {
+	case resp := <-w.responses:
+		t.Fatalf("got unexpected watch response %v", resp)
+	case err := <-w.err:
+		t.Fatalf("watch stream failed: %v", err)
+	case <-time.After(d):
+	}
+}
+
+func (w *testWatch) close() {
+	w.cancel()
+}
+
+// waitFor polls until the condition holds, failing the test after ten seconds
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,463 @@
+package server
+
+import (
+	"bytes"
+	"context"
+
+	"go.etcd.io/etcd/etcdserver/api/v3rpc/rpctypes"
+	"go.etcd.io/etcd/etcdserver/etcdserverpb"
+)
+
+// maxTxnOps matches the default limit etcd places on the number of compares
+// and operations in each branch of a transaction
+const maxTxnOps = 128
+
+// responseOp builds the response of an operation once the revision the
+// transaction committed at is known
+type responseOp func(rev int64) *etcdserverpb.ResponseOp
+
+// txn evaluates an arbitrary transaction. The compares and the operations of
+// the chosen branch run against a Transaction of the backend, so they all see
+// the same revision, and the writes are committed together. If a key the
+// transaction depends on is changed concurrently the commit fails and the
+// whole transaction is evaluated again.
+func (l *LimitedServer) txn(ctx context.Context, r *etcdserverpb.TxnRequest) (*etcdserverpb.TxnResponse, error) {
+	if err := checkTxn(r); err != nil {
+		return nil, err
+	}
+
+	for {
+		tx, err := l.backend.BeginTx(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		path, err := comparePath(ctx, tx, r)
+		if err != nil {
+			return nil, err
+		}
+
+		build, err := applyTxn(ctx, tx, r, &path)
+		if err != nil {
+			return nil, err
+		}
+
+		rev, err := tx.Commit(ctx)
+		if err == ErrKeyExists {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		return build(rev), nil
+	}
+}
+
+// comparePath evaluates the compares of the transaction and of the nested
+// transactions in the branches taken before any operation runs, so that like in
+// etcd the compares of a nested transaction don't see the writes of the
+// transactions around it. The results are in the order the transactions are
+// applied in.
+func comparePath(ctx context.Context, tx Transaction, r *etcdserverpb.TxnRequest) ([]bool, error) {
+	succeeded := true
+	for _, c := range r.Compare {
+		ok, err := applyCompare(ctx, tx, c)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			succeeded = false
+			break
+		}
+	}
+
+	ops := r.Success
+	if !succeeded {
+		ops = r.Failure
+	}
+
+	path := []bool{succeeded}
+	for _, op := range ops {
+		if nested := op.GetRequestTxn(); nested != nil {
+			nestedPath, err := comparePath(ctx, tx, nested)
+			if err != nil {
+				return nil, err
+			}
+			path = append(path, nestedPath...)
+		}
+	}
+	return path, nil
+}
+
+// applyTxn applies the branch of the transaction that the first result of the
+// path selects, and consumes the results of it and its nested transactions.
+func applyTxn(ctx context.Context, tx Transaction, r *etcdserverpb.TxnRequest, path *[]bool) (func(rev int64) *etcdserverpb.TxnResponse, error) {
+	succeeded := (*path)[0]
+	*path = (*path)[1:]
+
+	ops := r.Success
+	if !succeeded {
+		ops = r.Failure
+	}
+
+	builds := make([]responseOp, 0, len(ops))
+	for _, op := range ops {
+		build, err := applyOp(ctx, tx, op, path)
+		if err != nil {
+			return nil, err
+		}
+		builds = append(builds, build)
+	}
+
+	return func(rev int64) *etcdserverpb.TxnResponse {
+		resp := &etcdserverpb.TxnResponse{
+			Header:    txnHeader(rev),
+			Succeeded: succeeded,
+			Responses: make([]*etcdserverpb.ResponseOp, 0, len(builds)),
+		}
+		for _, build := range builds {
+			resp.Responses = append(resp.Responses, build(rev))
+		}
+		return resp
+	}, nil
+}
+
+func applyOp(ctx context.Context, tx Transaction, op *etcdserverpb.RequestOp, path *[]bool) (responseOp, error) {
+	switch {
+	case op.GetRequestRange() != nil:
+		return applyRange(ctx, tx, op.GetRequestRange())
+	case op.GetRequestPut() != nil:
+		return applyPut(ctx, tx, op.GetRequestPut())
+	case op.GetRequestDeleteRange() != nil:
+		return applyDeleteRange(ctx, tx, op.GetRequestDeleteRange())
+	case op.GetRequestTxn() != nil:
+		build, err := applyTxn(ctx, tx, op.GetRequestTxn(), path)
+		if err != nil {
+			return nil, err
+		}
+		return func(rev int64) *etcdserverpb.ResponseOp {
+			return &etcdserverpb.ResponseOp{
+				Response: &etcdserverpb.ResponseOp_ResponseTxn{
+					ResponseTxn: build(rev),
+				},
+			}
+		}, nil
+	}
+	return nil, unsupported("empty request")
+}
+
+func applyRange(ctx context.Context, tx Transaction, r *etcdserverpb.RangeRequest) (responseOp, error) {
+	if err := checkRange(r); err != nil {
+		return nil, err
+	}
+
+	resp, err := readRange(ctx, tx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(rev int64) *etcdserverpb.ResponseOp {
+		return &etcdserverpb.ResponseOp{
+			Response: &etcdserverpb.ResponseOp_ResponseRange{
+				ResponseRange: &etcdserverpb.RangeResponse{
+					Header: txnHeader(rev),
+					Kvs:    toKVs(resp.Kvs...),
+					More:   resp.More,
+					Count:  resp.Count,
+				},
+			},
+		}
+	}, nil
+}
+
+func applyPut(ctx context.Context, tx Transaction, r *etcdserverpb.PutRequest) (responseOp, error) {
+	value, lease := r.Value, r.Lease
+	if r.IgnoreValue || r.IgnoreLease {
+		_, kv, err := tx.Get(ctx, string(r.Key), 0)
+		if err != nil {
+			return nil, err
+		}
+		if kv == nil {
+			return nil, rpctypes.ErrGRPCKeyNotFound
+		}
+		if r.IgnoreValue {
+			value = kv.Value
+		}
+		if r.IgnoreLease {
+			lease = kv.Lease
+		}
+	}
+
+	prevKV, err := tx.Put(ctx, string(r.Key), value, lease)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(rev int64) *etcdserverpb.ResponseOp {
+		resp := &etcdserverpb.PutResponse{
+			Header: txnHeader(rev),
+		}
+		if r.PrevKv {
+			resp.PrevKv = toKV(prevKV)
+		}
+		return &etcdserverpb.ResponseOp{
+			Response: &etcdserverpb.ResponseOp_ResponsePut{
+				ResponsePut: resp,
+			},
+		}
+	}, nil
+}
+
+func applyDeleteRange(ctx context.Context, tx Transaction, r *etcdserverpb.DeleteRangeRequest) (responseOp, error) {
+	keys := []string{string(r.Key)}
+	if len(r.RangeEnd) > 0 {
+		kvs, err := rangeKVs(ctx, tx, r.Key, r.RangeEnd)
+		if err != nil {
+			return nil, err
+		}
+		keys = keys[:0]
+		for _, kv := range kvs {
+			keys = append(keys, kv.Key)
+		}
+	}
+
+	var prevKVs []*KeyValue
+	for _, key := range keys {
+		prevKV, err := tx.Delete(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if prevKV != nil {
+			prevKVs = append(prevKVs, prevKV)
+		}
+	}
+
+	return func(rev int64) *etcdserverpb.ResponseOp {
+		resp := &etcdserverpb.DeleteRangeResponse{
+			Header:  txnHeader(rev),
+			Deleted: int64(len(prevKVs)),
+		}
+		if r.PrevKv {
+			resp.PrevKvs = toKVs(prevKVs...)
+		}
+		return &etcdserverpb.ResponseOp{
+			Response: &etcdserverpb.ResponseOp_ResponseDeleteRange{
+				ResponseDeleteRange: resp,
+			},
+		}
+	}, nil
+}
+
+// rangeKVs returns the keys in [key, rangeEnd)
+func rangeKVs(ctx context.Context, b reader, key, rangeEnd []byte) ([]*KeyValue, error) {
+	_, kvs, err := b.List(ctx, string(key), string(rangeEnd), 0, 0, ListOptions{})
+	return kvs, err
+}
+
+// applyCompare follows etcd, a compare against a range must hold for every key
+// in the range, and a missing key compares as a key with all fields unset
+// except that comparing its value always fails.
+func applyCompare(ctx context.Context, tx Transaction, c *etcdserverpb.Compare) (bool, error) {
+	var kvs []*KeyValue
+	if len(c.RangeEnd) == 0 {
+		_, kv, err := tx.Get(ctx, string(c.Key), 0)
+		if err != nil {
+			return false, err
+		}
+		if kv != nil {
+			kvs = append(kvs, kv)
+		}
+	} else {
+		var err error
+		kvs, err = rangeKVs(ctx, tx, c.Key, c.RangeEnd)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if len(kvs) == 0 {
+		if c.Target == etcdserverpb.Compare_VALUE {
+			return false, nil
+		}
+		return compareKV(c, &KeyValue{}), nil
+	}
+
+	for _, kv := range kvs {
+		if !compareKV(c, kv) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func compareKV(c *etcdserverpb.Compare, kv *KeyValue) bool {
+	var result int
+	switch c.Target {
+	case etcdserverpb.Compare_VALUE:
+		result = bytes.Compare(kv.Value, c.GetValue())
+	case etcdserverpb.Compare_VERSION:
+		result = compareInt64(kv.Version, c.GetVersion())
+	case etcdserverpb.Compare_CREATE:
+		result = compareInt64(kv.CreateRevision, c.GetCreateRevision())
+	case etcdserverpb.Compare_MOD:
+		result = compareInt64(kv.ModRevision, c.GetModRevision())
+	case etcdserverpb.Compare_LEASE:
+		result = compareInt64(kv.Lease, c.GetLease())
+	}
+
+	switch c.Result {
+	case etcdserverpb.Compare_EQUAL:
+		return result == 0
+	case etcdserverpb.Compare_NOT_EQUAL:
+		return result != 0
+	case etcdserverpb.Compare_GREATER:
+		return result > 0
+	case etcdserverpb.Compare_LESS:
+		return result < 0
+	}
+	return false
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// inRange reports whether key falls in [start, end). An end of "\x00" means
+// every key from start on.
+func inRange(key, start, end []byte) bool {
+	if len(end) == 0 {
+		return bytes.Equal(key, start)
+	}
+	if bytes.Compare(key, start) < 0 {
+		return false
+	}
+	return bytes.Equal(end, []byte{0}) || bytes.Compare(key, end) < 0
+}
+
+// hasPut tells whether any branch of the transaction puts a key, including
+// the transactions nested in it
+func hasPut(r *etcdserverpb.TxnRequest) bool {
+	for _, ops := range [][]*etcdserverpb.RequestOp{r.Success, r.Failure} {
+		for _, op := range ops {
+			switch op := op.Request.(type) {
+			case *etcdserverpb.RequestOp_RequestPut:
+				return true
+			case *etcdserverpb.RequestOp_RequestTxn:
+				if hasPut(op.RequestTxn) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// checkTxn validates the size of the transaction and rejects writing a key
+// twice, like etcd does before applying it
+func checkTxn(r *etcdserverpb.TxnRequest) error {
+	if len(r.Compare) > maxTxnOps || len(r.Success) > maxTxnOps || len(r.Failure) > maxTxnOps {
+		return rpctypes.ErrGRPCTooManyOps
+	}
+
+	for _, ops := range [][]*etcdserverpb.RequestOp{r.Success, r.Failure} {
+		for _, op := range ops {
+			if nested := op.GetRequestTxn(); nested != nil {
+				if err := checkTxn(nested); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if _, _, err := checkIntervals(r.Success); err != nil {
+		return err
+	}
+	_, _, err := checkIntervals(r.Failure)
+	return err
+}
+
+type keyRange struct {
+	key, end []byte
+}
+
+// checkIntervals returns the keys put and the ranges deleted by the operations
+// and fails if any of them overlap. Both branches of a nested transaction may
+// put the same key, as only one of them runs.
+func checkIntervals(ops []*etcdserverpb.RequestOp) (map[string]struct{}, []keyRange, error) {
+	var dels []keyRange
+	for _, op := range ops {
+		if del := op.GetRequestDeleteRange(); del != nil {
+			dels = append(dels, keyRange{key: del.Key, end: del.RangeEnd})
+		}
+	}
+
+	deleted := func(key string) bool {
+		for _, del := range dels {
+			if inRange([]byte(key), del.key, del.end) {
+				return true
+			}
+		}
+		return false
+	}
+
+	puts := map[string]struct{}{}
+	for _, op := range ops {
+		nested := op.GetRequestTxn()
+		if nested == nil {
+			continue
+		}
+
+		putsThen, delsThen, err := checkIntervals(nested.Success)
+		if err != nil {
+			return nil, nil, err
+		}
+		putsElse, delsElse, err := checkIntervals(nested.Failure)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for key := range putsThen {
+			if _, ok := puts[key]; ok || deleted(key) {
+				return nil, nil, rpctypes.ErrGRPCDuplicateKey
+			}
+			puts[key] = struct{}{}
+		}
+		for key := range putsElse {
+			if _, ok := puts[key]; ok {
+				if _, safe := putsThen[key]; !safe {
+					return nil, nil, rpctypes.ErrGRPCDuplicateKey
+				}
+			}
+			if deleted(key) {
+				return nil, nil, rpctypes.ErrGRPCDuplicateKey
+			}
+			puts[key] = struct{}{}
+		}
+
+		dels = append(dels, delsThen...)
+		dels = append(dels, delsElse...)
+	}
+
+	for _, op := range ops {
+		put := op.GetRequestPut()
+		if put == nil {
+			continue
+		}
+		if _, ok := puts[string(put.Key)]; ok || deleted(string(put.Key)) {
+			return nil, nil, rpctypes.ErrGRPCDuplicateKey
+		}
+		puts[string(put.Key)] = struct{}{}
+	}
+
+	return puts, dels, nil
+}
@@ -0,0 +1,399 @@
+package server_test
+
+import (
+	"context"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/rancher/kine/pkg/logstructured"
+	"github.com/rancher/kine/pkg/server"
+	"go.etcd.io/etcd/etcdserver/api/v3rpc/rpctypes"
+	"go.etcd.io/etcd/etcdserver/etcdserverpb"
+)
+
+func compareValue(key, rangeEnd string, result etcdserverpb.Compare_CompareResult, value string) *etcdserverpb.Compare {
+	return &etcdserverpb.Compare{
+		Key:         []byte(key),
+		RangeEnd:    []byte(rangeEnd),
+		Target:      etcdserverpb.Compare_VALUE,
+		Result:      result,
+		TargetUnion: &etcdserverpb.Compare_Value{Value: []byte(value)},
+	}
+}
+
+func compareVersion(key, rangeEnd string, result etcdserverpb.Compare_CompareResult, version int64) *etcdserverpb.Compare {
+	return &etcdserverpb.Compare{
+		Key:         []byte(key),
+		RangeEnd:    []byte(rangeEnd),
+		Target:      etcdserverpb.Compare_VERSION,
+		Result:      result,
+		TargetUnion: &etcdserverpb.Compare_Version{Version: version},
+	}
+}
+
+func opPut(key, value string) *etcdserverpb.RequestOp {
+	return &etcdserverpb.RequestOp{Request: &etcdserverpb.RequestOp_RequestPut{RequestPut: &etcdserverpb.PutRequest{
+		Key:    []byte(key),
+		Value:  []byte(value),
+		PrevKv: true,
+	}}}
+}
+
+func opDelete(key, rangeEnd string) *etcdserverpb.RequestOp {
+	return &etcdserverpb.RequestOp{Request: &etcdserverpb.RequestOp_RequestDeleteRange{RequestDeleteRange: &etcdserverpb.DeleteRangeRequest{
+		Key:      []byte(key),
+		RangeEnd: []byte(rangeEnd),
+	}}}
+}
+
+func opRange(key string) *etcdserverpb.RequestOp {
+	return &etcdserverpb.RequestOp{Request: &etcdserverpb.RequestOp_RequestRange{RequestRange: &etcdserverpb.RangeRequest{
+		Key: []byte(key),
+	}}}
+}
+
+func opCount(key, rangeEnd string) *etcdserverpb.RequestOp {
+	return &etcdserverpb.RequestOp{Request: &etcdserverpb.RequestOp_RequestRange{RequestRange: &etcdserverpb.RangeRequest{
+		Key:       []byte(key),
+		RangeEnd:  []byte(rangeEnd),
+		CountOnly: true,
+	}}}
+}
+
+func opTxn(txn *etcdserverpb.TxnRequest) *etcdserverpb.RequestOp {
+	return &etcdserverpb.RequestOp{Request: &etcdserverpb.RequestOp_RequestTxn{RequestTxn: txn}}
+}
+
+func TestTxn(t *testing.T) {
+	// every case starts from these keys
+	initial := map[string]string{
+		"/k/a": "2",
+		"/k/b": "b",
+		"/k/c": "c",
+	}
+
+	for _, tt := range []struct {
+		name      string
+		txn       *etcdserverpb.TxnRequest
+		err       error
+		succeeded bool
+		// keys are the keys after the transaction
+		keys map[string]string
+	}{
+		{
+			name: "value equal",
+			txn: &etcdserverpb.TxnRequest{
+				Compare: []*etcdserverpb.Compare{compareValue("/k/a", "", etcdserverpb.Compare_EQUAL, "2")},
+				Success: []*etcdserverpb.RequestOp{opPut("/k/a", "3")},
+				Failure: []*etcdserverpb.RequestOp{opPut("/k/b", "failed")},
+			},
+			succeeded: true,
+			keys:      map[string]string{"/k/a": "3", "/k/b": "b", "/k/c": "c"},
+		},
+		{
+			name: "value of a missing key",
+			txn: &etcdserverpb.TxnRequest{
+				Compare: []*etcdserverpb.Compare{compareValue("/k/d", "", etcdserverpb.Compare_NOT_EQUAL, "x")},
+				Success: []*etcdserverpb.RequestOp{opPut("/k/d", "succeeded")},
+				Failure: []*etcdserverpb.RequestOp{opPut("/k/d", "failed")},
+			},
+			keys: map[string]string{"/k/a": "2", "/k/b": "b", "/k/c": "c", "/k/d": "failed"},
+		},
+		{
+			name: "value greater",
+			txn: &etcdserverpb.TxnRequest{
+				Compare: []*etcdserverpb.Compare{compareValue("/k/a", "", etcdserverpb.Compare_GREATER, "1")},
+				Success: []*etcdserverpb.RequestOp{opDelete("/k/a", "")},
+			},
+			succeeded: true,
+			keys:      map[string]string{"/k/b": "b", "/k/c": "c"},
+		},
+		{
+			name: "value of every key in a range",
+			txn: &etcdserverpb.TxnRequest{
+				Compare: []*etcdserverpb.Compare{compareValue("/k/", "/k0", etcdserverpb.Compare_GREATER, "1")},
+				Success: []*etcdserverpb.RequestOp{opDelete("/k/", "/k0")},
+			},
+			succeeded: true,
+			keys:      map[string]string{},
+		},
+		{
+			name: "value of a range that fails for one key",
+			txn: &etcdserverpb.TxnRequest{
+				Compare: []*etcdserverpb.Compare{compareValue("/k/", "/k0", etcdserverpb.Compare_GREATER, "a")},
+				Success: []*etcdserverpb.RequestOp{opDelete("/k/", "/k0")},
+			},
+			keys: initial,
+		},
+		{
+			name: "version of a missing key is zero",
+			txn: &etcdserverpb.TxnRequest{
+				Compare: []*etcdserverpb.Compare{compareVersion("/k/d", "", etcdserverpb.Compare_EQUAL, 0)},
+				Success: []*etcdserverpb.RequestOp{opPut("/k/d", "created")},
+			},
+			succeeded: true,
+			keys:      map[string]string{"/k/a": "2", "/k/b": "b", "/k/c": "c", "/k/d": "created"},
+		},
+		{
+			name: "version",
+			txn: &etcdserverpb.TxnRequest{
+				Compare: []*etcdserverpb.Compare{compareVersion("/k/a", "", etcdserverpb.Compare_EQUAL, 2)},
+				Success: []*etcdserverpb.RequestOp{opPut("/k/a", "3")},
+			},
+			succeeded: true,
+			keys:      map[string]string{"/k/a": "3", "/k/b": "b", "/k/c": "c"},
+		},
+		{
+			name: "version of every key in a range",
+			txn: &etcdserverpb.TxnRequest{
+				Compare: []*etcdserverpb.Compare{compareVersion("/k/b", "/k/d", etcdserverpb.Compare_LESS, 2)},
+				Success: []*etcdserverpb.RequestOp{opDelete("/k/b", "/k/d")},
+			},
+			succeeded: true,
+			keys:      map[string]string{"/k/a": "2"},
+		},
+		{
+			name: "version of a range that fails for one key",
+			txn: &etcdserverpb.TxnRequest{
+				Compare: []*etcdserverpb.Compare{compareVersion("/k/a", "/k/d", etcdserverpb.Compare_LESS, 2)},
+				Success: []*etcdserverpb.RequestOp{opDelete("/k/a", "/k/d")},
+			},
+			keys: initial,
+		},
+		{
+			name: "all compares have to succeed",
+			txn: &etcdserverpb.TxnRequest{
+				Compare: []*etcdserverpb.Compare{
+					compareValue("/k/a", "", etcdserverpb.Compare_EQUAL, "2"),
+					compareValue("/k/b", "", etcdserverpb.Compare_EQUAL, "x"),
+				},
+				Success: []*etcdserverpb.RequestOp{opPut("/k/a", "3")},
+			},
+			keys: initial,
+		},
+		{
+			name: "several writes",
+			txn: &etcdserverpb.TxnRequest{
+				Success: []*etcdserverpb.RequestOp{opPut("/k/a", "3"), opPut("/k/d", "d"), opDelete("/k/b", "")},
+			},
+			succeeded: true,
+			keys:      map[string]string{"/k/a": "3", "/k/c": "c", "/k/d": "d"},
+		},
+		{
+			name: "nested",
+			txn: &etcdserverpb.TxnRequest{
+				Compare: []*etcdserverpb.Compare{compareValue("/k/a", "", etcdserverpb.Compare_EQUAL, "2")},
+				Success: []*etcdserverpb.RequestOp{
+					opTxn(&etcdserverpb.TxnRequest{
+						Compare: []*etcdserverpb.Compare{compareValue("/k/b", "", etcdserverpb.Compare_EQUAL, "x")},
+						Success: []*etcdserverpb.RequestOp{opPut("/k/b", "succeeded")},
+						Failure: []*etcdserverpb.RequestOp{opPut("/k/b", "failed")},
+					}),
+					opPut("/k/c", "outer"),
+				},
+			},
+			succeeded: true,
+			keys:      map[string]string{"/k/a": "2", "/k/b": "failed", "/k/c": "outer"},
+		},
+		{
+			// like in etcd, every compare is evaluated before any op runs
+			name: "nested compares don't see the writes around them",
+			txn: &etcdserverpb.TxnRequest{
+				Success: []*etcdserverpb.RequestOp{
+					opPut("/k/d", "1"),
+					opTxn(&etcdserverpb.TxnRequest{
+						Compare: []*etcdserverpb.Compare{compareVersion("/k/d", "", etcdserverpb.Compare_EQUAL, 0)},
+						Success: []*etcdserverpb.RequestOp{opPut("/k/e", "before")},
+						Failure: []*etcdserverpb.RequestOp{opPut("/k/e", "after")},
+					}),
+				},
+			},
+			succeeded: true,
+			keys:      map[string]string{"/k/a": "2", "/k/b": "b", "/k/c": "c", "/k/d": "1", "/k/e": "before"},
+		},
+		{
+			name: "key written twice",
+			txn: &etcdserverpb.TxnRequest{
+				Success: []*etcdserverpb.RequestOp{opPut("/k/a", "3"), opPut("/k/a", "4")},
+			},
+			err:  rpctypes.ErrGRPCDuplicateKey,
+			keys: initial,
+		},
+		{
+			name: "key written twice in a nested transaction",
+			txn: &etcdserverpb.TxnRequest{
+				Success: []*etcdserverpb.RequestOp{
+					opPut("/k/a", "3"),
+					opTxn(&etcdserverpb.TxnRequest{Success: []*etcdserverpb.RequestOp{opDelete("/k/a", "")}}),
+				},
+			},
+			err:  rpctypes.ErrGRPCDuplicateKey,
+			keys: initial,
+		},
+	} {
+		for _, b := range testBackends {
+			t.Run(b.name+"/"+tt.name, func(t *testing.T) {
+				s := newTestServer(t, b)
+				defer s.close()
+
+				s.put(t, "/k/a", "1", 0)
+				s.put(t, "/k/a", "2", 0)
+				s.put(t, "/k/b", "b", 0)
+				before := s.put(t, "/k/c", "c", 0)
+
+				resp, err := s.kv.Txn(context.Background(), tt.txn)
+				if tt.err != nil {
+					if err == nil || err.Error() != tt.err.Error() {
+						t.Fatalf("got error %v, expected %v", err, tt.err)
+					}
+				} else if err != nil {
+					t.Fatal(err)
+				} else if resp.Succeeded != tt.succeeded {
+					t.Fatalf("succeeded is %v, expected %v", resp.Succeeded, tt.succeeded)
+				}
+
+				if keys := s.keys(t, "/k/", "/k0", 0); !reflect.DeepEqual(keys, tt.keys) {
+					t.Fatalf("keys are %v, expected %v", keys, tt.keys)
+				}
+				if resp == nil {
+					return
+				}
+				if reflect.DeepEqual(tt.keys, initial) {
+					if resp.Header.Revision != before {
+						t.Fatalf("revision is %d, expected %d", resp.Header.Revision, before)
+					}
+					return
+				}
+				if resp.Header.Revision <= before {
+					t.Fatalf("revision is %d, expected a revision after %d", resp.Header.Revision, before)
+				}
+				// reads between the revision the transaction started from and
+				// its own see none of its writes
+				if keys := s.keys(t, "/k/", "/k0", resp.Header.Revision-1); !reflect.DeepEqual(keys, initial) {
+					t.Fatalf("keys before the revision of the transaction are %v, expected %v", keys, initial)
+				}
+				// the writes of a transaction share its revision
+				for key := range tt.keys {
+					if kv := s.get(t, key); kv.ModRevision > before && kv.ModRevision != resp.Header.Revision {
+						t.Fatalf("%s was written at revision %d, expected %d", key, kv.ModRevision, resp.Header.Revision)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestTxnResponses(t *testing.T) {
+	for _, b := range testBackends {
+		t.Run(b.name, func(t *testing.T) {
+			s := newTestServer(t, b)
+			defer s.close()
+
+			s.put(t, "/k/a", "1", 0)
+			s.put(t, "/k/b", "b", 0)
+
+			resp, err := s.kv.Txn(context.Background(), &etcdserverpb.TxnRequest{
+				Success: []*etcdserverpb.RequestOp{
+					opPut("/k/a", "2"),
+					opRange("/k/a"),
+					opDelete("/k/b", ""),
+					opTxn(&etcdserverpb.TxnRequest{Success: []*etcdserverpb.RequestOp{opRange("/k/b")}}),
+					opPut("/k/c", "c"),
+					opCount("/k/", "/k0"),
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.Responses) != 6 {
+				t.Fatalf("got %d responses, expected 6", len(resp.Responses))
+			}
+
+			put := resp.Responses[0].GetResponsePut()
+			if put == nil || put.PrevKv == nil || string(put.PrevKv.Value) != "1" {
+				t.Fatalf("put response is %v, expected the previous value 1", put)
+			}
+			get := resp.Responses[1].GetResponseRange()
+			if get == nil || len(get.Kvs) != 1 || string(get.Kvs[0].Value) != "2" {
+				t.Fatalf("range response is %v, expected the value 2", get)
+			}
+			deleted := resp.Responses[2].GetResponseDeleteRange()
+			if deleted == nil || deleted.Deleted != 1 {
+				t.Fatalf("delete response is %v, expected one key deleted", deleted)
+			}
+			nested := resp.Responses[3].GetResponseTxn()
+			if nested == nil || !nested.Succeeded || len(nested.Responses[0].GetResponseRange().Kvs) != 0 {
+				t.Fatalf("nested response is %v, expected /k/b to be gone", nested)
+			}
+			count := resp.Responses[5].GetResponseRange()
+			if count == nil || count.Count != 2 || len(count.Kvs) != 0 {
+				t.Fatalf("count response is %v, expected /k/a and /k/c to be counted", count)
+			}
+		})
+	}
+}
+
+// racingBackend deletes a key behind the back of the first transaction that
+// puts a key, before the put
+type racingBackend struct {
+	server.Backend
+	key   string
+	raced int32
+}
+
+func (b *racingBackend) BeginTx(ctx context.Context) (server.Transaction, error) {
+	tx, err := b.Backend.BeginTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &racingTx{Transaction: tx, backend: b}, nil
+}
+
+type racingTx struct {
+	server.Transaction
+	backend *racingBackend
+}
+
+func (t *racingTx) Put(ctx context.Context, key string, value []byte, lease int64) (*server.KeyValue, error) {
+	if atomic.CompareAndSwapInt32(&t.backend.raced, 0, 1) {
+		if _, _, _, err := t.backend.Delete(ctx, t.backend.key, 0); err != nil {
+			return nil, err
+		}
+	}
+	return t.Transaction.Put(ctx, key, value, lease)
+}
+
+func TestTxnCountConflict(t *testing.T) {
+	for _, b := range testBackends {
+		t.Run(b.name, func(t *testing.T) {
+			var backend *racingBackend
+			s := newTestServerConfig(t, b, testConfig{
+				compact: logstructured.CompactConfig{Disable: true},
+				wrap: func(b server.Backend) server.Backend {
+					backend = &racingBackend{Backend: b, key: "/k/b"}
+					return backend
+				},
+			})
+			defer s.close()
+
+			s.put(t, "/k/a", "a", 0)
+			s.put(t, "/k/b", "b", 0)
+
+			// the counted keys are dependencies of the transaction, so it is
+			// run again once /k/b is deleted after it was counted
+			resp, err := s.kv.Txn(context.Background(), &etcdserverpb.TxnRequest{
+				Success: []*etcdserverpb.RequestOp{opCount("/k/", "/k0"), opPut("/k/c", "c")},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count := resp.Responses[0].GetResponseRange(); count == nil || count.Count != 1 {
+				t.Fatalf("count response is %v, expected only /k/a to be counted", count)
+			}
+			if keys := s.keys(t, "/k/", "/k0", 0); !reflect.DeepEqual(keys, map[string]string{"/k/a": "a", "/k/c": "c"}) {
+				t.Fatalf("keys are %v, expected /k/a and /k/c", keys)
+			}
+		})
+	}
+}
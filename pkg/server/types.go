@@ -4,22 +4,101 @@ import (
 	"context"
 
 	"go.etcd.io/etcd/etcdserver/api/v3rpc/rpctypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 var (
-	ErrKeyExists = rpctypes.ErrGRPCDuplicateKey
-	ErrCompacted = rpctypes.ErrGRPCCompacted
+	ErrKeyExists     = rpctypes.ErrGRPCDuplicateKey
+	ErrCompacted     = rpctypes.ErrGRPCCompacted
+	ErrFutureRev     = rpctypes.ErrGRPCFutureRev
+	ErrLeaseNotFound = rpctypes.ErrGRPCLeaseNotFound
+	ErrLeaseExists   = rpctypes.ErrGRPCLeaseExist
+	// ErrLeaseIDOutOfRange is returned for a lease requested with an ID that
+	// leases are not granted with
+	ErrLeaseIDOutOfRange = status.Error(codes.InvalidArgument, "etcdserver: lease ID out of range")
+	// ErrNoSpace is returned by writes the storage has no room left for
+	ErrNoSpace = rpctypes.ErrGRPCNoSpace
 )
 
+// Backend stores the keys. List and Count select keys the way etcd ranges do,
+// an empty rangeEnd selects only the key itself, a rangeEnd of "\x00" every key
+// from the key on and anything else the keys in [key, rangeEnd). Keys are
+// compared byte by byte and listed in that order.
 type Backend interface {
 	Start(ctx context.Context) error
 	Get(ctx context.Context, key string, revision int64) (int64, *KeyValue, error)
 	Create(ctx context.Context, key string, value []byte, lease int64) (int64, error)
 	Delete(ctx context.Context, key string, revision int64) (int64, *KeyValue, bool, error)
-	List(ctx context.Context, prefix, startKey string, limit, revision int64) (int64, []*KeyValue, error)
-	Count(ctx context.Context, prefix string) (int64, int64, error)
+	List(ctx context.Context, key, rangeEnd string, limit, revision int64, opts ListOptions) (int64, []*KeyValue, error)
+	Count(ctx context.Context, key, rangeEnd string) (int64, int64, error)
 	Update(ctx context.Context, key string, value []byte, revision, lease int64) (int64, *KeyValue, bool, error)
-	Watch(ctx context.Context, key string, revision int64) <-chan []*Event
+	Watch(ctx context.Context, key, rangeEnd string, revision int64) <-chan WatchResult
+	LeaseGrant(ctx context.Context, id, ttl int64) (int64, *Lease, error)
+	LeaseRevoke(ctx context.Context, id int64) (int64, error)
+	LeaseKeepAlive(ctx context.Context, id int64) (int64, *Lease, error)
+	LeaseTimeToLive(ctx context.Context, id int64) (int64, *Lease, []string, error)
+	LeaseLeases(ctx context.Context) (int64, []*Lease, error)
+	BeginTx(ctx context.Context) (Transaction, error)
+	// Compact discards the history before the revision. It fails with
+	// ErrCompacted if the revision is already compacted and ErrFutureRev if it
+	// is ahead of the current revision. Reads below the revision fail once
+	// Compact returns, the history is removed in the background. The channel
+	// receives the error of the removal, nil if it succeeded, and is closed
+	// once it is done.
+	Compact(ctx context.Context, revision int64) (int64, <-chan error, error)
+	CurrentRevision(ctx context.Context) (int64, error)
+	// Restore writes the keys into a backend that has not been started and
+	// has no keys, each at the revisions it has, and leaves the backend at the
+	// revision, with the history before it compacted. All keys are restored
+	// in one call, as keys that share a revision are restored together.
+	Restore(ctx context.Context, revision int64, kvs []*KeyValue) error
+	// DbSize returns the number of bytes the storage of the backend takes up.
+	DbSize(ctx context.Context) (int64, error)
+	// Defragment gives the space freed by compaction back to the storage.
+	Defragment(ctx context.Context) error
+	// ClusterID returns the ID of the cluster of kine instances sharing the
+	// storage. The first call records id as the ID, later calls return it.
+	ClusterID(ctx context.Context, id uint64) (uint64, error)
+	// PutMember registers the member, or renews its heartbeat if it is
+	// already registered.
+	PutMember(ctx context.Context, member *Member) error
+	// Members lists the registered members, whether or not their heartbeat
+	// is recent.
+	Members(ctx context.Context) ([]*Member, error)
+	DeleteMember(ctx context.Context, id uint64) error
+	// PutAlarm raises the alarm, it is not an error if it is already raised.
+	PutAlarm(ctx context.Context, alarm *Alarm) error
+	// Alarms lists the raised alarms of every member.
+	Alarms(ctx context.Context) ([]*Alarm, error)
+	// DeleteAlarm clears the alarm, it is not an error if it isn't raised.
+	DeleteAlarm(ctx context.Context, alarm *Alarm) error
+}
+
+// WatchResult is sent on the channel of a watch. Revision is the revision the
+// watch has caught up to, every matching event up to it has been sent by the
+// time the result is received. A result without events only reports progress.
+// A watch that can't start because its revision is compacted sends a single
+// result with CompactRevision set instead, and the channel is closed.
+type WatchResult struct {
+	Events          []*Event
+	Revision        int64
+	CompactRevision int64
+}
+
+// Transaction reads the backend at the revision that was current when it
+// began. Writes are buffered, are visible to later reads of the same
+// transaction, and are applied together by Commit. Commit fails with
+// ErrKeyExists if a key the transaction depends on was changed in the
+// meantime, in which case the transaction should be run again. A transaction
+// that is not committed is simply dropped.
+type Transaction interface {
+	Get(ctx context.Context, key string, revision int64) (int64, *KeyValue, error)
+	List(ctx context.Context, key, rangeEnd string, limit, revision int64, opts ListOptions) (int64, []*KeyValue, error)
+	Count(ctx context.Context, key, rangeEnd string) (int64, int64, error)
+	Put(ctx context.Context, key string, value []byte, lease int64) (*KeyValue, error)
+	Delete(ctx context.Context, key string) (*KeyValue, error)
+	Commit(ctx context.Context) (int64, error)
 }
 
 type KeyValue struct {
@@ -28,11 +107,66 @@ type KeyValue struct {
 	ModRevision    int64
 	Value          []byte
 	Lease          int64
+	// Version counts the writes of the key since it was created, starting
+	// at one
+	Version int64
+}
+
+// ListOptions narrow down and order the keys returned by List, the limit is
+// applied after both. The zero value lists every key in key order.
+type ListOptions struct {
+	// KeysOnly leaves out the values
+	KeysOnly   bool
+	SortTarget SortTarget
+	Descending bool
+	// Keys last modified or created outside the bounds are left out, a bound
+	// of zero is not checked
+	MinModRevision    int64
+	MaxModRevision    int64
+	MinCreateRevision int64
+	MaxCreateRevision int64
 }
 
+type SortTarget int
+
+const (
+	SortByKey SortTarget = iota
+	SortByCreateRevision
+	SortByModRevision
+	SortByValue
+	SortByVersion
+)
+
 type Event struct {
 	Delete bool
 	Create bool
 	KV     *KeyValue
 	PrevKV *KeyValue
 }
+
+type Lease struct {
+	ID  int64
+	TTL int64
+	// Expires is the unix time, in seconds, at which the lease runs out
+	// unless it is kept alive.
+	Expires int64
+}
+
+// Member is a kine instance serving the storage, listed by the cluster service
+// like an etcd member.
+type Member struct {
+	ID         uint64
+	Name       string
+	ClientURLs []string
+	// Heartbeat is the unix time, in seconds, at which the member last
+	// reported itself alive.
+	Heartbeat int64
+}
+
+// Alarm is an alarm raised by a member, stored along with the members so that
+// it is shared by every member and outlives restarts. Type is the value of an
+// etcd AlarmType.
+type Alarm struct {
+	MemberID uint64
+	Type     int32
+}
@@ -10,10 +10,11 @@ func isUpdate(txn *etcdserverpb.TxnRequest) (int64, string, []byte, int64, bool)
 	if len(txn.Compare) == 1 &&
 		txn.Compare[0].Target == etcdserverpb.Compare_MOD &&
 		txn.Compare[0].Result == etcdserverpb.Compare_EQUAL &&
+		len(txn.Compare[0].RangeEnd) == 0 &&
 		len(txn.Success) == 1 &&
-		txn.Success[0].GetRequestPut() != nil &&
+		isPlainPut(txn.Success[0].GetRequestPut(), txn.Compare[0].Key) &&
 		len(txn.Failure) == 1 &&
-		txn.Failure[0].GetRequestRange() != nil {
+		isPlainGet(txn.Failure[0].GetRequestRange(), txn.Compare[0].Key) {
 		return txn.Compare[0].GetModRevision(),
 			string(txn.Compare[0].Key),
 			txn.Success[0].GetRequestPut().Value,
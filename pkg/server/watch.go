@@ -4,7 +4,9 @@ import (
 	"context"
 	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/rancher/kine/pkg/metrics"
 	"github.com/sirupsen/logrus"
 	"go.etcd.io/etcd/etcdserver/etcdserverpb"
 	"go.etcd.io/etcd/mvcc/mvccpb"
@@ -14,11 +16,24 @@ var (
 	watchID int64
 )
 
+const (
+	// progressWatchID marks a progress response that applies to every watch
+	// of the stream
+	progressWatchID = -1
+
+	// maxFragmentBytes matches the default request size limit of etcd, which
+	// it also splits fragmented watch responses by
+	maxFragmentBytes = 1.5 * 1024 * 1024
+)
+
 func (s *KVServerBridge) Watch(ws etcdserverpb.Watch_WatchServer) error {
 	w := watcher{
-		server:  ws,
-		backend: s.limited.backend,
-		watches: map[int64]func(){},
+		server:         ws,
+		backend:        s.limited.backend,
+		notifyInterval: s.notifyInterval,
+		header:         s.header,
+		watches:        map[int64]func(){},
+		progress:       map[int64]int64{},
 	}
 	defer w.Close()
 
@@ -33,6 +48,10 @@ func (s *KVServerBridge) Watch(ws etcdserverpb.Watch_WatchServer) error {
 		} else if msg.GetCancelRequest() != nil {
 			logrus.Debugf("WATCH CANCEL REQ id=%d", msg.GetCancelRequest().GetWatchId())
 			w.Cancel(msg.GetCancelRequest().WatchId, nil)
+		} else if msg.GetProgressRequest() != nil {
+			logrus.Debugf("WATCH PROGRESS REQ")
+			w.wg.Add(1)
+			go w.Progress(ws.Context())
 		}
 	}
 }
@@ -40,10 +59,17 @@ func (s *KVServerBridge) Watch(ws etcdserverpb.Watch_WatchServer) error {
 type watcher struct {
 	sync.Mutex
 
-	wg      sync.WaitGroup
-	backend Backend
-	server  etcdserverpb.Watch_WatchServer
-	watches map[int64]func()
+	wg             sync.WaitGroup
+	backend        Backend
+	server         etcdserverpb.Watch_WatchServer
+	notifyInterval time.Duration
+	header         header
+	watches        map[int64]func()
+	// progress holds the revision every watch has sent all events up to,
+	// zero until it is known
+	progress map[int64]int64
+	// sendLock serializes the responses of all watches on the stream
+	sendLock sync.Mutex
 }
 
 func (w *watcher) Start(ctx context.Context, r *etcdserverpb.WatchCreateRequest) {
@@ -54,16 +80,19 @@ func (w *watcher) Start(ctx context.Context, r *etcdserverpb.WatchCreateRequest)
 
 	id := atomic.AddInt64(&watchID, 1)
 	w.watches[id] = cancel
+	w.progress[id] = 0
 	w.wg.Add(1)
+	metrics.ActiveWatches.Inc()
 
 	key := string(r.Key)
+	rangeEnd := string(r.RangeEnd)
 
-	logrus.Debugf("WATCH START id=%d, count=%d, key=%s, revision=%d", id, len(w.watches), key, r.StartRevision)
+	logrus.Debugf("WATCH START id=%d, count=%d, key=%s, rangeEnd=%s, revision=%d", id, len(w.watches), key, rangeEnd, r.StartRevision)
 
 	go func() {
 		defer w.wg.Done()
-		if err := w.server.Send(&etcdserverpb.WatchResponse{
-			Header:  &etcdserverpb.ResponseHeader{},
+		if err := w.send(&etcdserverpb.WatchResponse{
+			Header:  w.currentHeader(),
 			Created: true,
 			WatchId: id,
 		}); err != nil {
@@ -71,24 +100,69 @@ func (w *watcher) Start(ctx context.Context, r *etcdserverpb.WatchCreateRequest)
 			return
 		}
 
-		for events := range w.backend.Watch(ctx, key, r.StartRevision) {
-			if len(events) == 0 {
-				continue
-			}
+		var notify <-chan time.Time
+		if r.ProgressNotify && w.notifyInterval > 0 {
+			t := time.NewTicker(w.notifyInterval)
+			defer t.Stop()
+			notify = t.C
+		}
+
+		var (
+			results  = w.backend.Watch(ctx, key, rangeEnd, r.StartRevision)
+			revision int64
+			// like etcd, a notification is skipped if events were sent
+			// since the last one
+			sentEvents bool
+		)
 
-			if logrus.IsLevelEnabled(logrus.DebugLevel) {
-				for _, event := range events {
-					logrus.Debugf("WATCH READ id=%d, key=%s, revision=%d", id, event.KV.Key, event.KV.ModRevision)
+	loop:
+		for {
+			select {
+			case result, ok := <-results:
+				if !ok {
+					break loop
 				}
-			}
 
-			if err := w.server.Send(&etcdserverpb.WatchResponse{
-				Header:  txnHeader(events[len(events)-1].KV.ModRevision),
-				WatchId: id,
-				Events:  toEvents(events...),
-			}); err != nil {
-				w.Cancel(id, err)
-				continue
+				if result.CompactRevision > 0 {
+					w.Compacted(id, result.CompactRevision)
+					return
+				}
+
+				if events := filterEvents(result.Events, r.Filters); len(events) > 0 {
+					if logrus.IsLevelEnabled(logrus.DebugLevel) {
+						for _, event := range events {
+							logrus.Debugf("WATCH READ id=%d, key=%s, revision=%d", id, event.KV.Key, event.KV.ModRevision)
+						}
+					}
+
+					resp := &etcdserverpb.WatchResponse{
+						Header:  w.header.at(events[len(events)-1].KV.ModRevision),
+						WatchId: id,
+						Events:  toEvents(r.PrevKv, events...),
+					}
+					if err := w.sendEvents(resp, r.Fragment); err != nil {
+						w.Cancel(id, err)
+						continue
+					}
+					sentEvents = true
+				}
+
+				if result.Revision > revision {
+					revision = result.Revision
+					w.setProgress(id, revision)
+				}
+			case <-notify:
+				if sentEvents || revision == 0 {
+					sentEvents = false
+					continue
+				}
+				logrus.Debugf("WATCH PROGRESS id=%d, revision=%d", id, revision)
+				if err := w.send(&etcdserverpb.WatchResponse{
+					Header:  w.header.at(revision),
+					WatchId: id,
+				}); err != nil {
+					w.Cancel(id, err)
+				}
 			}
 		}
 		w.Cancel(id, nil)
@@ -96,18 +170,163 @@ func (w *watcher) Start(ctx context.Context, r *etcdserverpb.WatchCreateRequest)
 	}()
 }
 
-func toEvents(events ...*Event) []*mvccpb.Event {
+func (w *watcher) setProgress(id, revision int64) {
+	w.Lock()
+	defer w.Unlock()
+	if _, ok := w.progress[id]; ok {
+		w.progress[id] = revision
+	}
+}
+
+// Progress sends a single progress response for all watches of the stream,
+// at the lowest revision any of them has caught up to. Watches that have not
+// reported their revision yet are waited for.
+func (w *watcher) Progress(ctx context.Context) {
+	defer w.wg.Done()
+
+	t := time.NewTicker(10 * time.Millisecond)
+	defer t.Stop()
+
+	for {
+		revision, ok := w.minProgress()
+		if ok {
+			if revision == 0 {
+				// no watches, the stream is up to date by definition
+				rev, err := w.backend.CurrentRevision(ctx)
+				if err != nil {
+					logrus.Errorf("WATCH failed to get current revision for progress: %v", err)
+					return
+				}
+				revision = rev
+			}
+
+			logrus.Debugf("WATCH PROGRESS revision=%d", revision)
+			if err := w.send(&etcdserverpb.WatchResponse{
+				Header:  w.header.at(revision),
+				WatchId: progressWatchID,
+			}); err != nil {
+				logrus.Errorf("WATCH failed to send progress response: %v", err)
+			}
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// minProgress returns the lowest revision the watches have caught up to, or
+// false if it isn't known for all of them
+func (w *watcher) minProgress() (int64, bool) {
+	w.Lock()
+	defer w.Unlock()
+
+	var min int64
+	for _, revision := range w.progress {
+		if revision == 0 {
+			return 0, false
+		}
+		if min == 0 || revision < min {
+			min = revision
+		}
+	}
+	return min, true
+}
+
+// currentHeader returns the header of a response at the current revision, like
+// etcd sends with the responses that create or cancel a watch. The revision is
+// left out if it can't be read, the response is still worth sending.
+func (w *watcher) currentHeader() *etcdserverpb.ResponseHeader {
+	rev, err := w.backend.CurrentRevision(w.server.Context())
+	if err != nil {
+		logrus.Errorf("WATCH failed to get current revision for response header: %v", err)
+	}
+	return w.header.at(rev)
+}
+
+func (w *watcher) send(resp *etcdserverpb.WatchResponse) error {
+	w.header.fill(resp.Header)
+
+	w.sendLock.Lock()
+	defer w.sendLock.Unlock()
+	return w.server.Send(resp)
+}
+
+// sendEvents sends a response with events. If fragment is set and the response
+// is too large, its events are split over several responses that all but the
+// last one mark as a fragment, like etcd does.
+func (w *watcher) sendEvents(resp *etcdserverpb.WatchResponse, fragment bool) error {
+	if !fragment || len(resp.Events) < 2 || resp.Size() < maxFragmentBytes {
+		return w.send(resp)
+	}
+
+	events := resp.Events
+	for len(events) > 0 {
+		part := *resp
+		part.Fragment = true
+		part.Events = nil
+		for len(events) > 0 {
+			part.Events = append(part.Events, events[0])
+			if len(part.Events) > 1 && part.Size() >= maxFragmentBytes {
+				part.Events = part.Events[:len(part.Events)-1]
+				break
+			}
+			events = events[1:]
+		}
+		if len(events) == 0 {
+			part.Fragment = false
+		}
+
+		if err := w.send(&part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// filterEvents leaves out the events of the types the watch filters
+func filterEvents(events []*Event, filters []etcdserverpb.WatchCreateRequest_FilterType) []*Event {
+	if len(filters) == 0 {
+		return events
+	}
+
+	var noPut, noDelete bool
+	for _, filter := range filters {
+		switch filter {
+		case etcdserverpb.WatchCreateRequest_NOPUT:
+			noPut = true
+		case etcdserverpb.WatchCreateRequest_NODELETE:
+			noDelete = true
+		}
+	}
+
+	result := make([]*Event, 0, len(events))
+	for _, event := range events {
+		if (event.Delete && noDelete) || (!event.Delete && noPut) {
+			continue
+		}
+		result = append(result, event)
+	}
+	return result
+}
+
+func toEvents(prevKV bool, events ...*Event) []*mvccpb.Event {
 	ret := make([]*mvccpb.Event, 0, len(events))
 	for _, e := range events {
-		ret = append(ret, toEvent(e))
+		ret = append(ret, toEvent(e, prevKV))
 	}
 	return ret
 }
 
-func toEvent(event *Event) *mvccpb.Event {
+func toEvent(event *Event, prevKV bool) *mvccpb.Event {
 	e := &mvccpb.Event{
-		Kv:     toKV(event.KV),
-		PrevKv: toKV(event.PrevKV),
+		Kv: toKV(event.KV),
+	}
+	if prevKV {
+		e.PrevKv = toKV(event.PrevKV)
 	}
 	if event.Delete {
 		e.Type = mvccpb.DELETE
@@ -118,21 +337,46 @@ func toEvent(event *Event) *mvccpb.Event {
 	return e
 }
 
-func (w *watcher) Cancel(watchID int64, err error) {
+func (w *watcher) remove(watchID int64) {
 	w.Lock()
+	defer w.Unlock()
 	if cancel, ok := w.watches[watchID]; ok {
 		cancel()
 		delete(w.watches, watchID)
+		delete(w.progress, watchID)
+		metrics.ActiveWatches.Dec()
 	}
-	w.Unlock()
+}
+
+// Compacted cancels a watch whose revision is compacted. Like etcd, the
+// response carries the compact revision so that clients know to start over
+// from a newer revision.
+func (w *watcher) Compacted(watchID, compactRevision int64) {
+	w.remove(watchID)
+
+	logrus.Debugf("WATCH CANCEL id=%d compact=%d", watchID, compactRevision)
+	err := w.send(&etcdserverpb.WatchResponse{
+		Header:          w.currentHeader(),
+		Canceled:        true,
+		CancelReason:    ErrCompacted.Error(),
+		CompactRevision: compactRevision,
+		WatchId:         watchID,
+	})
+	if err != nil {
+		logrus.Errorf("WATCH Failed to send compacted response for watchID %d: %v", watchID, err)
+	}
+}
+
+func (w *watcher) Cancel(watchID int64, err error) {
+	w.remove(watchID)
 
 	reason := ""
 	if err != nil {
 		reason = err.Error()
 	}
 	logrus.Debugf("WATCH CANCEL id=%d reason=%s", watchID, reason)
-	serr := w.server.Send(&etcdserverpb.WatchResponse{
-		Header:       &etcdserverpb.ResponseHeader{},
+	serr := w.send(&etcdserverpb.WatchResponse{
+		Header:       w.currentHeader(),
 		Canceled:     true,
 		CancelReason: "watch closed",
 		WatchId:      watchID,
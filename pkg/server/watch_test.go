@@ -0,0 +1,267 @@
+package server_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rancher/kine/pkg/logstructured"
+	"go.etcd.io/etcd/etcdserver/etcdserverpb"
+	"go.etcd.io/etcd/mvcc/mvccpb"
+)
+
+func (s *testServer) delete(t *testing.T, key string) int64 {
+	resp, err := s.kv.DeleteRange(context.Background(), &etcdserverpb.DeleteRangeRequest{Key: []byte(key)})
+	if err != nil {
+		t.Fatalf("delete %s: %v", key, err)
+	}
+	return resp.Header.Revision
+}
+
+// eventKeys returns the type and key of every event, like "PUT /a"
+func eventKeys(events []*mvccpb.Event) []string {
+	var keys []string
+	for _, e := range events {
+		keys = append(keys, e.Type.String()+" "+string(e.Kv.Key))
+	}
+	return keys
+}
+
+func TestWatchRange(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		key      string
+		rangeEnd string
+		events   []string
+	}{
+		{
+			name:   "exact key",
+			key:    "/a",
+			events: []string{"PUT /a", "PUT /a"},
+		},
+		{
+			name:     "prefix",
+			key:      "/a",
+			rangeEnd: "/b",
+			events:   []string{"PUT /a", "PUT /ab", "PUT /a", "DELETE /ab"},
+		},
+		{
+			name:     "range",
+			key:      "/ab",
+			rangeEnd: "/c",
+			events:   []string{"PUT /ab", "PUT /b", "DELETE /ab", "PUT /b"},
+		},
+		{
+			name:     "from the key",
+			key:      "/b",
+			rangeEnd: "\x00",
+			events:   []string{"PUT /b", "PUT /b", "PUT /c"},
+		},
+	} {
+		for _, b := range testBackends {
+			t.Run(b.name+"/"+tt.name, func(t *testing.T) {
+				s := newTestServer(t, b)
+				defer s.close()
+
+				// the first writes are replayed from the history, the others
+				// are watched as they happen
+				start := s.put(t, "/a", "1", 0)
+				s.put(t, "/ab", "1", 0)
+				s.put(t, "/b", "1", 0)
+
+				w := s.startWatch(t, &etcdserverpb.WatchCreateRequest{Key: []byte(tt.key), RangeEnd: []byte(tt.rangeEnd), StartRevision: start})
+				defer w.close()
+				w.next(t)
+
+				s.put(t, "/a", "2", 0)
+				s.delete(t, "/ab")
+				s.put(t, "/b", "2", 0)
+				s.put(t, "/c", "1", 0)
+
+				if events := eventKeys(w.events(t, len(tt.events))); !reflect.DeepEqual(events, tt.events) {
+					t.Fatalf("got events %v, expected %v", events, tt.events)
+				}
+				w.idle(t, 100*time.Millisecond)
+			})
+		}
+	}
+}
+
+func TestWatchOptions(t *testing.T) {
+	for _, b := range testBackends {
+		t.Run(b.name, func(t *testing.T) {
+			s := newTestServer(t, b)
+			defer s.close()
+
+			start := s.put(t, "/a", "1", 0)
+			s.put(t, "/a", "2", 0)
+			s.delete(t, "/a")
+			s.put(t, "/a", "3", 0)
+
+			for _, tt := range []struct {
+				name    string
+				prevKV  bool
+				filters []etcdserverpb.WatchCreateRequest_FilterType
+				// events are the type, value and previous value of the events, delete
+				// events carry no value
+				events [][3]string
+			}{
+				{
+					name:   "events",
+					events: [][3]string{{"PUT", "1"}, {"PUT", "2"}, {"DELETE"}, {"PUT", "3"}},
+				},
+				{
+					name:   "previous values",
+					prevKV: true,
+					events: [][3]string{{"PUT", "1"}, {"PUT", "2", "1"}, {"DELETE", "", "2"}, {"PUT", "3"}},
+				},
+				{
+					name:    "no puts",
+					prevKV:  true,
+					filters: []etcdserverpb.WatchCreateRequest_FilterType{etcdserverpb.WatchCreateRequest_NOPUT},
+					events:  [][3]string{{"DELETE", "", "2"}},
+				},
+				{
+					name:    "no deletes",
+					filters: []etcdserverpb.WatchCreateRequest_FilterType{etcdserverpb.WatchCreateRequest_NODELETE},
+					events:  [][3]string{{"PUT", "1"}, {"PUT", "2"}, {"PUT", "3"}},
+				},
+			} {
+				t.Run(tt.name, func(t *testing.T) {
+					w := s.startWatch(t, &etcdserverpb.WatchCreateRequest{Key: []byte("/a"), StartRevision: start, PrevKv: tt.prevKV, Filters: tt.filters})
+					defer w.close()
+					w.next(t)
+
+					var events [][3]string
+					for _, e := range w.events(t, len(tt.events)) {
+						event := [3]string{e.Type.String()}
+						if e.Type == mvccpb.PUT {
+							event[1] = string(e.Kv.Value)
+						}
+						if e.PrevKv != nil {
+							event[2] = string(e.PrevKv.Value)
+						}
+						events = append(events, event)
+					}
+					if !reflect.DeepEqual(events, tt.events) {
+						t.Fatalf("got events %v, expected %v", events, tt.events)
+					}
+					w.idle(t, 100*time.Millisecond)
+				})
+			}
+		})
+	}
+}
+
+func TestWatchFragment(t *testing.T) {
+	for _, b := range testBackends {
+		t.Run(b.name, func(t *testing.T) {
+			s := newTestServer(t, b)
+			defer s.close()
+
+			// three values together are too large for a single response
+			value := string(make([]byte, 700*1024))
+			start := s.put(t, "/k/a", value, 0)
+			s.put(t, "/k/b", value, 0)
+			s.put(t, "/k/c", value, 0)
+
+			for _, tt := range []struct {
+				name     string
+				fragment bool
+				// fragments are the number of events of every response
+				fragments []int
+			}{
+				{name: "whole", fragments: []int{3}},
+				{name: "fragmented", fragment: true, fragments: []int{2, 1}},
+			} {
+				t.Run(tt.name, func(t *testing.T) {
+					w := s.startWatch(t, &etcdserverpb.WatchCreateRequest{Key: []byte("/k/"), RangeEnd: []byte("/k0"), StartRevision: start, Fragment: tt.fragment})
+					defer w.close()
+					w.next(t)
+
+					var fragments []int
+					var keys []string
+					for i := range tt.fragments {
+						resp := w.next(t)
+						if last := i == len(tt.fragments)-1; resp.Fragment == last {
+							t.Fatalf("response %d of %d is marked as fragment %v", i+1, len(tt.fragments), resp.Fragment)
+						}
+						fragments = append(fragments, len(resp.Events))
+						keys = append(keys, eventKeys(resp.Events)...)
+					}
+					if !reflect.DeepEqual(fragments, tt.fragments) {
+						t.Fatalf("got responses of %v events, expected %v", fragments, tt.fragments)
+					}
+					if expected := []string{"PUT /k/a", "PUT /k/b", "PUT /k/c"}; !reflect.DeepEqual(keys, expected) {
+						t.Fatalf("got events %v, expected %v", keys, expected)
+					}
+					w.idle(t, 100*time.Millisecond)
+				})
+			}
+		})
+	}
+}
+
+func TestWatchProgress(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		notify bool
+		// request sends a progress request on the stream
+		request bool
+		// watchID is the watch the progress response is for, none if zero
+		watchID int64
+	}{
+		{name: "no progress"},
+		{name: "progress notifications", notify: true, watchID: 1},
+		{name: "progress request", request: true, watchID: -1},
+	} {
+		for _, b := range testBackends {
+			t.Run(b.name+"/"+tt.name, func(t *testing.T) {
+				s := newTestServerConfig(t, b, testConfig{
+					compact:        logstructured.CompactConfig{Disable: true},
+					notifyInterval: 100 * time.Millisecond,
+				})
+				defer s.close()
+
+				start := s.put(t, "/a", "1", 0)
+				w := s.startWatch(t, &etcdserverpb.WatchCreateRequest{Key: []byte("/a"), StartRevision: start, ProgressNotify: tt.notify})
+				defer w.close()
+				created := w.next(t)
+				if events := w.events(t, 1); len(events) != 1 {
+					t.Fatalf("got %d events, expected 1", len(events))
+				}
+
+				// writes outside of the watched range only move the progress
+				rev := s.put(t, "/b", "1", 0)
+				progress := &etcdserverpb.WatchRequest{RequestUnion: &etcdserverpb.WatchRequest_ProgressRequest{ProgressRequest: &etcdserverpb.WatchProgressRequest{}}}
+				if tt.request {
+					w.send(t, progress)
+				}
+				if tt.watchID == 0 {
+					w.idle(t, 500*time.Millisecond)
+					return
+				}
+
+				watchID := created.WatchId
+				if tt.watchID < 0 {
+					watchID = tt.watchID
+				}
+				// a progress response may be sent before the watch has seen
+				// the last write, but never a revision past it
+				for {
+					resp := w.next(t)
+					if len(resp.Events) > 0 || resp.WatchId != watchID || resp.Header.Revision > rev {
+						t.Fatalf("got response %v, expected progress up to revision %d", resp, rev)
+					}
+					if resp.Header.Revision == rev {
+						break
+					}
+					if tt.request {
+						w.send(t, progress)
+					}
+				}
+			})
+		}
+	}
+}
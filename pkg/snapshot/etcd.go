@@ -0,0 +1,437 @@
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/kine/pkg/server"
+	"github.com/sirupsen/logrus"
+	"go.etcd.io/bbolt"
+	"go.etcd.io/etcd/lease/leasepb"
+	"go.etcd.io/etcd/mvcc/mvccpb"
+)
+
+// An etcd v3 snapshot is the bbolt database of a member followed by its
+// SHA-256. The key bucket holds every change to the keys since the last
+// compaction, keyed by the main revision, a '_' and the sub revision of the
+// change within its transaction. Deletions have a 't' appended to their key.
+// The meta bucket records the compaction and the lease bucket the leases by
+// their id.
+const (
+	etcdRevBytesLen = 8 + 1 + 8
+	etcdTombstone   = 't'
+
+	// etcdOpenTimeout bounds the wait for the lock of a database that an
+	// etcd member still has open
+	etcdOpenTimeout = 5 * time.Second
+)
+
+var (
+	etcdKeyBucket   = []byte("key")
+	etcdMetaBucket  = []byte("meta")
+	etcdLeaseBucket = []byte("lease")
+
+	etcdFinishedCompactKey  = []byte("finishedCompactRev")
+	etcdScheduledCompactKey = []byte("scheduledCompactRev")
+)
+
+// etcdKeyValue is a key of an etcd snapshot with the sub revision of its
+// latest change.
+type etcdKeyValue struct {
+	kv  *server.KeyValue
+	sub int64
+}
+
+// ImportEtcd restores an etcd v3 snapshot, as saved by `etcdctl snapshot
+// save`, into a backend that has not been started and has no keys or leases,
+// and returns the revision the backend continues from. The file may also be
+// the database of a member without the checksum.
+//
+// Only the latest value of each key is imported, at the version etcd
+// recorded, and the history is compacted. etcd changes several keys at a single revision in a
+// transaction, kine stores each change with an ID of its own no higher than
+// its revision, which the IDs below such a revision may not leave room for.
+// The revisions after such a change move up to give each key a revision of
+// its own instead. Otherwise the keys keep their revisions.
+func ImportEtcd(ctx context.Context, backend server.Backend, path string) (int64, error) {
+	if err := verifyEtcd(path); err != nil {
+		return 0, err
+	}
+	if err := checkEmpty(ctx, backend); err != nil {
+		return 0, err
+	}
+
+	db, err := bbolt.Open(path, 0400, &bbolt.Options{ReadOnly: true, Timeout: etcdOpenTimeout})
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to open %s", path)
+	}
+	defer db.Close()
+
+	var (
+		revision int64
+		leases   []*server.Lease
+		kvs      []*etcdKeyValue
+	)
+	err = db.View(func(tx *bbolt.Tx) error {
+		var err error
+		if revision, kvs, err = etcdKeys(tx); err != nil {
+			return err
+		}
+		leases, err = etcdLeases(tx)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	revision = renumber(revision, kvs)
+
+	// leases come first, so that the keys are restored after their leases
+	next := func() (*Record, error) {
+		switch {
+		case len(leases) > 0:
+			lease := leases[0]
+			leases = leases[1:]
+			return &Record{Lease: lease}, nil
+		case len(kvs) > 0:
+			kv := kvs[0].kv
+			kvs = kvs[1:]
+			return &Record{KV: kv}, nil
+		}
+		return nil, io.EOF
+	}
+	return revision, restore(ctx, backend, revision, next)
+}
+
+// ExportEtcd writes the keys and leases of the backend at the revision, or the
+// current revision if it is zero, as an etcd v3 snapshot that `etcdctl
+// snapshot restore` accepts, and returns the revision. The history before the
+// revision is compacted. Keys are exported at their versions, keys written
+// before kine recorded versions are at version 1.
+func ExportEtcd(ctx context.Context, backend server.Backend, w io.Writer, revision int64) (int64, error) {
+	// bbolt only writes to files, the database is copied out once complete
+	f, err := ioutil.TempFile("", "kine-etcd-snapshot")
+	if err != nil {
+		return 0, err
+	}
+	path := f.Name()
+	f.Close()
+	defer os.Remove(path)
+
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: etcdOpenTimeout})
+	if err != nil {
+		return 0, err
+	}
+
+	r, pw := io.Pipe()
+	go func(revision int64) {
+		_, err := Save(ctx, backend, pw, revision)
+		pw.CloseWithError(err)
+	}(revision)
+
+	revision, err = writeEtcd(db, r)
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		r.CloseWithError(err)
+		return 0, err
+	}
+
+	f, err = os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, h), f); err != nil {
+		return 0, err
+	}
+	if _, err := w.Write(h.Sum(nil)); err != nil {
+		return 0, err
+	}
+	return revision, nil
+}
+
+// verifyEtcd checks the SHA-256 at the end of the snapshot, if there is one.
+// bbolt databases are made of pages, so like etcdctl a file that is 32 bytes
+// longer than a multiple of 512 is taken to end with the checksum.
+func verifyEtcd(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size() - sha256.Size
+	if info.Size()%512 != sha256.Size {
+		logrus.Infof("%s has no checksum, importing it as a database", path)
+		return nil
+	}
+
+	h := sha256.New()
+	if _, err := io.CopyN(h, f, size); err != nil {
+		return err
+	}
+	expected := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(f, expected); err != nil {
+		return err
+	}
+	if sum := h.Sum(nil); !bytes.Equal(sum, expected) {
+		return fmt.Errorf("checksum of %s is %x rather than %x", path, sum, expected)
+	}
+	return nil
+}
+
+// etcdKeys returns the current revision of the snapshot and the latest
+// change of each key that is not deleted, in revision order.
+func etcdKeys(tx *bbolt.Tx) (int64, []*etcdKeyValue, error) {
+	bucket := tx.Bucket(etcdKeyBucket)
+	if bucket == nil {
+		return 0, nil, errors.New("not an etcd v3 snapshot, it has no key bucket")
+	}
+
+	// the database is ordered by revision, so the last change of a key wins
+	var (
+		revision int64
+		latest   = map[string]*etcdKeyValue{}
+	)
+	if meta := tx.Bucket(etcdMetaBucket); meta != nil {
+		if compact := meta.Get(etcdFinishedCompactKey); len(compact) >= etcdRevBytesLen {
+			revision = int64(binary.BigEndian.Uint64(compact))
+		}
+	}
+	err := bucket.ForEach(func(k, v []byte) error {
+		if len(k) < etcdRevBytesLen {
+			return fmt.Errorf("invalid revision %x in the key bucket", k)
+		}
+		main, sub := int64(binary.BigEndian.Uint64(k)), int64(binary.BigEndian.Uint64(k[9:]))
+		if main > revision {
+			revision = main
+		}
+
+		kv := mvccpb.KeyValue{}
+		if err := kv.Unmarshal(v); err != nil {
+			return errors.Wrapf(err, "failed to decode the key at revision %d", main)
+		}
+		if len(k) > etcdRevBytesLen && k[etcdRevBytesLen] == etcdTombstone {
+			delete(latest, string(kv.Key))
+			return nil
+		}
+		latest[string(kv.Key)] = &etcdKeyValue{
+			kv: &server.KeyValue{
+				Key:            string(kv.Key),
+				CreateRevision: kv.CreateRevision,
+				ModRevision:    main,
+				Value:          kv.Value,
+				Lease:          kv.Lease,
+				Version:        kv.Version,
+			},
+			sub: sub,
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	kvs := make([]*etcdKeyValue, 0, len(latest))
+	for _, kv := range latest {
+		kvs = append(kvs, kv)
+	}
+	sort.Slice(kvs, func(i, j int) bool {
+		if kvs[i].kv.ModRevision != kvs[j].kv.ModRevision {
+			return kvs[i].kv.ModRevision < kvs[j].kv.ModRevision
+		}
+		return kvs[i].sub < kvs[j].sub
+	})
+	return revision, kvs, nil
+}
+
+func etcdLeases(tx *bbolt.Tx) ([]*server.Lease, error) {
+	bucket := tx.Bucket(etcdLeaseBucket)
+	if bucket == nil {
+		return nil, nil
+	}
+
+	var leases []*server.Lease
+	err := bucket.ForEach(func(k, v []byte) error {
+		lease := leasepb.Lease{}
+		if err := lease.Unmarshal(v); err != nil {
+			return errors.Wrapf(err, "failed to decode lease %x", k)
+		}
+		leases = append(leases, &server.Lease{
+			ID:  lease.ID,
+			TTL: lease.TTL,
+		})
+		return nil
+	})
+	return leases, err
+}
+
+// renumber moves up the revisions after each revision that changed several
+// of the keys by the number of extra keys, and gives those keys consecutive
+// revisions. The keys have to be in revision order. It returns the revision
+// the current revision moves to.
+func renumber(revision int64, kvs []*etcdKeyValue) int64 {
+	// shared holds the revisions that changed several keys, and shifts how
+	// far the revisions after each move up
+	var shared, shifts []int64
+	for i := 1; i < len(kvs); i++ {
+		if kvs[i].kv.ModRevision != kvs[i-1].kv.ModRevision {
+			continue
+		}
+		shift := int64(1)
+		if n := len(shared); n > 0 {
+			shift += shifts[n-1]
+			if shared[n-1] == kvs[i].kv.ModRevision {
+				shifts[n-1] = shift
+				continue
+			}
+		}
+		shared = append(shared, kvs[i].kv.ModRevision)
+		shifts = append(shifts, shift)
+	}
+	if len(shared) == 0 {
+		return revision
+	}
+
+	// shiftBefore returns how far a revision moves up, the one of the keys
+	// changed before it
+	shiftBefore := func(rev int64) int64 {
+		i := sort.Search(len(shared), func(i int) bool { return shared[i] >= rev })
+		if i == 0 {
+			return 0
+		}
+		return shifts[i-1]
+	}
+
+	var last, sub int64
+	for _, kv := range kvs {
+		if kv.kv.ModRevision == last {
+			sub++
+		} else {
+			last, sub = kv.kv.ModRevision, 0
+		}
+		created := kv.kv.CreateRevision == kv.kv.ModRevision
+		kv.kv.ModRevision += shiftBefore(kv.kv.ModRevision) + sub
+		if created {
+			kv.kv.CreateRevision = kv.kv.ModRevision
+		} else {
+			kv.kv.CreateRevision += shiftBefore(kv.kv.CreateRevision)
+		}
+	}
+
+	logrus.Infof("Moved the revisions up by %d for the keys etcd changed in the same transaction", shifts[len(shifts)-1])
+	return revision + shifts[len(shifts)-1]
+}
+
+// writeEtcd writes the kine snapshot into the etcd database and returns its
+// revision, the database is compacted at the revision.
+func writeEtcd(db *bbolt.DB, r io.Reader) (int64, error) {
+	sr, err := NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{etcdKeyBucket, etcdMetaBucket, etcdLeaseBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		meta := tx.Bucket(etcdMetaBucket)
+		if err := meta.Put(etcdFinishedCompactKey, etcdRevision(sr.Revision, 0)); err != nil {
+			return err
+		}
+		return meta.Put(etcdScheduledCompactKey, etcdRevision(sr.Revision, 0))
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// the records are written in batches, a transaction holds its writes in
+	// memory until it commits
+	for done := false; !done; {
+		err := db.Update(func(tx *bbolt.Tx) error {
+			for i := 0; i < restoreBatch; i++ {
+				record, err := sr.Next()
+				if err == io.EOF {
+					done = true
+					return nil
+				} else if err != nil {
+					return err
+				}
+				if err := putEtcdRecord(tx, record); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return sr.Revision, nil
+}
+
+func putEtcdRecord(tx *bbolt.Tx, record *Record) error {
+	if lease := record.Lease; lease != nil {
+		data, err := (&leasepb.Lease{ID: lease.ID, TTL: lease.TTL}).Marshal()
+		if err != nil {
+			return err
+		}
+		id := make([]byte, 8)
+		binary.BigEndian.PutUint64(id, uint64(lease.ID))
+		return tx.Bucket(etcdLeaseBucket).Put(id, data)
+	}
+
+	kv := record.KV
+	version := kv.Version
+	if version <= 0 {
+		version = 1
+	}
+	data, err := (&mvccpb.KeyValue{
+		Key:            []byte(kv.Key),
+		CreateRevision: kv.CreateRevision,
+		ModRevision:    kv.ModRevision,
+		Version:        version,
+		Value:          kv.Value,
+		Lease:          kv.Lease,
+	}).Marshal()
+	if err != nil {
+		return err
+	}
+
+	// the keys written in a batch share their revision, each is a change of
+	// its own within it
+	keys := tx.Bucket(etcdKeyBucket)
+	sub := int64(0)
+	for keys.Get(etcdRevision(kv.ModRevision, sub)) != nil {
+		sub++
+	}
+	return keys.Put(etcdRevision(kv.ModRevision, sub), data)
+}
+
+// etcdRevision returns the key of a change at the main revision, the sub
+// revision orders the changes of a transaction
+func etcdRevision(main, sub int64) []byte {
+	rev := make([]byte, etcdRevBytesLen)
+	binary.BigEndian.PutUint64(rev, uint64(main))
+	rev[8] = '_'
+	binary.BigEndian.PutUint64(rev[9:], uint64(sub))
+	return rev
+}
@@ -0,0 +1,250 @@
+package snapshot_test
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rancher/kine/pkg/server"
+	"github.com/rancher/kine/pkg/snapshot"
+	"go.etcd.io/bbolt"
+	etcdsnapshot "go.etcd.io/etcd/clientv3/snapshot"
+	"go.etcd.io/etcd/mvcc/mvccpb"
+)
+
+// etcdRestore restores the snapshot as `etcdctl snapshot restore` does, and
+// returns the database of the restored member
+func etcdRestore(t *testing.T, dir, path string) string {
+	err := etcdsnapshot.NewV3(nil).Restore(etcdsnapshot.RestoreConfig{
+		SnapshotPath:        path,
+		Name:                "default",
+		OutputDataDir:       filepath.Join(dir, "etcd"),
+		PeerURLs:            []string{"http://localhost:2380"},
+		InitialCluster:      "default=http://localhost:2380",
+		InitialClusterToken: "etcd-cluster",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "etcd", "member", "snap", "db")
+}
+
+// etcdChange is a change to a key at a revision of an etcd database
+type etcdChange struct {
+	main, sub int64
+	kv        mvccpb.KeyValue
+	deleted   bool
+}
+
+// etcdDatabase writes the changes into the key bucket of an etcd database
+// without a checksum
+func etcdDatabase(t *testing.T, path string, changes []etcdChange) {
+	db, err := bbolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucket([]byte("key"))
+		if err != nil {
+			return err
+		}
+		for _, change := range changes {
+			key := make([]byte, 17, 18)
+			binary.BigEndian.PutUint64(key, uint64(change.main))
+			key[8] = '_'
+			binary.BigEndian.PutUint64(key[9:], uint64(change.sub))
+			if change.deleted {
+				key = append(key, 't')
+			}
+			data, err := change.kv.Marshal()
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(key, data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExportImportEtcd(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	src, compact := source(ctx, t)
+	_, leases, err := src.LeaseLeases(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lease := leases[0].ID
+	health := &server.KeyValue{Key: "/registry/health", CreateRevision: 1, ModRevision: 1, Value: []byte(`{"health":"true"}`), Version: 1}
+	// the keys /a, /d and /e share a revision, the revisions after it move up
+	// to give each of them a revision of its own
+	current := []*server.KeyValue{
+		{Key: "/a", CreateRevision: 2, ModRevision: 9, Value: []byte("2"), Version: 3},
+		{Key: "/b", CreateRevision: 12, ModRevision: 12, Value: []byte("2"), Lease: lease, Version: 1},
+		{Key: "/c", CreateRevision: 6, ModRevision: 6, Value: []byte("1"), Lease: lease, Version: 1},
+		{Key: "/d", CreateRevision: 10, ModRevision: 10, Value: []byte("2"), Version: 1},
+		{Key: "/e", CreateRevision: 11, ModRevision: 11, Value: []byte("2"), Version: 1},
+		health,
+	}
+
+	for _, tt := range []struct {
+		name     string
+		revision int64
+		// etcd restores the snapshot before it is imported
+		etcd     bool
+		exported int64
+		expected int64
+		kvs      []*server.KeyValue
+	}{
+		{name: "current revision", exported: 10, expected: 12, kvs: current},
+		{name: "restored by etcd", etcd: true, exported: 10, expected: 12, kvs: current},
+		{
+			name:     "compacted revision",
+			revision: compact,
+			exported: compact,
+			expected: compact,
+			kvs: []*server.KeyValue{
+				{Key: "/a", CreateRevision: 2, ModRevision: 3, Value: []byte("2"), Version: 2},
+				{Key: "/c", CreateRevision: 6, ModRevision: 6, Value: []byte("1"), Lease: lease, Version: 1},
+				health,
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "kine-snapshot-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			path := filepath.Join(dir, "snapshot.db")
+			f, err := os.Create(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rev, err := snapshot.ExportEtcd(ctx, src, f, tt.revision)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rev != tt.exported {
+				t.Fatalf("exported revision %d, expected %d", rev, tt.exported)
+			}
+			if tt.etcd {
+				path = etcdRestore(t, dir, path)
+			}
+
+			dst := newBackend(ctx, t)
+			rev, err = snapshot.ImportEtcd(ctx, dst, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rev != tt.expected {
+				t.Fatalf("imported revision %d, expected %d", rev, tt.expected)
+			}
+			checkRestored(ctx, t, dst, tt.expected, tt.expected, tt.kvs)
+
+			_, leases, err := dst.LeaseLeases(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(leases) != 1 || leases[0].ID != lease || leases[0].TTL != 600 {
+				t.Fatalf("imported leases %v, expected lease %d", leases, lease)
+			}
+		})
+	}
+}
+
+func TestImportEtcdTransaction(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "kine-snapshot-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// /a, /c and /d are created and /b deleted at revision 3, /d moves up to
+	// a revision of its own and so does the change of /c after it
+	path := filepath.Join(dir, "member.db")
+	health := mvccpb.KeyValue{Key: []byte("/registry/health"), CreateRevision: 1, ModRevision: 1, Value: []byte(`{"health":"true"}`), Version: 1}
+	etcdDatabase(t, path, []etcdChange{
+		{main: 1, kv: health},
+		{main: 2, kv: mvccpb.KeyValue{Key: []byte("/b"), CreateRevision: 2, ModRevision: 2, Value: []byte("1"), Version: 1}},
+		{main: 3, kv: mvccpb.KeyValue{Key: []byte("/a"), CreateRevision: 3, ModRevision: 3, Value: []byte("1"), Version: 1}},
+		{main: 3, sub: 1, kv: mvccpb.KeyValue{Key: []byte("/b")}, deleted: true},
+		{main: 3, sub: 2, kv: mvccpb.KeyValue{Key: []byte("/c"), CreateRevision: 3, ModRevision: 3, Value: []byte("1"), Version: 1}},
+		{main: 3, sub: 3, kv: mvccpb.KeyValue{Key: []byte("/d"), CreateRevision: 3, ModRevision: 3, Value: []byte("1"), Version: 1}},
+		{main: 4, kv: mvccpb.KeyValue{Key: []byte("/c"), CreateRevision: 3, ModRevision: 4, Value: []byte("2"), Version: 2}},
+	})
+
+	dst := newBackend(ctx, t)
+	rev, err := snapshot.ImportEtcd(ctx, dst, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev != 5 {
+		t.Fatalf("imported revision %d, expected 5", rev)
+	}
+	checkRestored(ctx, t, dst, 5, 5, []*server.KeyValue{
+		{Key: "/a", CreateRevision: 3, ModRevision: 3, Value: []byte("1"), Version: 1},
+		{Key: "/c", CreateRevision: 3, ModRevision: 5, Value: []byte("2"), Version: 2},
+		{Key: "/d", CreateRevision: 4, ModRevision: 4, Value: []byte("1"), Version: 1},
+		{Key: "/registry/health", CreateRevision: 1, ModRevision: 1, Value: health.Value, Version: 1},
+	})
+}
+
+func TestImportEtcdChecksum(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	src, _ := source(ctx, t)
+	dir, err := ioutil.TempDir("", "kine-snapshot-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "snapshot.db")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := snapshot.ExportEtcd(ctx, src, f, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// a snapshot that doesn't match its checksum is not imported
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{0xff}, info.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+	dst := newBackend(ctx, t)
+	if _, err := snapshot.ImportEtcd(ctx, dst, path); err == nil {
+		t.Fatal("imported a snapshot with a wrong checksum")
+	}
+	if rev, err := dst.CurrentRevision(ctx); err != nil || rev != 0 {
+		t.Fatalf("imported up to revision %d (%v) from a snapshot with a wrong checksum", rev, err)
+	}
+	if kvs := list(ctx, t, dst, 0); len(kvs) != 0 {
+		t.Fatalf("imported %d keys from a snapshot with a wrong checksum", len(kvs))
+	}
+}
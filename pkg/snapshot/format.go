@@ -0,0 +1,271 @@
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/kine/pkg/server"
+)
+
+// A snapshot starts with the magic and a header of the format version and the
+// revision. Records follow, each a type, the length of its payload and the
+// payload, and the end record closes the snapshot with the SHA-256 of
+// everything before the checksum itself.
+const (
+	magic = "KINESNAP"
+	// Version is the version of the format snapshots are written in. The
+	// keys of version 1 snapshots have no version of their own.
+	Version = 2
+
+	recordLease = 'l'
+	recordKV    = 'k'
+	recordEnd   = 'e'
+
+	// maxRecordSize bounds the payloads read, so that a corrupted length
+	// fails the read rather than exhausting the memory
+	maxRecordSize = 256 << 20
+)
+
+// ErrChecksum is returned at the end of a snapshot that was corrupted
+var ErrChecksum = errors.New("snapshot checksum mismatch")
+
+// Record is a record of a snapshot, either a lease or a key.
+type Record struct {
+	Lease *server.Lease
+	KV    *server.KeyValue
+}
+
+// Writer writes a snapshot. The snapshot is complete once the writer is
+// closed.
+type Writer struct {
+	w   *bufio.Writer
+	h   hash.Hash
+	buf []byte
+}
+
+func NewWriter(w io.Writer, revision int64) (*Writer, error) {
+	sw := &Writer{
+		w: bufio.NewWriter(w),
+		h: sha256.New(),
+	}
+
+	header := make([]byte, len(magic)+2+8)
+	copy(header, magic)
+	binary.BigEndian.PutUint16(header[len(magic):], Version)
+	binary.BigEndian.PutUint64(header[len(magic)+2:], uint64(revision))
+	if err := sw.write(header); err != nil {
+		return nil, err
+	}
+	return sw, nil
+}
+
+func (w *Writer) WriteLease(lease *server.Lease) error {
+	w.buf = w.buf[:0]
+	w.buf = appendVarint(w.buf, lease.ID)
+	w.buf = appendVarint(w.buf, lease.TTL)
+	return w.writeRecord(recordLease, w.buf)
+}
+
+func (w *Writer) WriteKeyValue(kv *server.KeyValue) error {
+	w.buf = w.buf[:0]
+	w.buf = appendBytes(w.buf, []byte(kv.Key))
+	w.buf = appendVarint(w.buf, kv.CreateRevision)
+	w.buf = appendVarint(w.buf, kv.ModRevision)
+	w.buf = appendVarint(w.buf, kv.Lease)
+	w.buf = appendBytes(w.buf, kv.Value)
+	w.buf = appendVarint(w.buf, kv.Version)
+	return w.writeRecord(recordKV, w.buf)
+}
+
+// Close ends the snapshot with its checksum and flushes it, the underlying
+// writer is left open.
+func (w *Writer) Close() error {
+	if err := w.write([]byte{recordEnd}); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(w.h.Sum(nil)); err != nil {
+		return err
+	}
+	return w.w.Flush()
+}
+
+func (w *Writer) writeRecord(kind byte, payload []byte) error {
+	header := appendUvarint([]byte{kind}, uint64(len(payload)))
+	if err := w.write(header); err != nil {
+		return err
+	}
+	return w.write(payload)
+}
+
+func (w *Writer) write(data []byte) error {
+	w.h.Write(data)
+	_, err := w.w.Write(data)
+	return err
+}
+
+// Reader reads a snapshot record by record. The checksum is only verified
+// once the last record has been read.
+type Reader struct {
+	// Revision is the revision the snapshot was taken at
+	Revision int64
+
+	version uint16
+	r       *bufio.Reader
+	h       hash.Hash
+}
+
+func NewReader(r io.Reader) (*Reader, error) {
+	sr := &Reader{
+		r: bufio.NewReader(r),
+		h: sha256.New(),
+	}
+
+	header := make([]byte, len(magic)+2+8)
+	if err := sr.read(header); err != nil {
+		return nil, errors.Wrap(err, "failed to read snapshot header")
+	}
+	if string(header[:len(magic)]) != magic {
+		return nil, errors.New("not a kine snapshot")
+	}
+	sr.version = binary.BigEndian.Uint16(header[len(magic):])
+	if sr.version < 1 || sr.version > Version {
+		return nil, fmt.Errorf("unsupported snapshot version %d, expected at most %d", sr.version, Version)
+	}
+	sr.Revision = int64(binary.BigEndian.Uint64(header[len(magic)+2:]))
+	return sr, nil
+}
+
+// Next returns the next record, or io.EOF once the snapshot has ended and its
+// checksum matched.
+func (r *Reader) Next() (*Record, error) {
+	kind := make([]byte, 1)
+	if err := r.read(kind); err != nil {
+		return nil, truncated(err)
+	}
+
+	if kind[0] == recordEnd {
+		return nil, r.end()
+	}
+
+	size, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return nil, truncated(err)
+	}
+	if size > maxRecordSize {
+		return nil, fmt.Errorf("snapshot record of %d bytes is too large", size)
+	}
+	r.h.Write(appendUvarint(nil, size))
+
+	payload := make([]byte, size)
+	if err := r.read(payload); err != nil {
+		return nil, truncated(err)
+	}
+
+	d := decoder{data: payload}
+	switch kind[0] {
+	case recordLease:
+		lease := &server.Lease{
+			ID:  d.varint(),
+			TTL: d.varint(),
+		}
+		return &Record{Lease: lease}, d.err
+	case recordKV:
+		kv := &server.KeyValue{
+			Key:            string(d.bytes()),
+			CreateRevision: d.varint(),
+			ModRevision:    d.varint(),
+			Lease:          d.varint(),
+			Value:          d.bytes(),
+		}
+		if r.version > 1 {
+			kv.Version = d.varint()
+		}
+		return &Record{KV: kv}, d.err
+	}
+	return nil, fmt.Errorf("unknown snapshot record type %q", kind[0])
+}
+
+// end verifies the checksum and that nothing follows it
+func (r *Reader) end() error {
+	expected := r.h.Sum(nil)
+	checksum := make([]byte, len(expected))
+	if _, err := io.ReadFull(r.r, checksum); err != nil {
+		return truncated(err)
+	}
+	if !bytes.Equal(checksum, expected) {
+		return ErrChecksum
+	}
+	if _, err := r.r.ReadByte(); err != io.EOF {
+		return errors.New("unexpected data after the end of the snapshot")
+	}
+	return io.EOF
+}
+
+func (r *Reader) read(data []byte) error {
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		return err
+	}
+	r.h.Write(data)
+	return nil
+}
+
+func truncated(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errors.New("snapshot is truncated")
+	}
+	return err
+}
+
+func appendUvarint(data []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(data, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func appendVarint(data []byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(data, buf[:binary.PutVarint(buf[:], v)]...)
+}
+
+func appendBytes(data, v []byte) []byte {
+	return append(appendUvarint(data, uint64(len(v))), v...)
+}
+
+// decoder reads the fields of a payload, the first error is kept and later
+// fields read as zero
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.err = errors.New("snapshot record is malformed")
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) bytes() []byte {
+	if d.err != nil {
+		return nil
+	}
+	size, n := binary.Uvarint(d.data)
+	if n <= 0 || size > uint64(len(d.data)-n) {
+		d.err = errors.New("snapshot record is malformed")
+		return nil
+	}
+	v := d.data[n : n+int(size)]
+	d.data = d.data[n+int(size):]
+	return v
+}
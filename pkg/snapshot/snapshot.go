@@ -0,0 +1,184 @@
+// Package snapshot saves the keys and leases of a backend at a revision, and
+// restores them into another backend of any driver with their revisions. It
+// also imports and exports the snapshots of etcd v3.
+package snapshot
+
+import (
+	"context"
+	"io"
+	"math"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/kine/pkg/server"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// listBatch is the number of keys listed at once while saving
+	listBatch = 1000
+	// restoreBatch is the number of records written to an etcd database at
+	// once
+	restoreBatch = 1000
+
+	// compactRevKey is the row the SQL backends record the compact revision
+	// in, it is not restored as a key
+	compactRevKey = "compact_rev_key"
+)
+
+// Save writes a snapshot of the keys at the revision, or the current revision
+// if it is zero, and returns the revision. Leases are not versioned, the ones
+// that exist while the snapshot is saved are written. The keys are listed in
+// batches, saving fails with server.ErrCompacted if the revision is compacted
+// in the meantime.
+func Save(ctx context.Context, backend server.Backend, w io.Writer, revision int64) (int64, error) {
+	if revision == 0 {
+		current, err := backend.CurrentRevision(ctx)
+		if err != nil {
+			return 0, err
+		}
+		revision = current
+	}
+
+	sw, err := NewWriter(w, revision)
+	if err != nil {
+		return 0, err
+	}
+
+	// leases come first, so that the keys are restored after their leases
+	_, leases, err := backend.LeaseLeases(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to list leases")
+	}
+	for _, lease := range leases {
+		if err := sw.WriteLease(lease); err != nil {
+			return 0, err
+		}
+	}
+
+	// an empty backend has nothing to list
+	for key := ""; revision > 0; {
+		_, kvs, err := backend.List(ctx, key, "\x00", listBatch, revision, server.ListOptions{})
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to list keys from %q at revision %d", key, revision)
+		}
+		for _, kv := range kvs {
+			if kv.Key == compactRevKey {
+				continue
+			}
+			if err := sw.WriteKeyValue(kv); err != nil {
+				return 0, err
+			}
+		}
+		if len(kvs) < listBatch {
+			break
+		}
+		key = kvs[len(kvs)-1].Key + "\x00"
+	}
+
+	return revision, sw.Close()
+}
+
+// Verify reads the snapshot through and returns its revision, if it is
+// complete and its checksum matches.
+func Verify(r io.Reader) (int64, error) {
+	sr, err := NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		if _, err := sr.Next(); err == io.EOF {
+			return sr.Revision, nil
+		} else if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Restore loads the snapshot into a backend that has not been started and
+// has no keys or leases, and returns the revision of the snapshot. Keys keep
+// their revisions and the backend continues from the revision of the
+// snapshot, the history before it is compacted. Leases start over with their
+// full TTL. Keys of leases that are not in the snapshot are left out, as the
+// lease ended after the keys were saved and took them with it.
+//
+// The keys are held in memory until they are all read, and the checksum is
+// only verified at the end, so the snapshot should be verified first.
+func Restore(ctx context.Context, backend server.Backend, r io.Reader) (int64, error) {
+	if err := checkEmpty(ctx, backend); err != nil {
+		return 0, err
+	}
+	sr, err := NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	return sr.Revision, restore(ctx, backend, sr.Revision, sr.Next)
+}
+
+func checkEmpty(ctx context.Context, backend server.Backend) error {
+	current, err := backend.CurrentRevision(ctx)
+	if err != nil {
+		return err
+	}
+	_, existing, err := backend.LeaseLeases(ctx)
+	if err != nil {
+		return err
+	}
+	if current != 0 || len(existing) != 0 {
+		return errors.New("snapshots can only be restored into an empty backend")
+	}
+	return nil
+}
+
+// restore loads the records returned by next until it returns io.EOF, the
+// leases have to come before their keys. The keys are held until the end and
+// restored at once, as the keys that share a revision can be anywhere in the
+// snapshot.
+func restore(ctx context.Context, backend server.Backend, revision int64, next func() (*Record, error)) error {
+	var (
+		// leases maps the ids of the snapshot to the ids they are granted as
+		leases = map[int64]int64{}
+		kvs    []*server.KeyValue
+	)
+
+	for {
+		record, err := next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		switch {
+		case record.Lease != nil:
+			// kine keeps lease ids in 32 bits while etcd's take 64, larger
+			// ones are granted under a new id that their keys follow
+			id := record.Lease.ID
+			if id > math.MaxInt32 {
+				id = 0
+			}
+			_, lease, err := backend.LeaseGrant(ctx, id, record.Lease.TTL)
+			if err != nil {
+				return errors.Wrapf(err, "failed to restore lease %d", record.Lease.ID)
+			}
+			if lease.ID != record.Lease.ID {
+				logrus.Infof("Restored lease %x as %x", record.Lease.ID, lease.ID)
+			}
+			leases[record.Lease.ID] = lease.ID
+		case record.KV != nil:
+			if record.KV.Lease != 0 {
+				id, ok := leases[record.KV.Lease]
+				if !ok {
+					logrus.Warnf("Leaving out %s, its lease %d is not in the snapshot", record.KV.Key, record.KV.Lease)
+					continue
+				}
+				record.KV.Lease = id
+			}
+			kvs = append(kvs, record.KV)
+		}
+	}
+
+	if err := backend.Restore(ctx, revision, kvs); err != nil {
+		return errors.Wrap(err, "failed to restore keys")
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+package snapshot_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/rancher/kine/pkg/drivers/bolt"
+	"github.com/rancher/kine/pkg/drivers/memory"
+	"github.com/rancher/kine/pkg/drivers/sqlite"
+	"github.com/rancher/kine/pkg/logstructured"
+	"github.com/rancher/kine/pkg/server"
+	"github.com/rancher/kine/pkg/snapshot"
+)
+
+// backends are the backends snapshots are restored into, each opened in the
+// directory
+var backends = []struct {
+	name string
+	new  func(ctx context.Context, dir string) (server.Backend, error)
+	// compactRow is set for backends that record the compact revision in a
+	// row of its own, at the revision after the snapshot
+	compactRow bool
+}{
+	{
+		name: "bolt",
+		new: func(ctx context.Context, dir string) (server.Backend, error) {
+			return bolt.New(ctx, filepath.Join(dir, "state.bolt"), logstructured.CompactConfig{Disable: true})
+		},
+	},
+	{
+		name: "memory",
+		new: func(ctx context.Context, dir string) (server.Backend, error) {
+			return memory.New(ctx, logstructured.CompactConfig{Disable: true})
+		},
+	},
+	{
+		name: "sqlite",
+		new: func(ctx context.Context, dir string) (server.Backend, error) {
+			return sqlite.New(ctx, filepath.Join(dir, "state.db?_journal=WAL&cache=shared"), logstructured.CompactConfig{Disable: true})
+		},
+		compactRow: true,
+	},
+}
+
+// newBackend returns a memory backend that has not been started
+func newBackend(ctx context.Context, t *testing.T) server.Backend {
+	backend, err := memory.New(ctx, logstructured.CompactConfig{Disable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backend
+}
+
+// source is a backend with updated, deleted and leased keys, and keys written
+// together in a transaction, compacted up to the revision it returns
+func source(ctx context.Context, t *testing.T) (server.Backend, int64) {
+	backend := newBackend(ctx, t)
+	if err := backend.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	_, lease, err := backend.LeaseGrant(ctx, 0, 600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rev, err := backend.Create(ctx, "/a", []byte("1"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev, _, _, err = backend.Update(ctx, "/a", []byte("2"), rev, 0); err != nil {
+		t.Fatal(err)
+	}
+	if rev, err = backend.Create(ctx, "/b", []byte("1"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err = backend.Delete(ctx, "/b", rev); err != nil {
+		t.Fatal(err)
+	}
+	compact, err := backend.Create(ctx, "/c", []byte("1"), lease.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := backend.BeginTx(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"/a", "/d", "/e"} {
+		if _, err := tx.Put(ctx, key, []byte("2"), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := tx.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.Create(ctx, "/b", []byte("2"), lease.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	_, done, err := backend.Compact(ctx, compact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	return backend, compact
+}
+
+// list returns every key of the backend at the revision, but the
+// compact_rev_key row of the SQL backends
+func list(ctx context.Context, t *testing.T, backend server.Backend, revision int64) []*server.KeyValue {
+	_, kvs, err := backend.List(ctx, "", "\x00", 0, revision, server.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, kv := range kvs {
+		if kv.Key == "compact_rev_key" {
+			return append(kvs[:i], kvs[i+1:]...)
+		}
+	}
+	return kvs
+}
+
+// checkRestored checks that the backend holds the keys at the revision and
+// continues from it, or from current, with the history before it compacted
+func checkRestored(ctx context.Context, t *testing.T, backend server.Backend, revision, current int64, kvs []*server.KeyValue) {
+	if err := backend.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	rev, err := backend.CurrentRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev != current {
+		t.Fatalf("restored at revision %d, expected %d", rev, current)
+	}
+	if restored := list(ctx, t, backend, 0); !reflect.DeepEqual(restored, kvs) {
+		t.Fatalf("restored\n%s\nexpected\n%s", format(restored), format(kvs))
+	}
+	if _, _, err := backend.List(ctx, "", "\x00", 0, revision-1, server.ListOptions{}); err != server.ErrCompacted {
+		t.Fatalf("listing before the revision got error %v, expected %v", err, server.ErrCompacted)
+	}
+
+	rev, err = backend.Create(ctx, "/new", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev <= current {
+		t.Fatalf("created a key at revision %d, expected a revision after %d", rev, current)
+	}
+}
+
+func format(kvs []*server.KeyValue) string {
+	var buf bytes.Buffer
+	for _, kv := range kvs {
+		fmt.Fprintf(&buf, "%s=%s create=%d mod=%d version=%d lease=%d\n", kv.Key, kv.Value, kv.CreateRevision, kv.ModRevision, kv.Version, kv.Lease)
+	}
+	return buf.String()
+}
+
+func TestSaveRestore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	src, compact := source(ctx, t)
+	current, err := src.CurrentRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, b := range backends {
+		for _, tt := range []struct {
+			name     string
+			revision int64
+			expected int64
+		}{
+			{name: "current revision", expected: current},
+			{name: "compacted revision", revision: compact, expected: compact},
+		} {
+			t.Run(b.name+"/"+tt.name, func(t *testing.T) {
+				var buf bytes.Buffer
+				rev, err := snapshot.Save(ctx, src, &buf, tt.revision)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if rev != tt.expected {
+					t.Fatalf("saved revision %d, expected %d", rev, tt.expected)
+				}
+				if rev, err := snapshot.Verify(bytes.NewReader(buf.Bytes())); err != nil || rev != tt.expected {
+					t.Fatalf("verified revision %d with error %v, expected revision %d", rev, err, tt.expected)
+				}
+
+				dir, err := ioutil.TempDir("", "kine-snapshot-test")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer os.RemoveAll(dir)
+				dstCtx, cancel := context.WithCancel(ctx)
+				defer cancel()
+				dst, err := b.new(dstCtx, dir)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				rev, err = snapshot.Restore(ctx, dst, bytes.NewReader(buf.Bytes()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if rev != tt.expected {
+					t.Fatalf("restored revision %d, expected %d", rev, tt.expected)
+				}
+				current := tt.expected
+				if b.compactRow {
+					current++
+				}
+				checkRestored(ctx, t, dst, tt.expected, current, list(ctx, t, src, tt.expected))
+
+				// leases are restored under their IDs
+				_, leases, err := dst.LeaseLeases(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, expected, err := src.LeaseLeases(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(leases) != 1 || leases[0].ID != expected[0].ID || leases[0].TTL != expected[0].TTL {
+					t.Fatalf("restored leases %v, expected %v", leases, expected)
+				}
+
+				// only empty backends are restored into
+				if _, err := snapshot.Restore(ctx, dst, bytes.NewReader(buf.Bytes())); err == nil {
+					t.Fatal("restored into a backend with keys")
+				}
+			})
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	src, _ := source(ctx, t)
+	var buf bytes.Buffer
+	if _, err := snapshot.Save(ctx, src, &buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	saved := buf.Bytes()
+
+	for _, tt := range []struct {
+		name     string
+		snapshot func() []byte
+	}{
+		{
+			name: "truncated",
+			snapshot: func() []byte {
+				return saved[:len(saved)-10]
+			},
+		},
+		{
+			name: "corrupted",
+			snapshot: func() []byte {
+				corrupted := append([]byte{}, saved...)
+				corrupted[len(corrupted)/2] ^= 0xff
+				return corrupted
+			},
+		},
+		{
+			name: "not a snapshot",
+			snapshot: func() []byte {
+				return []byte("not a snapshot")
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := snapshot.Verify(bytes.NewReader(tt.snapshot())); err == nil {
+				t.Fatal("verified a broken snapshot")
+			}
+		})
+	}
+}
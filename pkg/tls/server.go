@@ -0,0 +1,138 @@
+package tls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ServerConfig returns the TLS configuration of a server presenting the
+// certificate in CertFile and KeyFile. Client certificates are verified
+// against CAFile if they are sent, and required if clientCertAuth is set. The
+// files are reloaded when they change, so certificates can be rotated without
+// a restart.
+func (c Config) ServerConfig(clientCertAuth bool) (*tls.Config, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, fmt.Errorf("server TLS needs both a certificate and a key file")
+	}
+	if clientCertAuth && c.CAFile == "" {
+		return nil, fmt.Errorf("client certificate authentication needs a CA file")
+	}
+
+	r := &reloader{config: c, clientCertAuth: clientCertAuth}
+	if _, err := r.load(); err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.load()
+		},
+	}, nil
+}
+
+// reloader builds the server configuration from the files, and again when
+// any of them is modified
+type reloader struct {
+	sync.Mutex
+
+	config         Config
+	clientCertAuth bool
+	modTimes       []time.Time
+	tlsConfig      *tls.Config
+}
+
+func (r *reloader) load() (*tls.Config, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	files := []string{r.config.CertFile, r.config.KeyFile}
+	if r.config.CAFile != "" {
+		files = append(files, r.config.CAFile)
+	}
+
+	modTimes := make([]time.Time, 0, len(files))
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return r.loadFailed(err)
+		}
+		modTimes = append(modTimes, info.ModTime())
+	}
+
+	if r.tlsConfig != nil && sameTimes(modTimes, r.modTimes) {
+		return r.tlsConfig, nil
+	}
+
+	tlsConfig, err := r.build()
+	if err != nil {
+		return r.loadFailed(err)
+	}
+
+	if r.tlsConfig != nil {
+		logrus.Infof("Reloaded server certificate %s", r.config.CertFile)
+	}
+	r.tlsConfig = tlsConfig
+	r.modTimes = modTimes
+	return tlsConfig, nil
+}
+
+// loadFailed keeps serving the last good configuration, the files may be
+// caught in the middle of being replaced
+func (r *reloader) loadFailed(err error) (*tls.Config, error) {
+	if r.tlsConfig == nil {
+		return nil, err
+	}
+	logrus.Warnf("Failed to reload server certificate %s: %v", r.config.CertFile, err)
+	return r.tlsConfig, nil
+}
+
+func (r *reloader) build() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2"},
+	}
+
+	if r.config.CAFile != "" {
+		pem, err := ioutil.ReadFile(r.config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", r.config.CAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if r.clientCertAuth {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+func sameTimes(a, b []time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,288 @@
+package tls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for the tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	dir  string
+}
+
+func newTestCA(t *testing.T, dir, name string) *testCA {
+	ca := &testCA{dir: dir}
+	ca.cert, ca.key = ca.issue(t, name, 1, nil)
+	ca.write(t, name+"-ca.pem", ca.cert, nil)
+	return ca
+}
+
+// issue creates a certificate signed by the CA, or a self-signed CA if parent
+// is nil
+func (ca *testCA) issue(t *testing.T, name string, serial int64, parent *testCA) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// write writes the certificate and its key, if any, as PEM and returns the
+// paths of the files
+func (ca *testCA) write(t *testing.T, name string, cert *x509.Certificate, key *ecdsa.PrivateKey) (string, string) {
+	certFile := filepath.Join(ca.dir, name)
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if key == nil {
+		return certFile, ""
+	}
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := certFile + ".key"
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// tlsCert returns the certificate for a tls.Config
+func tlsCert(cert *x509.Certificate, key *ecdsa.PrivateKey) tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key}
+}
+
+// handshake connects a client with the configuration to a server with the
+// server configuration and returns the serial number of the certificate the
+// server presented
+func handshake(t *testing.T, server, client *tls.Config) (int64, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer conn.Close()
+		serverErr <- tls.Server(conn, server).Handshake()
+	}()
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), client)
+	if err == nil {
+		defer conn.Close()
+	}
+	// the client can finish before the server verified its certificate
+	if serverErr := <-serverErr; err == nil {
+		err = serverErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64(), nil
+}
+
+func TestServerConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kine-tls-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, dir, "kine")
+	other := newTestCA(t, dir, "other")
+	cert, key := ca.issue(t, "server", 2, ca)
+	certFile, keyFile := ca.write(t, "server.pem", cert, key)
+	caFile := filepath.Join(dir, "kine-ca.pem")
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	client := func(cert ...tls.Certificate) *tls.Config {
+		return &tls.Config{RootCAs: roots, ServerName: "127.0.0.1", Certificates: cert}
+	}
+	signed := tlsCert(ca.issue(t, "client", 3, ca))
+	untrusted := tlsCert(other.issue(t, "client", 4, other))
+
+	for _, tt := range []struct {
+		name           string
+		config         Config
+		clientCertAuth bool
+		// clients are the client configurations and whether each of them
+		// is accepted
+		clients map[string]bool
+		err     bool
+	}{
+		{
+			name:   "certificate",
+			config: Config{CertFile: certFile, KeyFile: keyFile},
+			clients: map[string]bool{
+				"without a certificate":     true,
+				"with a signed certificate": true,
+			},
+		},
+		{
+			name:   "client certificates verified if given",
+			config: Config{CertFile: certFile, KeyFile: keyFile, CAFile: caFile},
+			clients: map[string]bool{
+				"without a certificate":         true,
+				"with a signed certificate":     true,
+				"with an untrusted certificate": false,
+			},
+		},
+		{
+			name:           "client certificates required",
+			config:         Config{CertFile: certFile, KeyFile: keyFile, CAFile: caFile},
+			clientCertAuth: true,
+			clients: map[string]bool{
+				"without a certificate":         false,
+				"with a signed certificate":     true,
+				"with an untrusted certificate": false,
+			},
+		},
+		{name: "missing key", config: Config{CertFile: certFile}, err: true},
+		{name: "client certificates required without a CA", config: Config{CertFile: certFile, KeyFile: keyFile}, clientCertAuth: true, err: true},
+		{name: "missing certificate file", config: Config{CertFile: filepath.Join(dir, "missing.pem"), KeyFile: keyFile}, err: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			server, err := tt.config.ServerConfig(tt.clientCertAuth)
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			configs := map[string]*tls.Config{
+				"without a certificate":         client(),
+				"with a signed certificate":     client(signed),
+				"with an untrusted certificate": client(),
+			}
+			// clients leave out certificates the server CA didn't sign
+			// unless they are forced to send them
+			configs["with an untrusted certificate"].GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return &untrusted, nil
+			}
+			for name, accepted := range tt.clients {
+				serial, err := handshake(t, server, configs[name])
+				if accepted && (err != nil || serial != 2) {
+					t.Fatalf("client %s got certificate %d and error %v, expected certificate 2", name, serial, err)
+				}
+				if !accepted && err == nil {
+					t.Fatalf("client %s was accepted", name)
+				}
+			}
+		})
+	}
+}
+
+func TestServerConfigReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kine-tls-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, dir, "kine")
+	cert, key := ca.issue(t, "server", 2, ca)
+	certFile, keyFile := ca.write(t, "server.pem", cert, key)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	client := &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"}
+
+	server, err := Config{CertFile: certFile, KeyFile: keyFile}.ServerConfig(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// modification times may be too coarse to tell writes apart, so every
+	// change moves them ahead explicitly
+	modTime := time.Now()
+	touch := func() {
+		modTime = modTime.Add(time.Minute)
+		for _, file := range []string{certFile, keyFile} {
+			if err := os.Chtimes(file, modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	rotate := func(serial int64) {
+		cert, key := ca.issue(t, "server", serial, ca)
+		ca.write(t, "server.pem", cert, key)
+		touch()
+	}
+	expect := func(serial int64) {
+		got, err := handshake(t, server, client)
+		if err != nil || got != serial {
+			t.Fatalf("got certificate %d and error %v, expected certificate %d", got, err, serial)
+		}
+	}
+
+	expect(2)
+
+	// a rotated certificate is served to new connections
+	rotate(3)
+	expect(3)
+
+	// a certificate caught while it is being replaced is ignored until
+	// it is complete
+	if err := ioutil.WriteFile(certFile, []byte("partial"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	touch()
+	expect(3)
+
+	rotate(4)
+	expect(4)
+}
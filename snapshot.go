@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/kine/pkg/endpoint"
+	"github.com/rancher/kine/pkg/snapshot"
+	"github.com/rancher/wrangler/pkg/signals"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+var snapshotCommand = cli.Command{
+	Name:  "snapshot",
+	Usage: "Save and restore snapshots of the keys of the storage endpoint, or move them from and to etcd",
+	Subcommands: []cli.Command{
+		{
+			Name:      "save",
+			Usage:     "Save the keys and leases at a revision to a file",
+			ArgsUsage: "FILE",
+			Flags: []cli.Flag{
+				cli.Int64Flag{
+					Name:  "revision",
+					Usage: "Revision to save the keys at (default is the current revision)",
+				},
+			},
+			Action: snapshotSave,
+		},
+		{
+			Name:      "restore",
+			Usage:     "Restore a snapshot into an empty storage endpoint, keeping the revisions of the keys",
+			ArgsUsage: "FILE",
+			Action:    snapshotRestore,
+		},
+		{
+			Name:      "export",
+			Usage:     "Export the keys and leases at a revision as an etcd v3 snapshot, for etcdctl snapshot restore",
+			ArgsUsage: "FILE",
+			Flags: []cli.Flag{
+				cli.Int64Flag{
+					Name:  "revision",
+					Usage: "Revision to export the keys at (default is the current revision)",
+				},
+			},
+			Action: snapshotExport,
+		},
+		{
+			Name:      "import",
+			Usage:     "Import an etcd v3 snapshot, as saved by etcdctl snapshot save, into an empty storage endpoint",
+			ArgsUsage: "FILE",
+			Action:    snapshotImport,
+		},
+	},
+}
+
+func snapshotSave(c *cli.Context) error {
+	path, err := snapshotPath(c)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(signals.SetupSignalHandler(context.Background()))
+	defer cancel()
+
+	backend, err := endpoint.NewBackend(ctx, config)
+	if err != nil {
+		return err
+	}
+	revision, err := writeSnapshot(path, func(w io.Writer) (int64, error) {
+		return snapshot.Save(ctx, backend, w, c.Int64("revision"))
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to save snapshot")
+	}
+
+	logrus.Infof("Saved snapshot at revision %d to %s", revision, path)
+	return nil
+}
+
+func snapshotRestore(c *cli.Context) error {
+	path, err := snapshotPath(c)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(signals.SetupSignalHandler(context.Background()))
+	defer cancel()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// nothing is restored from a snapshot that is damaged
+	if _, err := snapshot.Verify(f); err != nil {
+		return errors.Wrapf(err, "failed to verify %s", path)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	backend, err := endpoint.NewBackend(ctx, config)
+	if err != nil {
+		return err
+	}
+	revision, err := snapshot.Restore(ctx, backend, f)
+	if err != nil {
+		return errors.Wrap(err, "failed to restore snapshot")
+	}
+
+	logrus.Infof("Restored snapshot at revision %d from %s", revision, path)
+	return nil
+}
+
+func snapshotExport(c *cli.Context) error {
+	path, err := snapshotPath(c)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(signals.SetupSignalHandler(context.Background()))
+	defer cancel()
+
+	backend, err := endpoint.NewBackend(ctx, config)
+	if err != nil {
+		return err
+	}
+	revision, err := writeSnapshot(path, func(w io.Writer) (int64, error) {
+		return snapshot.ExportEtcd(ctx, backend, w, c.Int64("revision"))
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to export snapshot")
+	}
+
+	logrus.Infof("Exported etcd snapshot at revision %d to %s", revision, path)
+	return nil
+}
+
+func snapshotImport(c *cli.Context) error {
+	path, err := snapshotPath(c)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(signals.SetupSignalHandler(context.Background()))
+	defer cancel()
+
+	backend, err := endpoint.NewBackend(ctx, config)
+	if err != nil {
+		return err
+	}
+	revision, err := snapshot.ImportEtcd(ctx, backend, path)
+	if err != nil {
+		return errors.Wrap(err, "failed to import snapshot")
+	}
+
+	logrus.Infof("Imported etcd snapshot from %s, continuing from revision %d", path, revision)
+	return nil
+}
+
+// writeSnapshot writes the snapshot to a temporary file next to the path, and
+// only renames it to the path once it is complete and synced.
+func writeSnapshot(path string, write func(w io.Writer) (int64, error)) (int64, error) {
+	tmp := path + ".part"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+
+	revision, err := write(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	return revision, nil
+}
+
+func snapshotPath(c *cli.Context) (string, error) {
+	if c.GlobalBool("debug") {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+	if c.NArg() != 1 {
+		return "", fmt.Errorf("expected a snapshot file, usage: %s %s", c.Command.HelpName, c.Command.ArgsUsage)
+	}
+	return c.Args().First(), nil
+}